@@ -0,0 +1,269 @@
+package authz
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/parser"
+
+	"biscuitExample/dblogic"
+)
+
+// Attenuation collects typed restrictions and datalog statements which are appended to a token as a single block, so callers never have to write datalog by hand and several restrictions cost one signature.
+type Attenuation struct {
+	facts   []biscuit.Fact
+	rules   []biscuit.Rule
+	checks  []biscuit.Check
+	context string
+}
+
+// NewAttenuation creates an empty Attenuation.
+func NewAttenuation() *Attenuation {
+	return &Attenuation{
+		facts:  []biscuit.Fact{},
+		rules:  []biscuit.Rule{},
+		checks: []biscuit.Check{},
+	}
+}
+
+// AddSource parses blockTxt as a datalog block of facts, rules and checks, each terminated by a ';', and adds them to the attenuation. A single statement may omit the trailing ';'.
+func (attenuation *Attenuation) AddSource(blockTxt string) error {
+	blockTxt = strings.TrimSpace(blockTxt)
+	if blockTxt != "" && !strings.HasSuffix(blockTxt, ";") {
+		blockTxt += ";"
+	}
+	parsedBlock, err := datalogParser.Block(blockTxt, nil)
+	if err != nil {
+		return fmt.Errorf("error when parsing attenuation block: %w", err)
+	}
+	attenuation.facts = append(attenuation.facts, parsedBlock.Facts...)
+	attenuation.rules = append(attenuation.rules, parsedBlock.Rules...)
+	attenuation.checks = append(attenuation.checks, parsedBlock.Checks...)
+	return nil
+}
+
+// SetContext sets the free form context string stored in the block, e.g. why or for whom the token was attenuated.
+func (attenuation *Attenuation) SetContext(context string) {
+	attenuation.context = context
+}
+
+// addCheck parses checkTxt with params and adds it to the attenuation. Values are always passed as params so they cannot be read as datalog.
+func (attenuation *Attenuation) addCheck(checkTxt string, params parser.ParametersMap) error {
+	check, err := datalogParser.Check(checkTxt, params)
+	if err != nil {
+		return fmt.Errorf("error when parsing check: %w", err)
+	}
+	attenuation.checks = append(attenuation.checks, check)
+	return nil
+}
+
+// RestrictToRepos restricts the token to operations on the given repo ids.
+func (attenuation *Attenuation) RestrictToRepos(repoIds ...int) error {
+	if len(repoIds) == 0 {
+		return fmt.Errorf("at least one repo is required")
+	}
+	repos := biscuit.Set{}
+	for _, repoId := range repoIds {
+		if repoId <= 0 {
+			return fmt.Errorf("invalid repo id: %d", repoId)
+		}
+		repos = append(repos, biscuit.String(namespaceRepo(repoId)))
+	}
+	return attenuation.addCheck(`check if operation($action, $repo), {repos}.contains($repo)`,
+		parser.ParametersMap{"repos": repos})
+}
+
+// RestrictToRepoNames restricts the token to operations on the repos with the given names, for callers which know repos by name rather than id, like git clients.
+func (attenuation *Attenuation) RestrictToRepoNames(reponames ...string) error {
+	if len(reponames) == 0 {
+		return fmt.Errorf("at least one repo is required")
+	}
+	names := biscuit.Set{}
+	for _, reponame := range reponames {
+		if reponame == "" {
+			return fmt.Errorf("repo name is required")
+		}
+		names = append(names, biscuit.String(reponame))
+	}
+	return attenuation.addCheck(`check if operation($action, $repo), reponame($repo, $name), {names}.contains($name)`,
+		parser.ParametersMap{"names": names})
+}
+
+// RestrictToRepogroup restricts the token to operations on repos in the given repogroup.
+func (attenuation *Attenuation) RestrictToRepogroup(repogroupId int) error {
+	if repogroupId <= 0 {
+		return fmt.Errorf("invalid repogroup id: %d", repogroupId)
+	}
+	return attenuation.addCheck(`check if operation($action, $repo), repogroup({repogroup}, $repo)`,
+		parser.ParametersMap{"repogroup": biscuit.String(namespaceRG(repogroupId))})
+}
+
+// RestrictToActions restricts the token to the given actions.
+func (attenuation *Attenuation) RestrictToActions(actions ...Action) error {
+	if len(actions) == 0 {
+		return fmt.Errorf("at least one action is required")
+	}
+	actionSet := biscuit.Set{}
+	for _, action := range actions {
+		actionStr, err := actionToStr(action)
+		if err != nil {
+			return fmt.Errorf("error when converting action: %w", err)
+		}
+		actionSet = append(actionSet, biscuit.String(namespaceAction(actionStr)))
+	}
+	return attenuation.addCheck(`check if operation($action, $repo), {actions}.contains($action)`,
+		parser.ParametersMap{"actions": actionSet})
+}
+
+// ExpiresAt restricts the token to requests made up to and including expiry.
+func (attenuation *Attenuation) ExpiresAt(expiry time.Time) error {
+	if expiry.IsZero() {
+		return fmt.Errorf("expiry is required")
+	}
+	if expiry.Before(time.Now()) {
+		return fmt.Errorf("expiry %s is in the past", expiry.Format(time.RFC3339))
+	}
+	return attenuation.addCheck(`check if time($time), $time <= {expiry}`,
+		parser.ParametersMap{"expiry": biscuit.Date(expiry.UTC().Truncate(time.Second))})
+}
+
+// RestrictToRefs restricts writes to the given git refs. A ref ending in "/*" matches every ref under that prefix. Reads and membership changes are not affected since they do not target a ref.
+func (attenuation *Attenuation) RestrictToRefs(refs ...string) error {
+	if len(refs) == 0 {
+		return fmt.Errorf("at least one ref is required")
+	}
+	queries := []string{`operation($action, $repo), {nonwrite}.contains($action)`}
+	params := parser.ParametersMap{
+		"nonwrite": biscuit.Set{
+			biscuit.String(namespaceAction(readStr)),
+			biscuit.String(namespaceAction(membershipStr)),
+		},
+	}
+	for i, ref := range refs {
+		if !strings.HasPrefix(ref, "refs/") || strings.ContainsAny(ref, " \t\n") {
+			return fmt.Errorf("invalid ref: %q", ref)
+		}
+		paramName := fmt.Sprintf("ref%d", i)
+		prefix, isPrefix := strings.CutSuffix(ref, "*")
+		switch {
+		case isPrefix && strings.HasSuffix(prefix, "/"):
+			queries = append(queries, fmt.Sprintf(`ref($ref), $ref.starts_with({%s})`, paramName))
+			params[paramName] = biscuit.String(prefix)
+		case strings.Contains(ref, "*"):
+			return fmt.Errorf("invalid ref: %q, wildcards are only allowed as a trailing /*", ref)
+		default:
+			queries = append(queries, fmt.Sprintf(`ref($ref), $ref == {%s}`, paramName))
+			params[paramName] = biscuit.String(ref)
+		}
+	}
+	return attenuation.addCheck("check if "+strings.Join(queries, " or "), params)
+}
+
+// ipToTerms converts ip into the two integers used by the source_ip fact. IPv4 addresses are mapped into IPv6 and each half is shifted into the signed range, keeping the order of addresses so CIDR ranges become integer comparisons.
+func ipToTerms(ip net.IP) (biscuit.Integer, biscuit.Integer) {
+	ip16 := ip.To16()
+	hi := binary.BigEndian.Uint64(ip16[:8]) ^ (1 << 63)
+	lo := binary.BigEndian.Uint64(ip16[8:]) ^ (1 << 63)
+	return biscuit.Integer(int64(hi)), biscuit.Integer(int64(lo))
+}
+
+// RestrictToSourceCIDR restricts the token to requests from addresses in one of the given CIDR ranges, such as "10.0.0.0/8".
+func (attenuation *Attenuation) RestrictToSourceCIDR(cidrs ...string) error {
+	if len(cidrs) == 0 {
+		return fmt.Errorf("at least one CIDR is required")
+	}
+	queries := []string{}
+	params := parser.ParametersMap{}
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("error when parsing CIDR: %w", err)
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits == 8*net.IPv4len {
+			ones += 8 * (net.IPv6len - net.IPv4len)
+		}
+		start := ipNet.IP.To16()
+		end := make(net.IP, net.IPv6len)
+		copy(end, start)
+		for bit := ones; bit < 8*net.IPv6len; bit++ {
+			end[bit/8] |= 0x80 >> (bit % 8)
+		}
+		startHi, startLo := ipToTerms(start)
+		endHi, endLo := ipToTerms(end)
+
+		if ones <= 64 {
+			queries = append(queries, fmt.Sprintf(`source_ip($ip, $hi, $lo), $hi >= {starthi%d}, $hi <= {endhi%d}`, i, i))
+		} else {
+			queries = append(queries, fmt.Sprintf(`source_ip($ip, $hi, $lo), $hi == {starthi%d}, $lo >= {startlo%d}, $lo <= {endlo%d}`, i, i, i))
+		}
+		params[fmt.Sprintf("starthi%d", i)] = startHi
+		params[fmt.Sprintf("endhi%d", i)] = endHi
+		params[fmt.Sprintf("startlo%d", i)] = startLo
+		params[fmt.Sprintf("endlo%d", i)] = endLo
+	}
+	return attenuation.addCheck("check if "+strings.Join(queries, " or "), params)
+}
+
+// RequireMFA restricts the token to requests where the client performed multi-factor authentication.
+func (attenuation *Attenuation) RequireMFA() error {
+	return attenuation.addCheck(`check if mfa_verified(true)`, nil)
+}
+
+// RestrictToTransports restricts the token to requests which reach the forge over one of the given transports, dblogic.TransportHTTP or dblogic.TransportSSH. Requests whose transport is unknown are refused.
+func (attenuation *Attenuation) RestrictToTransports(transports ...string) error {
+	if len(transports) == 0 {
+		return fmt.Errorf("at least one transport is required")
+	}
+	transportSet := biscuit.Set{}
+	for _, transport := range transports {
+		if transport != dblogic.TransportHTTP && transport != dblogic.TransportSSH {
+			return fmt.Errorf("unknown transport: %s", transport)
+		}
+		transportSet = append(transportSet, biscuit.String(transport))
+	}
+	return attenuation.addCheck(`check if transport($transport), {transports}.contains($transport)`,
+		parser.ParametersMap{"transports": transportSet})
+}
+
+// RestrictToClientTypes restricts the token to requests from the given kinds of client, such as "git" or "cli". Requests whose client type is unknown are refused.
+func (attenuation *Attenuation) RestrictToClientTypes(clientTypes ...string) error {
+	if len(clientTypes) == 0 {
+		return fmt.Errorf("at least one client type is required")
+	}
+	clientTypeSet := biscuit.Set{}
+	for _, clientType := range clientTypes {
+		clientTypeSet = append(clientTypeSet, biscuit.String(clientType))
+	}
+	return attenuation.addCheck(`check if client_type($type), {types}.contains($type)`,
+		parser.ParametersMap{"types": clientTypeSet})
+}
+
+// Apply appends the restrictions to biscuitToken as a single block.
+func (attenuation *Attenuation) Apply(biscuitToken *biscuit.Biscuit) (*biscuit.Biscuit, error) {
+	if len(attenuation.facts)+len(attenuation.rules)+len(attenuation.checks) == 0 {
+		return nil, fmt.Errorf("attenuation has no restrictions")
+	}
+	blockBuilder := biscuitToken.CreateBlock()
+	err := blockBuilder.AddBlock(biscuit.ParsedBlock{
+		Facts:  attenuation.facts,
+		Rules:  attenuation.rules,
+		Checks: attenuation.checks,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error when adding statements to block: %w", err)
+	}
+	if attenuation.context != "" {
+		blockBuilder.SetContext(attenuation.context)
+	}
+	biscuitToken, err = biscuitToken.Append(rand.Reader, blockBuilder.Build())
+	if err != nil {
+		return nil, fmt.Errorf("error when appending new block to token: %w", err)
+	}
+	return biscuitToken, nil
+}
@@ -0,0 +1,318 @@
+package authz
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/dblogic"
+)
+
+// testSetup opens the seeded example database and creates a token issuer, discarding logging for the rest of the test or benchmark.
+func testSetup(t testing.TB) (*dblogic.DBInstance, *TokenIssuer) {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dbInstance, err := dblogic.InitMemoryDb(true)
+	if err != nil {
+		t.Fatalf("InitMemoryDb: %s", err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	tokenIssuer, err := NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	return dbInstance, tokenIssuer
+}
+
+// testRequest is a request to check a token against, made by the user or service account the token was issued to.
+type testRequest struct {
+	// user is the user the token was issued to, unless service is set
+	user int
+	// service is the service account the token was issued to
+	service int
+	repo    string
+	action  Action
+	context dblogic.RequestContext
+}
+
+// checkRequest gathers the details of request from dbInstance and returns whether CheckAuthz allows it for token, along with the reason if it does not.
+func checkRequest(t *testing.T, dbInstance *dblogic.DBInstance, tokenIssuer *TokenIssuer, token *biscuit.Biscuit, request testRequest) (bool, error) {
+	t.Helper()
+	var reqDetails *dblogic.RequestDetails
+	var err error
+	if request.service != 0 {
+		reqDetails, err = dblogic.GatherServiceRequestDetails(request.service, request.repo, dbInstance)
+	} else {
+		reqDetails, err = dblogic.GatherRequestDetails(request.user, request.repo, dbInstance)
+	}
+	if err != nil {
+		t.Fatalf("gathering request details: %s", err)
+	}
+	reqDetails.RequestContext = request.context
+	return CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, request.action)
+}
+
+// TestAttenuationBuilders checks each typed restriction against requests which the unrestricted token is allowed to make, using Liam (user 4), who may read and write Bravo and Charlie through the Foo repogroup, and ci-bot (service 1), who may read and write them through its grant on the Foo repogroup and is given a grant on Alpha here.
+func TestAttenuationBuilders(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	err := dbInstance.LoadFixtures(&dblogic.Fixtures{
+		AssignedRoles: []*dblogic.AssignedRole{
+			{UserOrGroup: dblogic.ServiceAccountUGR, UserOrGroupID: 1, RepoOrGroup: dblogic.RepoUGR, RepoOrGroupID: 1, RepoRole: dblogic.ReaderRole},
+		},
+	})
+	if err != nil {
+		t.Fatalf("LoadFixtures: %s", err)
+	}
+	liamToken, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	ciToken, err := tokenIssuer.IssueServiceToken(1, IssueOptions{})
+	if err != nil {
+		t.Fatalf("IssueServiceToken: %s", err)
+	}
+
+	liam := func(repo string, action Action) testRequest {
+		return testRequest{user: 4, repo: repo, action: action}
+	}
+	ci := func(repo string, action Action) testRequest {
+		return testRequest{service: 1, repo: repo, action: action}
+	}
+	withContext := func(request testRequest, context dblogic.RequestContext) testRequest {
+		request.context = context
+		return request
+	}
+	testCases := []struct {
+		name     string
+		token    *biscuit.Biscuit
+		restrict func(attenuation *Attenuation) error
+		allowed  []testRequest
+		denied   []testRequest
+		// wait is how long to wait after checking allowed before checking denied, for restrictions which only deny once they expire
+		wait time.Duration
+	}{
+		{
+			name:  "repos",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToRepos(2)
+			},
+			allowed: []testRequest{liam("Bravo", Read)},
+			denied:  []testRequest{liam("Charlie", Read)},
+		},
+		{
+			name:  "repo names",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToRepoNames("Charlie")
+			},
+			allowed: []testRequest{liam("Charlie", Write)},
+			denied:  []testRequest{liam("Bravo", Write)},
+		},
+		{
+			name:  "repogroup",
+			token: ciToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToRepogroup(1)
+			},
+			allowed: []testRequest{ci("Bravo", Read), ci("Charlie", Write)},
+			denied:  []testRequest{ci("Alpha", Read)},
+		},
+		{
+			name:  "other repogroup",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToRepogroup(2)
+			},
+			denied: []testRequest{liam("Charlie", Read)},
+		},
+		{
+			name:  "actions",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToActions(Read)
+			},
+			allowed: []testRequest{liam("Charlie", Read)},
+			denied:  []testRequest{liam("Charlie", Write)},
+		},
+		{
+			name:  "expiry",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				// The expiry is truncated to the second, so this is at least a second away
+				return attenuation.ExpiresAt(time.Now().Add(2 * time.Second))
+			},
+			allowed: []testRequest{liam("Charlie", Read)},
+			denied:  []testRequest{liam("Charlie", Read)},
+			wait:    3 * time.Second,
+		},
+		{
+			name:  "refs",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToRefs("refs/heads/main", "refs/tags/*")
+			},
+			allowed: []testRequest{
+				withContext(liam("Charlie", Write), dblogic.RequestContext{Ref: "refs/heads/main"}),
+				withContext(liam("Charlie", Write), dblogic.RequestContext{Ref: "refs/tags/v1"}),
+				liam("Charlie", Read),
+			},
+			denied: []testRequest{
+				withContext(liam("Charlie", Write), dblogic.RequestContext{Ref: "refs/heads/dev"}),
+				withContext(liam("Charlie", Write), dblogic.RequestContext{Ref: "refs/heads/main2"}),
+				liam("Charlie", Write),
+			},
+		},
+		{
+			name:  "CIDRs",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToSourceCIDR("10.0.0.0/8", "2001:db8::1/128")
+			},
+			allowed: []testRequest{
+				withContext(liam("Charlie", Read), dblogic.RequestContext{SourceIP: "10.1.2.3"}),
+				withContext(liam("Charlie", Read), dblogic.RequestContext{SourceIP: "2001:db8::1"}),
+			},
+			denied: []testRequest{
+				withContext(liam("Charlie", Read), dblogic.RequestContext{SourceIP: "11.0.0.1"}),
+				withContext(liam("Charlie", Read), dblogic.RequestContext{SourceIP: "2001:db8::2"}),
+				liam("Charlie", Read),
+			},
+		},
+		{
+			name:  "MFA",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RequireMFA()
+			},
+			allowed: []testRequest{withContext(liam("Charlie", Read), dblogic.RequestContext{MFA: true})},
+			denied:  []testRequest{liam("Charlie", Read)},
+		},
+		{
+			name:  "transports",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToTransports(dblogic.TransportSSH)
+			},
+			allowed: []testRequest{withContext(liam("Charlie", Read), dblogic.RequestContext{Transport: dblogic.TransportSSH})},
+			denied: []testRequest{
+				withContext(liam("Charlie", Read), dblogic.RequestContext{Transport: dblogic.TransportHTTP}),
+				liam("Charlie", Read),
+			},
+		},
+		{
+			name:  "client types",
+			token: liamToken,
+			restrict: func(attenuation *Attenuation) error {
+				return attenuation.RestrictToClientTypes("git")
+			},
+			allowed: []testRequest{withContext(liam("Charlie", Read), dblogic.RequestContext{ClientType: "git"})},
+			denied:  []testRequest{withContext(liam("Charlie", Read), dblogic.RequestContext{ClientType: "browser"})},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			attenuation := NewAttenuation()
+			err := testCase.restrict(attenuation)
+			if err != nil {
+				t.Fatalf("building restriction: %s", err)
+			}
+			attenuated, err := attenuation.Apply(testCase.token)
+			if err != nil {
+				t.Fatalf("Apply: %s", err)
+			}
+			for _, request := range testCase.allowed {
+				hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, attenuated, request)
+				if !hasPermission {
+					t.Errorf("expected %+v to be allowed: %s", request, err)
+				}
+			}
+			time.Sleep(testCase.wait)
+			for _, request := range testCase.denied {
+				// The request must only be denied by the restriction
+				hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, testCase.token, request)
+				if !hasPermission {
+					t.Fatalf("unrestricted token was denied %+v: %s", request, err)
+				}
+				hasPermission, _ = checkRequest(t, dbInstance, tokenIssuer, attenuated, request)
+				if hasPermission {
+					t.Errorf("expected %+v to be denied", request)
+				}
+			}
+		})
+	}
+}
+
+// TestAttenuationOneBlock checks that several restrictions are appended as a single block and all apply.
+func TestAttenuationOneBlock(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	token, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	attenuation := NewAttenuation()
+	if err := attenuation.RestrictToRepos(3); err != nil {
+		t.Fatalf("RestrictToRepos: %s", err)
+	}
+	if err := attenuation.RestrictToActions(Read); err != nil {
+		t.Fatalf("RestrictToActions: %s", err)
+	}
+	attenuation.SetContext("read Charlie")
+	attenuated, err := attenuation.Apply(token)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	if attenuated.BlockCount() != token.BlockCount()+1 {
+		t.Errorf("expected one block to be appended, got %d", attenuated.BlockCount()-token.BlockCount())
+	}
+
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, attenuated, testRequest{user: 4, repo: "Charlie", action: Read})
+	if !hasPermission {
+		t.Errorf("expected reading Charlie to be allowed: %s", err)
+	}
+	for _, request := range []testRequest{
+		{user: 4, repo: "Charlie", action: Write},
+		{user: 4, repo: "Bravo", action: Read},
+	} {
+		hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, attenuated, request)
+		if hasPermission {
+			t.Errorf("expected %+v to be denied", request)
+		}
+	}
+}
+
+// TestAttenuationValidation checks that the builders refuse input which would make a meaningless or unintended restriction.
+func TestAttenuationValidation(t *testing.T) {
+	testCases := map[string]func(attenuation *Attenuation) error{
+		"no repos":           func(attenuation *Attenuation) error { return attenuation.RestrictToRepos() },
+		"zero repo id":       func(attenuation *Attenuation) error { return attenuation.RestrictToRepos(0) },
+		"empty repo name":    func(attenuation *Attenuation) error { return attenuation.RestrictToRepoNames("") },
+		"zero repogroup id":  func(attenuation *Attenuation) error { return attenuation.RestrictToRepogroup(0) },
+		"no actions":         func(attenuation *Attenuation) error { return attenuation.RestrictToActions() },
+		"unknown action":     func(attenuation *Attenuation) error { return attenuation.RestrictToActions(Action(99)) },
+		"zero expiry":        func(attenuation *Attenuation) error { return attenuation.ExpiresAt(time.Time{}) },
+		"past expiry":        func(attenuation *Attenuation) error { return attenuation.ExpiresAt(time.Now().Add(-time.Hour)) },
+		"ref outside refs/":  func(attenuation *Attenuation) error { return attenuation.RestrictToRefs("main") },
+		"inner wildcard ref": func(attenuation *Attenuation) error { return attenuation.RestrictToRefs("refs/*/main") },
+		"bad CIDR":           func(attenuation *Attenuation) error { return attenuation.RestrictToSourceCIDR("10.0.0.0") },
+		"unknown transport":  func(attenuation *Attenuation) error { return attenuation.RestrictToTransports("ftp") },
+		"bad datalog":        func(attenuation *Attenuation) error { return attenuation.AddSource("check if") },
+	}
+	for name, restrict := range testCases {
+		if restrict(NewAttenuation()) == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	_, err := NewAttenuation().Apply(nil)
+	if err == nil {
+		t.Errorf("expected applying an empty attenuation to fail")
+	}
+}
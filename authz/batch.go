@@ -0,0 +1,110 @@
+package authz
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/dblogic"
+)
+
+// BatchItem is a repo and action to authorize as part of a batch.
+type BatchItem struct {
+	// RepoName is the name of the repo acted upon
+	RepoName string
+	// Action is the action to perform on the repo
+	Action Action
+}
+
+// BatchDecision is the decision made for a BatchItem.
+type BatchDecision struct {
+	BatchItem
+	// Allowed is set if the token allows the action on the repo
+	Allowed bool
+	// Err is why the action is not allowed, such as the repo not existing or the policy denying it. Nil if Allowed is set.
+	Err error
+}
+
+// BatchAuthorize decides each of items for token, for callers such as repo listings which check many repos at once. The token is verified and checked for revocation once, the org data for its user or service account is gathered for all the repos in one transaction, and every item is then evaluated against the same policy with reqContext describing the request. Decisions are returned in the order of items; an error is only returned if the token or the database cannot be used at all.
+func BatchAuthorize(token *biscuit.Biscuit, publicRoot ed25519.PublicKey, dbInstance *dblogic.DBInstance, reqContext dblogic.RequestContext, items []BatchItem) ([]*BatchDecision, error) {
+	// Creating the first authorizer verifies the signatures, so the ones for
+	// each item are created without verifying them again
+	authorizer, err := token.Authorizer(publicRoot, authorizerOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("error when verifying token and creating authorizer: %w", err)
+	}
+	issuances, err := queryIssuance(authorizer)
+	if err != nil {
+		return nil, fmt.Errorf("error when reading token issuance: %w", err)
+	}
+	if store := getRevocationStore(); store != nil {
+		err = checkIssuanceRevocation(store, token, issuances)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(issuances) != 1 {
+		return nil, fmt.Errorf("token must be issued to exactly one principal, found %d", len(issuances))
+	}
+	facts, err := tokenFacts(token)
+	if err != nil {
+		return nil, err
+	}
+
+	reponames := []string{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if !seen[item.RepoName] {
+			seen[item.RepoName] = true
+			reponames = append(reponames, item.RepoName)
+		}
+	}
+	var batch []*dblogic.RequestDetails
+	if issuances[0].serviceAccountId != 0 {
+		batch, err = dblogic.GatherServiceBatchRequestDetails(issuances[0].serviceAccountId, reponames, dbInstance)
+	} else {
+		batch, err = dblogic.GatherBatchRequestDetails(issuances[0].userId, reponames, dbInstance)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when gathering request details: %w", err)
+	}
+	reqDetailsByName := map[string]*dblogic.RequestDetails{}
+	for i, reponame := range reponames {
+		if batch[i] != nil {
+			reqDetailsByName[reponame] = batch[i]
+		}
+	}
+
+	// Use one policy for the whole batch even if it is reloaded meanwhile
+	policy := GetPolicy()
+	decisions := make([]*BatchDecision, 0, len(items))
+	for _, item := range items {
+		decision := &BatchDecision{BatchItem: item}
+		decisions = append(decisions, decision)
+		_, err := actionToStr(item.Action)
+		if err != nil {
+			decision.Err = err
+			continue
+		}
+		reqDetails, found := reqDetailsByName[item.RepoName]
+		if !found {
+			decision.Err = fmt.Errorf("unknown repo: %s", item.RepoName)
+			continue
+		}
+		itemDetails := *reqDetails
+		itemDetails.RequestContext = reqContext
+		itemAuthorizer, err := biscuit.NewVerifier(token, authorizerOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("error when creating authorizer: %w", err)
+		}
+		loadRequest(itemAuthorizer, facts, &itemDetails, item.Action, policy)
+		err = itemAuthorizer.Authorize()
+		if err != nil {
+			decision.Err = fmt.Errorf("error in Authorize: %w", err)
+			continue
+		}
+		decision.Allowed = true
+	}
+	return decisions, nil
+}
@@ -0,0 +1,133 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/dblogic"
+)
+
+// benchmarkSetup opens the seeded example database, issues a token to Liam (user 4) and gathers the details of Liam reading Charlie, which Liam may do through a usergroup. Debug logging is left off as it is by default, and any other logging is discarded.
+func benchmarkSetup(b *testing.B) (*dblogic.DBInstance, *TokenIssuer, *biscuit.Biscuit, *dblogic.RequestDetails) {
+	b.Helper()
+	dbInstance, tokenIssuer := testSetup(b)
+	token, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		b.Fatalf("IssueToken: %s", err)
+	}
+	reqDetails, err := dblogic.GatherRequestDetails(4, "Charlie", dbInstance)
+	if err != nil {
+		b.Fatalf("GatherRequestDetails: %s", err)
+	}
+	return dbInstance, tokenIssuer, token, reqDetails
+}
+
+// benchmarkCheckAuthz measures CheckAuthz of token reading Charlie, which must be allowed.
+func benchmarkCheckAuthz(b *testing.B, token *biscuit.Biscuit, tokenIssuer *TokenIssuer, reqDetails *dblogic.RequestDetails) {
+	b.Helper()
+	hasPermission, err := CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, Read)
+	if !hasPermission {
+		b.Fatalf("CheckAuthz denied the benchmark request: %s", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, Read)
+	}
+}
+
+// BenchmarkCheckAuthz measures a single check with details already gathered, with and without the revocation store servers use.
+func BenchmarkCheckAuthz(b *testing.B) {
+	dbInstance, tokenIssuer, token, reqDetails := benchmarkSetup(b)
+
+	b.Run("no-revocation", func(b *testing.B) {
+		benchmarkCheckAuthz(b, token, tokenIssuer, reqDetails)
+	})
+	b.Run("revocation", func(b *testing.B) {
+		SetRevocationStore(dbInstance)
+		defer SetRevocationStore(nil)
+		benchmarkCheckAuthz(b, token, tokenIssuer, reqDetails)
+	})
+	b.Run("attenuated", func(b *testing.B) {
+		attenuation := NewAttenuation()
+		if err := attenuation.RestrictToRepoNames("Charlie"); err != nil {
+			b.Fatalf("RestrictToRepoNames: %s", err)
+		}
+		if err := attenuation.RestrictToActions(Read, Write); err != nil {
+			b.Fatalf("RestrictToActions: %s", err)
+		}
+		if err := attenuation.RestrictToTransports(dblogic.TransportSSH); err != nil {
+			b.Fatalf("RestrictToTransports: %s", err)
+		}
+		attenuated, err := attenuation.Apply(token)
+		if err != nil {
+			b.Fatalf("Apply: %s", err)
+		}
+		sshDetails := *reqDetails
+		sshDetails.Transport = dblogic.TransportSSH
+		benchmarkCheckAuthz(b, attenuated, tokenIssuer, &sshDetails)
+	})
+}
+
+// BenchmarkGatherAndCheckAuthz measures what the SSH gateway does for each git command: gathering the details from the database and checking them.
+func BenchmarkGatherAndCheckAuthz(b *testing.B) {
+	dbInstance, tokenIssuer, token, _ := benchmarkSetup(b)
+	SetRevocationStore(dbInstance)
+	defer SetRevocationStore(nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reqDetails, err := dblogic.GatherRequestDetails(4, "Charlie", dbInstance)
+		if err != nil {
+			b.Fatalf("GatherRequestDetails: %s", err)
+		}
+		CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, Read)
+	}
+}
+
+// BenchmarkBatchAuthorize compares deciding every action on every example repo with BatchAuthorize against gathering and checking them one at a time.
+func BenchmarkBatchAuthorize(b *testing.B) {
+	dbInstance, tokenIssuer, token, _ := benchmarkSetup(b)
+	reponames := []string{"Alpha", "Bravo", "Charlie"}
+	items := []BatchItem{}
+	for _, reponame := range reponames {
+		for _, action := range []Action{Membership, Read, Write} {
+			items = append(items, BatchItem{RepoName: reponame, Action: action})
+		}
+	}
+
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := BatchAuthorize(token, tokenIssuer.PublicRoot, dbInstance, dblogic.RequestContext{}, items)
+			if err != nil {
+				b.Fatalf("BatchAuthorize: %s", err)
+			}
+		}
+	})
+	b.Run("one-at-a-time", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, item := range items {
+				reqDetails, err := dblogic.GatherRequestDetails(4, item.RepoName, dbInstance)
+				if err != nil {
+					b.Fatalf("GatherRequestDetails: %s", err)
+				}
+				CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, item.Action)
+			}
+		}
+	})
+}
+
+// BenchmarkParsePolicy measures parsing the policy, which is done when it is loaded rather than for each check.
+func BenchmarkParsePolicy(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := ParsePolicy(defaultPolicySource)
+		if err != nil {
+			b.Fatalf("ParsePolicy: %s", err)
+		}
+	}
+}
@@ -1,16 +1,22 @@
 package authz
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"strconv"
 	"strings"
-	"text/template"
+	"sync/atomic"
 	"time"
 
 	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/datalog"
 	"github.com/biscuit-auth/biscuit-go/v2/parser"
 
 	"biscuitExample/dblogic"
@@ -40,62 +46,316 @@ const (
 	usergroupNS = "usergroupid"
 	repoNS      = "repo"
 	repogroupNS = "repogroupid"
+	svcNS       = "svc"
 )
 
+// serviceKind is the ledger kind of service account tokens.
+const serviceKind = "service"
+
+// ParseAction converts an action name such as "read" to an Action.
+func ParseAction(actionStr string) (Action, error) {
+	switch actionStr {
+	case membershipStr:
+		return Membership, nil
+	case readStr:
+		return Read, nil
+	case writeStr:
+		return Write, nil
+	default:
+		return Read, fmt.Errorf("unknown action: %s", actionStr)
+	}
+}
+
+// actionToStr converts an Action to its name, the inverse of ParseAction.
+func actionToStr(action Action) (string, error) {
+	switch action {
+	case Membership:
+		return membershipStr, nil
+	case Read:
+		return readStr, nil
+	case Write:
+		return writeStr, nil
+	default:
+		return "", fmt.Errorf("unknown action: %d", action)
+	}
+}
+
+// IssueOptions controls the validity window of an issued token. The window is written into the authority block as checks against the time() fact, so attenuation cannot widen it.
+type IssueOptions struct {
+	// TTL is how long the token is valid for, counted from NotBefore if set and from issuance otherwise. Zero means the token does not expire.
+	TTL time.Duration
+	// NotBefore is the earliest time the token is valid. Zero means the token is valid immediately.
+	NotBefore time.Time
+	// Name is a label recorded in the issuance ledger, like a personal access token name
+	Name string
+	// Description is recorded in the issuance ledger
+	Description string
+	// Kind is the kind of token recorded in the issuance ledger, e.g. "pat". Empty for plain user tokens.
+	Kind string
+	// Scope holds checks which are added to the authority block rather than appended as a block. It must not hold facts or rules, since authority facts are trusted.
+	Scope *Attenuation
+	// BoundKey is the fingerprint of the key, as returned by KeyFingerprint, the token is bound to. Bound tokens get an authority check on a possession fact for the key, which transports only supply once the client has signed a challenge with it, so the token is useless without the key. Empty for bearer tokens.
+	BoundKey string
+	// ScopeDescription is a readable summary of Scope recorded in the issuance ledger
+	ScopeDescription string
+	// ParentTokenId is recorded in the issuance ledger for tokens issued in exchange for another, so that revoking the other through the ledger revokes this one too
+	ParentTokenId string
+}
+
+// IssuanceLedger records every token an issuer mints. dblogic.DBInstance implements it.
+type IssuanceLedger interface {
+	RecordIssuance(issuedToken *dblogic.IssuedToken) error
+}
+
 // TokenIssuer issues a biscuit with a user's token.
 // NOTE: This is example code and in the real world keep private keys tightly accessc controlled.
 type TokenIssuer struct {
 	privateRoot ed25519.PrivateKey
 	PublicRoot  ed25519.PublicKey
+	// DefaultOptions are used by IssueToken, and fill in the zero fields of the options given to IssueTokenWithOptions.
+	DefaultOptions IssueOptions
+	// MaxLifetime is the longest a token may be valid for, from issuance to expiry. Tokens without a TTL get MaxLifetime as their TTL. Zero means no limit.
+	MaxLifetime time.Duration
+	// RequireExpiry refuses to issue tokens which would never expire.
+	RequireExpiry bool
+	// RequireSealedKinds are token kinds, like "deploy", which are only accepted once sealed. Tokens of these kinds get an authority check on the sealed fact, so they must be sealed before use.
+	RequireSealedKinds []string
+	// KeyId identifies PublicRoot, so ledger entries and tokens can be traced to the key which signed them
+	KeyId string
+	// Ledger records every issued token, nil to keep no record
+	Ledger IssuanceLedger
 }
 
-// IssueToken issues a biscuit for a user in string format.
+// validity resolves opts against the issuer defaults and policy into the token's not-before and expiry times. Either may be zero, meaning no bound.
+func (tokenIssuer *TokenIssuer) validity(opts IssueOptions, now time.Time) (time.Time, time.Time, error) {
+	if opts.TTL == 0 {
+		opts.TTL = tokenIssuer.DefaultOptions.TTL
+	}
+	if opts.NotBefore.IsZero() {
+		opts.NotBefore = tokenIssuer.DefaultOptions.NotBefore
+	}
+	if opts.TTL < 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid TTL: %s", opts.TTL)
+	}
+
+	start := now
+	if opts.NotBefore.After(now) {
+		start = opts.NotBefore
+	}
+	expiry := time.Time{}
+	if opts.TTL != 0 {
+		expiry = start.Add(opts.TTL)
+	}
+
+	if tokenIssuer.MaxLifetime != 0 {
+		latest := now.Add(tokenIssuer.MaxLifetime)
+		switch {
+		case expiry.IsZero():
+			expiry = latest
+		case expiry.After(latest):
+			return time.Time{}, time.Time{}, fmt.Errorf("token would expire at %s, after the max lifetime of %s",
+				expiry.Format(time.RFC3339), tokenIssuer.MaxLifetime)
+		}
+	}
+	if !expiry.IsZero() && !expiry.After(start) {
+		// With no TTL the max lifetime is counted from now, so a not-before
+		// past it would give a token which is never valid.
+		return time.Time{}, time.Time{}, fmt.Errorf("token would expire at %s, before it becomes valid at %s",
+			expiry.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+	if expiry.IsZero() && tokenIssuer.RequireExpiry {
+		return time.Time{}, time.Time{}, fmt.Errorf("token has no expiry and the issuer requires one")
+	}
+	return opts.NotBefore, expiry, nil
+}
+
+// IssueToken issues a biscuit for a user with the issuer's default options.
 func (tokenIssuer *TokenIssuer) IssueToken(userId int) (*biscuit.Biscuit, error) {
-	// There is a function FromStringBlockWithParams, but I can't get it
-	// to work properly
-	// (below just results in {id} not being filled in)
-	/*
-		authority, err := parser.FromStringBlockWithParams(
-			`user("userid:{id}");`,
-			map[string]biscuit.Term{
-				"id": biscuit.Integer(userId),
-			},
-		)
-	*/
-	userFact := fmt.Sprintf(`user("userid:%d");`, userId)
-	authority, err := parser.FromStringBlock(userFact)
+	return tokenIssuer.IssueTokenWithOptions(userId, IssueOptions{})
+}
+
+// IssueTokenWithOptions issues a biscuit for a user which is only valid within the window described by opts and the issuer policy.
+func (tokenIssuer *TokenIssuer) IssueTokenWithOptions(userId int, opts IssueOptions) (*biscuit.Biscuit, error) {
+	principal := newFact("user", biscuit.String(namespaceUser(userId)))
+	return tokenIssuer.issue(principal, &dblogic.IssuedToken{UserId: userId}, opts)
+}
+
+// IssueServiceToken issues a biscuit for a service account, carrying a service("svc:N") authority fact instead of a user. The policy only lets service accounts read and write, whatever roles they are granted.
+func (tokenIssuer *TokenIssuer) IssueServiceToken(serviceAccountId int, opts IssueOptions) (*biscuit.Biscuit, error) {
+	if opts.Kind == "" {
+		opts.Kind = serviceKind
+	}
+	principal := newFact("service", biscuit.String(namespaceSvc(serviceAccountId)))
+	return tokenIssuer.issue(principal, &dblogic.IssuedToken{ServiceAccountId: serviceAccountId}, opts)
+}
+
+// issue builds a token for the principal fact, and records it in the ledger with the principal ids from issuedToken.
+func (tokenIssuer *TokenIssuer) issue(principal biscuit.Fact, issuedToken *dblogic.IssuedToken, opts IssueOptions) (*biscuit.Biscuit, error) {
+	notBefore, expiry, err := tokenIssuer.validity(opts, time.Now())
 	if err != nil {
-		return nil, fmt.Errorf("error when parsing authority block: %w",
-			err)
+		return nil, fmt.Errorf("error when resolving token validity: %w", err)
+	}
+
+	tokenIdBytes := make([]byte, 16)
+	_, err = rand.Read(tokenIdBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error when generating token id: %w", err)
 	}
+	tokenId := hex.EncodeToString(tokenIdBytes)
+	issuedAt := time.Now().UTC().Truncate(time.Second)
 
 	builder := biscuit.NewBuilder(tokenIssuer.privateRoot)
-	err = builder.AddBlock(authority)
+	err = builder.AddAuthorityFact(principal)
 	if err != nil {
 		return nil, fmt.Errorf("error when adding authority block: %w",
 			err)
 	}
+	err = builder.AddAuthorityFact(newFact("issued_at", biscuit.Date(issuedAt)))
+	if err != nil {
+		return nil, fmt.Errorf("error when adding issued_at to authority block: %w",
+			err)
+	}
+	err = builder.AddAuthorityFact(newFact("token_id", biscuit.String(tokenId)))
+	if err != nil {
+		return nil, fmt.Errorf("error when adding token_id to authority block: %w",
+			err)
+	}
+	if opts.Scope != nil {
+		if len(opts.Scope.facts) != 0 || len(opts.Scope.rules) != 0 {
+			return nil, fmt.Errorf("token scope must only hold checks")
+		}
+		for _, check := range opts.Scope.checks {
+			err = builder.AddAuthorityCheck(check)
+			if err != nil {
+				return nil, fmt.Errorf("error when adding scope check: %w", err)
+			}
+		}
+	}
+	if opts.BoundKey != "" {
+		check, err := newPossessionCheck(opts.BoundKey)
+		if err != nil {
+			return nil, err
+		}
+		err = builder.AddAuthorityCheck(check)
+		if err != nil {
+			return nil, fmt.Errorf("error when adding possession check: %w", err)
+		}
+	}
+	for _, sealedKind := range tokenIssuer.RequireSealedKinds {
+		if opts.Kind != sealedKind {
+			continue
+		}
+		check, err := datalogParser.Check(sealedCheck, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error when parsing sealed check: %w", err)
+		}
+		err = builder.AddAuthorityCheck(check)
+		if err != nil {
+			return nil, fmt.Errorf("error when adding sealed check: %w", err)
+		}
+		break
+	}
+	if !notBefore.IsZero() {
+		check, err := datalogParser.Check(`check if time($time), $time >= {notbefore}`,
+			parser.ParametersMap{"notbefore": biscuit.Date(notBefore.UTC().Truncate(time.Second))})
+		if err != nil {
+			return nil, fmt.Errorf("error when parsing not-before check: %w", err)
+		}
+		err = builder.AddAuthorityCheck(check)
+		if err != nil {
+			return nil, fmt.Errorf("error when adding not-before check: %w", err)
+		}
+	}
+	if !expiry.IsZero() {
+		check, err := datalogParser.Check(`check if time($time), $time <= {expiry}`,
+			parser.ParametersMap{"expiry": biscuit.Date(expiry.UTC().Truncate(time.Second))})
+		if err != nil {
+			return nil, fmt.Errorf("error when parsing expiry check: %w", err)
+		}
+		err = builder.AddAuthorityCheck(check)
+		if err != nil {
+			return nil, fmt.Errorf("error when adding expiry check: %w", err)
+		}
+	}
 
 	biscuitToken, err := builder.Build()
 	if err != nil {
 		return nil, fmt.Errorf("error when building biscuit: %w", err)
 	}
+
+	if tokenIssuer.Ledger != nil {
+		revocationIds := []string{}
+		for _, revocationId := range biscuitToken.RevocationIds() {
+			revocationIds = append(revocationIds, hex.EncodeToString(revocationId))
+		}
+		// A token which is not in the ledger is never handed out
+		issuedToken.TokenId = tokenId
+		issuedToken.KeyId = tokenIssuer.KeyId
+		issuedToken.CreatedAt = issuedAt
+		issuedToken.ExpiresAt = expiry
+		issuedToken.RevocationIds = revocationIds
+		issuedToken.Name = opts.Name
+		issuedToken.Description = opts.Description
+		issuedToken.Kind = opts.Kind
+		issuedToken.Scope = opts.ScopeDescription
+		issuedToken.ParentTokenId = opts.ParentTokenId
+		err = tokenIssuer.Ledger.RecordIssuance(issuedToken)
+		if err != nil {
+			return nil, fmt.Errorf("error when recording token in ledger: %w", err)
+		}
+	}
 	return biscuitToken, nil
 }
 
 // NewTokenIssuer creates and returns a new TokenIssuer to create biscuits.
 func NewTokenIssuer() (*TokenIssuer, error) {
-	publicRoot, privateRoot, err := ed25519.GenerateKey(rand.Reader)
+	_, privateRoot, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return nil, fmt.Errorf("error generating new RoT for token issuer: %w",
 			err)
 	}
+	return newTokenIssuerFromKey(privateRoot), nil
+}
 
-	tokenIssuer := &TokenIssuer{
+// newTokenIssuerFromKey creates a TokenIssuer which signs with privateRoot.
+func newTokenIssuerFromKey(privateRoot ed25519.PrivateKey) *TokenIssuer {
+	publicRoot := privateRoot.Public().(ed25519.PublicKey)
+	return &TokenIssuer{
 		privateRoot: privateRoot,
 		PublicRoot:  publicRoot,
+		KeyId:       keyIdOf(publicRoot),
 	}
-	return tokenIssuer, nil
+}
+
+// keyIdOf returns the short id of a root public key, the hex of the first 8 bytes of its SHA-256.
+func keyIdOf(publicRoot ed25519.PublicKey) string {
+	keyIdSum := sha256.Sum256(publicRoot)
+	return hex.EncodeToString(keyIdSum[:8])
+}
+
+// LoadTokenIssuer creates a TokenIssuer from the hex encoded ed25519 seed in keyPath, so tokens stay verifiable across restarts. If keyPath does not exist a new key is generated and written to it, readable only by the owner.
+func LoadTokenIssuer(keyPath string) (*TokenIssuer, error) {
+	keyHex, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		_, err = rand.Read(seed)
+		if err != nil {
+			return nil, fmt.Errorf("error generating new RoT for token issuer: %w", err)
+		}
+		err = os.WriteFile(keyPath, []byte(hex.EncodeToString(seed)+"\n"), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("error when writing root key to %s: %w", keyPath, err)
+		}
+		return newTokenIssuerFromKey(ed25519.NewKeyFromSeed(seed)), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when reading root key from %s: %w", keyPath, err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(keyHex)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("root key in %s is not a hex encoded %d byte ed25519 seed", keyPath, ed25519.SeedSize)
+	}
+	return newTokenIssuerFromKey(ed25519.NewKeyFromSeed(seed)), nil
 }
 
 // namespaceAuthz adds a namespace to a datalog symbol
@@ -117,6 +377,13 @@ func namespaceUser(symbol int) string {
 	return namespacedStr
 }
 
+// namespaceSvc is a special case of namespaceAuthz for svcNS
+func namespaceSvc(symbol int) string {
+	symbolStr := fmt.Sprintf("%d", symbol)
+	namespacedStr := namespaceAuthz(symbolStr, svcNS)
+	return namespacedStr
+}
+
 // namespaceRepo is a special case of namespaceAuthz for repoNS
 func namespaceRepo(symbol int) string {
 	symbolStr := fmt.Sprintf("%d", symbol)
@@ -144,186 +411,145 @@ func namespaceRG(symbol int) string {
 	return namespacedStr
 }
 
-// buildRoleActions turns a set of actions into the datalog values for repo_role_actions
-func buildRoleActions(actions []string) string {
-	datalogedActions := []string{}
+// newFact builds a fact from typed terms. Facts are never built by formatting values into datalog source, so a value containing quotes or datalog syntax stays a single term.
+func newFact(name string, terms ...biscuit.Term) biscuit.Fact {
+	return biscuit.Fact{
+		Predicate: biscuit.Predicate{
+			Name: name,
+			IDs:  terms,
+		},
+	}
+}
+
+// buildRoleActions turns a set of actions into the datalog set for repo_role_actions
+func buildRoleActions(actions []string) biscuit.Set {
+	datalogedActions := biscuit.Set{}
 	for _, action := range actions {
-		namespacedAction := namespaceAuthz(action, actionNS)
-		quoteAction := fmt.Sprintf(`"%s"`, namespacedAction)
-		datalogedActions = append(datalogedActions, quoteAction)
+		datalogedActions = append(datalogedActions, biscuit.String(namespaceAction(action)))
 	}
-	joinedActions := strings.Join(datalogedActions, ", ")
-	return joinedActions
+	return datalogedActions
 }
 
-// CheckAuthz decides if the user in userDetails has permission to perform operation against repo.
-func CheckAuthz(token *biscuit.Biscuit, publicRoot ed25519.PublicKey, reqDetails *dblogic.RequestDetails, operation Action) (bool, error) {
+// roleActionFacts are the repo_role_actions facts, which are the same for every request so they are only built once.
+var roleActionFacts = buildRoleActionFacts()
+
+// buildRoleActionFacts describes which actions each role allows as repo_role_actions facts.
+func buildRoleActionFacts() []biscuit.Fact {
 	type repoRoleActions struct {
 		RoleName           string
 		RoleAllowedActions []string
 	}
-	type userInGroup struct {
-		UsergroupId int
-		UserId      int
-	}
-	type ugInUg struct {
-		ParentUsergroupId int
-		ChildUsergroupId  int
-	}
-	type userGroupRels struct {
-		UserInGroups []*userInGroup
-		UgsInUgs     []*ugInUg
-	}
-	type assignedRole struct {
-		Role           string
-		UserNamespaced string
-		RepoNamespaced string
-	}
-	type authzDetails struct {
-		RepoRoleActions []repoRoleActions
-		UserID          int
-		UserGroupRels   *userGroupRels
-		ActionStr       string
-		RepoID          int
-		RepogroupRels   []*dblogic.RepogroupRel
-		AssignedRoles   []*assignedRole
-		DateTime        string
-	}
-
-	authzTemplStr := `
-{{range .RepoRoleActions}}repo_role_actions("{{NamespaceRole .RoleName}}", [{{BuildRoleActions .RoleAllowedActions}}]);
-{{end}}
-
-operation("{{NamespaceAction .ActionStr}}", "{{NamespaceRepo .RepoID}}");
-time({{.DateTime}});
-
-repo($repoid) <-
-  operation($action, $repoid);
-
-{{with .UserGroupRels}}{{range .UserInGroups}}usergroup("{{NamespaceUG .UsergroupId}}", "{{NamespaceUser .UserId}}");
-{{end}}{{range .UgsInUgs}}usergroup("{{NamespaceUG .ParentUsergroupId}}", "{{NamespaceUG .ChildUsergroupId}}");
-{{end}}{{end}}
-
-{{range .RepogroupRels}}repogroup("{{NamespaceRG .RepogroupId}}", "{{NamespaceRepo .RepoId}}");
-{{end}}
-
-{{range .AssignedRoles}}role("{{.UserNamespaced}}", "{{.RepoNamespaced}}", "{{.Role}}");
-{{end}}
-
-user_authority($member, $member) <-
-  user($member);
-user_authority($member, $group) <-
-  usergroup($group, $member), 
-  $member.starts_with("userid:");
-user_authority($member, $subgroup) <-
-  usergroup($group, $subgroup),
-  $subgroup.starts_with("usergroupid:"),
-  user_authority($member, $group);
-
-repo_authority($member, $member) <-
-  repo($member);
-repo_authority($member, $group) <-
-  repogroup($group, $member);
-
-req_role($role, $action) <-
-  operation($action, $repo),
-  repo_role_actions($role, $permissions), $permissions.contains($action);
-
-allow if
-  user($user),
-  operation($action, $repo),
-  req_role($role, $action),
-  user_authority($user, $userOrgroup),
-  repo_authority($repo, $repoOrgroup),
-  role($userOrGroup, $repoOrGroup, $role);
-
-`
-	tmpl := template.Must(template.New("DatalogAuthZ").
-		Funcs(template.FuncMap{
-			"BuildRoleActions": buildRoleActions,
-			"NamespaceRole":    namespaceRole,
-			"NamespaceUser":    namespaceUser,
-			"NamespaceUG":      namespaceUG,
-			"NamespaceRepo":    namespaceRepo,
-			"NamespaceAction":  namespaceAction,
-			"NamespaceRG":      namespaceRG,
-		},
-		).Parse(authzTemplStr))
-
-	authzDetailsInst := authzDetails{
-		// Describe role -> action logic. This is stored in code since it
-		// describes logical operations. It _could_ be in a database
-		// if more flexibility around defining roles was desired.
-		RepoRoleActions: []repoRoleActions{
-			repoRoleActions{
-				RoleName: ownerRoleStr,
-				RoleAllowedActions: []string{
-					membershipStr,
-					writeStr,
-					readStr,
-				},
-			},
-			repoRoleActions{
-				RoleName: writerRoleStr,
-				RoleAllowedActions: []string{
-					writeStr,
-					readStr,
-				},
+	// Describe role -> action logic. This is stored in code since it
+	// describes logical operations. It _could_ be in a database
+	// if more flexibility around defining roles was desired.
+	allRepoRoleActions := []repoRoleActions{
+		{
+			RoleName: ownerRoleStr,
+			RoleAllowedActions: []string{
+				membershipStr,
+				writeStr,
+				readStr,
 			},
-			repoRoleActions{
-				RoleName: readerRoleStr,
-				RoleAllowedActions: []string{
-					readStr,
-				},
+		},
+		{
+			RoleName: writerRoleStr,
+			RoleAllowedActions: []string{
+				writeStr,
+				readStr,
 			},
 		},
-		UserID: reqDetails.UserId,
-		UserGroupRels: &userGroupRels{
-			UserInGroups: []*userInGroup{},
-			UgsInUgs:     []*ugInUg{},
+		{
+			RoleName: readerRoleStr,
+			RoleAllowedActions: []string{
+				readStr,
+			},
 		},
-		RepoID:        reqDetails.RepoId,
-		RepogroupRels: reqDetails.RepogroupRels,
-		AssignedRoles: []*assignedRole{},
-		DateTime:      time.Now().UTC().Format(time.RFC3339),
 	}
 
-	switch operation {
-	case Membership:
-		authzDetailsInst.ActionStr = membershipStr
-	case Read:
-		authzDetailsInst.ActionStr = readStr
-	case Write:
-		authzDetailsInst.ActionStr = writeStr
-	default:
-		log.Fatalf("Unknown operation: %s", operation)
+	facts := []biscuit.Fact{}
+	for _, roleActions := range allRepoRoleActions {
+		facts = append(facts, newFact("repo_role_actions",
+			biscuit.String(namespaceRole(roleActions.RoleName)),
+			buildRoleActions(roleActions.RoleAllowedActions),
+		))
 	}
+	return facts
+}
 
-	// Why not just use the dblogic UserRelationships directly? This
-	// makes it easier to change it over time as needed in the template.
-	// (I later give up for RepogroupRels)
-	userGroupRelsPtr := reqDetails.UsergroupRelationships
-	for _, userInGroupDB := range userGroupRelsPtr.UserInGroups {
-		userInGroupTmpl := &userInGroup{
-			UsergroupId: userInGroupDB.UsergroupId,
-			UserId:      userInGroupDB.UserId,
-		}
-		authzDetailsInst.UserGroupRels.UserInGroups = append(
-			authzDetailsInst.UserGroupRels.UserInGroups,
-			userInGroupTmpl)
-	}
-	for _, ugsInUgsDB := range userGroupRelsPtr.UserGroupInGroups {
-		ugInUgTmpl := &ugInUg{
-			ParentUsergroupId: ugsInUgsDB.ParentUsergroupId,
-			ChildUsergroupId:  ugsInUgsDB.ChildUsergroupId,
-		}
-		authzDetailsInst.UserGroupRels.UgsInUgs = append(
-			authzDetailsInst.UserGroupRels.UgsInUgs,
-			ugInUgTmpl)
+// buildAuthzFacts converts reqDetails and operation into the facts the policy is evaluated against.
+func buildAuthzFacts(reqDetails *dblogic.RequestDetails, operation Action, now time.Time) []biscuit.Fact {
+	facts := append([]biscuit.Fact{}, roleActionFacts...)
+
+	actionStr, err := actionToStr(operation)
+	if err != nil {
+		log.Fatalf("Unknown operation: %d", operation)
+	}
+	facts = append(facts,
+		newFact("operation",
+			biscuit.String(namespaceAction(actionStr)),
+			biscuit.String(namespaceRepo(reqDetails.RepoId)),
+		),
+		newFact("time", biscuit.Date(now.UTC().Truncate(time.Second))),
+		newFact("reponame",
+			biscuit.String(namespaceRepo(reqDetails.RepoId)),
+			biscuit.String(reqDetails.RepoName),
+		),
+	)
+	if reqDetails.UserId != 0 {
+		facts = append(facts, newFact("username",
+			biscuit.String(namespaceUser(reqDetails.UserId)),
+			biscuit.String(reqDetails.Username),
+		))
+	}
+	if reqDetails.ServiceAccountId != 0 {
+		facts = append(facts, newFact("servicename",
+			biscuit.String(namespaceSvc(reqDetails.ServiceAccountId)),
+			biscuit.String(reqDetails.ServiceAccountName),
+		))
+	}
+
+	if reqDetails.Ref != "" {
+		facts = append(facts, newFact("ref", biscuit.String(reqDetails.Ref)))
+	}
+	if sourceIP := net.ParseIP(reqDetails.SourceIP); sourceIP != nil {
+		hi, lo := ipToTerms(sourceIP)
+		facts = append(facts, newFact("source_ip", biscuit.String(sourceIP.String()), hi, lo))
+	}
+	for _, possessedKey := range reqDetails.PossessedKeys {
+		facts = append(facts, newFact("possession", biscuit.String(possessedKey)))
+	}
+	facts = append(facts, newFact("mfa_verified", biscuit.Bool(reqDetails.MFA)))
+	if reqDetails.ClientType != "" {
+		facts = append(facts, newFact("client_type", biscuit.String(reqDetails.ClientType)))
+	}
+	if reqDetails.UserAgent != "" {
+		facts = append(facts, newFact("user_agent", biscuit.String(reqDetails.UserAgent)))
+	}
+	if reqDetails.Transport != "" {
+		facts = append(facts, newFact("transport", biscuit.String(reqDetails.Transport)))
+	}
+
+	userGroupRels := reqDetails.UsergroupRelationships
+	for _, userInGroup := range userGroupRels.UserInGroups {
+		facts = append(facts, newFact("usergroup",
+			biscuit.String(namespaceUG(userInGroup.UsergroupId)),
+			biscuit.String(namespaceUser(userInGroup.UserId)),
+		))
+	}
+	for _, ugInUg := range userGroupRels.UserGroupInGroups {
+		facts = append(facts, newFact("usergroup",
+			biscuit.String(namespaceUG(ugInUg.ParentUsergroupId)),
+			biscuit.String(namespaceUG(ugInUg.ChildUsergroupId)),
+		))
+	}
+
+	for _, repogroupRel := range reqDetails.RepogroupRels {
+		facts = append(facts, newFact("repogroup",
+			biscuit.String(namespaceRG(repogroupRel.RepogroupId)),
+			biscuit.String(namespaceRepo(repogroupRel.RepoId)),
+		))
 	}
 
-	// For better or worse, avoid using templates and build out
-	// the role($userOrGroup, $repoOrGroup, $role) facts here
 	for _, dbAssignRole := range reqDetails.AssignedRoles {
 		userOrGroup := ""
 		switch dbAssignRole.UserOrGroup {
@@ -331,6 +557,8 @@ allow if
 			userOrGroup = namespaceUser(dbAssignRole.UserOrGroupID)
 		case dblogic.UsergroupUGR:
 			userOrGroup = namespaceUG(dbAssignRole.UserOrGroupID)
+		case dblogic.ServiceAccountUGR:
+			userOrGroup = namespaceSvc(dbAssignRole.UserOrGroupID)
 		default:
 			log.Fatalf("Failed to match UserOrGroup in role assignment: %d", dbAssignRole.UserOrGroup)
 		}
@@ -355,58 +583,243 @@ allow if
 			log.Fatalf("Failed to match RepoRole in role assignment: %d", dbAssignRole.RepoRole)
 		}
 
-		assignedRoleMapping := &assignedRole{
-			Role:           roleName,
-			UserNamespaced: userOrGroup,
-			RepoNamespaced: repoOrGroup,
+		facts = append(facts, newFact("role",
+			biscuit.String(userOrGroup),
+			biscuit.String(repoOrGroup),
+			biscuit.String(roleName),
+		))
+	}
+
+	return facts
+}
+
+// worldRunLimit bounds how long the datalog of one authorizer may run. A check takes well under a millisecond, but the biscuit-go default of 2ms is reached when the host is busy, which refuses requests that should be allowed.
+const worldRunLimit = 20 * time.Millisecond
+
+// authorizerOptions are passed to every authorizer which evaluates datalog.
+var authorizerOptions = []biscuit.AuthorizerOption{
+	biscuit.WithWorldOptions(datalog.WithMaxDuration(worldRunLimit)),
+}
+
+// newAuthorizer verifies token against publicRoot, refuses it if revoked, and returns an authorizer loaded with the active policy, the facts from reqDetails, whether the token is sealed, and the facts attested by trusted parties. Authorize has not been called on the returned authorizer.
+func newAuthorizer(token *biscuit.Biscuit, publicRoot ed25519.PublicKey, reqDetails *dblogic.RequestDetails, operation Action) (biscuit.Authorizer, error) {
+	authorizer, err := token.Authorizer(publicRoot, authorizerOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("error when verifying token and creating authorizer: %w", err)
+	}
+	if store := getRevocationStore(); store != nil {
+		issuances, err := queryIssuance(authorizer)
+		if err != nil {
+			return nil, fmt.Errorf("error when reading token issuance: %w", err)
+		}
+		err = checkIssuanceRevocation(store, token, issuances)
+		if err != nil {
+			return nil, err
+		}
+		// Reading the issuance ran the authorizer, so start over with a new
+		// one rather than verifying the signatures again
+		authorizer, err = biscuit.NewVerifier(token, authorizerOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("error when creating authorizer: %w", err)
 		}
-		authzDetailsInst.AssignedRoles = append(
-			authzDetailsInst.AssignedRoles,
-			assignedRoleMapping,
-		)
 	}
 
-	buffer := &bytes.Buffer{}
-	if err := tmpl.Execute(buffer, authzDetailsInst); err != nil {
-		return false, fmt.Errorf("error executing template: %w", err)
+	facts, err := tokenFacts(token)
+	if err != nil {
+		return nil, err
 	}
+	loadRequest(authorizer, facts, reqDetails, operation, GetPolicy())
 
-	log.Printf("Biscuit authorizer is:\n%s\n== END AUTHORIZER ==", buffer.String())
+	return authorizer, nil
+}
 
-	authorizer, err := token.Authorizer(publicRoot)
+// tokenFacts returns the facts about token itself which are added to every request it is authorized for: whether it is sealed, and the facts attested by trusted parties.
+func tokenFacts(token *biscuit.Biscuit) ([]biscuit.Fact, error) {
+	sealed, err := IsSealed(token)
 	if err != nil {
-		return false, fmt.Errorf("error when verifying token and creating authorizer: %w", err.Error())
+		return nil, fmt.Errorf("error when reading token seal: %w", err)
+	}
+	facts := []biscuit.Fact{newFact("sealed", biscuit.Bool(sealed))}
+	if parties := getTrustedParties(); parties != nil {
+		partyFacts, err := attestedFacts(token, parties)
+		if err != nil {
+			return nil, fmt.Errorf("error when verifying attestations: %w", err)
+		}
+		facts = append(facts, partyFacts...)
+	}
+	return facts, nil
+}
+
+// debugLogging is set by SetDebugLogging.
+var debugLogging atomic.Bool
+
+// SetDebugLogging makes CheckAuthz log each authorizer it builds, with all of its facts and the policy, and the world after authorizing. It is off by default, as the logs are large and formatting them adds to every check.
+func SetDebugLogging(enabled bool) {
+	debugLogging.Store(enabled)
+}
+
+// loadRequest adds the facts from reqDetails and operation, the facts about the token from tokenFacts, and policy to authorizer.
+func loadRequest(authorizer biscuit.Authorizer, tokenFacts []biscuit.Fact, reqDetails *dblogic.RequestDetails, operation Action, policy *Policy) {
+	facts := buildAuthzFacts(reqDetails, operation, time.Now())
+	facts = append(facts, tokenFacts...)
+	for _, fact := range facts {
+		authorizer.AddFact(fact)
+	}
+	authorizer.AddAuthorizer(policy.parsed)
+
+	if debugLogging.Load() {
+		factStrs := []string{}
+		for _, fact := range facts {
+			factStrs = append(factStrs, fact.String()+";")
+		}
+		log.Printf("Biscuit authorizer is:\n%s\n%s\n== END AUTHORIZER ==", strings.Join(factStrs, "\n"), policy.Source)
 	}
-	authorizerContents, err := parser.FromStringAuthorizer(buffer.String())
+}
+
+// CheckAuthz decides if the user or service account in reqDetails has permission to perform operation against repo. The RequestContext of reqDetails describes how the request was made, and is added to the facts along with the org data.
+func CheckAuthz(token *biscuit.Biscuit, publicRoot ed25519.PublicKey, reqDetails *dblogic.RequestDetails, operation Action) (bool, error) {
+	authorizer, err := newAuthorizer(token, publicRoot, reqDetails, operation)
 	if err != nil {
-		return false, fmt.Errorf("error when parsing authorizer: %w", err)
+		return false, fmt.Errorf("error when creating authorizer: %w", err)
 	}
-	authorizer.AddAuthorizer(authorizerContents)
 
 	err = authorizer.Authorize()
-	log.Printf("Biscuit World (post auth) is:\n%s\n== END POST AUTH WORLD ==", authorizer.PrintWorld())
+	if debugLogging.Load() {
+		log.Printf("Biscuit World (post auth) is:\n%s\n== END POST AUTH WORLD ==", authorizer.PrintWorld())
+	}
 	if err != nil {
-		return false, fmt.Errorf("error in Authorize: %w", err.Error())
+		return false, fmt.Errorf("error in Authorize: %w", err)
 	}
 
 	return true, nil
 }
 
-// AttenuateBiscuit attenuates a biscuit with the provided set of checks
-func AttenuateBiscuit(biscuitToken *biscuit.Biscuit, blockTxt string) (*biscuit.Biscuit, error) {
-	blockBuilder := biscuitToken.CreateBlock()
-	check, err := parser.FromStringCheck(blockTxt)
+// splitNamespaced is the inverse of namespaceAuthz for the integer id namespaces. Returns an error if symbol is not in the form namespace:id.
+func splitNamespaced(symbol string) (string, int, error) {
+	namespace, idStr, found := strings.Cut(symbol, ":")
+	if !found {
+		return "", 0, fmt.Errorf("symbol %s is not namespaced", symbol)
+	}
+	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return nil, fmt.Errorf("error when parsing repo attenuation: %w", err.Error())
+		return "", 0, fmt.Errorf("symbol %s does not have an integer id: %w", symbol, err)
 	}
-	err = blockBuilder.AddCheck(check)
+	return namespace, id, nil
+}
+
+// ExplainAuthz returns the role assignments from reqDetails which grant the user or service account permission to perform operation against the repo. An error is returned if the principal does not have permission.
+func ExplainAuthz(token *biscuit.Biscuit, publicRoot ed25519.PublicKey, reqDetails *dblogic.RequestDetails, operation Action) ([]*dblogic.AssignedRole, error) {
+	authorizer, err := newAuthorizer(token, publicRoot, reqDetails, operation)
 	if err != nil {
-		return nil, fmt.Errorf("error when adding check to block: %w", err.Error())
+		return nil, fmt.Errorf("error when creating authorizer: %w", err)
 	}
-	biscuitToken, err = biscuitToken.Append(rand.Reader, blockBuilder.Build())
+	err = authorizer.Authorize()
 	if err != nil {
-		return nil, fmt.Errorf("error when appending new block to token: %w", err.Error())
+		return nil, fmt.Errorf("error in Authorize: %w", err)
 	}
 
-	return biscuitToken, nil
+	// Mirrors the allow policy, but keeps the role facts which matched
+	grantingRule, err := datalogParser.Rule(`granting($userOrGroup, $repoOrGroup, $role) <-
+  user($user),
+  operation($action, $repo),
+  req_role($role, $action),
+  user_authority($user, $userOrGroup),
+  repo_authority($repo, $repoOrGroup),
+  role($userOrGroup, $repoOrGroup, $role)`, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing granting rule: %w", err)
+	}
+	grantingFacts, err := authorizer.Query(grantingRule)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for granting roles: %w", err)
+	}
+	// Mirrors the service account allow policy
+	serviceGrantingRule, err := datalogParser.Rule(`granting($service, $repoOrGroup, $role) <-
+  service($service),
+  operation($action, $repo),
+  ["action:read", "action:write"].contains($action),
+  req_role($role, $action),
+  ["role:reader", "role:writer"].contains($role),
+  repo_authority($repo, $repoOrGroup),
+  role($service, $repoOrGroup, $role)`, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing service granting rule: %w", err)
+	}
+	serviceGrantingFacts, err := authorizer.Query(serviceGrantingRule)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for service granting roles: %w", err)
+	}
+	grantingFacts = append(grantingFacts, serviceGrantingFacts...)
+
+	grantingRoles := []*dblogic.AssignedRole{}
+	for _, grantingFact := range grantingFacts {
+		if len(grantingFact.IDs) != 3 {
+			return nil, fmt.Errorf("unexpected granting fact: %s", grantingFact.String())
+		}
+		grantingRole := &dblogic.AssignedRole{}
+
+		userOrGroupStr, _ := grantingFact.IDs[0].(biscuit.String)
+		namespace, id, err := splitNamespaced(string(userOrGroupStr))
+		if err != nil {
+			return nil, fmt.Errorf("error when reading user or group: %w", err)
+		}
+		switch namespace {
+		case userNS:
+			grantingRole.UserOrGroup = dblogic.UserUGR
+		case usergroupNS:
+			grantingRole.UserOrGroup = dblogic.UsergroupUGR
+		case svcNS:
+			grantingRole.UserOrGroup = dblogic.ServiceAccountUGR
+		default:
+			return nil, fmt.Errorf("unknown user or group namespace: %s", namespace)
+		}
+		grantingRole.UserOrGroupID = id
+
+		repoOrGroupStr, _ := grantingFact.IDs[1].(biscuit.String)
+		namespace, id, err = splitNamespaced(string(repoOrGroupStr))
+		if err != nil {
+			return nil, fmt.Errorf("error when reading repo or group: %w", err)
+		}
+		switch namespace {
+		case repoNS:
+			grantingRole.RepoOrGroup = dblogic.RepoUGR
+		case repogroupNS:
+			grantingRole.RepoOrGroup = dblogic.RepogroupUGR
+		default:
+			return nil, fmt.Errorf("unknown repo or group namespace: %s", namespace)
+		}
+		grantingRole.RepoOrGroupID = id
+
+		roleStr, _ := grantingFact.IDs[2].(biscuit.String)
+		switch string(roleStr) {
+		case namespaceRole(ownerRoleStr):
+			grantingRole.RepoRole = dblogic.OwnerRole
+		case namespaceRole(writerRoleStr):
+			grantingRole.RepoRole = dblogic.WriterRole
+		case namespaceRole(readerRoleStr):
+			grantingRole.RepoRole = dblogic.ReaderRole
+		default:
+			return nil, fmt.Errorf("unknown role: %s", roleStr)
+		}
+
+		grantingRoles = append(grantingRoles, grantingRole)
+	}
+
+	return grantingRoles, nil
+}
+
+// AttenuateBiscuit attenuates a biscuit with a single block parsed from blockTxt, which may hold several facts, rules and checks separated by ';'.
+func AttenuateBiscuit(biscuitToken *biscuit.Biscuit, blockTxt string) (*biscuit.Biscuit, error) {
+	return AttenuateBiscuitWithContext(biscuitToken, blockTxt, "")
+}
+
+// AttenuateBiscuitWithContext is AttenuateBiscuit with a context string stored in the appended block.
+func AttenuateBiscuitWithContext(biscuitToken *biscuit.Biscuit, blockTxt string, context string) (*biscuit.Biscuit, error) {
+	attenuation := NewAttenuation()
+	err := attenuation.AddSource(blockTxt)
+	if err != nil {
+		return nil, err
+	}
+	attenuation.SetContext(context)
+	return attenuation.Apply(biscuitToken)
 }
@@ -0,0 +1,191 @@
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+)
+
+// validAt returns whether the checks of token pass at the given time, regardless of any request.
+func validAt(t *testing.T, token *biscuit.Biscuit, tokenIssuer *TokenIssuer, at time.Time) bool {
+	t.Helper()
+	authorizer, err := token.Authorizer(tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("Authorizer: %s", err)
+	}
+	authorizer.AddFact(newFact("time", biscuit.Date(at)))
+	authorizer.AddPolicy(biscuit.DefaultAllowPolicy)
+	return authorizer.Authorize() == nil
+}
+
+// TestValidity checks how issue options and issuer policy resolve into a token's not-before and expiry times.
+func TestValidity(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(2 * time.Hour)
+	testCases := []struct {
+		name          string
+		issuer        TokenIssuer
+		opts          IssueOptions
+		wantNotBefore time.Time
+		wantExpiry    time.Time
+		wantErr       bool
+	}{
+		{
+			name: "no bounds",
+		},
+		{
+			name:       "TTL from issuance",
+			opts:       IssueOptions{TTL: time.Hour},
+			wantExpiry: now.Add(time.Hour),
+		},
+		{
+			name:          "TTL from not-before",
+			opts:          IssueOptions{TTL: time.Hour, NotBefore: later},
+			wantNotBefore: later,
+			wantExpiry:    later.Add(time.Hour),
+		},
+		{
+			name:       "default TTL",
+			issuer:     TokenIssuer{DefaultOptions: IssueOptions{TTL: time.Minute}},
+			wantExpiry: now.Add(time.Minute),
+		},
+		{
+			name:       "TTL overrides default",
+			issuer:     TokenIssuer{DefaultOptions: IssueOptions{TTL: time.Minute}},
+			opts:       IssueOptions{TTL: time.Hour},
+			wantExpiry: now.Add(time.Hour),
+		},
+		{
+			name:    "negative TTL",
+			opts:    IssueOptions{TTL: -time.Hour},
+			wantErr: true,
+		},
+		{
+			name:       "max lifetime as TTL",
+			issuer:     TokenIssuer{MaxLifetime: 24 * time.Hour},
+			wantExpiry: now.Add(24 * time.Hour),
+		},
+		{
+			name:       "TTL within max lifetime",
+			issuer:     TokenIssuer{MaxLifetime: 24 * time.Hour},
+			opts:       IssueOptions{TTL: time.Hour},
+			wantExpiry: now.Add(time.Hour),
+		},
+		{
+			name:    "TTL beyond max lifetime",
+			issuer:  TokenIssuer{MaxLifetime: time.Hour},
+			opts:    IssueOptions{TTL: 2 * time.Hour},
+			wantErr: true,
+		},
+		{
+			name:    "not-before pushes expiry beyond max lifetime",
+			issuer:  TokenIssuer{MaxLifetime: 2 * time.Hour},
+			opts:    IssueOptions{TTL: time.Hour, NotBefore: later},
+			wantErr: true,
+		},
+		{
+			name:          "not-before within max lifetime",
+			issuer:        TokenIssuer{MaxLifetime: 24 * time.Hour},
+			opts:          IssueOptions{NotBefore: later},
+			wantNotBefore: later,
+			wantExpiry:    now.Add(24 * time.Hour),
+		},
+		{
+			name:    "not-before beyond max lifetime",
+			issuer:  TokenIssuer{MaxLifetime: time.Hour},
+			opts:    IssueOptions{NotBefore: later},
+			wantErr: true,
+		},
+		{
+			name:    "not-before at max lifetime",
+			issuer:  TokenIssuer{MaxLifetime: 2 * time.Hour},
+			opts:    IssueOptions{NotBefore: later},
+			wantErr: true,
+		},
+		{
+			name:    "required expiry missing",
+			issuer:  TokenIssuer{RequireExpiry: true},
+			wantErr: true,
+		},
+		{
+			name:       "required expiry from max lifetime",
+			issuer:     TokenIssuer{RequireExpiry: true, MaxLifetime: time.Hour},
+			wantExpiry: now.Add(time.Hour),
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			notBefore, expiry, err := testCase.issuer.validity(testCase.opts, now)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got not-before %s and expiry %s", notBefore, expiry)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validity: %s", err)
+			}
+			if !notBefore.Equal(testCase.wantNotBefore) {
+				t.Errorf("expected not-before %s, got %s", testCase.wantNotBefore, notBefore)
+			}
+			if !expiry.Equal(testCase.wantExpiry) {
+				t.Errorf("expected expiry %s, got %s", testCase.wantExpiry, expiry)
+			}
+		})
+	}
+}
+
+// TestValidityWindowEnforced checks that the authorizer refuses a token before its not-before time and after its expiry, and accepts it in between.
+func TestValidityWindowEnforced(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	request := testRequest{user: 4, repo: "Charlie", action: Read}
+
+	notYetValid, err := tokenIssuer.IssueTokenWithOptions(4, IssueOptions{NotBefore: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, notYetValid, request)
+	if hasPermission {
+		t.Errorf("expected a token used before its not-before time to be refused")
+	}
+
+	// Bounds are written to the second, so the token expires within two seconds
+	shortLived, err := tokenIssuer.IssueTokenWithOptions(4, IssueOptions{TTL: time.Second})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, shortLived, request)
+	if !hasPermission {
+		t.Fatalf("expected the token to be accepted before it expires: %s", err)
+	}
+	time.Sleep(2 * time.Second)
+	hasPermission, _ = checkRequest(t, dbInstance, tokenIssuer, shortLived, request)
+	if hasPermission {
+		t.Errorf("expected an expired token to be refused")
+	}
+}
+
+// TestIssuedValidityBounds checks that the bounds written into an issued token are the ones the issuer resolved, and that issuance fails when the issuer policy refuses the options.
+func TestIssuedValidityBounds(t *testing.T) {
+	_, tokenIssuer := testSetup(t)
+	tokenIssuer.MaxLifetime = 24 * time.Hour
+	tokenIssuer.RequireExpiry = true
+
+	before := time.Now().Truncate(time.Second)
+	token, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	if !validAt(t, token, tokenIssuer, before.Add(tokenIssuer.MaxLifetime)) {
+		t.Errorf("expected the token to be valid until the max lifetime")
+	}
+	if validAt(t, token, tokenIssuer, time.Now().Add(tokenIssuer.MaxLifetime+time.Second)) {
+		t.Errorf("expected a token without a TTL to expire at the max lifetime")
+	}
+
+	_, err = tokenIssuer.IssueTokenWithOptions(4, IssueOptions{TTL: 48 * time.Hour})
+	if err == nil {
+		t.Errorf("expected a TTL beyond the max lifetime to be refused")
+	}
+}
@@ -0,0 +1,315 @@
+package authz
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/dblogic"
+)
+
+// orgModel is a randomly generated org graph along with a pure Go reference for who can do what. It is the oracle both the SQL resolution in dblogic and the datalog in the policy are compared against.
+type orgModel struct {
+	fixtures *dblogic.Fixtures
+}
+
+// generateOrgModel builds a random org graph. Nested usergroups may form cycles, and users, repos and groups may be left unconnected, since both show up in real data.
+func generateOrgModel(rng *rand.Rand) *orgModel {
+	fixtures := &dblogic.Fixtures{}
+	numUsers := 1 + rng.Intn(5)
+	numUsergroups := rng.Intn(6)
+	numRepos := 1 + rng.Intn(4)
+	numRepogroups := rng.Intn(4)
+	for id := 1; id <= numUsers; id++ {
+		fixtures.Users = append(fixtures.Users, &dblogic.NamedEntity{Id: id, Name: fmt.Sprintf("user%d", id)})
+	}
+	for id := 1; id <= numUsergroups; id++ {
+		fixtures.Usergroups = append(fixtures.Usergroups, &dblogic.NamedEntity{Id: id, Name: fmt.Sprintf("usergroup%d", id)})
+	}
+	for id := 1; id <= numRepos; id++ {
+		fixtures.Repos = append(fixtures.Repos, &dblogic.NamedEntity{Id: id, Name: fmt.Sprintf("repo%d", id)})
+	}
+	for id := 1; id <= numRepogroups; id++ {
+		fixtures.Repogroups = append(fixtures.Repogroups, &dblogic.NamedEntity{Id: id, Name: fmt.Sprintf("repogroup%d", id)})
+	}
+
+	if numUsergroups > 0 {
+		for i := rng.Intn(2 * numUsers); i > 0; i-- {
+			fixtures.UserInGroups = append(fixtures.UserInGroups, &dblogic.UserInGroup{
+				UserId:      1 + rng.Intn(numUsers),
+				UsergroupId: 1 + rng.Intn(numUsergroups),
+			})
+		}
+		for i := rng.Intn(2 * numUsergroups); i > 0; i-- {
+			fixtures.UserGroupInGroups = append(fixtures.UserGroupInGroups, &dblogic.UserGroupInGroup{
+				ParentUsergroupId: 1 + rng.Intn(numUsergroups),
+				ChildUsergroupId:  1 + rng.Intn(numUsergroups),
+			})
+		}
+	}
+	if numRepogroups > 0 {
+		for i := rng.Intn(2 * numRepos); i > 0; i-- {
+			fixtures.RepogroupRels = append(fixtures.RepogroupRels, &dblogic.RepogroupRel{
+				RepogroupId: 1 + rng.Intn(numRepogroups),
+				RepoId:      1 + rng.Intn(numRepos),
+			})
+		}
+	}
+
+	for i := rng.Intn(8); i > 0; i-- {
+		assignedRole := &dblogic.AssignedRole{
+			UserOrGroup:   dblogic.UserUGR,
+			UserOrGroupID: 1 + rng.Intn(numUsers),
+			RepoOrGroup:   dblogic.RepoUGR,
+			RepoOrGroupID: 1 + rng.Intn(numRepos),
+			RepoRole:      []dblogic.RepoRoleType{dblogic.OwnerRole, dblogic.WriterRole, dblogic.ReaderRole}[rng.Intn(3)],
+		}
+		if numUsergroups > 0 && rng.Intn(2) == 0 {
+			assignedRole.UserOrGroup = dblogic.UsergroupUGR
+			assignedRole.UserOrGroupID = 1 + rng.Intn(numUsergroups)
+		}
+		if numRepogroups > 0 && rng.Intn(2) == 0 {
+			// There is no owner role on repogroups
+			assignedRole.RepoOrGroup = dblogic.RepogroupUGR
+			assignedRole.RepoOrGroupID = 1 + rng.Intn(numRepogroups)
+			assignedRole.RepoRole = []dblogic.RepoRoleType{dblogic.WriterRole, dblogic.ReaderRole}[rng.Intn(2)]
+		}
+		fixtures.AssignedRoles = append(fixtures.AssignedRoles, assignedRole)
+	}
+
+	return &orgModel{fixtures: fixtures}
+}
+
+// principals returns every user and usergroup the user has authority through: themselves, their usergroups, and every usergroup nested under those.
+func (model *orgModel) principals(userId int) map[string]bool {
+	principals := map[string]bool{namespaceUser(userId): true}
+	queue := []int{}
+	for _, userInGroup := range model.fixtures.UserInGroups {
+		if userInGroup.UserId == userId && !principals[namespaceUG(userInGroup.UsergroupId)] {
+			principals[namespaceUG(userInGroup.UsergroupId)] = true
+			queue = append(queue, userInGroup.UsergroupId)
+		}
+	}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, ugInUg := range model.fixtures.UserGroupInGroups {
+			if ugInUg.ParentUsergroupId == parent && !principals[namespaceUG(ugInUg.ChildUsergroupId)] {
+				principals[namespaceUG(ugInUg.ChildUsergroupId)] = true
+				queue = append(queue, ugInUg.ChildUsergroupId)
+			}
+		}
+	}
+	return principals
+}
+
+// targets returns the repo and every repogroup it is in.
+func (model *orgModel) targets(repoId int) map[string]bool {
+	targets := map[string]bool{namespaceRepo(repoId): true}
+	for _, repogroupRel := range model.fixtures.RepogroupRels {
+		if repogroupRel.RepoId == repoId {
+			targets[namespaceRG(repogroupRel.RepogroupId)] = true
+		}
+	}
+	return targets
+}
+
+// assignedRoleKey renders an assigned role so sets of them can be compared.
+func assignedRoleKey(assignedRole *dblogic.AssignedRole) string {
+	userOrGroup := namespaceUser(assignedRole.UserOrGroupID)
+	if assignedRole.UserOrGroup == dblogic.UsergroupUGR {
+		userOrGroup = namespaceUG(assignedRole.UserOrGroupID)
+	}
+	repoOrGroup := namespaceRepo(assignedRole.RepoOrGroupID)
+	if assignedRole.RepoOrGroup == dblogic.RepogroupUGR {
+		repoOrGroup = namespaceRG(assignedRole.RepoOrGroupID)
+	}
+	return fmt.Sprintf("%s %s %d", userOrGroup, repoOrGroup, assignedRole.RepoRole)
+}
+
+// relevantRoles returns every role grant which applies to the user acting on the repo.
+func (model *orgModel) relevantRoles(userId int, repoId int) []*dblogic.AssignedRole {
+	principals := model.principals(userId)
+	targets := model.targets(repoId)
+	relevant := []*dblogic.AssignedRole{}
+	for _, assignedRole := range model.fixtures.AssignedRoles {
+		userOrGroup := namespaceUser(assignedRole.UserOrGroupID)
+		if assignedRole.UserOrGroup == dblogic.UsergroupUGR {
+			userOrGroup = namespaceUG(assignedRole.UserOrGroupID)
+		}
+		repoOrGroup := namespaceRepo(assignedRole.RepoOrGroupID)
+		if assignedRole.RepoOrGroup == dblogic.RepogroupUGR {
+			repoOrGroup = namespaceRG(assignedRole.RepoOrGroupID)
+		}
+		if principals[userOrGroup] && targets[repoOrGroup] {
+			relevant = append(relevant, assignedRole)
+		}
+	}
+	return relevant
+}
+
+// allowed is the reference decision for the user performing action on the repo.
+func (model *orgModel) allowed(userId int, repoId int, action Action) bool {
+	for _, assignedRole := range model.relevantRoles(userId, repoId) {
+		switch {
+		case assignedRole.RepoRole == dblogic.OwnerRole:
+			return true
+		case assignedRole.RepoRole == dblogic.WriterRole && action != Membership:
+			return true
+		case assignedRole.RepoRole == dblogic.ReaderRole && action == Read:
+			return true
+		}
+	}
+	return false
+}
+
+// roleKeys renders a list of assigned roles as a sorted set so lists can be compared.
+func roleKeys(assignedRoles []*dblogic.AssignedRole) []string {
+	keys := map[string]bool{}
+	for _, assignedRole := range assignedRoles {
+		keys[assignedRoleKey(assignedRole)] = true
+	}
+	return sortedKeys(keys)
+}
+
+// sortedKeys returns the keys of set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkOrgModel loads the model into a database and checks every user, repo and action against the reference.
+func checkOrgModel(t *testing.T, model *orgModel) {
+	t.Helper()
+	dbInstance, err := dblogic.InitMemoryDb(false)
+	if err != nil {
+		t.Fatalf("InitMemoryDb: %s", err)
+	}
+	defer dbInstance.Close()
+	if err := dbInstance.LoadFixtures(model.fixtures); err != nil {
+		t.Fatalf("LoadFixtures: %s", err)
+	}
+
+	tokenIssuer, err := NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+
+	for _, user := range model.fixtures.Users {
+		token, err := tokenIssuer.IssueToken(user.Id)
+		if err != nil {
+			t.Fatalf("IssueToken: %s", err)
+		}
+		for _, repo := range model.fixtures.Repos {
+			reqDetails, err := dblogic.GatherRequestDetails(user.Id, repo.Name, dbInstance)
+			if err != nil {
+				t.Fatalf("GatherRequestDetails(%d, %s): %s", user.Id, repo.Name, err)
+			}
+			gatheredRoles := roleKeys(reqDetails.AssignedRoles)
+			expectedRoles := roleKeys(model.relevantRoles(user.Id, repo.Id))
+			if fmt.Sprint(gatheredRoles) != fmt.Sprint(expectedRoles) {
+				t.Errorf("user %d repo %d: GatherRequestDetails found roles %v, reference found %v",
+					user.Id, repo.Id, gatheredRoles, expectedRoles)
+			}
+
+			// The same request with every role grant in the org loaded into the
+			// world, so the policy rather than the SQL has to ignore the roles of
+			// other principals and on other repos
+			worldDetails := *reqDetails
+			worldDetails.AssignedRoles = model.fixtures.AssignedRoles
+
+			for _, action := range []Action{Membership, Read, Write} {
+				expected := model.allowed(user.Id, repo.Id, action)
+				hasPermission, _ := CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, action)
+				if hasPermission != expected {
+					t.Errorf("user %d repo %d action %d: CheckAuthz decided %t, reference decided %t",
+						user.Id, repo.Id, action, hasPermission, expected)
+				}
+				hasPermission, _ = CheckAuthz(token, tokenIssuer.PublicRoot, &worldDetails, action)
+				if hasPermission != expected {
+					t.Errorf("user %d repo %d action %d: CheckAuthz with every role in the world decided %t, reference decided %t",
+						user.Id, repo.Id, action, hasPermission, expected)
+				}
+			}
+		}
+
+		checkBatch(t, model, user.Id, token, tokenIssuer, dbInstance)
+	}
+}
+
+// checkBatch checks GatherBatchRequestDetails and BatchAuthorize for every repo and action of userId against the reference, along with a repo which does not exist.
+func checkBatch(t *testing.T, model *orgModel, userId int, token *biscuit.Biscuit, tokenIssuer *TokenIssuer, dbInstance *dblogic.DBInstance) {
+	t.Helper()
+	reponames := []string{}
+	for _, repo := range model.fixtures.Repos {
+		reponames = append(reponames, repo.Name)
+	}
+	batch, err := dblogic.GatherBatchRequestDetails(userId, reponames, dbInstance)
+	if err != nil {
+		t.Fatalf("GatherBatchRequestDetails(%d): %s", userId, err)
+	}
+	for i, repo := range model.fixtures.Repos {
+		gatheredRoles := roleKeys(batch[i].AssignedRoles)
+		expectedRoles := roleKeys(model.relevantRoles(userId, repo.Id))
+		if fmt.Sprint(gatheredRoles) != fmt.Sprint(expectedRoles) {
+			t.Errorf("user %d repo %d: GatherBatchRequestDetails found roles %v, reference found %v",
+				userId, repo.Id, gatheredRoles, expectedRoles)
+		}
+	}
+
+	items := []BatchItem{{RepoName: "no-such-repo", Action: Read}}
+	for _, repo := range model.fixtures.Repos {
+		for _, action := range []Action{Membership, Read, Write} {
+			items = append(items, BatchItem{RepoName: repo.Name, Action: action})
+		}
+	}
+	decisions, err := BatchAuthorize(token, tokenIssuer.PublicRoot, dbInstance, dblogic.RequestContext{}, items)
+	if err != nil {
+		t.Fatalf("BatchAuthorize(%d): %s", userId, err)
+	}
+	if decisions[0].Allowed || decisions[0].Err == nil {
+		t.Errorf("user %d: BatchAuthorize allowed a repo which does not exist", userId)
+	}
+	for i, decision := range decisions[1:] {
+		repo := model.fixtures.Repos[i/3]
+		expected := model.allowed(userId, repo.Id, decision.Action)
+		if decision.Allowed != expected {
+			t.Errorf("user %d repo %d action %d: BatchAuthorize decided %t, reference decided %t",
+				userId, repo.Id, decision.Action, decision.Allowed, expected)
+		}
+	}
+}
+
+// TestDifferentialResolution compares dblogic and CheckAuthz against the reference model for a fixed set of random org graphs.
+func TestDifferentialResolution(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for seed := int64(0); seed < 30; seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			checkOrgModel(t, generateOrgModel(rand.New(rand.NewSource(seed))))
+		})
+	}
+}
+
+// FuzzDifferentialResolution explores more org graphs with go test -fuzz.
+func FuzzDifferentialResolution(f *testing.F) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f.Add(int64(0))
+	f.Add(int64(42))
+	f.Fuzz(func(t *testing.T, seed int64) {
+		checkOrgModel(t, generateOrgModel(rand.New(rand.NewSource(seed))))
+	})
+}
@@ -0,0 +1,305 @@
+package authz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/pb"
+)
+
+// exchangeKind is the ledger kind of tokens issued by token exchange.
+const exchangeKind = "exchange"
+
+const (
+	// defaultExchangeTTL is how long exchanged tokens are valid for when no TTL is requested
+	defaultExchangeTTL = 15 * time.Minute
+	// maxExchangeTTL is the longest TTL which may be requested for an exchanged token
+	maxExchangeTTL = time.Hour
+)
+
+// TokenExchange requests a short-lived token in exchange for a longer-lived one.
+type TokenExchange struct {
+	// Repos are the repo ids the new token is restricted to. Empty means every repo the presented token allows.
+	Repos []int `json:"repos"`
+	// Actions are the actions the new token is restricted to. Empty means every repo action the presented token allows.
+	Actions []string `json:"actions"`
+	// TTL is how long the new token is valid for, defaultExchangeTTL if zero and at most maxExchangeTTL. The new token never outlives the presented one.
+	TTL time.Duration `json:"-"`
+}
+
+// ExchangeToken verifies token and issues a short-lived token to the same principal, restricted to the intersection of token's restrictions and the repos and actions in exchange. Every check of token is copied into the new token's authority block, so restrictions which are not repo or action restrictions, like refs or source addresses, still apply. Tokens whose attenuation blocks hold facts or rules are refused, since those would not keep their meaning outside their block, and attested facts are not carried over. The new token is recorded in the issuer's ledger with the presented token's id as its parent, so revoking the presented token through the ledger with RevokeIssuedToken revokes the new token too. Tokens without a token id are refused, since they could not be recorded as a parent.
+func (tokenIssuer *TokenIssuer) ExchangeToken(token *biscuit.Biscuit, exchange *TokenExchange) (*biscuit.Biscuit, error) {
+	if tokenIssuer.Ledger == nil {
+		return nil, fmt.Errorf("token exchange requires an issuer with a ledger")
+	}
+	now := time.Now()
+	introspection, err := Introspect(token, tokenIssuer.PublicRoot, now)
+	if err != nil {
+		return nil, fmt.Errorf("error when verifying token: %w", err)
+	}
+	if !introspection.Active {
+		return nil, fmt.Errorf("token is not active")
+	}
+	issuances, err := readIssuance(token, tokenIssuer.PublicRoot)
+	if err != nil {
+		return nil, fmt.Errorf("error when reading token issuance: %w", err)
+	}
+	if len(issuances) != 1 || issuances[0].tokenId == "" {
+		// Without a token id the new token could not be revoked along with the presented one
+		return nil, fmt.Errorf("token has no token id to record as the parent of the exchanged token")
+	}
+
+	ttl := exchange.TTL
+	if ttl == 0 {
+		ttl = defaultExchangeTTL
+	}
+	if ttl < 0 || ttl > maxExchangeTTL {
+		return nil, fmt.Errorf("exchanged token TTL must be between 0 and %s, got %s", maxExchangeTTL, ttl)
+	}
+	if introspection.ExpiresAt != 0 {
+		remaining := time.Unix(introspection.ExpiresAt, 0).Sub(now.Truncate(time.Second))
+		if remaining < ttl {
+			ttl = remaining
+		}
+		if ttl < time.Second {
+			return nil, fmt.Errorf("token expires too soon to be exchanged")
+		}
+	}
+
+	scope, err := copyChecks(token)
+	if err != nil {
+		return nil, err
+	}
+	scopeDescriptions := []string{}
+	repos, err := intersectRequested(introspection.Repos, exchange.Repos)
+	if err != nil {
+		return nil, fmt.Errorf("error when restricting repos: %w", err)
+	}
+	if len(repos) > 0 {
+		err = scope.RestrictToRepos(repos...)
+		if err != nil {
+			return nil, fmt.Errorf("error when restricting repos: %w", err)
+		}
+		repoStrs := []string{}
+		for _, repoId := range repos {
+			repoStrs = append(repoStrs, strconv.Itoa(repoId))
+		}
+		scopeDescriptions = append(scopeDescriptions, "repos="+strings.Join(repoStrs, ","))
+	}
+
+	allowedActions := strings.Fields(introspection.Scope)
+	if len(allowedActions) == 0 {
+		allowedActions = []string{membershipStr, readStr, writeStr}
+	}
+	actionStrs := allowedActions
+	if len(exchange.Actions) > 0 {
+		actionStrs = []string{}
+		for _, actionStr := range exchange.Actions {
+			found := false
+			for _, allowedStr := range allowedActions {
+				found = found || actionStr == allowedStr
+			}
+			if !found {
+				return nil, fmt.Errorf("action %s is not allowed by the presented token", actionStr)
+			}
+			actionStrs = append(actionStrs, actionStr)
+		}
+	}
+	actionsDescription, err := restrictScopeActions(scope, actionStrs)
+	if err != nil {
+		return nil, err
+	}
+	scopeDescriptions = append(scopeDescriptions, actionsDescription)
+
+	opts := IssueOptions{
+		TTL:              ttl,
+		Kind:             exchangeKind,
+		Description:      "exchanged for token " + issuances[0].tokenId,
+		ParentTokenId:    issuances[0].tokenId,
+		Scope:            scope,
+		ScopeDescription: strings.Join(scopeDescriptions, " "),
+	}
+	if issuances[0].userId != 0 {
+		return tokenIssuer.IssueTokenWithOptions(issuances[0].userId, opts)
+	}
+	return tokenIssuer.IssueServiceToken(issuances[0].serviceAccountId, opts)
+}
+
+// intersectRequested returns the requested repos, all of which must be in allowed, or allowed if none are requested. A nil allowed means every repo is allowed.
+func intersectRequested(allowed []int, requested []int) ([]int, error) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	if allowed == nil {
+		return requested, nil
+	}
+	for _, repoId := range requested {
+		found := false
+		for _, allowedId := range allowed {
+			found = found || repoId == allowedId
+		}
+		if !found {
+			return nil, fmt.Errorf("repo %d is not allowed by the presented token", repoId)
+		}
+	}
+	return requested, nil
+}
+
+// copyChecks returns an attenuation holding every check of token, authority first. Tokens whose attenuation blocks hold facts or rules are refused.
+func copyChecks(token *biscuit.Biscuit) (*Attenuation, error) {
+	container, err := decodeContainer(token)
+	if err != nil {
+		return nil, err
+	}
+	readers, err := decodeBlocks(container)
+	if err != nil {
+		return nil, err
+	}
+	scope := NewAttenuation()
+	for i, reader := range readers {
+		if i > 0 && (len(reader.block.FactsV2) != 0 || len(reader.block.RulesV2) != 0) {
+			return nil, fmt.Errorf("tokens with facts or rules in attenuation blocks cannot be exchanged")
+		}
+		for _, check := range reader.block.ChecksV2 {
+			builderCheck, err := reader.builderCheck(check)
+			if err != nil {
+				return nil, fmt.Errorf("error when copying check from block %d: %w", i, err)
+			}
+			scope.checks = append(scope.checks, builderCheck)
+		}
+	}
+	return scope, nil
+}
+
+// builderTerm converts a term to the biscuit builder type.
+func (reader *blockReader) builderTerm(term *pb.TermV2) (biscuit.Term, error) {
+	switch content := term.Content.(type) {
+	case *pb.TermV2_Variable:
+		return biscuit.Variable(reader.symbol(uint64(content.Variable))), nil
+	case *pb.TermV2_Integer:
+		return biscuit.Integer(content.Integer), nil
+	case *pb.TermV2_String_:
+		return biscuit.String(reader.symbol(content.String_)), nil
+	case *pb.TermV2_Date:
+		return biscuit.Date(time.Unix(int64(content.Date), 0).UTC()), nil
+	case *pb.TermV2_Bytes:
+		return biscuit.Bytes(content.Bytes), nil
+	case *pb.TermV2_Bool:
+		return biscuit.Bool(content.Bool), nil
+	case *pb.TermV2_Set:
+		set := biscuit.Set{}
+		for _, element := range content.Set.Set {
+			builderElement, err := reader.builderTerm(element)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, builderElement)
+		}
+		return set, nil
+	default:
+		return nil, fmt.Errorf("unsupported term %T", term.Content)
+	}
+}
+
+// builderPredicate converts a predicate to the biscuit builder type.
+func (reader *blockReader) builderPredicate(predicate *pb.PredicateV2) (biscuit.Predicate, error) {
+	terms := []biscuit.Term{}
+	for _, term := range predicate.Terms {
+		builderTerm, err := reader.builderTerm(term)
+		if err != nil {
+			return biscuit.Predicate{}, err
+		}
+		terms = append(terms, builderTerm)
+	}
+	return biscuit.Predicate{Name: reader.symbol(predicate.GetName()), IDs: terms}, nil
+}
+
+// builderUnaryOps and builderBinaryOps map protobuf operators to the biscuit builder operators.
+var (
+	builderUnaryOps = map[pb.OpUnary_Kind]biscuit.UnaryOp{
+		pb.OpUnary_Negate: biscuit.UnaryNegate,
+		pb.OpUnary_Parens: biscuit.UnaryParens,
+		pb.OpUnary_Length: biscuit.UnaryLength,
+	}
+	builderBinaryOps = map[pb.OpBinary_Kind]biscuit.BinaryOp{
+		pb.OpBinary_LessThan:       biscuit.BinaryLessThan,
+		pb.OpBinary_GreaterThan:    biscuit.BinaryGreaterThan,
+		pb.OpBinary_LessOrEqual:    biscuit.BinaryLessOrEqual,
+		pb.OpBinary_GreaterOrEqual: biscuit.BinaryGreaterOrEqual,
+		pb.OpBinary_Equal:          biscuit.BinaryEqual,
+		pb.OpBinary_Contains:       biscuit.BinaryContains,
+		pb.OpBinary_Prefix:         biscuit.BinaryPrefix,
+		pb.OpBinary_Suffix:         biscuit.BinarySuffix,
+		pb.OpBinary_Regex:          biscuit.BinaryRegex,
+		pb.OpBinary_Add:            biscuit.BinaryAdd,
+		pb.OpBinary_Sub:            biscuit.BinarySub,
+		pb.OpBinary_Mul:            biscuit.BinaryMul,
+		pb.OpBinary_Div:            biscuit.BinaryDiv,
+		pb.OpBinary_And:            biscuit.BinaryAnd,
+		pb.OpBinary_Or:             biscuit.BinaryOr,
+		pb.OpBinary_Intersection:   biscuit.BinaryIntersection,
+		pb.OpBinary_Union:          biscuit.BinaryUnion,
+	}
+)
+
+// builderRule converts a rule or check query to the biscuit builder type.
+func (reader *blockReader) builderRule(rule *pb.RuleV2) (biscuit.Rule, error) {
+	builderRule := biscuit.Rule{Body: []biscuit.Predicate{}, Expressions: []biscuit.Expression{}}
+	head, err := reader.builderPredicate(rule.Head)
+	if err != nil {
+		return builderRule, err
+	}
+	builderRule.Head = head
+	for _, predicate := range rule.Body {
+		builderPredicate, err := reader.builderPredicate(predicate)
+		if err != nil {
+			return builderRule, err
+		}
+		builderRule.Body = append(builderRule.Body, builderPredicate)
+	}
+	for _, expression := range rule.Expressions {
+		builderExpression := biscuit.Expression{}
+		for _, op := range expression.Ops {
+			switch content := op.Content.(type) {
+			case *pb.Op_Value:
+				term, err := reader.builderTerm(content.Value)
+				if err != nil {
+					return builderRule, err
+				}
+				builderExpression = append(builderExpression, biscuit.Value{Term: term})
+			case *pb.Op_Unary:
+				unaryOp, ok := builderUnaryOps[content.Unary.GetKind()]
+				if !ok {
+					return builderRule, fmt.Errorf("unsupported unary operator %s", content.Unary.GetKind())
+				}
+				builderExpression = append(builderExpression, unaryOp)
+			case *pb.Op_Binary:
+				binaryOp, ok := builderBinaryOps[content.Binary.GetKind()]
+				if !ok {
+					return builderRule, fmt.Errorf("unsupported binary operator %s", content.Binary.GetKind())
+				}
+				builderExpression = append(builderExpression, binaryOp)
+			default:
+				return builderRule, fmt.Errorf("unsupported operation %T", op.Content)
+			}
+		}
+		builderRule.Expressions = append(builderRule.Expressions, builderExpression)
+	}
+	return builderRule, nil
+}
+
+// builderCheck converts a check to the biscuit builder type.
+func (reader *blockReader) builderCheck(check *pb.CheckV2) (biscuit.Check, error) {
+	builderCheck := biscuit.Check{Queries: []biscuit.Rule{}}
+	for _, query := range check.Queries {
+		builderQuery, err := reader.builderRule(query)
+		if err != nil {
+			return builderCheck, err
+		}
+		builderCheck.Queries = append(builderCheck.Queries, builderQuery)
+	}
+	return builderCheck, nil
+}
@@ -0,0 +1,298 @@
+package authz
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/dblogic"
+)
+
+// exchangeSetup returns the seeded db, an issuer recording to it and checking its revocations, and a personal access token for Liam (user 4) restricted to reading and writing Bravo and Charlie for ten minutes.
+func exchangeSetup(t *testing.T) (*dblogic.DBInstance, *TokenIssuer, *biscuit.Biscuit) {
+	t.Helper()
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.Ledger = dbInstance
+	useRevocationStore(t, dbInstance)
+
+	parent, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{
+		Name:    "laptop",
+		Repos:   []int{2, 3},
+		Actions: []string{"read", "write"},
+		TTL:     10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("IssuePersonalAccessToken: %s", err)
+	}
+	return dbInstance, tokenIssuer, parent
+}
+
+// TestExchangeCannotWiden checks that requests for repos, actions or a lifetime beyond the presented token's are refused, and that a token exchanged without a request is no wider than the presented one.
+func TestExchangeCannotWiden(t *testing.T) {
+	dbInstance, tokenIssuer, parent := exchangeSetup(t)
+
+	for name, exchange := range map[string]*TokenExchange{
+		"repo outside the token":   {Repos: []int{1}},
+		"one repo outside":         {Repos: []int{3, 1}},
+		"action outside the token": {Actions: []string{"membership"}},
+		"unknown action":           {Actions: []string{"manage_tokens"}},
+		"TTL beyond the maximum":   {TTL: maxExchangeTTL + time.Second},
+		"negative TTL":             {TTL: -time.Second},
+	} {
+		_, err := tokenIssuer.ExchangeToken(parent, exchange)
+		if err == nil {
+			t.Errorf("%s: expected the exchange to be refused", name)
+		}
+	}
+
+	// The parent expires in ten minutes, before the hour requested
+	exchanged, err := tokenIssuer.ExchangeToken(parent, &TokenExchange{TTL: maxExchangeTTL})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %s", err)
+	}
+	parentInspection, err := Inspect(parent, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("Inspect: %s", err)
+	}
+	inspection, err := Inspect(exchanged, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("Inspect: %s", err)
+	}
+	if inspection.ExpiresAt == nil || inspection.ExpiresAt.After(*parentInspection.ExpiresAt) {
+		t.Errorf("expected the exchanged token to expire by %s, got %v", parentInspection.ExpiresAt, inspection.ExpiresAt)
+	}
+	if len(inspection.Repos) != 2 || len(inspection.Actions) != 2 {
+		t.Errorf("expected the parent's repos and actions, got %v and %v", inspection.Repos, inspection.Actions)
+	}
+	for _, request := range []testRequest{
+		{user: 4, repo: "Alpha", action: Read},
+		{user: 4, repo: "Charlie", action: Membership},
+	} {
+		hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, exchanged, request)
+		if hasPermission {
+			t.Errorf("expected %+v to be denied", request)
+		}
+	}
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, exchanged, testRequest{user: 4, repo: "Bravo", action: Write})
+	if !hasPermission {
+		t.Errorf("expected writing Bravo to be allowed: %s", err)
+	}
+}
+
+// TestExchangeKeepsAttenuation checks that restrictions appended to the presented token, including ones which are not repo or action restrictions, bind the exchanged token too.
+func TestExchangeKeepsAttenuation(t *testing.T) {
+	dbInstance, tokenIssuer, parent := exchangeSetup(t)
+	attenuation := NewAttenuation()
+	if err := attenuation.RestrictToRepos(3); err != nil {
+		t.Fatalf("RestrictToRepos: %s", err)
+	}
+	if err := attenuation.RestrictToRefs("refs/heads/main"); err != nil {
+		t.Fatalf("RestrictToRefs: %s", err)
+	}
+	attenuated, err := attenuation.Apply(parent)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+
+	_, err = tokenIssuer.ExchangeToken(attenuated, &TokenExchange{Repos: []int{2}})
+	if err == nil {
+		t.Errorf("expected a repo removed by attenuation to be refused")
+	}
+	exchanged, err := tokenIssuer.ExchangeToken(attenuated, &TokenExchange{})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %s", err)
+	}
+	for _, request := range []testRequest{
+		{user: 4, repo: "Bravo", action: Read},
+		{user: 4, repo: "Charlie", action: Write, context: dblogic.RequestContext{Ref: "refs/heads/dev"}},
+	} {
+		hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, exchanged, request)
+		if hasPermission {
+			t.Errorf("expected %+v to be denied", request)
+		}
+	}
+	request := testRequest{user: 4, repo: "Charlie", action: Write, context: dblogic.RequestContext{Ref: "refs/heads/main"}}
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, exchanged, request)
+	if !hasPermission {
+		t.Errorf("expected %+v to be allowed: %s", request, err)
+	}
+
+	withFacts := NewAttenuation()
+	if err := withFacts.AddSource(`repo_note("trusted");`); err != nil {
+		t.Fatalf("AddSource: %s", err)
+	}
+	factToken, err := withFacts.Apply(parent)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	_, err = tokenIssuer.ExchangeToken(factToken, &TokenExchange{})
+	if err == nil {
+		t.Errorf("expected a token with facts in an attenuation block to be refused")
+	}
+}
+
+// TestExchangeDownscopes checks that an exchanged token is restricted to the requested repos and actions with a short lifetime, is recorded against the presented token, and cannot manage tokens.
+func TestExchangeDownscopes(t *testing.T) {
+	dbInstance, tokenIssuer, parent := exchangeSetup(t)
+	exchanged, err := tokenIssuer.ExchangeToken(parent, &TokenExchange{Repos: []int{3}, Actions: []string{"read"}, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %s", err)
+	}
+
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, exchanged, testRequest{user: 4, repo: "Charlie", action: Read})
+	if !hasPermission {
+		t.Errorf("expected reading Charlie to be allowed: %s", err)
+	}
+	for _, request := range []testRequest{
+		{user: 4, repo: "Charlie", action: Write},
+		{user: 4, repo: "Bravo", action: Read},
+	} {
+		hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, exchanged, request)
+		if hasPermission {
+			t.Errorf("expected %+v to be denied", request)
+		}
+	}
+
+	introspection, err := Introspect(exchanged, tokenIssuer.PublicRoot, time.Now())
+	if err != nil {
+		t.Fatalf("Introspect: %s", err)
+	}
+	if !introspection.Active || introspection.Subject != "userid:4" || introspection.ExpiresAt > time.Now().Add(time.Minute).Unix() {
+		t.Errorf("expected an active token for userid:4 expiring within the minute, got %+v", introspection)
+	}
+	parentId, err := TokenId(parent, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("TokenId: %s", err)
+	}
+	issuedToken, err := dbInstance.GetIssuedToken(introspection.TokenId)
+	if err != nil {
+		t.Fatalf("GetIssuedToken: %s", err)
+	}
+	if issuedToken.Kind != exchangeKind || !strings.Contains(issuedToken.Description, parentId) ||
+		issuedToken.ParentTokenId != parentId || issuedToken.Scope != "repos=3 actions=read" {
+		t.Errorf("expected an exchange ledger entry naming %s, got %+v", parentId, issuedToken)
+	}
+
+	_, err = AuthenticateTokenManagement(exchanged, tokenIssuer.PublicRoot)
+	if err == nil {
+		t.Errorf("expected the exchanged token to be refused token management")
+	}
+}
+
+// TestExchangeUnrestricted checks that a token without restrictions or expiry is exchanged for one with the default lifetime which still cannot manage tokens, and that service account tokens keep their principal.
+func TestExchangeUnrestricted(t *testing.T) {
+	_, tokenIssuer, _ := exchangeSetup(t)
+	userToken, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	before := time.Now().Truncate(time.Second)
+	exchanged, err := tokenIssuer.ExchangeToken(userToken, &TokenExchange{})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %s", err)
+	}
+	inspection, err := Inspect(exchanged, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("Inspect: %s", err)
+	}
+	if inspection.ExpiresAt == nil || inspection.ExpiresAt.Before(before.Add(defaultExchangeTTL)) || inspection.ExpiresAt.After(time.Now().Add(defaultExchangeTTL)) {
+		t.Errorf("expected expiry about %s from now, got %v", defaultExchangeTTL, inspection.ExpiresAt)
+	}
+	_, err = AuthenticateTokenManagement(exchanged, tokenIssuer.PublicRoot)
+	if err == nil {
+		t.Errorf("expected the exchanged token to be refused token management")
+	}
+
+	serviceToken, err := tokenIssuer.IssueServiceToken(2, IssueOptions{})
+	if err != nil {
+		t.Fatalf("IssueServiceToken: %s", err)
+	}
+	exchanged, err = tokenIssuer.ExchangeToken(serviceToken, &TokenExchange{Actions: []string{"read"}})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %s", err)
+	}
+	introspection, err := Introspect(exchanged, tokenIssuer.PublicRoot, time.Now())
+	if err != nil {
+		t.Fatalf("Introspect: %s", err)
+	}
+	if introspection.Subject != "svc:2" {
+		t.Errorf("expected the exchanged token to be issued to svc:2, got %q", introspection.Subject)
+	}
+}
+
+// TestExchangeInactive checks that revoked and forged tokens cannot be exchanged.
+func TestExchangeInactive(t *testing.T) {
+	dbInstance, tokenIssuer, parent := exchangeSetup(t)
+	forgingIssuer, err := NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	forged, err := forgingIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	_, err = tokenIssuer.ExchangeToken(forged, &TokenExchange{})
+	if err == nil {
+		t.Errorf("expected a forged token to be refused")
+	}
+
+	err = dbInstance.RevokeIds(TokenRevocationIds(parent, true), time.Time{}, "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIds: %s", err)
+	}
+	_, err = tokenIssuer.ExchangeToken(parent, &TokenExchange{})
+	if err == nil {
+		t.Errorf("expected a revoked token to be refused")
+	}
+}
+
+// TestExchangeRevokedWithParent checks that revoking a token through the ledger revokes the tokens exchanged for it, and the tokens exchanged for those.
+func TestExchangeRevokedWithParent(t *testing.T) {
+	dbInstance, tokenIssuer, parent := exchangeSetup(t)
+	child, err := tokenIssuer.ExchangeToken(parent, &TokenExchange{})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %s", err)
+	}
+	grandchild, err := tokenIssuer.ExchangeToken(child, &TokenExchange{})
+	if err != nil {
+		t.Fatalf("ExchangeToken: %s", err)
+	}
+	parentId, err := TokenId(parent, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("TokenId: %s", err)
+	}
+
+	err = dbInstance.RevokeIssuedToken(parentId, "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIssuedToken: %s", err)
+	}
+	request := testRequest{user: 4, repo: "Charlie", action: Read}
+	for name, token := range map[string]*biscuit.Biscuit{"parent": parent, "child": child, "grandchild": grandchild} {
+		hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, token, request)
+		if hasPermission || !errors.Is(err, ErrRevoked) {
+			t.Errorf("expected the %s token to be refused as revoked, got %t and %v", name, hasPermission, err)
+		}
+	}
+}
+
+// TestExchangeWithoutTokenId checks that a token without a token id, which could not be recorded as the parent of the exchanged token, is refused.
+func TestExchangeWithoutTokenId(t *testing.T) {
+	_, tokenIssuer, _ := exchangeSetup(t)
+	builder := biscuit.NewBuilder(tokenIssuer.privateRoot)
+	err := builder.AddAuthorityFact(newFact("user", biscuit.String(namespaceUser(4))))
+	if err != nil {
+		t.Fatalf("AddAuthorityFact: %s", err)
+	}
+	token, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+
+	_, err = tokenIssuer.ExchangeToken(token, &TokenExchange{})
+	if err == nil || !strings.Contains(err.Error(), "token id") {
+		t.Errorf("expected a token without a token id to be refused, got %v", err)
+	}
+}
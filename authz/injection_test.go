@@ -0,0 +1,102 @@
+package authz
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/parser"
+
+	"biscuitExample/dblogic"
+)
+
+// isDenied reports if err is the authorizer refusing the request, rather than failing to evaluate it.
+func isDenied(err error) bool {
+	return errors.Is(err, biscuit.ErrNoMatchingPolicy) || errors.Is(err, biscuit.ErrPolicyDenied)
+}
+
+// FuzzHostileNames checks that names from the database are only ever data to the authorizer, no matter what datalog syntax they contain.
+func FuzzHostileNames(f *testing.F) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f.Add("Charlie")
+	f.Add(`Charlie");`)
+	f.Add(`Charlie"); allow if true; //`)
+	f.Add(`x", "repo:3", "role:owner"); role("userid:4`)
+	f.Add("Charlie\");\nallow if true;\n//")
+	f.Add(`\"`)
+	f.Add(`{id}`)
+	f.Add(`$user`)
+	f.Add("")
+
+	tokenIssuer, err := NewTokenIssuer()
+	if err != nil {
+		f.Fatalf("NewTokenIssuer: %s", err)
+	}
+	token, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		f.Fatalf("IssueToken: %s", err)
+	}
+	reponameRule, err := parser.FromStringRule(`found($name) <- reponame($repo, $name)`)
+	if err != nil {
+		f.Fatalf("FromStringRule: %s", err)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		for _, hasRole := range []bool{false, true} {
+			reqDetails := &dblogic.RequestDetails{
+				UserId:   4,
+				Username: name,
+				RepoId:   3,
+				RepoName: name,
+				UsergroupRelationships: &dblogic.UsergroupRelationships{
+					UserInGroups:      []*dblogic.UserInGroup{},
+					UserGroupInGroups: []*dblogic.UserGroupInGroup{},
+				},
+				RepogroupRels: []*dblogic.RepogroupRel{},
+				AssignedRoles: []*dblogic.AssignedRole{},
+			}
+			if hasRole {
+				reqDetails.AssignedRoles = append(reqDetails.AssignedRoles, &dblogic.AssignedRole{
+					UserOrGroup:   dblogic.UserUGR,
+					UserOrGroupID: 4,
+					RepoOrGroup:   dblogic.RepoUGR,
+					RepoOrGroupID: 3,
+					RepoRole:      dblogic.ReaderRole,
+				})
+			}
+
+			hasPermission, err := CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, Read)
+			if hasPermission != hasRole {
+				t.Fatalf("name %q changed the decision: got %t, want %t: %v", name, hasPermission, hasRole, err)
+			}
+			if !hasRole && !isDenied(err) {
+				t.Fatalf("name %q broke the read check: %s", name, err)
+			}
+			hasPermission, err = CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, Write)
+			if hasPermission {
+				t.Fatalf("name %q allowed a write with at most a reader role", name)
+			}
+			if !isDenied(err) {
+				t.Fatalf("name %q broke the write check: %s", name, err)
+			}
+
+			// The name should arrive as exactly one string term
+			authorizer, err := newAuthorizer(token, tokenIssuer.PublicRoot, reqDetails, Read)
+			if err != nil {
+				t.Fatalf("newAuthorizer: %s", err)
+			}
+			found, err := authorizer.Query(reponameRule)
+			if err != nil {
+				t.Fatalf("Query: %s", err)
+			}
+			if len(found) != 1 || len(found[0].IDs) != 1 || found[0].IDs[0] != biscuit.String(name) {
+				t.Fatalf("name %q did not round trip, found %v", name, found)
+			}
+		}
+	})
+}
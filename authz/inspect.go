@@ -0,0 +1,413 @@
+package authz
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/datalog"
+	"github.com/biscuit-auth/biscuit-go/v2/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// TokenInspection describes the contents of a token, as returned by Inspect.
+type TokenInspection struct {
+	// RootKeyId is the root key hint stored in the token, if any. Tokens issued by TokenIssuer do not set one.
+	RootKeyId *uint32 `json:"root_key_id,omitempty"`
+	// KeyId identifies the root key the token was verified with, in the same form as TokenIssuer.KeyId. Empty if the token was not verified.
+	KeyId string `json:"key_id,omitempty"`
+	// Verified is true if the token's signatures were verified against a root key
+	Verified bool `json:"verified"`
+	// Sealed is true if no more blocks can be appended to the token
+	Sealed bool `json:"sealed"`
+	// NotBefore is the latest not-before time checked by any block, nil if there is none
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	// ExpiresAt is the earliest expiry checked by any block, nil if the token never expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Actions are the actions allowed by every block's action restrictions, such as "read", nil if no block restricts actions. Only restrictions in the form written by Attenuation.RestrictToActions are recognized.
+	Actions []string `json:"actions"`
+	// Repos are the repo ids allowed by every block's repo restrictions, nil if no block restricts repos. Only restrictions in the form written by Attenuation.RestrictToRepos are recognized.
+	Repos []int `json:"repos"`
+	// RevocationIds are the hex revocation ids of every block, authority first
+	RevocationIds []string `json:"revocation_ids"`
+	// Blocks are the token's blocks, authority first
+	Blocks []*InspectedBlock `json:"blocks"`
+}
+
+// InspectedBlock is the datalog and metadata of one block of a token.
+type InspectedBlock struct {
+	// Index is 0 for the authority block and counts up for each appended block
+	Index int `json:"index"`
+	// Facts, Rules and Checks are the block's datalog in source form
+	Facts  []string `json:"facts"`
+	Rules  []string `json:"rules"`
+	Checks []string `json:"checks"`
+	// Context is the block's context string, if any
+	Context string `json:"context,omitempty"`
+	// AttestedBy is the hex public key of the external party if the block holds an attestation
+	AttestedBy string `json:"attested_by,omitempty"`
+	// RevocationId is the hex revocation id of the block
+	RevocationId string `json:"revocation_id"`
+}
+
+// Inspect decodes the blocks of token into datalog source and reads its metadata. If publicRoot is not nil the token's signatures are verified against it first and an invalid token is an error; otherwise the token is inspected unverified. Revocation is not checked.
+func Inspect(token *biscuit.Biscuit, publicRoot ed25519.PublicKey) (*TokenInspection, error) {
+	inspection := &TokenInspection{RevocationIds: []string{}, Blocks: []*InspectedBlock{}}
+	if publicRoot != nil {
+		_, err := token.Authorizer(publicRoot)
+		if err != nil {
+			return nil, fmt.Errorf("error when verifying token: %w", err)
+		}
+		inspection.Verified = true
+		inspection.KeyId = keyIdOf(publicRoot)
+	}
+
+	container, err := decodeContainer(token)
+	if err != nil {
+		return nil, err
+	}
+	inspection.RootKeyId = container.RootKeyId
+	inspection.Sealed = container.Proof.GetFinalSignature() != nil
+
+	readers, err := decodeBlocks(container)
+	if err != nil {
+		return nil, err
+	}
+	revocationIds := token.RevocationIds()
+	for i, reader := range readers {
+		block := reader.block
+		inspected := &InspectedBlock{
+			Index:   i,
+			Facts:   []string{},
+			Rules:   []string{},
+			Checks:  []string{},
+			Context: block.GetContext(),
+		}
+		if i < len(revocationIds) {
+			inspected.RevocationId = hex.EncodeToString(revocationIds[i])
+			inspection.RevocationIds = append(inspection.RevocationIds, inspected.RevocationId)
+		}
+		if strings.HasPrefix(inspected.Context, attestationPrefix) {
+			attestation, err := DecodeAttestation(strings.TrimPrefix(inspected.Context, attestationPrefix))
+			if err == nil {
+				inspected.AttestedBy = hex.EncodeToString(attestation.PublicKey)
+			}
+		}
+		for _, fact := range block.FactsV2 {
+			inspected.Facts = append(inspected.Facts, reader.predicate(fact.Predicate))
+		}
+		for _, rule := range block.RulesV2 {
+			inspected.Rules = append(inspected.Rules, reader.rule(rule))
+		}
+		for _, check := range block.ChecksV2 {
+			inspected.Checks = append(inspected.Checks, reader.check(check))
+			if operationTerm, allowed, ok := reader.operationRestriction(check); ok {
+				if operationTerm == 0 {
+					inspection.Actions = intersectAllowed(inspection.Actions, allowed, actionNS)
+				} else {
+					repos := []int{}
+					for _, repoStr := range intersectAllowed(nil, allowed, repoNS) {
+						repoId, err := strconv.Atoi(repoStr)
+						if err == nil {
+							repos = append(repos, repoId)
+						}
+					}
+					inspection.Repos = intersectRepos(inspection.Repos, repos)
+				}
+				continue
+			}
+			bound, expiry, ok := reader.timeBound(check)
+			if !ok {
+				continue
+			}
+			if expiry {
+				if inspection.ExpiresAt == nil || bound.Before(*inspection.ExpiresAt) {
+					inspection.ExpiresAt = &bound
+				}
+			} else if inspection.NotBefore == nil || bound.After(*inspection.NotBefore) {
+				inspection.NotBefore = &bound
+			}
+		}
+		inspection.Blocks = append(inspection.Blocks, inspected)
+	}
+	return inspection, nil
+}
+
+// blockReader reads the protobuf datalog of a block, looking up symbols in the token's symbol table up to and including that block.
+type blockReader struct {
+	block   *pb.Block
+	symbols []string
+}
+
+// decodeBlocks decodes the blocks of container, authority first.
+func decodeBlocks(container *pb.Biscuit) ([]*blockReader, error) {
+	signedBlocks := append([]*pb.SignedBlock{container.Authority}, container.Blocks...)
+	readers := []*blockReader{}
+	symbols := []string{}
+	for i, signedBlock := range signedBlocks {
+		block := &pb.Block{}
+		err := proto.Unmarshal(signedBlock.Block, block)
+		if err != nil {
+			return nil, fmt.Errorf("error when decoding block %d: %w", i, err)
+		}
+		// Each block's symbols extend the table of the blocks before it
+		symbols = append(symbols, block.Symbols...)
+		readers = append(readers, &blockReader{block: block, symbols: symbols})
+	}
+	return readers, nil
+}
+
+// symbol looks up a symbol index in the default symbols or the token symbols.
+func (reader *blockReader) symbol(index uint64) string {
+	if index < uint64(len(datalog.DEFAULT_SYMBOLS)) {
+		return datalog.DEFAULT_SYMBOLS[index]
+	}
+	if index >= uint64(datalog.OFFSET) && index-uint64(datalog.OFFSET) < uint64(len(reader.symbols)) {
+		return reader.symbols[index-uint64(datalog.OFFSET)]
+	}
+	return fmt.Sprintf("<unknown symbol %d>", index)
+}
+
+// term renders a term as a datalog literal or variable.
+func (reader *blockReader) term(term *pb.TermV2) string {
+	switch content := term.Content.(type) {
+	case *pb.TermV2_Variable:
+		return "$" + reader.symbol(uint64(content.Variable))
+	case *pb.TermV2_Integer:
+		return fmt.Sprintf("%d", content.Integer)
+	case *pb.TermV2_String_:
+		return fmt.Sprintf("%q", reader.symbol(content.String_))
+	case *pb.TermV2_Date:
+		return time.Unix(int64(content.Date), 0).UTC().Format(time.RFC3339)
+	case *pb.TermV2_Bytes:
+		return "hex:" + hex.EncodeToString(content.Bytes)
+	case *pb.TermV2_Bool:
+		return fmt.Sprintf("%t", content.Bool)
+	case *pb.TermV2_Set:
+		elements := []string{}
+		for _, element := range content.Set.Set {
+			elements = append(elements, reader.term(element))
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	default:
+		return fmt.Sprintf("<unknown term %T>", term.Content)
+	}
+}
+
+// predicate renders a predicate such as a fact or a rule head.
+func (reader *blockReader) predicate(predicate *pb.PredicateV2) string {
+	terms := []string{}
+	for _, term := range predicate.Terms {
+		terms = append(terms, reader.term(term))
+	}
+	return fmt.Sprintf("%s(%s)", reader.symbol(predicate.GetName()), strings.Join(terms, ", "))
+}
+
+// expression renders an expression, which is stored as a stack machine program.
+func (reader *blockReader) expression(expression *pb.ExpressionV2) string {
+	stack := []string{}
+	for _, op := range expression.Ops {
+		switch content := op.Content.(type) {
+		case *pb.Op_Value:
+			stack = append(stack, reader.term(content.Value))
+		case *pb.Op_Unary:
+			if len(stack) < 1 {
+				return "<invalid expression>"
+			}
+			value := stack[len(stack)-1]
+			switch content.Unary.GetKind() {
+			case pb.OpUnary_Negate:
+				value = "!" + value
+			case pb.OpUnary_Parens:
+				value = "(" + value + ")"
+			case pb.OpUnary_Length:
+				value = value + ".length()"
+			}
+			stack[len(stack)-1] = value
+		case *pb.Op_Binary:
+			if len(stack) < 2 {
+				return "<invalid expression>"
+			}
+			format, ok := binaryOpFormats[content.Binary.GetKind()]
+			if !ok {
+				return "<invalid expression>"
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1] = format(left, right)
+		}
+	}
+	if len(stack) != 1 {
+		return "<invalid expression>"
+	}
+	return stack[0]
+}
+
+// binaryOpFormats render each binary operator from its operands, as in the biscuit datalog syntax.
+var binaryOpFormats = map[pb.OpBinary_Kind]func(left string, right string) string{
+	pb.OpBinary_LessThan:       func(left string, right string) string { return left + " < " + right },
+	pb.OpBinary_GreaterThan:    func(left string, right string) string { return left + " > " + right },
+	pb.OpBinary_LessOrEqual:    func(left string, right string) string { return left + " <= " + right },
+	pb.OpBinary_GreaterOrEqual: func(left string, right string) string { return left + " >= " + right },
+	pb.OpBinary_Equal:          func(left string, right string) string { return left + " == " + right },
+	pb.OpBinary_Contains:       func(left string, right string) string { return left + ".contains(" + right + ")" },
+	pb.OpBinary_Prefix:         func(left string, right string) string { return left + ".starts_with(" + right + ")" },
+	pb.OpBinary_Suffix:         func(left string, right string) string { return left + ".ends_with(" + right + ")" },
+	pb.OpBinary_Regex:          func(left string, right string) string { return left + ".matches(" + right + ")" },
+	pb.OpBinary_Add:            func(left string, right string) string { return left + " + " + right },
+	pb.OpBinary_Sub:            func(left string, right string) string { return left + " - " + right },
+	pb.OpBinary_Mul:            func(left string, right string) string { return left + " * " + right },
+	pb.OpBinary_Div:            func(left string, right string) string { return left + " / " + right },
+	pb.OpBinary_And:            func(left string, right string) string { return left + " && " + right },
+	pb.OpBinary_Or:             func(left string, right string) string { return left + " || " + right },
+	pb.OpBinary_Intersection:   func(left string, right string) string { return left + ".intersection(" + right + ")" },
+	pb.OpBinary_Union:          func(left string, right string) string { return left + ".union(" + right + ")" },
+}
+
+// body renders the body and expressions of a rule or check query.
+func (reader *blockReader) body(rule *pb.RuleV2) string {
+	parts := []string{}
+	for _, predicate := range rule.Body {
+		parts = append(parts, reader.predicate(predicate))
+	}
+	for _, expression := range rule.Expressions {
+		parts = append(parts, reader.expression(expression))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rule renders a rule.
+func (reader *blockReader) rule(rule *pb.RuleV2) string {
+	return reader.predicate(rule.Head) + " <- " + reader.body(rule)
+}
+
+// check renders a check, whose queries are alternatives.
+func (reader *blockReader) check(check *pb.CheckV2) string {
+	queries := []string{}
+	for _, query := range check.Queries {
+		queries = append(queries, reader.body(query))
+	}
+	return "check if " + strings.Join(queries, " or ")
+}
+
+// timeBound recognizes checks of the form `check if time($time), $time <= {date}`, as written by TokenIssuer and Attenuation.ExpiresAt, and returns the date and whether it is an expiry (<=) or a not-before (>=) bound. Checks with alternative queries do not bound the token's validity on their own and are not recognized.
+func (reader *blockReader) timeBound(check *pb.CheckV2) (time.Time, bool, bool) {
+	if len(check.Queries) != 1 {
+		return time.Time{}, false, false
+	}
+	query := check.Queries[0]
+	if len(query.Body) != 1 || reader.symbol(query.Body[0].GetName()) != "time" || len(query.Body[0].Terms) != 1 ||
+		len(query.Expressions) != 1 || len(query.Expressions[0].Ops) != 3 {
+		return time.Time{}, false, false
+	}
+	timeVar, ok := query.Body[0].Terms[0].Content.(*pb.TermV2_Variable)
+	if !ok {
+		return time.Time{}, false, false
+	}
+	ops := query.Expressions[0].Ops
+	exprVar, ok := ops[0].GetValue().GetContent().(*pb.TermV2_Variable)
+	if !ok || exprVar.Variable != timeVar.Variable {
+		return time.Time{}, false, false
+	}
+	date, ok := ops[1].GetValue().GetContent().(*pb.TermV2_Date)
+	if !ok {
+		return time.Time{}, false, false
+	}
+	binary := ops[2].GetBinary()
+	if binary == nil {
+		return time.Time{}, false, false
+	}
+	bound := time.Unix(int64(date.Date), 0).UTC()
+	switch binary.GetKind() {
+	case pb.OpBinary_LessOrEqual, pb.OpBinary_LessThan:
+		return bound, true, true
+	case pb.OpBinary_GreaterOrEqual, pb.OpBinary_GreaterThan:
+		return bound, false, true
+	default:
+		return time.Time{}, false, false
+	}
+}
+
+// operationRestriction recognizes checks of the form `check if operation($action, $repo), {set}.contains($action)`, as written by Attenuation.RestrictToActions and RestrictToRepos, and returns which operation term is restricted, 0 for the action and 1 for the repo, along with the allowed strings.
+func (reader *blockReader) operationRestriction(check *pb.CheckV2) (int, []string, bool) {
+	if len(check.Queries) != 1 {
+		return 0, nil, false
+	}
+	query := check.Queries[0]
+	if len(query.Body) != 1 || reader.symbol(query.Body[0].GetName()) != "operation" || len(query.Body[0].Terms) != 2 ||
+		len(query.Expressions) != 1 || len(query.Expressions[0].Ops) != 3 {
+		return 0, nil, false
+	}
+	ops := query.Expressions[0].Ops
+	set, ok := ops[0].GetValue().GetContent().(*pb.TermV2_Set)
+	if !ok {
+		return 0, nil, false
+	}
+	exprVar, ok := ops[1].GetValue().GetContent().(*pb.TermV2_Variable)
+	if !ok || ops[2].GetBinary() == nil || ops[2].GetBinary().GetKind() != pb.OpBinary_Contains {
+		return 0, nil, false
+	}
+	operationTerm := -1
+	for i, term := range query.Body[0].Terms {
+		termVar, ok := term.Content.(*pb.TermV2_Variable)
+		if ok && termVar.Variable == exprVar.Variable {
+			operationTerm = i
+		}
+	}
+	if operationTerm == -1 {
+		return 0, nil, false
+	}
+	allowed := []string{}
+	for _, element := range set.Set.Set {
+		str, ok := element.Content.(*pb.TermV2_String_)
+		if !ok {
+			return 0, nil, false
+		}
+		allowed = append(allowed, reader.symbol(str.String_))
+	}
+	return operationTerm, allowed, true
+}
+
+// intersectAllowed strips namespace from the allowed strings which have it and intersects them with current, where nil means no restriction yet.
+func intersectAllowed(current []string, allowed []string, namespace string) []string {
+	stripped := []string{}
+	for _, allowedStr := range allowed {
+		if name, found := strings.CutPrefix(allowedStr, namespace+":"); found {
+			stripped = append(stripped, name)
+		}
+	}
+	if current == nil {
+		return stripped
+	}
+	intersection := []string{}
+	for _, currentStr := range current {
+		for _, name := range stripped {
+			if currentStr == name {
+				intersection = append(intersection, currentStr)
+				break
+			}
+		}
+	}
+	return intersection
+}
+
+// intersectRepos intersects repo ids with current, where nil means no restriction yet.
+func intersectRepos(current []int, repos []int) []int {
+	if current == nil {
+		return repos
+	}
+	intersection := []int{}
+	for _, currentId := range current {
+		for _, repoId := range repos {
+			if currentId == repoId {
+				intersection = append(intersection, currentId)
+				break
+			}
+		}
+	}
+	return intersection
+}
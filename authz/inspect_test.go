@@ -0,0 +1,121 @@
+package authz
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestInspect checks that inspection reports a token's blocks and combines the restrictions of every block into the repos, actions and validity window the token is usable for.
+func TestInspect(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.Ledger = dbInstance
+
+	token, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{
+		Name:    "laptop",
+		Repos:   []int{2, 3},
+		Actions: []string{"read", "write"},
+		TTL:     2 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("IssuePersonalAccessToken: %s", err)
+	}
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	attenuation := NewAttenuation()
+	for _, err := range []error{
+		attenuation.RestrictToRepos(3, 1),
+		attenuation.RestrictToActions(Read),
+		attenuation.ExpiresAt(expiry),
+	} {
+		if err != nil {
+			t.Fatalf("building attenuation: %s", err)
+		}
+	}
+	attenuation.SetContext("read Charlie")
+	attenuated, err := attenuation.Apply(token)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+
+	inspection, err := Inspect(attenuated, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("Inspect: %s", err)
+	}
+	if !inspection.Verified || inspection.KeyId != tokenIssuer.KeyId || inspection.Sealed {
+		t.Errorf("expected a verified, unsealed token signed by %s, got verified %t, key %s, sealed %t",
+			tokenIssuer.KeyId, inspection.Verified, inspection.KeyId, inspection.Sealed)
+	}
+	if len(inspection.Repos) != 1 || inspection.Repos[0] != 3 {
+		t.Errorf("expected repos [3], got %v", inspection.Repos)
+	}
+	if len(inspection.Actions) != 1 || inspection.Actions[0] != "read" {
+		t.Errorf("expected actions [read], got %v", inspection.Actions)
+	}
+	if inspection.ExpiresAt == nil || !inspection.ExpiresAt.Equal(expiry) {
+		t.Errorf("expected the earlier expiry %s, got %v", expiry, inspection.ExpiresAt)
+	}
+
+	if len(inspection.Blocks) != 2 || len(inspection.RevocationIds) != 2 {
+		t.Fatalf("expected 2 blocks and revocation ids, got %d and %d", len(inspection.Blocks), len(inspection.RevocationIds))
+	}
+	authority := strings.Join(inspection.Blocks[0].Facts, "\n")
+	if !strings.Contains(authority, `user("userid:4")`) {
+		t.Errorf("expected the authority facts to name the user, got %s", authority)
+	}
+	if inspection.Blocks[1].Context != "read Charlie" || len(inspection.Blocks[1].Checks) != 3 {
+		t.Errorf("expected the attenuation block with its context and 3 checks, got %+v", inspection.Blocks[1])
+	}
+	for i, block := range inspection.Blocks {
+		if block.Index != i || block.RevocationId != inspection.RevocationIds[i] {
+			t.Errorf("block %d has index %d and revocation id %s, expected %s", i, block.Index, block.RevocationId, inspection.RevocationIds[i])
+		}
+	}
+}
+
+// TestInspectNotBefore checks that inspection reports the not-before time of a token issued for later.
+func TestInspectNotBefore(t *testing.T) {
+	_, tokenIssuer := testSetup(t)
+	notBefore := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	token, err := tokenIssuer.IssueTokenWithOptions(4, IssueOptions{NotBefore: notBefore, TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	inspection, err := Inspect(token, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("Inspect: %s", err)
+	}
+	if inspection.NotBefore == nil || !inspection.NotBefore.Equal(notBefore) {
+		t.Errorf("expected not-before %s, got %v", notBefore, inspection.NotBefore)
+	}
+	if inspection.ExpiresAt == nil || !inspection.ExpiresAt.Equal(notBefore.Add(time.Hour)) {
+		t.Errorf("expected expiry %s, got %v", notBefore.Add(time.Hour), inspection.ExpiresAt)
+	}
+	if inspection.Actions != nil || inspection.Repos != nil {
+		t.Errorf("expected an unrestricted token to report no action or repo restriction, got %v and %v", inspection.Actions, inspection.Repos)
+	}
+}
+
+// TestInspectVerification checks that a token signed by another root key is refused when a root key is given, and is only inspected unverified without one.
+func TestInspectVerification(t *testing.T) {
+	_, tokenIssuer := testSetup(t)
+	otherIssuer, err := NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	token, err := otherIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+
+	_, err = Inspect(token, tokenIssuer.PublicRoot)
+	if err == nil {
+		t.Errorf("expected a token signed by another key to be refused")
+	}
+	inspection, err := Inspect(token, nil)
+	if err != nil {
+		t.Fatalf("Inspect: %s", err)
+	}
+	if inspection.Verified || inspection.KeyId != "" {
+		t.Errorf("expected an unverified inspection, got verified %t and key %s", inspection.Verified, inspection.KeyId)
+	}
+}
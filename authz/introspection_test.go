@@ -0,0 +1,153 @@
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+)
+
+// introspect introspects token at now, failing the test if no decision could be made.
+func introspect(t *testing.T, tokenIssuer *TokenIssuer, token *biscuit.Biscuit, now time.Time) *Introspection {
+	t.Helper()
+	introspection, err := Introspect(token, tokenIssuer.PublicRoot, now)
+	if err != nil {
+		t.Fatalf("Introspect: %s", err)
+	}
+	return introspection
+}
+
+// expectInactive fails the test unless introspection is an inactive response, which reveals nothing else about the token.
+func expectInactive(t *testing.T, name string, introspection *Introspection) {
+	t.Helper()
+	if introspection.Active || introspection.Subject != "" || introspection.TokenId != "" || introspection.ExpiresAt != 0 {
+		t.Errorf("%s: expected a bare inactive response, got %+v", name, introspection)
+	}
+}
+
+// TestIntrospectActive checks that an active token reports its subject, scope and validity.
+func TestIntrospectActive(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.Ledger = dbInstance
+	useRevocationStore(t, dbInstance)
+
+	token, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{
+		Name:    "laptop",
+		Repos:   []int{3},
+		Actions: []string{"read"},
+		TTL:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("IssuePersonalAccessToken: %s", err)
+	}
+	tokenId, err := TokenId(token, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("TokenId: %s", err)
+	}
+	now := time.Now()
+	introspection := introspect(t, tokenIssuer, token, now)
+	if !introspection.Active || introspection.TokenType != introspectionTokenType {
+		t.Fatalf("expected an active %s token, got %+v", introspectionTokenType, introspection)
+	}
+	if introspection.Subject != "userid:4" || introspection.TokenId != tokenId || introspection.KeyId != tokenIssuer.KeyId {
+		t.Errorf("expected subject userid:4, token id %s and key %s, got %+v", tokenId, tokenIssuer.KeyId, introspection)
+	}
+	if introspection.Scope != "read" || len(introspection.Repos) != 1 || introspection.Repos[0] != 3 {
+		t.Errorf("expected scope read on repo 3, got %q on %v", introspection.Scope, introspection.Repos)
+	}
+	if introspection.IssuedAt > now.Unix() || introspection.ExpiresAt <= now.Unix() || introspection.ExpiresAt > now.Add(time.Hour).Unix() {
+		t.Errorf("expected issuance before now and expiry within the hour, got iat %d and exp %d", introspection.IssuedAt, introspection.ExpiresAt)
+	}
+
+	serviceToken, err := tokenIssuer.IssueServiceToken(1, IssueOptions{})
+	if err != nil {
+		t.Fatalf("IssueServiceToken: %s", err)
+	}
+	introspection = introspect(t, tokenIssuer, serviceToken, now)
+	if !introspection.Active || introspection.Subject != "svc:1" {
+		t.Errorf("expected an active token for svc:1, got %+v", introspection)
+	}
+}
+
+// TestIntrospectInactive checks that expired, not yet valid, revoked and forged tokens, and tokens whose restrictions leave nothing usable, are all reported inactive.
+func TestIntrospectInactive(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	useRevocationStore(t, dbInstance)
+	now := time.Now()
+
+	token, err := tokenIssuer.IssueTokenWithOptions(4, IssueOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	expectInactive(t, "expired", introspect(t, tokenIssuer, token, now.Add(2*time.Hour)))
+
+	notYetValid, err := tokenIssuer.IssueTokenWithOptions(4, IssueOptions{NotBefore: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	expectInactive(t, "not yet valid", introspect(t, tokenIssuer, notYetValid, now))
+
+	// Attenuated expiry counts as well as the issued one
+	attenuation := NewAttenuation()
+	if err := attenuation.ExpiresAt(now.Add(time.Minute)); err != nil {
+		t.Fatalf("ExpiresAt: %s", err)
+	}
+	shortened, err := attenuation.Apply(token)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	expectInactive(t, "expired by attenuation", introspect(t, tokenIssuer, shortened, now.Add(2*time.Minute)))
+
+	revoked, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	err = dbInstance.RevokeIds(TokenRevocationIds(revoked, true), time.Time{}, "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIds: %s", err)
+	}
+	expectInactive(t, "revoked", introspect(t, tokenIssuer, revoked, now))
+
+	userRevoked, err := tokenIssuer.IssueToken(3)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	err = dbInstance.RevokeUser(3, "left the org")
+	if err != nil {
+		t.Fatalf("RevokeUser: %s", err)
+	}
+	expectInactive(t, "user revoked", introspect(t, tokenIssuer, userRevoked, now))
+
+	forgingIssuer, err := NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	forged, err := forgingIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	expectInactive(t, "forged", introspect(t, tokenIssuer, forged, now))
+
+	disjoint := NewAttenuation()
+	if err := disjoint.RestrictToRepos(2); err != nil {
+		t.Fatalf("RestrictToRepos: %s", err)
+	}
+	narrowed, err := disjoint.Apply(token)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	disjoint = NewAttenuation()
+	if err := disjoint.RestrictToRepos(3); err != nil {
+		t.Fatalf("RestrictToRepos: %s", err)
+	}
+	unusable, err := disjoint.Apply(narrowed)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	expectInactive(t, "no usable repos", introspect(t, tokenIssuer, unusable, now))
+
+	// The token itself is still active
+	if !introspect(t, tokenIssuer, token, now).Active {
+		t.Errorf("expected the unrevoked, unexpired token to be active")
+	}
+}
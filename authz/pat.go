@@ -0,0 +1,141 @@
+package authz
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+)
+
+// patKind is the ledger kind of personal access tokens.
+const patKind = "pat"
+
+// manageTokensStr is the action checked when a token is used to manage the user's tokens. It is never a repo action, so any token restricted to repo actions, including every personal access token, cannot manage tokens.
+const manageTokensStr = "manage_tokens"
+
+// PersonalAccessToken describes a named, scoped token a user creates for a laptop, CI system or IDE.
+type PersonalAccessToken struct {
+	// Name is shown to the user when listing their tokens
+	Name string `json:"name"`
+	// Repos are the repo ids the token is restricted to. Empty means every repo the user can access.
+	Repos []int `json:"repos"`
+	// Actions are the actions the token is restricted to. Empty means every repo action, which still excludes managing tokens.
+	Actions []string `json:"actions"`
+	// TTL is how long the token is valid for. Personal access tokens always expire, so zero is only accepted when the issuer has a default TTL or a MaxLifetime.
+	TTL time.Duration `json:"-"`
+}
+
+// IssuePersonalAccessToken issues a token for userId restricted to pat's scope. The scope and expiry are checks in the authority block, so they cannot be removed, and the token is recorded in the issuer's ledger with its name.
+func (tokenIssuer *TokenIssuer) IssuePersonalAccessToken(userId int, pat *PersonalAccessToken) (*biscuit.Biscuit, error) {
+	if strings.TrimSpace(pat.Name) == "" {
+		return nil, fmt.Errorf("personal access tokens require a name")
+	}
+	if pat.TTL <= 0 && tokenIssuer.DefaultOptions.TTL <= 0 && tokenIssuer.MaxLifetime == 0 {
+		return nil, fmt.Errorf("personal access tokens require an expiry")
+	}
+	if tokenIssuer.Ledger == nil {
+		return nil, fmt.Errorf("personal access tokens require an issuer with a ledger")
+	}
+
+	scope := NewAttenuation()
+	scopeDescriptions := []string{}
+	if len(pat.Repos) > 0 {
+		err := scope.RestrictToRepos(pat.Repos...)
+		if err != nil {
+			return nil, fmt.Errorf("error when restricting repos: %w", err)
+		}
+		repoStrs := []string{}
+		for _, repoId := range pat.Repos {
+			repoStrs = append(repoStrs, strconv.Itoa(repoId))
+		}
+		scopeDescriptions = append(scopeDescriptions, "repos="+strings.Join(repoStrs, ","))
+	}
+
+	actionStrs := pat.Actions
+	if len(actionStrs) == 0 {
+		actionStrs = []string{membershipStr, readStr, writeStr}
+	}
+	actionsDescription, err := restrictScopeActions(scope, actionStrs)
+	if err != nil {
+		return nil, err
+	}
+	scopeDescriptions = append(scopeDescriptions, actionsDescription)
+
+	return tokenIssuer.IssueTokenWithOptions(userId, IssueOptions{
+		TTL:              pat.TTL,
+		Name:             pat.Name,
+		Kind:             patKind,
+		Scope:            scope,
+		ScopeDescription: strings.Join(scopeDescriptions, " "),
+	})
+}
+
+// restrictScopeActions restricts scope, the authority checks of a token being issued, to actionStrs and returns the restriction's description for the ledger. Tokens issued on behalf of another token, like personal access tokens and exchanged tokens, always have their actions restricted, even to every repo action, as the restriction fails the token management operation AuthenticateTokenManagement checks, so they can never be used to manage tokens.
+func restrictScopeActions(scope *Attenuation, actionStrs []string) (string, error) {
+	actions := []Action{}
+	for _, actionStr := range actionStrs {
+		action, err := ParseAction(actionStr)
+		if err != nil {
+			return "", fmt.Errorf("error when parsing action: %w", err)
+		}
+		actions = append(actions, action)
+	}
+	err := scope.RestrictToActions(actions...)
+	if err != nil {
+		return "", fmt.Errorf("error when restricting actions: %w", err)
+	}
+	return "actions=" + strings.Join(actionStrs, ","), nil
+}
+
+// AuthenticateTokenManagement verifies token and returns the user it was issued to, if the token may be used to manage that user's tokens. Revoked tokens, personal access tokens, service account tokens and tokens attenuated to repo actions are refused.
+func AuthenticateTokenManagement(token *biscuit.Biscuit, publicRoot ed25519.PublicKey) (int, error) {
+	authorizer, err := token.Authorizer(publicRoot, authorizerOptions...)
+	if err != nil {
+		return 0, fmt.Errorf("error when verifying token and creating authorizer: %w", err)
+	}
+	err = checkRevocation(token, publicRoot)
+	if err != nil {
+		return 0, err
+	}
+	issuances, err := readIssuance(token, publicRoot)
+	if err != nil {
+		return 0, fmt.Errorf("error when reading token issuance: %w", err)
+	}
+	if len(issuances) != 1 {
+		return 0, fmt.Errorf("token must be issued to exactly one user, found %d", len(issuances))
+	}
+	if issuances[0].userId == 0 {
+		return 0, fmt.Errorf("service account tokens cannot manage tokens")
+	}
+
+	authorizer.AddFact(newFact("time", biscuit.Date(time.Now().UTC().Truncate(time.Second))))
+	authorizer.AddFact(newFact("operation",
+		biscuit.String(namespaceAction(manageTokensStr)),
+		biscuit.String(namespaceUser(issuances[0].userId)),
+	))
+	policy, err := datalogParser.Policy(`allow if user($user)`, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error when parsing token management policy: %w", err)
+	}
+	authorizer.AddPolicy(policy)
+	err = authorizer.Authorize()
+	if err != nil {
+		return 0, fmt.Errorf("token may not manage tokens: %w", err)
+	}
+	return issuances[0].userId, nil
+}
+
+// TokenId verifies token and returns the id recorded in its token_id authority fact, which is its key in the issuance ledger.
+func TokenId(token *biscuit.Biscuit, publicRoot ed25519.PublicKey) (string, error) {
+	issuances, err := readIssuance(token, publicRoot)
+	if err != nil {
+		return "", fmt.Errorf("error when reading token issuance: %w", err)
+	}
+	if len(issuances) == 0 || issuances[0].tokenId == "" {
+		return "", fmt.Errorf("token has no token_id")
+	}
+	return issuances[0].tokenId, nil
+}
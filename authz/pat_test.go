@@ -0,0 +1,162 @@
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+)
+
+// TestPersonalAccessTokenScope checks that a personal access token only allows the repos and actions of its scope, and is recorded in the ledger with its name, scope and expiry.
+func TestPersonalAccessTokenScope(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.Ledger = dbInstance
+
+	token, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{
+		Name:    "laptop",
+		Repos:   []int{2},
+		Actions: []string{"read"},
+		TTL:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("IssuePersonalAccessToken: %s", err)
+	}
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, token, testRequest{user: 4, repo: "Bravo", action: Read})
+	if !hasPermission {
+		t.Errorf("expected reading Bravo to be allowed: %s", err)
+	}
+	for _, request := range []testRequest{
+		{user: 4, repo: "Bravo", action: Write},
+		{user: 4, repo: "Charlie", action: Read},
+	} {
+		hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, token, request)
+		if hasPermission {
+			t.Errorf("expected %+v to be denied", request)
+		}
+	}
+
+	tokenId, err := TokenId(token, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("TokenId: %s", err)
+	}
+	issuedToken, err := dbInstance.GetIssuedToken(tokenId)
+	if err != nil {
+		t.Fatalf("GetIssuedToken: %s", err)
+	}
+	if issuedToken.UserId != 4 || issuedToken.Name != "laptop" || issuedToken.Kind != patKind || issuedToken.Scope != "repos=2 actions=read" {
+		t.Errorf("unexpected ledger entry %+v", issuedToken)
+	}
+	if issuedToken.ExpiresAt.IsZero() || issuedToken.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expected the ledger entry to expire within the hour, got %s", issuedToken.ExpiresAt)
+	}
+}
+
+// TestPersonalAccessTokenScopeIsAuthority checks that the scope of a personal access token is part of its authority block, so the token has no attenuation block which could be stripped.
+func TestPersonalAccessTokenScopeIsAuthority(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.Ledger = dbInstance
+
+	token, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{Name: "ci", Repos: []int{3}, TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("IssuePersonalAccessToken: %s", err)
+	}
+	if token.BlockCount() != 0 {
+		t.Errorf("expected only an authority block, got %d more blocks", token.BlockCount())
+	}
+	hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, token, testRequest{user: 4, repo: "Bravo", action: Read})
+	if hasPermission {
+		t.Errorf("expected the token to be restricted to repo 3")
+	}
+}
+
+// TestTokenManagement checks that only unrestricted user tokens may manage tokens: personal access tokens, whatever their scope, service account tokens, tokens attenuated to repo actions and revoked tokens are refused.
+func TestTokenManagement(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.Ledger = dbInstance
+	useRevocationStore(t, dbInstance)
+
+	userToken, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	userId, err := AuthenticateTokenManagement(userToken, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("expected a user token to manage tokens: %s", err)
+	}
+	if userId != 4 {
+		t.Errorf("expected user 4, got %d", userId)
+	}
+
+	unscopedPAT, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{Name: "everything", TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("IssuePersonalAccessToken: %s", err)
+	}
+	scopedPAT, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{Name: "read", Actions: []string{"read"}, TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("IssuePersonalAccessToken: %s", err)
+	}
+	serviceToken, err := tokenIssuer.IssueServiceToken(1, IssueOptions{})
+	if err != nil {
+		t.Fatalf("IssueServiceToken: %s", err)
+	}
+	attenuation := NewAttenuation()
+	if err := attenuation.RestrictToActions(Read, Write, Membership); err != nil {
+		t.Fatalf("RestrictToActions: %s", err)
+	}
+	attenuated, err := attenuation.Apply(userToken)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	revokedToken, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	err = dbInstance.RevokeIds(TokenRevocationIds(revokedToken, true), time.Time{}, "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIds: %s", err)
+	}
+
+	for name, token := range map[string]*biscuit.Biscuit{
+		"unscoped personal access token": unscopedPAT,
+		"scoped personal access token":   scopedPAT,
+		"service account token":          serviceToken,
+		"attenuated token":               attenuated,
+		"revoked token":                  revokedToken,
+	} {
+		_, err := AuthenticateTokenManagement(token, tokenIssuer.PublicRoot)
+		if err == nil {
+			t.Errorf("expected a %s to be refused token management", name)
+		}
+	}
+}
+
+// TestPersonalAccessTokenValidation checks that personal access tokens without a name or an expiry, or with an invalid scope, are not issued.
+func TestPersonalAccessTokenValidation(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.Ledger = dbInstance
+
+	for name, pat := range map[string]*PersonalAccessToken{
+		"no name":        {Name: " ", TTL: time.Hour},
+		"no expiry":      {Name: "laptop"},
+		"unknown action": {Name: "laptop", Actions: []string{"admin"}, TTL: time.Hour},
+		"invalid repo":   {Name: "laptop", Repos: []int{0}, TTL: time.Hour},
+	} {
+		_, err := tokenIssuer.IssuePersonalAccessToken(4, pat)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// An issuer wide lifetime is expiry enough
+	tokenIssuer.MaxLifetime = time.Hour
+	_, err := tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{Name: "laptop"})
+	if err != nil {
+		t.Errorf("expected the max lifetime to serve as the expiry: %s", err)
+	}
+
+	tokenIssuer.Ledger = nil
+	_, err = tokenIssuer.IssuePersonalAccessToken(4, &PersonalAccessToken{Name: "laptop", TTL: time.Hour})
+	if err == nil {
+		t.Errorf("expected an issuer without a ledger to refuse personal access tokens")
+	}
+}
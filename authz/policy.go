@@ -0,0 +1,150 @@
+package authz
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/parser"
+)
+
+//go:embed policy/forge.datalog
+var defaultPolicySource string
+
+// Policy is the set of authorizer rules and allow / deny policies CheckAuthz evaluates the request facts against.
+type Policy struct {
+	// Source is the datalog the policy was parsed from
+	Source string
+	// Path is the file the policy was loaded from, empty for the embedded default
+	Path string
+	// parsed is Source run through the biscuit parser
+	parsed biscuit.ParsedAuthorizer
+}
+
+// activePolicy is the policy used by CheckAuthz. It is swapped atomically so it can be reloaded while requests are in flight.
+var activePolicy atomic.Pointer[Policy]
+
+// datalogParser parses all the datalog in the package. The parser.FromString functions build the biscuit grammars afresh on every call, which costs more than authorizing a request, so they are built once here and shared.
+var datalogParser = parser.New()
+
+// parseAuthorizer wraps the biscuit authorizer parser, which panics on some inputs (biscuit-go v2.2.0 dereferences a nil allow block when given "deny if"), so that a bad policy file cannot take down the process on reload.
+func parseAuthorizer(source string) (parsed biscuit.ParsedAuthorizer, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("biscuit parser panicked: %v", recovered)
+		}
+	}()
+	return datalogParser.Authorizer(source, nil)
+}
+
+// ParsePolicy validates policySource with the biscuit parser and returns it as a Policy.
+func ParsePolicy(policySource string) (*Policy, error) {
+	parsed, err := parseAuthorizer(policySource)
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing policy: %w", err)
+	}
+	hasAllow := false
+	for _, policy := range parsed.Policies {
+		if policy.Kind == biscuit.PolicyKindAllow {
+			hasAllow = true
+		}
+	}
+	if !hasAllow {
+		// Without an allow policy every request is denied, which is more
+		// likely a broken file than an intentional lockout.
+		return nil, fmt.Errorf("policy has no allow policies")
+	}
+	if len(parsed.Block.Facts) != 0 {
+		return nil, fmt.Errorf("policy must not contain facts, found %d", len(parsed.Block.Facts))
+	}
+
+	policy := &Policy{
+		Source: policySource,
+		parsed: parsed,
+	}
+	return policy, nil
+}
+
+// DefaultPolicy returns the policy embedded in the binary.
+func DefaultPolicy() *Policy {
+	policy, err := ParsePolicy(defaultPolicySource)
+	if err != nil {
+		log.Fatalf("Embedded policy is invalid: %s", err.Error())
+	}
+	return policy
+}
+
+// LoadPolicy reads and validates the policy at policyPath. An empty policyPath loads the embedded default.
+func LoadPolicy(policyPath string) (*Policy, error) {
+	if policyPath == "" {
+		return DefaultPolicy(), nil
+	}
+	policyBytes, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile for %s: %w", policyPath, err)
+	}
+	policy, err := ParsePolicy(string(policyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error when validating %s: %w", policyPath, err)
+	}
+	policy.Path = policyPath
+	return policy, nil
+}
+
+// SetPolicy makes policy the one used by CheckAuthz.
+func SetPolicy(policy *Policy) {
+	activePolicy.Store(policy)
+}
+
+// GetPolicy returns the policy used by CheckAuthz, falling back to the embedded default if SetPolicy was never called.
+func GetPolicy() *Policy {
+	policy := activePolicy.Load()
+	if policy == nil {
+		policy = DefaultPolicy()
+		activePolicy.CompareAndSwap(nil, policy)
+	}
+	return policy
+}
+
+// reloadPolicy loads the policy at policyPath and makes it the active one. If it fails to load the active policy is left in place.
+func reloadPolicy(policyPath string) error {
+	policy, err := LoadPolicy(policyPath)
+	if err != nil {
+		return err
+	}
+	SetPolicy(policy)
+	return nil
+}
+
+// ReloadPolicyOnSIGHUP reloads the policy at policyPath each time the process receives SIGHUP. A policy which fails to load is logged and the previous policy is kept. The returned function stops watching for the signal.
+func ReloadPolicyOnSIGHUP(policyPath string) (stop func()) {
+	sigChan := make(chan os.Signal, 1)
+	doneChan := make(chan struct{})
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-sigChan:
+				err := reloadPolicy(policyPath)
+				if err != nil {
+					log.Printf("Keeping previous policy, reload failed: %s", err.Error())
+					continue
+				}
+				log.Printf("Reloaded policy from %q", policyPath)
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigChan)
+		close(doneChan)
+	}
+}
@@ -0,0 +1,162 @@
+package authz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"biscuitExample/dblogic"
+)
+
+// TestAllowNeedsOwnRole checks that a role held by someone else on the repo does not allow the request, so the allow policy must tie the role fact to the requesting user's and the repo's authority.
+func TestAllowNeedsOwnRole(t *testing.T) {
+	tokenIssuer, err := NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	token, err := tokenIssuer.IssueToken(5)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	reqDetails := &dblogic.RequestDetails{
+		UserId:                 5,
+		Username:               "Tony",
+		UsergroupRelationships: &dblogic.UsergroupRelationships{},
+		RepoId:                 3,
+		RepoName:               "Charlie",
+		AssignedRoles: []*dblogic.AssignedRole{
+			{UserOrGroup: dblogic.UserUGR, UserOrGroupID: 1, RepoOrGroup: dblogic.RepoUGR, RepoOrGroupID: 3, RepoRole: dblogic.OwnerRole},
+		},
+	}
+	for _, action := range []Action{Read, Write, Membership} {
+		hasPermission, err := CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, action)
+		if hasPermission || err == nil {
+			t.Errorf("action %d allowed through another user's role", action)
+		}
+	}
+
+	reqDetails.AssignedRoles[0].UserOrGroupID = 5
+	hasPermission, err := CheckAuthz(token, tokenIssuer.PublicRoot, reqDetails, Read)
+	if !hasPermission {
+		t.Errorf("read denied through the user's own role: %s", err)
+	}
+}
+
+// TestParsePolicy checks that ParsePolicy accepts the embedded policy and refuses policies carrying facts, policies without an allow policy, and datalog which makes the biscuit parser panic.
+func TestParsePolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		source  string
+		wantErr string
+	}{
+		{name: "embedded default", source: defaultPolicySource},
+		{name: "facts", source: "user(\"userid:1\");\nallow if true;", wantErr: "must not contain facts"},
+		{name: "no allow policy", source: "check if time($time);", wantErr: "no allow policies"},
+		{name: "parser panic", source: "deny if true;", wantErr: "panicked"},
+		{name: "syntax error", source: "allow if", wantErr: "error when parsing policy"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			policy, err := ParsePolicy(testCase.source)
+			if testCase.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParsePolicy: %s", err)
+				}
+				if policy.Source != testCase.source {
+					t.Errorf("expected the source to be kept")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), testCase.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", testCase.wantErr, err)
+			}
+		})
+	}
+}
+
+// writePolicy writes source to a policy file in a temporary directory and returns its path.
+func writePolicy(t *testing.T, source string) string {
+	t.Helper()
+	policyPath := filepath.Join(t.TempDir(), "forge.datalog")
+	err := os.WriteFile(policyPath, []byte(source), 0o600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	return policyPath
+}
+
+// keepPolicy restores the active policy when the test finishes.
+func keepPolicy(t *testing.T) {
+	t.Helper()
+	previous := GetPolicy()
+	t.Cleanup(func() { SetPolicy(previous) })
+}
+
+// TestLoadPolicy checks that an empty path loads the embedded default, a file is loaded with its path recorded, and a missing or invalid file is an error.
+func TestLoadPolicy(t *testing.T) {
+	policy, err := LoadPolicy("")
+	if err != nil {
+		t.Fatalf("LoadPolicy of the default: %s", err)
+	}
+	if policy.Source != defaultPolicySource || policy.Path != "" {
+		t.Errorf("expected the embedded default, got path %q", policy.Path)
+	}
+
+	policyPath := writePolicy(t, defaultPolicySource)
+	policy, err = LoadPolicy(policyPath)
+	if err != nil {
+		t.Fatalf("LoadPolicy of %s: %s", policyPath, err)
+	}
+	if policy.Path != policyPath {
+		t.Errorf("expected path %q, got %q", policyPath, policy.Path)
+	}
+
+	_, err = LoadPolicy(filepath.Join(t.TempDir(), "missing.datalog"))
+	if err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	_, err = LoadPolicy(writePolicy(t, "check if time($time);"))
+	if err == nil {
+		t.Errorf("expected an error for a policy without an allow policy")
+	}
+}
+
+// TestReloadPolicy checks that a reload which fails keeps the previous policy, and that SIGHUP reloads the file once it is fixed.
+func TestReloadPolicy(t *testing.T) {
+	keepPolicy(t)
+	previous, err := ParsePolicy(defaultPolicySource)
+	if err != nil {
+		t.Fatalf("ParsePolicy: %s", err)
+	}
+	SetPolicy(previous)
+
+	policyPath := writePolicy(t, "deny if true;")
+	err = reloadPolicy(policyPath)
+	if err == nil {
+		t.Fatalf("expected the reload of a broken policy to fail")
+	}
+	if GetPolicy() != previous {
+		t.Fatalf("expected the previous policy to be kept")
+	}
+
+	stop := ReloadPolicyOnSIGHUP(policyPath)
+	defer stop()
+	err = os.WriteFile(policyPath, []byte(defaultPolicySource), 0o600)
+	if err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if err != nil {
+		t.Fatalf("Kill: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for GetPolicy().Path != policyPath {
+		if time.Now().After(deadline) {
+			t.Fatalf("policy was not reloaded on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,73 @@
+package authz
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/parser"
+	"golang.org/x/crypto/ssh"
+)
+
+// possessionCheck requires the client to have proved it holds the key with the given fingerprint. Transports add a possession fact for each key the client signed a challenge with.
+const possessionCheck = `check if possession({key})`
+
+// fingerprintPrefix starts every OpenSSH SHA256 fingerprint, which is how keys are named in possession facts.
+const fingerprintPrefix = "SHA256:"
+
+// KeyFingerprint returns the OpenSSH SHA256 fingerprint naming a key in possession facts. key is either a fingerprint, which is returned as is, or a public key in authorized_keys format such as the contents of id_ed25519.pub.
+func KeyFingerprint(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if strings.HasPrefix(key, fingerprintPrefix) {
+		return key, nil
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", fmt.Errorf("error when parsing public key: %w", err)
+	}
+	return ssh.FingerprintSHA256(publicKey), nil
+}
+
+// Ed25519Fingerprint returns the fingerprint naming a raw ed25519 public key in possession facts, which is the same as the fingerprint of the key in SSH form.
+func Ed25519Fingerprint(publicKey ed25519.PublicKey) (string, error) {
+	sshKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("error when converting ed25519 key: %w", err)
+	}
+	return ssh.FingerprintSHA256(sshKey), nil
+}
+
+// newPossessionCheck builds the check binding a token to the key with fingerprint.
+func newPossessionCheck(fingerprint string) (biscuit.Check, error) {
+	if !strings.HasPrefix(fingerprint, fingerprintPrefix) {
+		return biscuit.Check{}, fmt.Errorf("invalid key fingerprint: %s", fingerprint)
+	}
+	check, err := datalogParser.Check(possessionCheck, parser.ParametersMap{"key": biscuit.String(fingerprint)})
+	if err != nil {
+		return biscuit.Check{}, fmt.Errorf("error when parsing possession check: %w", err)
+	}
+	return check, nil
+}
+
+// BindToKey restricts the token to clients which prove they hold the key with fingerprint, so a holder can bind a token to a runner's key before handing it over.
+func (attenuation *Attenuation) BindToKey(fingerprint string) error {
+	check, err := newPossessionCheck(fingerprint)
+	if err != nil {
+		return err
+	}
+	attenuation.checks = append(attenuation.checks, check)
+	return nil
+}
+
+// TokenPrincipal verifies token and returns the user or service account it was issued to; the other id is 0. Transports which accept tokens from clients use it to gather the request details to authorize the token against.
+func TokenPrincipal(token *biscuit.Biscuit, publicRoot ed25519.PublicKey) (int, int, error) {
+	issuances, err := readIssuance(token, publicRoot)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error when reading token issuance: %w", err)
+	}
+	if len(issuances) != 1 {
+		return 0, 0, fmt.Errorf("token must be issued to exactly one principal, found %d", len(issuances))
+	}
+	return issuances[0].userId, issuances[0].serviceAccountId, nil
+}
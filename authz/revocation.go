@@ -0,0 +1,198 @@
+package authz
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+)
+
+// ErrRevoked is returned when a token, or every token of its user, has been revoked.
+var ErrRevoked = errors.New("token has been revoked")
+
+// RevocationStore is consulted after a token's signatures are verified and before the policy is evaluated. dblogic.DBInstance implements it.
+type RevocationStore interface {
+	// IsRevoked reports whether any of revocationIds has been revoked, or whether the user's tokens issued at or before issuedAt have been revoked. issuedAt is zero for tokens which do not record it.
+	IsRevoked(revocationIds [][]byte, userId int, issuedAt time.Time) (bool, error)
+}
+
+var (
+	revocationStoreMu sync.RWMutex
+	// revocationStore is the store checked by CheckAuthz and ExplainAuthz, nil to skip revocation checks
+	revocationStore RevocationStore
+)
+
+// SetRevocationStore sets the store tokens are checked against. Passing nil disables revocation checks.
+func SetRevocationStore(store RevocationStore) {
+	revocationStoreMu.Lock()
+	defer revocationStoreMu.Unlock()
+	revocationStore = store
+}
+
+// getRevocationStore returns the store set by SetRevocationStore.
+func getRevocationStore() RevocationStore {
+	revocationStoreMu.RLock()
+	defer revocationStoreMu.RUnlock()
+	return revocationStore
+}
+
+// tokenIssuance is who a token was issued to and when, as recorded in its authority block. Exactly one of userId and serviceAccountId is set.
+type tokenIssuance struct {
+	userId           int
+	serviceAccountId int
+	issuedAt         time.Time
+	tokenId          string
+}
+
+// The issuance queries read the user, service, issued_at and token_id facts of a token. They are parsed once rather than for every token read.
+var (
+	userIssuanceQuery     = datalogParser.Must().Rule(`issuance($user) <- user($user)`, nil)
+	serviceIssuanceQuery  = datalogParser.Must().Rule(`issuance($service) <- service($service)`, nil)
+	issuedAtIssuanceQuery = datalogParser.Must().Rule(`issuance($time) <- issued_at($time)`, nil)
+	tokenIdIssuanceQuery  = datalogParser.Must().Rule(`issuance($id) <- token_id($id)`, nil)
+)
+
+// readIssuance reads the user, service, issued_at and token_id facts from the authority block of token.
+func readIssuance(token *biscuit.Biscuit, publicRoot ed25519.PublicKey) ([]*tokenIssuance, error) {
+	authorizer, err := token.Authorizer(publicRoot, authorizerOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("error when verifying token and creating authorizer: %w", err)
+	}
+	return queryIssuance(authorizer)
+}
+
+// queryIssuance reads the issuance facts of the token authorizer was created for. Facts are only loaded into the authorizer world by Authorize, so authorizer, which must be a fresh one, is run without a policy and thrown away afterwards; its denial is expected and ignored. Facts from attenuation blocks never reach this world, so they cannot change the result.
+func queryIssuance(authorizer biscuit.Authorizer) ([]*tokenIssuance, error) {
+	authorizer.Authorize()
+
+	userFacts, err := authorizer.Query(userIssuanceQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying token user: %w", err)
+	}
+	serviceFacts, err := authorizer.Query(serviceIssuanceQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying token service: %w", err)
+	}
+	issuedAtFacts, err := authorizer.Query(issuedAtIssuanceQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying token issued_at: %w", err)
+	}
+
+	tokenIdFacts, err := authorizer.Query(tokenIdIssuanceQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying token token_id: %w", err)
+	}
+
+	tokenId := ""
+	for _, fact := range tokenIdFacts {
+		tokenIdStr, ok := fact.Predicate.IDs[0].(biscuit.String)
+		if !ok {
+			return nil, fmt.Errorf("token_id is not a string: %s", fact.Predicate.IDs[0])
+		}
+		tokenId = string(tokenIdStr)
+	}
+	issuedAt := time.Time{}
+	for _, fact := range issuedAtFacts {
+		date, ok := fact.Predicate.IDs[0].(biscuit.Date)
+		if !ok {
+			return nil, fmt.Errorf("issued_at is not a date: %s", fact.Predicate.IDs[0])
+		}
+		issuedAt = time.Time(date)
+	}
+
+	issuances := []*tokenIssuance{}
+	for _, fact := range userFacts {
+		userStr, ok := fact.Predicate.IDs[0].(biscuit.String)
+		if !ok {
+			return nil, fmt.Errorf("user is not a string: %s", fact.Predicate.IDs[0])
+		}
+		namespace, userId, err := splitNamespaced(string(userStr))
+		if err != nil || namespace != userNS {
+			return nil, fmt.Errorf("unexpected token user: %s", userStr)
+		}
+		issuances = append(issuances, &tokenIssuance{userId: userId, issuedAt: issuedAt, tokenId: tokenId})
+	}
+	for _, fact := range serviceFacts {
+		serviceStr, ok := fact.Predicate.IDs[0].(biscuit.String)
+		if !ok {
+			return nil, fmt.Errorf("service is not a string: %s", fact.Predicate.IDs[0])
+		}
+		namespace, serviceAccountId, err := splitNamespaced(string(serviceStr))
+		if err != nil || namespace != svcNS {
+			return nil, fmt.Errorf("unexpected token service: %s", serviceStr)
+		}
+		issuances = append(issuances, &tokenIssuance{serviceAccountId: serviceAccountId, issuedAt: issuedAt, tokenId: tokenId})
+	}
+	return issuances, nil
+}
+
+// checkRevocation returns ErrRevoked if any block of token, or its user, has been revoked in the active revocation store. Service account tokens can only be revoked by revocation id.
+func checkRevocation(token *biscuit.Biscuit, publicRoot ed25519.PublicKey) error {
+	store := getRevocationStore()
+	if store == nil {
+		return nil
+	}
+	issuances, err := readIssuance(token, publicRoot)
+	if err != nil {
+		return fmt.Errorf("error when reading token issuance: %w", err)
+	}
+	return checkIssuanceRevocation(store, token, issuances)
+}
+
+// checkIssuanceRevocation is checkRevocation for a token whose issuances have already been read.
+func checkIssuanceRevocation(store RevocationStore, token *biscuit.Biscuit, issuances []*tokenIssuance) error {
+	if len(issuances) == 0 {
+		// Still check the revocation ids of tokens without a principal
+		issuances = append(issuances, &tokenIssuance{})
+	}
+	for _, issuance := range issuances {
+		revoked, err := store.IsRevoked(token.RevocationIds(), issuance.userId, issuance.issuedAt)
+		if err != nil {
+			return fmt.Errorf("error when checking revocation: %w", err)
+		}
+		if revoked {
+			return ErrRevoked
+		}
+	}
+	return nil
+}
+
+// TokenRevocationIds returns the hex encoded revocation ids to revoke token by. Only the last block's id is returned, which refuses token and any token attenuated from it while leaving the tokens it was attenuated from valid. With allBlocks every block's id is returned, including the authority block's, which refuses every token derived from the same issued token.
+func TokenRevocationIds(token *biscuit.Biscuit, allBlocks bool) []string {
+	blockIds := token.RevocationIds()
+	if !allBlocks {
+		blockIds = blockIds[len(blockIds)-1:]
+	}
+	revocationIds := []string{}
+	for _, blockId := range blockIds {
+		revocationIds = append(revocationIds, hex.EncodeToString(blockId))
+	}
+	return revocationIds
+}
+
+// EncodeToken serializes token as URL safe base64, the form tokens are passed around in.
+func EncodeToken(token *biscuit.Biscuit) (string, error) {
+	serialized, err := token.Serialize()
+	if err != nil {
+		return "", fmt.Errorf("error when serializing token: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(serialized), nil
+}
+
+// DecodeToken is the inverse of EncodeToken. The token's signatures are not verified.
+func DecodeToken(encoded string) (*biscuit.Biscuit, error) {
+	serialized, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding token: %w", err)
+	}
+	token, err := biscuit.Unmarshal(serialized)
+	if err != nil {
+		return nil, fmt.Errorf("error when unmarshalling token: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,144 @@
+package authz
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+)
+
+// useRevocationStore makes CheckAuthz consult store for the rest of the test.
+func useRevocationStore(t *testing.T, store RevocationStore) {
+	t.Helper()
+	SetRevocationStore(store)
+	t.Cleanup(func() { SetRevocationStore(nil) })
+}
+
+// TestRevokeById checks that revoking a block refuses the token holding it and every token derived from it, and leaves other tokens and the block's parent alone.
+func TestRevokeById(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	useRevocationStore(t, dbInstance)
+	request := testRequest{user: 4, repo: "Charlie", action: Read}
+
+	parent, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	other, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	attenuation := NewAttenuation()
+	if err := attenuation.RestrictToActions(Read); err != nil {
+		t.Fatalf("RestrictToActions: %s", err)
+	}
+	child, err := attenuation.Apply(parent)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+
+	// Revoking the attenuation block only refuses the child
+	err = dbInstance.RevokeIds(TokenRevocationIds(child, false), time.Time{}, "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIds: %s", err)
+	}
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, child, request)
+	if hasPermission || !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected the child token to be refused as revoked, got %t and %v", hasPermission, err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, parent, request)
+	if !hasPermission {
+		t.Errorf("expected the parent token to be accepted: %s", err)
+	}
+
+	// Revoking the authority block refuses the parent, but not other tokens
+	err = dbInstance.RevokeIds(TokenRevocationIds(parent, true), time.Time{}, "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIds: %s", err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, parent, request)
+	if hasPermission || !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected the parent token to be refused as revoked, got %t and %v", hasPermission, err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, other, request)
+	if !hasPermission {
+		t.Errorf("expected another token of the same user to be accepted: %s", err)
+	}
+}
+
+// TestRevokeServiceTokenById checks that a service account token, which cannot be revoked by user, is refused once revoked by id.
+func TestRevokeServiceTokenById(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	useRevocationStore(t, dbInstance)
+	request := testRequest{service: 2, repo: "Alpha", action: Read}
+
+	token, err := tokenIssuer.IssueServiceToken(2, IssueOptions{})
+	if err != nil {
+		t.Fatalf("IssueServiceToken: %s", err)
+	}
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, token, request)
+	if !hasPermission {
+		t.Fatalf("expected the service token to be accepted: %s", err)
+	}
+	err = dbInstance.RevokeIds(TokenRevocationIds(token, true), time.Time{}, "rotated")
+	if err != nil {
+		t.Fatalf("RevokeIds: %s", err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, token, request)
+	if hasPermission || !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected the service token to be refused as revoked, got %t and %v", hasPermission, err)
+	}
+}
+
+// TestRevokeUser checks that revoking a user refuses every token issued to them so far, including attenuated ones, while other users' tokens and tokens issued to the user afterwards are accepted.
+func TestRevokeUser(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	useRevocationStore(t, dbInstance)
+	liamRequest := testRequest{user: 4, repo: "Charlie", action: Read}
+	emmaRequest := testRequest{user: 3, repo: "Charlie", action: Read}
+
+	liamToken, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	attenuation := NewAttenuation()
+	if err := attenuation.RestrictToRepos(3); err != nil {
+		t.Fatalf("RestrictToRepos: %s", err)
+	}
+	liamChild, err := attenuation.Apply(liamToken)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	emmaToken, err := tokenIssuer.IssueToken(3)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+
+	err = dbInstance.RevokeUser(4, "left the org")
+	if err != nil {
+		t.Fatalf("RevokeUser: %s", err)
+	}
+	for _, token := range []*biscuit.Biscuit{liamToken, liamChild} {
+		hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, token, liamRequest)
+		if hasPermission || !errors.Is(err, ErrRevoked) {
+			t.Errorf("expected Liam's token to be refused as revoked, got %t and %v", hasPermission, err)
+		}
+	}
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, emmaToken, emmaRequest)
+	if !hasPermission {
+		t.Errorf("expected Emma's token to be accepted: %s", err)
+	}
+
+	// Issuance times are recorded to the second, and a token issued in the
+	// same second as the revocation is revoked with it
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	newToken, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, newToken, liamRequest)
+	if !hasPermission {
+		t.Errorf("expected a token issued after the revocation to be accepted: %s", err)
+	}
+}
@@ -0,0 +1,36 @@
+package authz
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+)
+
+// SealBiscuit seals token so that no more blocks can be appended to it, by attenuation or attestation. The token stays verifiable with the same root key.
+func SealBiscuit(token *biscuit.Biscuit) (*biscuit.Biscuit, error) {
+	sealed, err := IsSealed(token)
+	if err != nil {
+		return nil, err
+	}
+	if sealed {
+		return nil, fmt.Errorf("token is already sealed")
+	}
+	sealedToken, err := token.Seal(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error when sealing token: %w", err)
+	}
+	return sealedToken, nil
+}
+
+// IsSealed reports whether token has been sealed. The seal's signature is verified along with the rest of the token when an authorizer is created, which is when newAuthorizer supplies the sealed fact.
+func IsSealed(token *biscuit.Biscuit) (bool, error) {
+	container, err := decodeContainer(token)
+	if err != nil {
+		return false, err
+	}
+	return container.Proof.GetFinalSignature() != nil, nil
+}
+
+// sealedCheck is added to the authority block of tokens whose kind the issuer requires to be sealed.
+const sealedCheck = `check if sealed(true)`
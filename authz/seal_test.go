@@ -0,0 +1,106 @@
+package authz
+
+import "testing"
+
+// TestSealBiscuit checks that a sealed token is still accepted but can no longer be attenuated or sealed again.
+func TestSealBiscuit(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	request := testRequest{user: 4, repo: "Charlie", action: Read}
+
+	token, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	sealed, err := IsSealed(token)
+	if err != nil {
+		t.Fatalf("IsSealed: %s", err)
+	}
+	if sealed {
+		t.Fatalf("expected an issued token not to be sealed")
+	}
+
+	sealedToken, err := SealBiscuit(token)
+	if err != nil {
+		t.Fatalf("SealBiscuit: %s", err)
+	}
+	sealed, err = IsSealed(sealedToken)
+	if err != nil {
+		t.Fatalf("IsSealed: %s", err)
+	}
+	if !sealed {
+		t.Errorf("expected the sealed token to be reported as sealed")
+	}
+	hasPermission, err := checkRequest(t, dbInstance, tokenIssuer, sealedToken, request)
+	if !hasPermission {
+		t.Errorf("expected the sealed token to be accepted: %s", err)
+	}
+
+	attenuation := NewAttenuation()
+	if err := attenuation.RestrictToActions(Read); err != nil {
+		t.Fatalf("RestrictToActions: %s", err)
+	}
+	_, err = attenuation.Apply(sealedToken)
+	if err == nil {
+		t.Errorf("expected attenuating a sealed token to fail")
+	}
+	_, err = SealBiscuit(sealedToken)
+	if err == nil {
+		t.Errorf("expected sealing a sealed token to fail")
+	}
+}
+
+// TestRequireSealedKinds checks that tokens of a kind the issuer requires to be sealed are refused until sealed, and that other kinds are not affected.
+func TestRequireSealedKinds(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.RequireSealedKinds = []string{"deploy"}
+	request := testRequest{user: 4, repo: "Charlie", action: Read}
+
+	deployToken, err := tokenIssuer.IssueTokenWithOptions(4, IssueOptions{Kind: "deploy"})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, deployToken, request)
+	if hasPermission {
+		t.Errorf("expected the unsealed deploy token to be refused")
+	}
+	sealedToken, err := SealBiscuit(deployToken)
+	if err != nil {
+		t.Fatalf("SealBiscuit: %s", err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, sealedToken, request)
+	if !hasPermission {
+		t.Errorf("expected the sealed deploy token to be accepted: %s", err)
+	}
+
+	userToken, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	hasPermission, err = checkRequest(t, dbInstance, tokenIssuer, userToken, request)
+	if !hasPermission {
+		t.Errorf("expected an unsealed token of another kind to be accepted: %s", err)
+	}
+}
+
+// TestSealedFactCannotBeForged checks that a sealed(true) fact appended by an attenuation block does not satisfy the sealing requirement, since only the authorizer supplies it.
+func TestSealedFactCannotBeForged(t *testing.T) {
+	dbInstance, tokenIssuer := testSetup(t)
+	tokenIssuer.RequireSealedKinds = []string{"deploy"}
+
+	deployToken, err := tokenIssuer.IssueTokenWithOptions(4, IssueOptions{Kind: "deploy"})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	attenuation := NewAttenuation()
+	if err := attenuation.AddSource(`sealed(true);`); err != nil {
+		t.Fatalf("AddSource: %s", err)
+	}
+	forged, err := attenuation.Apply(deployToken)
+	if err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	hasPermission, _ := checkRequest(t, dbInstance, tokenIssuer, forged, testRequest{user: 4, repo: "Charlie", action: Read})
+	if hasPermission {
+		t.Errorf("expected a token claiming to be sealed in an attenuation block to be refused")
+	}
+}
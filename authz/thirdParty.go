@@ -0,0 +1,358 @@
+package authz
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"github.com/biscuit-auth/biscuit-go/v2/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// biscuit-go v2.2.0 predates third-party blocks, so attestations emulate them:
+// the external party signs a set of facts together with the signature of the
+// token's last block, and the holder appends the signed attestation as the
+// context of an otherwise empty block. The authorizer verifies each
+// attestation against its registry of trusted external keys and adds the
+// facts to the authorizer world wrapped in an attested fact naming the party,
+// so a party can never assert the org facts the policy grants access from.
+
+// attestationPrefix marks block contexts which hold an attestation.
+const attestationPrefix = "attestation:v1:"
+
+// attestationDomain separates attestation signatures from any other use of the external key.
+const attestationDomain = "forge-attestation-v1\x00"
+
+// ErrUntrustedAttestation is returned when an attestation is signed by a key which is not in the trusted parties registry.
+var ErrUntrustedAttestation = errors.New("attestation is signed by an untrusted key")
+
+// AttestationRequest is sent by a token holder to an external party to ask it to vouch for facts in that token. It binds the attestation to the token's current last block, so it cannot be replayed into another token.
+type AttestationRequest struct {
+	// PreviousSignature is the signature of the token's last block
+	PreviousSignature []byte `json:"previous_signature"`
+}
+
+// Attestation is a set of facts signed by an external party for one token.
+type Attestation struct {
+	// PublicKey is the external party's key, which must be registered as a trusted party for the facts to be used
+	PublicKey ed25519.PublicKey `json:"public_key"`
+	// Facts is the datalog source of the vouched facts, each terminated by a ';'
+	Facts string `json:"facts"`
+	// PreviousSignature is copied from the AttestationRequest
+	PreviousSignature []byte `json:"previous_signature"`
+	// Signature is the external party's signature over the facts and PreviousSignature
+	Signature []byte `json:"signature"`
+}
+
+// decodeContainer returns the protobuf container of token, which holds the block signatures and contexts that biscuit-go does not expose.
+func decodeContainer(token *biscuit.Biscuit) (*pb.Biscuit, error) {
+	serialized, err := token.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("error when serializing token: %w", err)
+	}
+	container := &pb.Biscuit{}
+	err = proto.Unmarshal(serialized, container)
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding token container: %w", err)
+	}
+	return container, nil
+}
+
+// NewAttestationRequest creates the request to send to an external party to attest facts for token.
+func NewAttestationRequest(token *biscuit.Biscuit) (*AttestationRequest, error) {
+	container, err := decodeContainer(token)
+	if err != nil {
+		return nil, err
+	}
+	lastBlock := container.Authority
+	if len(container.Blocks) > 0 {
+		lastBlock = container.Blocks[len(container.Blocks)-1]
+	}
+	return &AttestationRequest{PreviousSignature: lastBlock.Signature}, nil
+}
+
+// attestationPayload is the message an external party signs.
+func attestationPayload(facts string, previousSignature []byte) []byte {
+	payload := []byte(attestationDomain)
+	payload = append(payload, previousSignature...)
+	payload = append(payload, []byte(facts)...)
+	return payload
+}
+
+// parseAttestedFacts parses facts, which must hold nothing but facts.
+func parseAttestedFacts(facts string) ([]biscuit.Fact, error) {
+	parsedBlock, err := datalogParser.Block(facts, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing attested facts: %w", err)
+	}
+	if len(parsedBlock.Rules) != 0 || len(parsedBlock.Checks) != 0 {
+		return nil, fmt.Errorf("attestations may only hold facts")
+	}
+	if len(parsedBlock.Facts) == 0 {
+		return nil, fmt.Errorf("attestation has no facts")
+	}
+	return parsedBlock.Facts, nil
+}
+
+// SignAttestation is run by the external party to vouch for facts, given as datalog source, in the token request was made for.
+func SignAttestation(request *AttestationRequest, privateKey ed25519.PrivateKey, facts string) (*Attestation, error) {
+	facts = strings.TrimSpace(facts)
+	if facts != "" && !strings.HasSuffix(facts, ";") {
+		facts += ";"
+	}
+	_, err := parseAttestedFacts(facts)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.PreviousSignature) == 0 {
+		return nil, fmt.Errorf("attestation request has no previous signature")
+	}
+	return &Attestation{
+		PublicKey:         privateKey.Public().(ed25519.PublicKey),
+		Facts:             facts,
+		PreviousSignature: request.PreviousSignature,
+		Signature:         ed25519.Sign(privateKey, attestationPayload(facts, request.PreviousSignature)),
+	}, nil
+}
+
+// AppendAttestation appends attestation to token as a new block. The attestation must have been requested for token in its current state.
+func AppendAttestation(token *biscuit.Biscuit, attestation *Attestation) (*biscuit.Biscuit, error) {
+	request, err := NewAttestationRequest(token)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(request.PreviousSignature, attestation.PreviousSignature) {
+		return nil, fmt.Errorf("attestation was not requested for this token")
+	}
+	encoded, err := EncodeAttestation(attestation)
+	if err != nil {
+		return nil, err
+	}
+	blockBuilder := token.CreateBlock()
+	blockBuilder.SetContext(attestationPrefix + encoded)
+	attestedToken, err := token.Append(rand.Reader, blockBuilder.Build())
+	if err != nil {
+		return nil, fmt.Errorf("error when appending attestation block: %w", err)
+	}
+	return attestedToken, nil
+}
+
+// EncodeAttestation serializes attestation as URL safe base64 JSON, the form attestations are passed around in.
+func EncodeAttestation(attestation *Attestation) (string, error) {
+	attestationJSON, err := json.Marshal(attestation)
+	if err != nil {
+		return "", fmt.Errorf("error when marshalling attestation: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(attestationJSON), nil
+}
+
+// DecodeAttestation is the inverse of EncodeAttestation. The signature is not verified.
+func DecodeAttestation(encoded string) (*Attestation, error) {
+	attestationJSON, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding attestation: %w", err)
+	}
+	attestation := &Attestation{}
+	err = json.Unmarshal(attestationJSON, attestation)
+	if err != nil {
+		return nil, fmt.Errorf("error when unmarshalling attestation: %w", err)
+	}
+	return attestation, nil
+}
+
+// EncodeAttestationRequest serializes request as URL safe base64 JSON.
+func EncodeAttestationRequest(request *AttestationRequest) (string, error) {
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("error when marshalling attestation request: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(requestJSON), nil
+}
+
+// DecodeAttestationRequest is the inverse of EncodeAttestationRequest.
+func DecodeAttestationRequest(encoded string) (*AttestationRequest, error) {
+	requestJSON, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding attestation request: %w", err)
+	}
+	request := &AttestationRequest{}
+	err = json.Unmarshal(requestJSON, request)
+	if err != nil {
+		return nil, fmt.Errorf("error when unmarshalling attestation request: %w", err)
+	}
+	return request, nil
+}
+
+// TrustedParties is the registry of external keys whose attestations the authorizer accepts, each under a name which policies use to require facts from that party.
+type TrustedParties struct {
+	mu sync.RWMutex
+	// names maps hex encoded public keys to party names
+	names map[string]string
+}
+
+// NewTrustedParties creates an empty registry.
+func NewTrustedParties() *TrustedParties {
+	return &TrustedParties{names: map[string]string{}}
+}
+
+// Add trusts publicKey under name. A key can only be registered once.
+func (trustedParties *TrustedParties) Add(name string, publicKey ed25519.PublicKey) error {
+	if name == "" {
+		return fmt.Errorf("trusted parties require a name")
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key of %s is not a %d byte ed25519 key", name, ed25519.PublicKeySize)
+	}
+	trustedParties.mu.Lock()
+	defer trustedParties.mu.Unlock()
+	keyHex := hex.EncodeToString(publicKey)
+	if existing, found := trustedParties.names[keyHex]; found {
+		return fmt.Errorf("key of %s is already trusted as %s", name, existing)
+	}
+	trustedParties.names[keyHex] = name
+	return nil
+}
+
+// Lookup returns the name publicKey is trusted under.
+func (trustedParties *TrustedParties) Lookup(publicKey ed25519.PublicKey) (string, bool) {
+	trustedParties.mu.RLock()
+	defer trustedParties.mu.RUnlock()
+	name, found := trustedParties.names[hex.EncodeToString(publicKey)]
+	return name, found
+}
+
+// LoadTrustedParties reads a registry from partiesPath, which has a name and a hex encoded ed25519 public key per line. Blank lines and lines starting with '#' are ignored.
+func LoadTrustedParties(partiesPath string) (*TrustedParties, error) {
+	partiesFile, err := os.Open(partiesPath)
+	if err != nil {
+		return nil, fmt.Errorf("error when opening trusted parties %s: %w", partiesPath, err)
+	}
+	defer partiesFile.Close()
+
+	trustedParties := NewTrustedParties()
+	scanner := bufio.NewScanner(partiesFile)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a public key", partiesPath, lineNumber)
+		}
+		publicKey, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: error when decoding public key: %w", partiesPath, lineNumber, err)
+		}
+		err = trustedParties.Add(fields[0], publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", partiesPath, lineNumber, err)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error when reading trusted parties %s: %w", partiesPath, err)
+	}
+	return trustedParties, nil
+}
+
+var (
+	trustedPartiesMu sync.RWMutex
+	// trustedParties is the registry used by CheckAuthz and ExplainAuthz, nil to ignore attestations
+	trustedParties *TrustedParties
+)
+
+// SetTrustedParties sets the registry attestations are verified against. Passing nil ignores every attestation.
+func SetTrustedParties(parties *TrustedParties) {
+	trustedPartiesMu.Lock()
+	defer trustedPartiesMu.Unlock()
+	trustedParties = parties
+}
+
+// getTrustedParties returns the registry set by SetTrustedParties.
+func getTrustedParties() *TrustedParties {
+	trustedPartiesMu.RLock()
+	defer trustedPartiesMu.RUnlock()
+	return trustedParties
+}
+
+// verifyAttestation checks the signature of attestation and that it was made for the block before it, whose signature is previousSignature, and returns its facts.
+func verifyAttestation(attestation *Attestation, previousSignature []byte) ([]biscuit.Fact, error) {
+	if len(attestation.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("attestation public key is not a %d byte ed25519 key", ed25519.PublicKeySize)
+	}
+	if !bytes.Equal(attestation.PreviousSignature, previousSignature) {
+		return nil, fmt.Errorf("attestation was made for another token")
+	}
+	if !ed25519.Verify(attestation.PublicKey, attestationPayload(attestation.Facts, attestation.PreviousSignature), attestation.Signature) {
+		return nil, fmt.Errorf("attestation signature is invalid")
+	}
+	return parseAttestedFacts(attestation.Facts)
+}
+
+// attestedFacts returns the facts of every attestation in token signed by a party in parties, each as an attested($party, $predicate, ..) fact holding the party name, the attested predicate name and its terms, along with a trusted_party fact per party. Attestations from unknown keys are skipped; attestations which fail verification refuse the token. The token's own signatures must already have been verified.
+func attestedFacts(token *biscuit.Biscuit, parties *TrustedParties) ([]biscuit.Fact, error) {
+	container, err := decodeContainer(token)
+	if err != nil {
+		return nil, err
+	}
+	facts := []biscuit.Fact{}
+	previousSignature := container.Authority.Signature
+	for blockIndex, signedBlock := range container.Blocks {
+		block := &pb.Block{}
+		err = proto.Unmarshal(signedBlock.Block, block)
+		if err != nil {
+			return nil, fmt.Errorf("error when decoding block %d: %w", blockIndex+1, err)
+		}
+		blockSignature := signedBlock.Signature
+		encoded, found := strings.CutPrefix(block.GetContext(), attestationPrefix)
+		if !found {
+			previousSignature = blockSignature
+			continue
+		}
+
+		attestation, err := DecodeAttestation(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("error in attestation of block %d: %w", blockIndex+1, err)
+		}
+		blockFacts, err := verifyAttestation(attestation, previousSignature)
+		if err != nil {
+			return nil, fmt.Errorf("error in attestation of block %d: %w", blockIndex+1, err)
+		}
+		previousSignature = blockSignature
+
+		party, trusted := parties.Lookup(attestation.PublicKey)
+		if !trusted {
+			log.Printf("Ignoring attestation in block %d: %s", blockIndex+1, ErrUntrustedAttestation)
+			continue
+		}
+		facts = append(facts, newFact("trusted_party", biscuit.String(party)))
+		for _, fact := range blockFacts {
+			terms := append([]biscuit.Term{biscuit.String(party), biscuit.String(fact.Predicate.Name)}, fact.Predicate.IDs...)
+			facts = append(facts, newFact("attested", terms...))
+		}
+	}
+	return facts, nil
+}
+
+// LoadTrustedPartyKey reads a hex encoded ed25519 seed from keyPath, generating and writing one if it does not exist, in the same format as LoadTokenIssuer. It is meant for external parties, like a CI system, signing attestations.
+func LoadTrustedPartyKey(keyPath string) (ed25519.PrivateKey, error) {
+	tokenIssuer, err := LoadTokenIssuer(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return tokenIssuer.privateRoot, nil
+}
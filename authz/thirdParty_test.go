@@ -0,0 +1,96 @@
+package authz
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/dblogic"
+)
+
+// attest has a party with privateKey vouch for facts in token and returns the token with the attestation appended.
+func attest(t *testing.T, token *biscuit.Biscuit, privateKey ed25519.PrivateKey, facts string) *biscuit.Biscuit {
+	t.Helper()
+	request, err := NewAttestationRequest(token)
+	if err != nil {
+		t.Fatalf("NewAttestationRequest: %s", err)
+	}
+	attestation, err := SignAttestation(request, privateKey, facts)
+	if err != nil {
+		t.Fatalf("SignAttestation: %s", err)
+	}
+	attestedToken, err := AppendAttestation(token, attestation)
+	if err != nil {
+		t.Fatalf("AppendAttestation: %s", err)
+	}
+	return attestedToken
+}
+
+// attestationSetup opens the seeded example database, trusts a new key as the party "sso" for the rest of the test and issues a token to Liam (user 4), who may read Charlie but not Alpha.
+func attestationSetup(t *testing.T) (*dblogic.DBInstance, *TokenIssuer, ed25519.PrivateKey, *biscuit.Biscuit) {
+	t.Helper()
+	dbInstance, tokenIssuer := testSetup(t)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	parties := NewTrustedParties()
+	if err := parties.Add("sso", publicKey); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	SetTrustedParties(parties)
+	t.Cleanup(func() { SetTrustedParties(nil) })
+	token, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	return dbInstance, tokenIssuer, privateKey, token
+}
+
+// TestAttestedFacts checks that a policy check can require a fact from a trusted party by naming the party and the attested predicate.
+func TestAttestedFacts(t *testing.T) {
+	dbInstance, tokenIssuer, privateKey, token := attestationSetup(t)
+	reqDetails, err := dblogic.GatherRequestDetails(4, "Charlie", dbInstance)
+	if err != nil {
+		t.Fatalf("GatherRequestDetails: %s", err)
+	}
+	requireMFA, err := AttenuateBiscuit(token, `check if attested("sso", "mfa", $user), user($user)`)
+	if err != nil {
+		t.Fatalf("AttenuateBiscuit: %s", err)
+	}
+
+	hasPermission, _ := CheckAuthz(requireMFA, tokenIssuer.PublicRoot, reqDetails, Read)
+	if hasPermission {
+		t.Errorf("token requiring an attestation was allowed without one")
+	}
+	attested := attest(t, requireMFA, privateKey, `mfa("userid:4")`)
+	hasPermission, err = CheckAuthz(attested, tokenIssuer.PublicRoot, reqDetails, Read)
+	if !hasPermission {
+		t.Errorf("token with the required attestation was denied: %s", err)
+	}
+}
+
+// TestAttestedRoleDoesNotGrant checks that a trusted party cannot grant access by attesting the org facts the policy allows from.
+func TestAttestedRoleDoesNotGrant(t *testing.T) {
+	dbInstance, tokenIssuer, privateKey, token := attestationSetup(t)
+	reqDetails, err := dblogic.GatherRequestDetails(4, "Alpha", dbInstance)
+	if err != nil {
+		t.Fatalf("GatherRequestDetails: %s", err)
+	}
+
+	for _, facts := range []string{
+		`role("userid:4", "repo:1", "role:owner")`,
+		// Grouping the user under a group named after the party, which owns
+		// the repo
+		`usergroup("userid:4"); role("repo:1", "role:owner")`,
+		`user_authority("userid:4", "userid:4"); repo_authority("repo:1", "repo:1")`,
+	} {
+		attested := attest(t, token, privateKey, facts)
+		hasPermission, _ := CheckAuthz(attested, tokenIssuer.PublicRoot, reqDetails, Read)
+		if hasPermission {
+			t.Errorf("attesting %s allowed Liam to read Alpha", facts)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// git-credential-biscuit is a git credential helper which hands git a token derived from the user's stored forge token, restricted to the repo being fetched or pushed and a short expiry, so the stored token never leaves the workstation.
+//
+// Configure it per forge host, naming the host with -host, and with useHttpPath so git sends the repo path:
+//
+//	git config --global credential.https://forge.example.com.helper "biscuit -host forge.example.com"
+//	git config --global credential.https://forge.example.com.useHttpPath true
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"biscuitExample/authz"
+	"biscuitExample/tokenstore"
+)
+
+// credentialUsername is the username returned with the token. The forge reads the token from the password.
+const credentialUsername = "biscuit"
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("git-credential-biscuit: ")
+	tokenPath := flag.String("token-file", "", "file holding the stored token (defaults to forge/token in the user config dir, as written by login)")
+	ttl := flag.Duration("ttl", 5*time.Minute, "how long each derived token is valid for")
+	host := flag.String("host", "", "the forge host to answer for, e.g. forge.example.com (required)")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatalf("expected one action: get, store or erase")
+	}
+	// Tokens are derived on demand, so there is nothing to store or erase
+	if flag.Arg(0) != "get" {
+		io.Copy(io.Discard, os.Stdin)
+		return
+	}
+
+	request, err := readCredentialRequest(os.Stdin)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	if *tokenPath == "" {
+		*tokenPath, err = tokenstore.DefaultPath()
+		if err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+	}
+	password, err := answerRequest(request, *host, *tokenPath, *ttl)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	if password != "" {
+		fmt.Printf("username=%s\npassword=%s\n", credentialUsername, password)
+	}
+}
+
+// answerRequest returns the password for the credential request git sent, or "" to let git try other helpers when the request is not for host. Requests are refused when host is unset, so the helper never hands tokens to whichever host git asks about, and when the protocol is not https, so tokens are never sent in the clear.
+func answerRequest(request map[string]string, host string, tokenPath string, ttl time.Duration) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("-host is not set, refusing to answer for %s", request["host"])
+	}
+	if request["host"] != host {
+		// Not our forge, let git try other helpers
+		return "", nil
+	}
+	if request["protocol"] != "https" {
+		return "", fmt.Errorf("refusing to send a token to %s over %q, only https is allowed", host, request["protocol"])
+	}
+	reponame := repoFromPath(request["path"])
+	if reponame == "" {
+		log.Printf("git did not send the repo path, set credential.useHttpPath to true for %s", host)
+		return "", nil
+	}
+	return deriveToken(tokenPath, reponame, ttl, "https://"+host+"/"+request["path"])
+}
+
+// readCredentialRequest reads the key=value lines git sends on stdin, up to a blank line or the end of input.
+func readCredentialRequest(input io.Reader) (map[string]string, error) {
+	request := map[string]string{}
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("malformed credential line: %q", line)
+		}
+		request[key] = value
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error when reading credential request: %w", err)
+	}
+	return request, nil
+}
+
+// repoFromPath returns the repo name in a remote path such as "org/Charlie.git", or "" if there is no path.
+func repoFromPath(remotePath string) string {
+	remotePath = strings.Trim(remotePath, "/")
+	if remotePath == "" {
+		return ""
+	}
+	return strings.TrimSuffix(path.Base(remotePath), ".git")
+}
+
+// deriveToken attenuates the stored token to reading and writing reponame for ttl, and returns it encoded. The remote is recorded in the appended block's context.
+func deriveToken(tokenPath string, reponame string, ttl time.Duration, remote string) (string, error) {
+	encoded, err := tokenstore.Load(tokenPath)
+	if err != nil {
+		return "", err
+	}
+	token, err := authz.DecodeToken(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	attenuation := authz.NewAttenuation()
+	err = attenuation.RestrictToRepoNames(reponame)
+	if err != nil {
+		return "", err
+	}
+	// git does not say whether it is fetching or pushing, so allow both but
+	// never membership changes
+	err = attenuation.RestrictToActions(authz.Read, authz.Write)
+	if err != nil {
+		return "", err
+	}
+	err = attenuation.ExpiresAt(time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	attenuation.SetContext("git-credential-biscuit " + remote)
+	derived, err := attenuation.Apply(token)
+	if err != nil {
+		return "", fmt.Errorf("error when attenuating stored token: %w", err)
+	}
+	return authz.EncodeToken(derived)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+	"biscuitExample/tokenstore"
+)
+
+// TestReadCredentialRequest checks that the request git sends is read up to the blank line, and malformed lines are refused.
+func TestReadCredentialRequest(t *testing.T) {
+	request, err := readCredentialRequest(strings.NewReader("protocol=https\nhost=forge.example.com\npath=org/Charlie.git\n\nignored=1\n"))
+	if err != nil {
+		t.Fatalf("readCredentialRequest: %s", err)
+	}
+	if len(request) != 3 || request["host"] != "forge.example.com" || request["path"] != "org/Charlie.git" {
+		t.Errorf("unexpected request %v", request)
+	}
+	_, err = readCredentialRequest(strings.NewReader("protocol\n"))
+	if err == nil {
+		t.Errorf("expected a line without = to be refused")
+	}
+}
+
+// TestRepoFromPath checks that the repo name is taken from the last element of the remote path.
+func TestRepoFromPath(t *testing.T) {
+	for remotePath, expected := range map[string]string{
+		"org/Charlie.git": "Charlie",
+		"/Charlie/":       "Charlie",
+		"Charlie":         "Charlie",
+		"":                "",
+		"/":               "",
+	} {
+		if reponame := repoFromPath(remotePath); reponame != expected {
+			t.Errorf("%q: expected %q, got %q", remotePath, expected, reponame)
+		}
+	}
+}
+
+// storedTokenSetup opens the example db and stores a token for Liam (userid 4) as login would, returning the db, the issuer, the token file and the stored token.
+func storedTokenSetup(t *testing.T) (*dblogic.DBInstance, *authz.TokenIssuer, string, string) {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	dbInstance, err := dblogic.InitMemoryDb(true)
+	if err != nil {
+		t.Fatalf("InitMemoryDb: %s", err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	tokenIssuer, err := authz.NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	token, err := tokenIssuer.IssueToken(4)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	stored, err := authz.EncodeToken(token)
+	if err != nil {
+		t.Fatalf("EncodeToken: %s", err)
+	}
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err = tokenstore.Save(tokenPath, stored)
+	if err != nil {
+		t.Fatalf("tokenstore.Save: %s", err)
+	}
+	return dbInstance, tokenIssuer, tokenPath, stored
+}
+
+// TestAnswerRequest checks that tokens are only handed out for https requests to the configured host, and that nothing is answered when no host is configured.
+func TestAnswerRequest(t *testing.T) {
+	_, _, tokenPath, _ := storedTokenSetup(t)
+	for _, test := range []struct {
+		name     string
+		host     string
+		request  map[string]string
+		answered bool
+		refused  bool
+	}{
+		{"https to the host", "forge.example.com", map[string]string{"protocol": "https", "host": "forge.example.com", "path": "org/Charlie.git"}, true, false},
+		{"another host", "forge.example.com", map[string]string{"protocol": "https", "host": "evil.example.com", "path": "org/Charlie.git"}, false, false},
+		{"no -host", "", map[string]string{"protocol": "https", "host": "evil.example.com", "path": "org/Charlie.git"}, false, true},
+		{"http to the host", "forge.example.com", map[string]string{"protocol": "http", "host": "forge.example.com", "path": "org/Charlie.git"}, false, true},
+		{"ssh to the host", "forge.example.com", map[string]string{"protocol": "ssh", "host": "forge.example.com", "path": "org/Charlie.git"}, false, true},
+	} {
+		password, err := answerRequest(test.request, test.host, tokenPath, 5*time.Minute)
+		if (err != nil) != test.refused {
+			t.Errorf("%s: expected refused %t, got error %v", test.name, test.refused, err)
+		}
+		if (password != "") != test.answered {
+			t.Errorf("%s: expected answered %t, got password %q", test.name, test.answered, password)
+		}
+	}
+}
+
+// TestDeriveToken checks that the derived token only reads and writes the requested repo, expires after the TTL, and leaves the stored token unchanged.
+func TestDeriveToken(t *testing.T) {
+	dbInstance, tokenIssuer, tokenPath, stored := storedTokenSetup(t)
+
+	before := time.Now().Truncate(time.Second)
+	encoded, err := deriveToken(tokenPath, "Charlie", 5*time.Minute, "https://forge.example.com/org/Charlie.git")
+	if err != nil {
+		t.Fatalf("deriveToken: %s", err)
+	}
+	if encoded == stored {
+		t.Fatalf("expected a derived token rather than the stored one")
+	}
+	derived, err := authz.DecodeToken(encoded)
+	if err != nil {
+		t.Fatalf("DecodeToken: %s", err)
+	}
+
+	for _, check := range []struct {
+		repo    string
+		action  authz.Action
+		allowed bool
+	}{
+		{"Charlie", authz.Read, true},
+		{"Charlie", authz.Write, true},
+		{"Charlie", authz.Membership, false},
+		{"Bravo", authz.Read, false},
+	} {
+		reqDetails, err := dblogic.GatherRequestDetails(4, check.repo, dbInstance)
+		if err != nil {
+			t.Fatalf("GatherRequestDetails: %s", err)
+		}
+		hasPermission, err := authz.CheckAuthz(derived, tokenIssuer.PublicRoot, reqDetails, check.action)
+		if hasPermission != check.allowed {
+			t.Errorf("%d on %s: expected allowed %t, got %t (%v)", check.action, check.repo, check.allowed, hasPermission, err)
+		}
+	}
+
+	inspection, err := authz.Inspect(derived, tokenIssuer.PublicRoot)
+	if err != nil {
+		t.Fatalf("Inspect: %s", err)
+	}
+	if inspection.ExpiresAt == nil || inspection.ExpiresAt.Before(before.Add(5*time.Minute)) || inspection.ExpiresAt.After(time.Now().Add(5*time.Minute)) {
+		t.Errorf("expected expiry about 5m from now, got %v", inspection.ExpiresAt)
+	}
+	lastBlock := inspection.Blocks[len(inspection.Blocks)-1]
+	if !strings.Contains(lastBlock.Context, "https://forge.example.com/org/Charlie.git") {
+		t.Errorf("expected the remote in the block context, got %q", lastBlock.Context)
+	}
+
+	unchanged, err := tokenstore.Load(tokenPath)
+	if err != nil {
+		t.Fatalf("tokenstore.Load: %s", err)
+	}
+	if unchanged != stored {
+		t.Errorf("expected the stored token to be left unchanged")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"flag"
+	"fmt"
+
+	"biscuitExample/authz"
+)
+
+// runAttestation dispatches the attestation subcommands.
+func runAttestation(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected an attestation subcommand: request, sign, append or pubkey")
+	}
+	switch args[0] {
+	case "request":
+		return runAttestationRequest(args[1:])
+	case "sign":
+		return runAttestationSign(args[1:])
+	case "append":
+		return runAttestationAppend(args[1:])
+	case "pubkey":
+		return runAttestationPubkey(args[1:])
+	default:
+		return fmt.Errorf("unknown attestation subcommand: %s", args[0])
+	}
+}
+
+// runAttestationRequest prints the request a token holder sends to an external party.
+func runAttestationRequest(args []string) error {
+	flagSet := flag.NewFlagSet("attestation request", flag.ExitOnError)
+	tokenStr := flagSet.String("token", "", "encoded token the attestation is for")
+	flagSet.Parse(args)
+	if *tokenStr == "" {
+		return fmt.Errorf("-token is required")
+	}
+
+	token, err := authz.DecodeToken(*tokenStr)
+	if err != nil {
+		return err
+	}
+	request, err := authz.NewAttestationRequest(token)
+	if err != nil {
+		return err
+	}
+	encoded, err := authz.EncodeAttestationRequest(request)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encoded)
+	return nil
+}
+
+// runAttestationSign signs facts for a request with an external party's key and prints the attestation.
+func runAttestationSign(args []string) error {
+	flagSet := flag.NewFlagSet("attestation sign", flag.ExitOnError)
+	keyPath := flagSet.String("key", "", "hex ed25519 seed of the external party, generated if missing")
+	requestStr := flagSet.String("request", "", "encoded attestation request")
+	facts := flagSet.String("facts", "", "datalog facts to vouch for, separated by ';'")
+	flagSet.Parse(args)
+	if *keyPath == "" || *requestStr == "" || *facts == "" {
+		return fmt.Errorf("-key, -request and -facts are required")
+	}
+
+	privateKey, err := authz.LoadTrustedPartyKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	request, err := authz.DecodeAttestationRequest(*requestStr)
+	if err != nil {
+		return err
+	}
+	attestation, err := authz.SignAttestation(request, privateKey, *facts)
+	if err != nil {
+		return err
+	}
+	encoded, err := authz.EncodeAttestation(attestation)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encoded)
+	return nil
+}
+
+// runAttestationAppend appends an attestation to the token it was requested for and prints the token.
+func runAttestationAppend(args []string) error {
+	flagSet := flag.NewFlagSet("attestation append", flag.ExitOnError)
+	tokenStr := flagSet.String("token", "", "encoded token the attestation was requested for")
+	attestationStr := flagSet.String("attestation", "", "encoded attestation")
+	flagSet.Parse(args)
+	if *tokenStr == "" || *attestationStr == "" {
+		return fmt.Errorf("-token and -attestation are required")
+	}
+
+	token, err := authz.DecodeToken(*tokenStr)
+	if err != nil {
+		return err
+	}
+	attestation, err := authz.DecodeAttestation(*attestationStr)
+	if err != nil {
+		return err
+	}
+	attestedToken, err := authz.AppendAttestation(token, attestation)
+	if err != nil {
+		return err
+	}
+	encoded, err := authz.EncodeToken(attestedToken)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encoded)
+	return nil
+}
+
+// runAttestationPubkey prints the public key of an external party's key, for its line in the trusted parties file.
+func runAttestationPubkey(args []string) error {
+	flagSet := flag.NewFlagSet("attestation pubkey", flag.ExitOnError)
+	keyPath := flagSet.String("key", "", "hex ed25519 seed of the external party, generated if missing")
+	flagSet.Parse(args)
+	if *keyPath == "" {
+		return fmt.Errorf("-key is required")
+	}
+
+	privateKey, err := authz.LoadTrustedPartyKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(privateKey.Public().(ed25519.PublicKey)))
+	return nil
+}
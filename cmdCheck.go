@@ -0,0 +1,322 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// attenuationFlags holds the command line flags which map onto the typed attenuation builders.
+type attenuationFlags struct {
+	repos      *string
+	repogroup  *int
+	actions    *string
+	expires    *time.Duration
+	refs       *string
+	cidrs      *string
+	mfa        *bool
+	transports *string
+	clients    *string
+	source     *string
+	context    *string
+}
+
+// addAttenuationFlags registers the attenuation flags on flagSet.
+func addAttenuationFlags(flagSet *flag.FlagSet) *attenuationFlags {
+	return &attenuationFlags{
+		repos:      flagSet.String("restrict-repos", "", "comma separated repo ids the token is restricted to"),
+		repogroup:  flagSet.Int("restrict-repogroup", 0, "repogroup id the token is restricted to"),
+		actions:    flagSet.String("restrict-actions", "", "comma separated actions the token is restricted to"),
+		expires:    flagSet.Duration("expires", 0, "duration after which the token expires"),
+		refs:       flagSet.String("restrict-refs", "", "comma separated git refs writes are restricted to, a trailing /* matches a prefix"),
+		cidrs:      flagSet.String("restrict-cidr", "", "comma separated CIDR ranges requests must come from"),
+		mfa:        flagSet.Bool("require-mfa", false, "require requests to have performed multi-factor authentication"),
+		transports: flagSet.String("restrict-transport", "", "comma separated transports requests must use: http, ssh"),
+		clients:    flagSet.String("restrict-client", "", "comma separated client types requests must come from, e.g. git"),
+		source:     flagSet.String("attenuate", "", "datalog facts, rules and checks separated by ';' to add to the attenuation block"),
+		context:    flagSet.String("context", "", "context string to store in the attenuation block"),
+	}
+}
+
+// issuerFlags holds the command line flags which configure the token issuer and the validity window of issued tokens.
+type issuerFlags struct {
+	keyPath       *string
+	ttl           *time.Duration
+	notBefore     *string
+	maxLifetime   *time.Duration
+	requireExpiry *bool
+	requireSealed *string
+}
+
+// addIssuerFlags registers the issuer flags on flagSet. defaultKeyPath is the default root key file, "" for a throwaway key.
+func addIssuerFlags(flagSet *flag.FlagSet, defaultKeyPath string) *issuerFlags {
+	return &issuerFlags{
+		keyPath:       flagSet.String("key", defaultKeyPath, "file holding the hex encoded root key seed, created if missing, empty for a throwaway key"),
+		ttl:           flagSet.Duration("ttl", 0, "how long the issued token is valid for"),
+		notBefore:     flagSet.String("not-before", "", "RFC 3339 time before which the issued token is not valid"),
+		maxLifetime:   flagSet.Duration("max-lifetime", 0, "refuse to issue tokens valid for longer than this, tokens without -ttl get it as their expiry"),
+		requireExpiry: flagSet.Bool("require-expiry", false, "refuse to issue tokens without an expiry"),
+		requireSealed: flagSet.String("require-sealed", "", "comma separated token kinds which are only accepted once sealed"),
+	}
+}
+
+// build creates a token issuer configured from the flags, along with the options to issue tokens with, which are also the issuer's defaults.
+func (flags *issuerFlags) build() (*authz.TokenIssuer, authz.IssueOptions, error) {
+	opts := authz.IssueOptions{TTL: *flags.ttl}
+	if *flags.notBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, *flags.notBefore)
+		if err != nil {
+			return nil, opts, fmt.Errorf("error when parsing not-before: %w", err)
+		}
+		opts.NotBefore = notBefore
+	}
+
+	var tokenIssuer *authz.TokenIssuer
+	var err error
+	if *flags.keyPath == "" {
+		tokenIssuer, err = authz.NewTokenIssuer()
+	} else {
+		tokenIssuer, err = authz.LoadTokenIssuer(*flags.keyPath)
+	}
+	if err != nil {
+		return nil, opts, fmt.Errorf("error when creating biscuit token issuer: %w", err)
+	}
+	tokenIssuer.DefaultOptions = opts
+	tokenIssuer.MaxLifetime = *flags.maxLifetime
+	tokenIssuer.RequireExpiry = *flags.requireExpiry
+	tokenIssuer.RequireSealedKinds = splitList(*flags.requireSealed)
+	return tokenIssuer, opts, nil
+}
+
+// boundKeyFingerprint resolves a key flag, which is a fingerprint or the path of a public key file, to the key's fingerprint. An empty flag resolves to "".
+func boundKeyFingerprint(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "SHA256:") {
+		return key, nil
+	}
+	publicKey, err := os.ReadFile(key)
+	if err != nil {
+		return "", fmt.Errorf("error when reading public key from %s: %w", key, err)
+	}
+	return authz.KeyFingerprint(string(publicKey))
+}
+
+// splitList splits a comma separated flag value, ignoring empty entries.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// build converts the flags into an Attenuation. Returns nil if no restriction was requested.
+func (flags *attenuationFlags) build() (*authz.Attenuation, error) {
+	attenuation := authz.NewAttenuation()
+	restricted := false
+
+	if repos := splitList(*flags.repos); len(repos) > 0 {
+		repoIds := []int{}
+		for _, repo := range repos {
+			repoId, err := strconv.Atoi(repo)
+			if err != nil {
+				return nil, fmt.Errorf("error when parsing repo id: %w", err)
+			}
+			repoIds = append(repoIds, repoId)
+		}
+		if err := attenuation.RestrictToRepos(repoIds...); err != nil {
+			return nil, fmt.Errorf("error when restricting repos: %w", err)
+		}
+		restricted = true
+	}
+	if *flags.repogroup != 0 {
+		if err := attenuation.RestrictToRepogroup(*flags.repogroup); err != nil {
+			return nil, fmt.Errorf("error when restricting repogroup: %w", err)
+		}
+		restricted = true
+	}
+	if actionStrs := splitList(*flags.actions); len(actionStrs) > 0 {
+		actions := []authz.Action{}
+		for _, actionStr := range actionStrs {
+			action, err := authz.ParseAction(actionStr)
+			if err != nil {
+				return nil, fmt.Errorf("error when parsing action: %w", err)
+			}
+			actions = append(actions, action)
+		}
+		if err := attenuation.RestrictToActions(actions...); err != nil {
+			return nil, fmt.Errorf("error when restricting actions: %w", err)
+		}
+		restricted = true
+	}
+	if *flags.expires != 0 {
+		if err := attenuation.ExpiresAt(time.Now().Add(*flags.expires)); err != nil {
+			return nil, fmt.Errorf("error when setting expiry: %w", err)
+		}
+		restricted = true
+	}
+	if refs := splitList(*flags.refs); len(refs) > 0 {
+		if err := attenuation.RestrictToRefs(refs...); err != nil {
+			return nil, fmt.Errorf("error when restricting refs: %w", err)
+		}
+		restricted = true
+	}
+	if cidrs := splitList(*flags.cidrs); len(cidrs) > 0 {
+		if err := attenuation.RestrictToSourceCIDR(cidrs...); err != nil {
+			return nil, fmt.Errorf("error when restricting source CIDR: %w", err)
+		}
+		restricted = true
+	}
+	if *flags.mfa {
+		if err := attenuation.RequireMFA(); err != nil {
+			return nil, fmt.Errorf("error when requiring MFA: %w", err)
+		}
+		restricted = true
+	}
+	if transports := splitList(*flags.transports); len(transports) > 0 {
+		if err := attenuation.RestrictToTransports(transports...); err != nil {
+			return nil, fmt.Errorf("error when restricting transports: %w", err)
+		}
+		restricted = true
+	}
+	if clientTypes := splitList(*flags.clients); len(clientTypes) > 0 {
+		if err := attenuation.RestrictToClientTypes(clientTypes...); err != nil {
+			return nil, fmt.Errorf("error when restricting client types: %w", err)
+		}
+		restricted = true
+	}
+
+	if *flags.source != "" {
+		if err := attenuation.AddSource(*flags.source); err != nil {
+			return nil, err
+		}
+		restricted = true
+	}
+
+	if !restricted {
+		return nil, nil
+	}
+	attenuation.SetContext(*flags.context)
+	return attenuation, nil
+}
+
+// runCheck issues a token for a user or service account, or takes an existing one, attenuates and optionally seals it, and checks whether it allows the action on a repo.
+func runCheck(args []string) error {
+	flagSet := flag.NewFlagSet("check", flag.ExitOnError)
+	userId := flagSet.Int("user", 0, "user id to issue the token for")
+	serviceAccountId := flagSet.Int("service", 0, "service account id to issue the token for, instead of -user")
+	reponame := flagSet.String("repo", "", "repo name to check access to")
+	actionStr := flagSet.String("action", "read", "action to check")
+	ref := flagSet.String("ref", "", "git ref the request writes to")
+	sourceIP := flagSet.String("source-ip", "", "address the request comes from")
+	mfa := flagSet.Bool("mfa", false, "the request performed multi-factor authentication")
+	clientType := flagSet.String("client-type", "", "kind of client the request comes from, e.g. git")
+	userAgent := flagSet.String("user-agent", "", "user agent the request comes from")
+	transport := flagSet.String("transport", "", "transport the request uses: http or ssh")
+	tokenStr := flagSet.String("token", "", "encoded token to check instead of issuing one, requires -key")
+	kind := flagSet.String("kind", "", "kind of the issued token, e.g. deploy")
+	seal := flagSet.Bool("seal", false, "seal the token after attenuating it")
+	bindKey := flagSet.String("bind-key", "", "bind the issued token to a key, given as a fingerprint or a public key file")
+	possession := flagSet.String("possession", "", "comma separated fingerprints or public key files of keys the client proved it holds")
+	issuer := addIssuerFlags(flagSet, "")
+	attenuation := addAttenuationFlags(flagSet)
+	flagSet.Parse(args)
+
+	if (*userId == 0) == (*serviceAccountId == 0) || *reponame == "" {
+		return fmt.Errorf("-repo and exactly one of -user and -service are required")
+	}
+	action, err := authz.ParseAction(*actionStr)
+	if err != nil {
+		return fmt.Errorf("error when parsing action: %w", err)
+	}
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+	authz.SetRevocationStore(dbInstance)
+
+	var reqDetails *dblogic.RequestDetails
+	if *serviceAccountId != 0 {
+		reqDetails, err = dblogic.GatherServiceRequestDetails(*serviceAccountId, *reponame, dbInstance)
+	} else {
+		reqDetails, err = dblogic.GatherRequestDetails(*userId, *reponame, dbInstance)
+	}
+	if err != nil {
+		return fmt.Errorf("error when gathering request details from DB: %w", err)
+	}
+	reqDetails.Ref = *ref
+	reqDetails.SourceIP = *sourceIP
+	reqDetails.MFA = *mfa
+	reqDetails.ClientType = *clientType
+	reqDetails.UserAgent = *userAgent
+	reqDetails.Transport = *transport
+	for _, possessedKey := range splitList(*possession) {
+		fingerprint, err := boundKeyFingerprint(possessedKey)
+		if err != nil {
+			return err
+		}
+		reqDetails.PossessedKeys = append(reqDetails.PossessedKeys, fingerprint)
+	}
+
+	tokenIssuer, issueOptions, err := issuer.build()
+	if err != nil {
+		return err
+	}
+	issueOptions.BoundKey, err = boundKeyFingerprint(*bindKey)
+	if err != nil {
+		return err
+	}
+	var biscuitToken *biscuit.Biscuit
+	if *tokenStr != "" {
+		if *issuer.keyPath == "" {
+			return fmt.Errorf("-token requires -key to verify the token against")
+		}
+		biscuitToken, err = authz.DecodeToken(*tokenStr)
+	} else if *serviceAccountId != 0 {
+		issueOptions.Kind = *kind
+		biscuitToken, err = tokenIssuer.IssueServiceToken(*serviceAccountId, issueOptions)
+	} else {
+		issueOptions.Kind = *kind
+		biscuitToken, err = tokenIssuer.IssueTokenWithOptions(*userId, issueOptions)
+	}
+	if err != nil {
+		return fmt.Errorf("error when getting biscuit token: %w", err)
+	}
+
+	restrictions, err := attenuation.build()
+	if err != nil {
+		return err
+	}
+	if restrictions != nil {
+		biscuitToken, err = restrictions.Apply(biscuitToken)
+		if err != nil {
+			return fmt.Errorf("error when attenuating biscuit token: %w", err)
+		}
+	}
+	if *seal {
+		biscuitToken, err = authz.SealBiscuit(biscuitToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	hasPermission, err := authz.CheckAuthz(biscuitToken, tokenIssuer.PublicRoot, reqDetails, action)
+	if hasPermission {
+		fmt.Println("allow")
+	} else {
+		fmt.Printf("deny: %s\n", err.Error())
+	}
+	return nil
+}
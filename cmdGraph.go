@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+	"biscuitExample/orggraph"
+)
+
+// runGraph renders the user / usergroup / repogroup / repo / role graph. When both a user and a repo are given the edges which allow the user to perform the action are highlighted.
+func runGraph(args []string) error {
+	flagSet := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := flagSet.String("format", "dot", "output format, dot or mermaid")
+	userId := flagSet.Int("user", 0, "only show the graph relevant to this user id")
+	reponame := flagSet.String("repo", "", "only show the graph relevant to this repo name")
+	actionStr := flagSet.String("action", "read", "action to highlight when both -user and -repo are set")
+	flagSet.Parse(args)
+
+	action, err := authz.ParseAction(*actionStr)
+	if err != nil {
+		return fmt.Errorf("error when parsing action: %w", err)
+	}
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	orgGraph, err := dblogic.GatherOrgGraph(dbInstance)
+	if err != nil {
+		return fmt.Errorf("error when gathering org graph from DB: %w", err)
+	}
+	graph := orggraph.FromOrgGraph(orgGraph)
+
+	repoId := 0
+	if *reponame != "" {
+		for id, name := range orgGraph.Repos {
+			if name == *reponame {
+				repoId = id
+			}
+		}
+		if repoId == 0 {
+			return fmt.Errorf("unknown repo: %s", *reponame)
+		}
+	}
+
+	switch {
+	case *userId != 0 && repoId != 0:
+		graph = graph.FilterByUserAndRepo(*userId, repoId)
+
+		reqDetails, err := dblogic.GatherRequestDetails(*userId, *reponame, dbInstance)
+		if err != nil {
+			return fmt.Errorf("error when gathering request details from DB: %w", err)
+		}
+		tokenIssuer, err := authz.NewTokenIssuer()
+		if err != nil {
+			return fmt.Errorf("error when creating biscuit token issuer: %w", err)
+		}
+		biscuitToken, err := tokenIssuer.IssueToken(*userId)
+		if err != nil {
+			return fmt.Errorf("error when issuing biscuit token: %w", err)
+		}
+		grantingRoles, err := authz.ExplainAuthz(biscuitToken, tokenIssuer.PublicRoot, reqDetails, action)
+		if err != nil {
+			// Still worth rendering what relationships do exist
+			log.Printf("User %d is not authorized to %s %s: %s", *userId, *actionStr, *reponame, err.Error())
+		}
+		graph.Highlight(*userId, repoId, grantingRoles)
+	case *userId != 0:
+		graph = graph.FilterByUser(*userId)
+	case repoId != 0:
+		graph = graph.FilterByRepo(repoId)
+	}
+
+	switch *format {
+	case "dot":
+		fmt.Print(graph.DOT())
+	case "mermaid":
+		fmt.Print(graph.Mermaid())
+	default:
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"biscuitExample/authz"
+)
+
+// runInspect prints the blocks and metadata of an encoded token as JSON.
+func runInspect(args []string) error {
+	flagSet := flag.NewFlagSet("inspect", flag.ExitOnError)
+	tokenStr := flagSet.String("token", "", "encoded token to inspect")
+	keyPath := flagSet.String("key", "", "file holding the hex encoded root key seed to verify the token with, empty to inspect it unverified")
+	flagSet.Parse(args)
+	if *tokenStr == "" {
+		return fmt.Errorf("-token is required")
+	}
+
+	token, err := authz.DecodeToken(*tokenStr)
+	if err != nil {
+		return err
+	}
+	var publicRoot ed25519.PublicKey
+	if *keyPath != "" {
+		tokenIssuer, err := authz.LoadTokenIssuer(*keyPath)
+		if err != nil {
+			return fmt.Errorf("error when loading root key: %w", err)
+		}
+		publicRoot = tokenIssuer.PublicRoot
+	}
+	inspection, err := authz.Inspect(token, publicRoot)
+	if err != nil {
+		return err
+	}
+	// Print checks such as $time <= ... as written, rather than HTML escaped
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(inspection)
+	if err != nil {
+		return fmt.Errorf("error when marshalling inspection: %w", err)
+	}
+	return nil
+}
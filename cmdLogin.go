@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"biscuitExample/tokenstore"
+)
+
+// deviceCodeGrantType is the grant_type of device access token requests, from RFC 8628.
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceCodeResponse is the part of the device authorization response login uses.
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// deviceTokenResponse is the device access token response, or an OAuth error while the grant is pending.
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+}
+
+// postForm posts form to endpoint and decodes the JSON response into body, whatever the status, since OAuth errors are JSON too.
+func postForm(endpoint string, form url.Values, body interface{}) error {
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		return fmt.Errorf("error when posting to %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(body)
+	if err != nil {
+		return fmt.Errorf("error when decoding response from %s (status %s): %w", endpoint, resp.Status, err)
+	}
+	return nil
+}
+
+// runLogin signs the user in with the OAuth2 device flow against a forge server and stores the issued token.
+func runLogin(args []string) error {
+	flagSet := flag.NewFlagSet("login", flag.ExitOnError)
+	server := flagSet.String("server", "http://localhost:8080", "forge server to log in to")
+	clientId := flagSet.String("client-id", "forge-cli", "client id recorded as the token name in the ledger")
+	tokenPath := flagSet.String("token-file", "", "file to store the token in (defaults to forge/token in the user config dir)")
+	flagSet.Parse(args)
+
+	if *tokenPath == "" {
+		defaultPath, err := tokenstore.DefaultPath()
+		if err != nil {
+			return err
+		}
+		*tokenPath = defaultPath
+	}
+
+	codeResp := &deviceCodeResponse{}
+	err := postForm(*server+"/device/code", url.Values{"client_id": {*clientId}}, codeResp)
+	if err != nil {
+		return err
+	}
+	if codeResp.DeviceCode == "" {
+		return fmt.Errorf("server did not start a device login")
+	}
+	fmt.Fprintf(os.Stderr, "To log in, visit %s and enter the code %s\n", codeResp.VerificationURI, codeResp.UserCode)
+	fmt.Fprintf(os.Stderr, "or open %s\n", codeResp.VerificationURIComplete)
+
+	interval := time.Duration(codeResp.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(codeResp.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		tokenResp := &deviceTokenResponse{}
+		err = postForm(*server+"/device/token", url.Values{
+			"grant_type":  {deviceCodeGrantType},
+			"device_code": {codeResp.DeviceCode},
+			"client_id":   {*clientId},
+		}, tokenResp)
+		if err != nil {
+			return err
+		}
+		switch tokenResp.Error {
+		case "":
+			err = tokenstore.Save(*tokenPath, tokenResp.AccessToken)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Logged in, token stored in %s\n", *tokenPath)
+			return nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return fmt.Errorf("login was denied")
+		default:
+			return fmt.Errorf("login failed: %s", tokenResp.Error)
+		}
+	}
+	return fmt.Errorf("login expired before it was approved")
+}
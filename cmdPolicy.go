@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"biscuitExample/authz"
+	"biscuitExample/policytest"
+)
+
+// defaultScenarioDir holds the policy scenarios checked in alongside the embedded policy.
+const defaultScenarioDir = "authz/policy/tests"
+
+// runPolicy dispatches the policy subcommands.
+func runPolicy(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected a policy subcommand: test")
+	}
+	switch args[0] {
+	case "test":
+		return runPolicyTest(args[1:])
+	default:
+		return fmt.Errorf("unknown policy subcommand: %s", args[0])
+	}
+}
+
+// runPolicyTest runs the policy scenarios in the given files or directories against the active policy.
+func runPolicyTest(args []string) error {
+	flagSet := flag.NewFlagSet("policy test", flag.ExitOnError)
+	verbose := flagSet.Bool("v", false, "log the authorizer for every case")
+	flagSet.Parse(args)
+
+	paths := flagSet.Args()
+	if len(paths) == 0 {
+		paths = []string{defaultScenarioDir}
+	}
+	scenarioPaths, err := policytest.FindScenarioFiles(paths)
+	if err != nil {
+		return fmt.Errorf("error when finding scenarios: %w", err)
+	}
+
+	if *verbose {
+		authz.SetDebugLogging(true)
+	} else {
+		// Keep the output to the case results
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	failed := 0
+	total := 0
+	for _, scenarioPath := range scenarioPaths {
+		scenario, err := policytest.LoadScenario(scenarioPath)
+		if err != nil {
+			return fmt.Errorf("error when loading scenario: %w", err)
+		}
+		caseResults, err := scenario.Run()
+		if err != nil {
+			return fmt.Errorf("error when running scenario: %w", err)
+		}
+		for _, caseResult := range caseResults {
+			total++
+			if caseResult.Passed() {
+				fmt.Printf("PASS %s: %s\n", caseResult.Scenario, caseResult.Case)
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL %s: %s: expected %s, got %s\n",
+				caseResult.Scenario, caseResult.Case, caseResult.Expected, caseResult.Actual)
+			if caseResult.Err != nil {
+				fmt.Printf("     %s\n", caseResult.Err.Error())
+			} else if caseResult.Reason != nil {
+				fmt.Printf("     %s\n", caseResult.Reason.Error())
+			}
+		}
+	}
+
+	fmt.Printf("%d of %d cases passed\n", total-failed, total)
+	if failed != 0 {
+		return fmt.Errorf("%d policy cases failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// runRevocation dispatches the revocation subcommands.
+func runRevocation(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected a revocation subcommand: revoke, list or prune")
+	}
+	switch args[0] {
+	case "revoke":
+		return runRevocationRevoke(args[1:])
+	case "list":
+		return runRevocationList(args[1:])
+	case "prune":
+		return runRevocationPrune(args[1:])
+	default:
+		return fmt.Errorf("unknown revocation subcommand: %s", args[0])
+	}
+}
+
+// runRevocationRevoke revokes revocation ids, a token, or every token issued to a user.
+func runRevocationRevoke(args []string) error {
+	flagSet := flag.NewFlagSet("revocation revoke", flag.ExitOnError)
+	ids := flagSet.String("id", "", "comma separated hex revocation ids to revoke")
+	tokenStr := flagSet.String("token", "", "encoded token to revoke, along with tokens attenuated from it")
+	allBlocks := flagSet.Bool("all-blocks", false, "with -token, revoke every block including the authority block, refusing every token derived from the same issued token")
+	userId := flagSet.Int("user", 0, "revoke every token issued to this user id so far")
+	expiresAt := flagSet.String("expires-at", "", "RFC 3339 time the revoked token expires, after which prune removes the revocation")
+	reason := flagSet.String("reason", "", "reason recorded with the revocation")
+	flagSet.Parse(args)
+	if *allBlocks && *tokenStr == "" {
+		return fmt.Errorf("-all-blocks is only valid with -token")
+	}
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	switch {
+	case *userId != 0:
+		return dbInstance.RevokeUser(*userId, *reason)
+	case *ids != "" || *tokenStr != "":
+		revocationIds := splitList(*ids)
+		if *tokenStr != "" {
+			token, err := authz.DecodeToken(*tokenStr)
+			if err != nil {
+				return err
+			}
+			revocationIds = append(revocationIds, authz.TokenRevocationIds(token, *allBlocks)...)
+		}
+		expiry := time.Time{}
+		if *expiresAt != "" {
+			expiry, err = time.Parse(time.RFC3339, *expiresAt)
+			if err != nil {
+				return fmt.Errorf("error when parsing expires-at: %w", err)
+			}
+		}
+		return dbInstance.RevokeIds(revocationIds, expiry, *reason)
+	default:
+		return fmt.Errorf("one of -id, -token or -user is required")
+	}
+}
+
+// runRevocationList prints every revocation.
+func runRevocationList(args []string) error {
+	flagSet := flag.NewFlagSet("revocation list", flag.ExitOnError)
+	flagSet.Parse(args)
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	revocations, err := dbInstance.ListRevocations()
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "REVOKED\tUSER\tREVOCATION ID\tEXPIRES\tREASON")
+	for _, revocation := range revocations {
+		user := "-"
+		if revocation.UserId != 0 {
+			user = fmt.Sprint(revocation.UserId)
+		}
+		revocationId := "-"
+		if revocation.RevocationId != "" {
+			revocationId = revocation.RevocationId
+		}
+		expires := "-"
+		if !revocation.ExpiresAt.IsZero() {
+			expires = revocation.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", revocation.RevokedAt.Format(time.RFC3339),
+			user, revocationId, expires, revocation.Reason)
+	}
+	return writer.Flush()
+}
+
+// runRevocationPrune removes revocations of tokens which have expired.
+func runRevocationPrune(args []string) error {
+	flagSet := flag.NewFlagSet("revocation prune", flag.ExitOnError)
+	flagSet.Parse(args)
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	pruned, err := dbInstance.PruneRevocations(time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pruned %d revocations\n", pruned)
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+	"biscuitExample/sshgateway"
+)
+
+// runSSHServe serves git over SSH until the process is stopped.
+func runSSHServe(args []string) error {
+	flagSet := flag.NewFlagSet("ssh-serve", flag.ExitOnError)
+	addr := flagSet.String("addr", "localhost:2222", "address to listen on")
+	hostKeyPath := flagSet.String("host-key", "forgeHost.key", "file holding the OpenSSH host key, created if missing")
+	authorizedKeysPath := flagSet.String("authorized-keys", "", "file of authorized keys, each line prefixed with the id of the user the key belongs to, used instead of the SSH key registry in the db")
+	repoDir := flagSet.String("repo-dir", "repos", "directory holding the bare repos, named <reponame>.git")
+	keyPath := flagSet.String("key", defaultKeyPath, "file holding the hex encoded root key seed, which tokens presented by clients are verified against")
+	acceptUnregistered := flagSet.Bool("accept-unregistered-keys", false, "let clients with unregistered keys connect if they present a token in FORGE_TOKEN, for runners with key-bound tokens")
+	flagSet.Parse(args)
+
+	hostKey, err := sshgateway.LoadHostKey(*hostKeyPath)
+	if err != nil {
+		return err
+	}
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+	authz.SetRevocationStore(dbInstance)
+
+	var keys sshgateway.KeyLookup = sshgateway.NewRegisteredKeys(dbInstance)
+	if *authorizedKeysPath != "" {
+		keys, err = sshgateway.LoadAuthorizedKeys(*authorizedKeysPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	tokenIssuer, err := authz.LoadTokenIssuer(*keyPath)
+	if err != nil {
+		return fmt.Errorf("error when creating biscuit token issuer: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("error when listening on %s: %w", *addr, err)
+	}
+	gateway := sshgateway.NewGateway(dbInstance, tokenIssuer, keys, hostKey, *repoDir)
+	if *acceptUnregistered {
+		gateway.AcceptUnregisteredKeys()
+	}
+	log.Printf("Serving git over SSH on %s", *addr)
+	return gateway.Serve(listener)
+}
+
+// runSSHKey dispatches the ssh-key subcommands.
+func runSSHKey(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected an ssh-key subcommand: add, list or remove")
+	}
+	switch args[0] {
+	case "add":
+		return runSSHKeyAdd(args[1:])
+	case "list":
+		return runSSHKeyList(args[1:])
+	case "remove":
+		return runSSHKeyRemove(args[1:])
+	default:
+		return fmt.Errorf("unknown ssh-key subcommand: %s", args[0])
+	}
+}
+
+// runSSHKeyAdd registers a public key for a user, or as a deploy key for a service account, and prints the registry entry.
+func runSSHKeyAdd(args []string) error {
+	flagSet := flag.NewFlagSet("ssh-key add", flag.ExitOnError)
+	userId := flagSet.Int("user", 0, "user id the key belongs to")
+	serviceAccountId := flagSet.Int("service", 0, "service account id a deploy key belongs to, instead of -user")
+	keyPath := flagSet.String("key-file", "", "file holding the public key in authorized_keys format, e.g. id_ed25519.pub")
+	repoId := flagSet.Int("repo", 0, "only allow the key to be used for this repo id")
+	readOnly := flagSet.Bool("read-only", false, "only allow the key to be used for reads")
+	title := flagSet.String("title", "", "label for the key (defaults to the key's comment)")
+	flagSet.Parse(args)
+
+	if (*userId == 0) == (*serviceAccountId == 0) {
+		return fmt.Errorf("exactly one of -user and -service is required")
+	}
+	if *keyPath == "" {
+		return fmt.Errorf("-key-file is required")
+	}
+	authorizedKey, err := os.ReadFile(*keyPath)
+	if err != nil {
+		return fmt.Errorf("error when reading public key from %s: %w", *keyPath, err)
+	}
+	sshKey, err := sshgateway.ParseSSHKey(string(authorizedKey))
+	if err != nil {
+		return err
+	}
+	sshKey.UserId = *userId
+	sshKey.ServiceAccountId = *serviceAccountId
+	sshKey.RepoId = *repoId
+	sshKey.ReadOnly = *readOnly
+	if *title != "" {
+		sshKey.Title = *title
+	}
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+	err = dbInstance.AddSSHKey(sshKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added key %d: %s\n", sshKey.Id, sshKey.Fingerprint)
+	return nil
+}
+
+// runSSHKeyList prints the registered keys, optionally only for one user.
+func runSSHKeyList(args []string) error {
+	flagSet := flag.NewFlagSet("ssh-key list", flag.ExitOnError)
+	userId := flagSet.Int("user", 0, "only list the keys of this user id")
+	flagSet.Parse(args)
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+	sshKeys, err := dbInstance.ListSSHKeys(*userId)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tFINGERPRINT\tUSER\tSERVICE\tREPO\tREAD ONLY\tTITLE")
+	for _, sshKey := range sshKeys {
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%d\t%d\t%t\t%s\n", sshKey.Id, sshKey.Fingerprint, sshKey.UserId, sshKey.ServiceAccountId,
+			sshKey.RepoId, sshKey.ReadOnly, sshKey.Title)
+	}
+	return writer.Flush()
+}
+
+// runSSHKeyRemove removes a key from the registry.
+func runSSHKeyRemove(args []string) error {
+	flagSet := flag.NewFlagSet("ssh-key remove", flag.ExitOnError)
+	id := flagSet.Int("id", 0, "id of the key to remove, as printed by ssh-key list")
+	flagSet.Parse(args)
+
+	if *id == 0 {
+		return fmt.Errorf("-id is required")
+	}
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+	return dbInstance.RemoveSSHKey(*id)
+}
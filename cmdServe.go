@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+	"biscuitExample/httpapi"
+)
+
+// runServe serves the HTTP API until the process is stopped.
+func runServe(args []string) error {
+	flagSet := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flagSet.String("addr", "localhost:8080", "address to listen on")
+	issuer := addIssuerFlags(flagSet, defaultKeyPath)
+	adminSecretEnv := flagSet.String("admin-secret-env", "FORGE_ADMIN_SECRET", "environment variable holding the bearer secret for admin endpoints, which are disabled if it is unset")
+	introspectionSecretEnv := flagSet.String("introspection-secret-env", "FORGE_INTROSPECTION_SECRET", "environment variable holding the bearer secret for the introspection endpoint, which is disabled if it is unset")
+	standInApproval := flagSet.Bool("stand-in-device-approval", false, "serve a device login approval page which lets anyone approve as any user, for local testing only")
+	flagSet.Parse(args)
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+	authz.SetRevocationStore(dbInstance)
+
+	tokenIssuer, _, err := issuer.build()
+	if err != nil {
+		return err
+	}
+	tokenIssuer.Ledger = dbInstance
+
+	adminSecret := os.Getenv(*adminSecretEnv)
+	if adminSecret == "" {
+		log.Printf("%s is not set, admin endpoints are disabled", *adminSecretEnv)
+	}
+
+	introspectionSecret := os.Getenv(*introspectionSecretEnv)
+	if introspectionSecret == "" {
+		log.Printf("%s is not set, the introspection endpoint is disabled", *introspectionSecretEnv)
+	}
+
+	server := httpapi.NewServer(dbInstance, tokenIssuer, adminSecret, introspectionSecret)
+	if *standInApproval {
+		log.Printf("Serving the stand-in device approval page, anyone can approve device logins as any user")
+		server.EnableStandInApproval()
+	}
+
+	log.Printf("Listening on %s", *addr)
+	return http.ListenAndServe(*addr, server)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// defaultKeyPath is the root key file used by commands which hand tokens out of the process.
+const defaultKeyPath = "forgeRoot.key"
+
+// runToken dispatches the token subcommands.
+func runToken(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected a token subcommand: issue, seal, list, show or prune")
+	}
+	switch args[0] {
+	case "issue":
+		return runTokenIssue(args[1:])
+	case "seal":
+		return runTokenSeal(args[1:])
+	case "list":
+		return runTokenList(args[1:])
+	case "show":
+		return runTokenShow(args[1:])
+	case "prune":
+		return runTokenPrune(args[1:])
+	default:
+		return fmt.Errorf("unknown token subcommand: %s", args[0])
+	}
+}
+
+// runTokenIssue issues a token to a user or service account, records it in the ledger and prints it.
+func runTokenIssue(args []string) error {
+	flagSet := flag.NewFlagSet("token issue", flag.ExitOnError)
+	userId := flagSet.Int("user", 0, "user id to issue the token to")
+	serviceAccountId := flagSet.Int("service", 0, "service account id to issue the token to, instead of -user")
+	name := flagSet.String("name", "", "label recorded in the ledger")
+	description := flagSet.String("description", "", "description recorded in the ledger")
+	kind := flagSet.String("kind", "", "kind of token recorded in the ledger, e.g. deploy")
+	seal := flagSet.Bool("seal", false, "seal the token so no blocks can be appended to it")
+	bindKey := flagSet.String("bind-key", "", "bind the token to a key, given as a fingerprint or a public key file, so it is only accepted from clients proving they hold the key")
+	issuer := addIssuerFlags(flagSet, defaultKeyPath)
+	flagSet.Parse(args)
+
+	if (*userId == 0) == (*serviceAccountId == 0) {
+		return fmt.Errorf("exactly one of -user and -service is required")
+	}
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	tokenIssuer, issueOptions, err := issuer.build()
+	if err != nil {
+		return err
+	}
+	tokenIssuer.Ledger = dbInstance
+	issueOptions.Name = *name
+	issueOptions.Description = *description
+	issueOptions.Kind = *kind
+	issueOptions.BoundKey, err = boundKeyFingerprint(*bindKey)
+	if err != nil {
+		return err
+	}
+
+	var biscuitToken *biscuit.Biscuit
+	if *serviceAccountId != 0 {
+		biscuitToken, err = tokenIssuer.IssueServiceToken(*serviceAccountId, issueOptions)
+	} else {
+		biscuitToken, err = tokenIssuer.IssueTokenWithOptions(*userId, issueOptions)
+	}
+	if err != nil {
+		return fmt.Errorf("error when issuing biscuit token: %w", err)
+	}
+	if *seal {
+		biscuitToken, err = authz.SealBiscuit(biscuitToken)
+		if err != nil {
+			return err
+		}
+	}
+	encoded, err := authz.EncodeToken(biscuitToken)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encoded)
+	return nil
+}
+
+// runTokenSeal seals an encoded token and prints it.
+func runTokenSeal(args []string) error {
+	flagSet := flag.NewFlagSet("token seal", flag.ExitOnError)
+	tokenStr := flagSet.String("token", "", "encoded token to seal")
+	flagSet.Parse(args)
+	if *tokenStr == "" {
+		return fmt.Errorf("-token is required")
+	}
+
+	biscuitToken, err := authz.DecodeToken(*tokenStr)
+	if err != nil {
+		return err
+	}
+	sealedToken, err := authz.SealBiscuit(biscuitToken)
+	if err != nil {
+		return err
+	}
+	encoded, err := authz.EncodeToken(sealedToken)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encoded)
+	return nil
+}
+
+// formatExpiry renders an expiry for display, "never" for the zero time.
+func formatExpiry(expiresAt time.Time) string {
+	if expiresAt.IsZero() {
+		return "never"
+	}
+	return expiresAt.Format(time.RFC3339)
+}
+
+// runTokenList prints the ledger entries, optionally only for one user.
+func runTokenList(args []string) error {
+	flagSet := flag.NewFlagSet("token list", flag.ExitOnError)
+	userId := flagSet.Int("user", 0, "only list tokens issued to this user id")
+	flagSet.Parse(args)
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	issuedTokens, err := dbInstance.ListIssuedTokens(*userId)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TOKEN ID\tUSER\tSERVICE\tKEY ID\tCREATED\tEXPIRES\tNAME")
+	for _, issuedToken := range issuedTokens {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", issuedToken.TokenId, issuedToken.UserId, issuedToken.ServiceAccountId, issuedToken.KeyId,
+			issuedToken.CreatedAt.Format(time.RFC3339), formatExpiry(issuedToken.ExpiresAt), issuedToken.Name)
+	}
+	return writer.Flush()
+}
+
+// runTokenShow prints a ledger entry as JSON.
+func runTokenShow(args []string) error {
+	flagSet := flag.NewFlagSet("token show", flag.ExitOnError)
+	flagSet.Parse(args)
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("expected a token id")
+	}
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	issuedToken, err := dbInstance.GetIssuedToken(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+	prettyBytes, err := json.MarshalIndent(issuedToken, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error when marshalling token: %w", err)
+	}
+	fmt.Println(string(prettyBytes))
+	return nil
+}
+
+// runTokenPrune removes ledger entries of expired tokens. Expired entries are also removed whenever a token is issued.
+func runTokenPrune(args []string) error {
+	flagSet := flag.NewFlagSet("token prune", flag.ExitOnError)
+	flagSet.Parse(args)
+
+	dbInstance, err := dblogic.InitDb()
+	if err != nil {
+		return fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+
+	pruned, err := dbInstance.PruneIssuedTokens(time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pruned %d tokens\n", pruned)
+	return nil
+}
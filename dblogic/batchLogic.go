@@ -0,0 +1,344 @@
+package dblogic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// bindInts returns a bind list of one "?" per id for an IN clause, and the ids as the matching bind params. SQLite accepts an empty IN list, which matches nothing.
+func bindInts(ids []int) (string, []interface{}) {
+	bindList := make([]string, 0, len(ids))
+	params := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		bindList = append(bindList, "?")
+		params = append(params, id)
+	}
+	return strings.Join(bindList, ", "), params
+}
+
+// getRepoIds will get the ids of the repos in reponames, keyed by name. Repos which are not in the database are left out. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getRepoIds(reponames []string, sqlTx *sql.Tx) (map[string]int, error) {
+	bindList := make([]string, 0, len(reponames))
+	params := make([]interface{}, 0, len(reponames))
+	for _, reponame := range reponames {
+		bindList = append(bindList, "?")
+		params = append(params, reponame)
+	}
+	getReposQuery := fmt.Sprintf("SELECT id, reponame FROM Repos WHERE reponame IN ( %s )", strings.Join(bindList, ", "))
+	sqlRows, err := sqlTx.Query(getReposQuery, params...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying for repos from DB: %w", err)
+	}
+	defer sqlRows.Close()
+
+	repoIds := map[string]int{}
+	for sqlRows.Next() {
+		var repoId int
+		var reponame string
+		if err := sqlRows.Scan(&repoId, &reponame); err != nil {
+			return nil, fmt.Errorf("error when scanning for repos: %w", err)
+		}
+		repoIds[reponame] = repoId
+	}
+	return repoIds, sqlRows.Err()
+}
+
+// getBatchRepogroupRels is getRepogroupRels for several repos, keyed by repo id. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getBatchRepogroupRels(repoIds []int, sqlTx *sql.Tx) (map[int][]*RepogroupRel, error) {
+	repoBindList, params := bindInts(repoIds)
+	getRepogroupQuery := fmt.Sprintf("SELECT repogroup_id, repo_id FROM RepoGroup_membership WHERE repo_id IN ( %s )", repoBindList)
+	sqlRows, err := sqlTx.Query(getRepogroupQuery, params...)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for repogroup membership: %w", err)
+	}
+	defer sqlRows.Close()
+
+	repogroupRels := map[int][]*RepogroupRel{}
+	for sqlRows.Next() {
+		repogroupRel := &RepogroupRel{}
+		if err := sqlRows.Scan(&repogroupRel.RepogroupId, &repogroupRel.RepoId); err != nil {
+			return nil, fmt.Errorf("error when scanning for repogroups: %w", err)
+		}
+		repogroupRels[repogroupRel.RepoId] = append(repogroupRels[repogroupRel.RepoId], repogroupRel)
+	}
+	return repogroupRels, sqlRows.Err()
+}
+
+// queryGrants runs query, whose rows are the id of the repo or repogroup a role is granted on, the id of the user, usergroup or service account it is granted to, and the role name, and returns the rows as AssignedRoles. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func queryGrants(query string, params []interface{}, userOrGroup UserOrGroupRel, repoOrGroup RepoOrGroupRel, sqlTx *sql.Tx) ([]*AssignedRole, error) {
+	sqlRows, err := sqlTx.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for role grants: %w", err)
+	}
+	defer sqlRows.Close()
+
+	assignedRoles := []*AssignedRole{}
+	for sqlRows.Next() {
+		var roleNameStr string
+		assignedRole := &AssignedRole{
+			UserOrGroup: userOrGroup,
+			RepoOrGroup: repoOrGroup,
+		}
+		if err := sqlRows.Scan(&assignedRole.RepoOrGroupID, &assignedRole.UserOrGroupID, &roleNameStr); err != nil {
+			return nil, fmt.Errorf("error when scanning for role grants: %w", err)
+		}
+		assignedRole.RepoRole, err = repoRoleStrToEnum(roleNameStr, repoOrGroup == RepogroupUGR)
+		if err != nil {
+			return nil, fmt.Errorf("error when mapping db role to enum: %w", err)
+		}
+		assignedRoles = append(assignedRoles, assignedRole)
+	}
+	return assignedRoles, sqlRows.Err()
+}
+
+// batchTargets are the repos of a batch and the repogroups they are in.
+type batchTargets struct {
+	// repoIds are the ids of the repos found, keyed by name
+	repoIds map[string]int
+	// repogroupRels are the repogroups of each repo, keyed by repo id
+	repogroupRels map[int][]*RepogroupRel
+}
+
+// getBatchTargets looks up the repos in reponames and their repogroups. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getBatchTargets(reponames []string, sqlTx *sql.Tx) (*batchTargets, error) {
+	repoIds, err := getRepoIds(reponames, sqlTx)
+	if err != nil {
+		return nil, fmt.Errorf("error from getRepoIds: %w", err)
+	}
+	targets := &batchTargets{repoIds: repoIds}
+	targets.repogroupRels, err = getBatchRepogroupRels(targets.repoIdList(), sqlTx)
+	if err != nil {
+		return nil, fmt.Errorf("error from getBatchRepogroupRels: %w", err)
+	}
+	return targets, nil
+}
+
+// idList returns the ids in the set ids.
+func idList(ids map[int]bool) []int {
+	list := make([]int, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+	return list
+}
+
+// repoIdList returns the ids of the repos found. Names are unique, so are the ids.
+func (targets *batchTargets) repoIdList() []int {
+	repoIds := make([]int, 0, len(targets.repoIds))
+	for _, repoId := range targets.repoIds {
+		repoIds = append(repoIds, repoId)
+	}
+	return repoIds
+}
+
+// repogroupIdList returns the ids of the repogroups the repos found are in.
+func (targets *batchTargets) repogroupIdList() []int {
+	repogroupIds := map[int]bool{}
+	for _, repogroupRels := range targets.repogroupRels {
+		for _, repogroupRel := range repogroupRels {
+			repogroupIds[repogroupRel.RepogroupId] = true
+		}
+	}
+	return idList(repogroupIds)
+}
+
+// requestDetails returns an entry for each of reponames, copying principal and giving each repo the grants on it and its repogroups. Entries for repos which were not found are nil.
+func (targets *batchTargets) requestDetails(principal RequestDetails, reponames []string, grants []*AssignedRole) []*RequestDetails {
+	batch := make([]*RequestDetails, len(reponames))
+	for i, reponame := range reponames {
+		repoId, found := targets.repoIds[reponame]
+		if !found {
+			continue
+		}
+		reqDetails := principal
+		reqDetails.RepoId = repoId
+		reqDetails.RepoName = reponame
+		reqDetails.RepogroupRels = []*RepogroupRel{}
+		inRepogroup := map[int]bool{}
+		for _, repogroupRel := range targets.repogroupRels[repoId] {
+			reqDetails.RepogroupRels = append(reqDetails.RepogroupRels, repogroupRel)
+			inRepogroup[repogroupRel.RepogroupId] = true
+		}
+		reqDetails.AssignedRoles = []*AssignedRole{}
+		for _, grant := range grants {
+			if (grant.RepoOrGroup == RepoUGR && grant.RepoOrGroupID == repoId) ||
+				(grant.RepoOrGroup == RepogroupUGR && inRepogroup[grant.RepoOrGroupID]) {
+				reqDetails.AssignedRoles = append(reqDetails.AssignedRoles, grant)
+			}
+		}
+		batch[i] = &reqDetails
+	}
+	return batch
+}
+
+// GatherBatchRequestDetails is GatherRequestDetails for many repos at once, for pages which list repos. The user and their usergroups are looked up once and the grants on all the repos and their repogroups are fetched together, in one transaction. The result has an entry for each of reponames in order, which is nil if there is no such repo.
+func GatherBatchRequestDetails(userId int, reponames []string, dbInstance *DBInstance) ([]*RequestDetails, error) {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when making Tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+
+	username, err := checkUserInDb(userId, sqlTx)
+	if err != nil {
+		return nil, fmt.Errorf("error from checkUserInDb: %w", err)
+	}
+	usergroupRels, err := getUsergroupsRecursive(userId, sqlTx)
+	if err != nil {
+		return nil, fmt.Errorf("error from getUsergroupsRecursive: %w", err)
+	}
+	targets, err := getBatchTargets(reponames, sqlTx)
+	if err != nil {
+		return nil, err
+	}
+
+	usergroupIds := map[int]bool{}
+	for _, userInGroup := range usergroupRels.UserInGroups {
+		usergroupIds[userInGroup.UsergroupId] = true
+	}
+	for _, userGroupInGroup := range usergroupRels.UserGroupInGroups {
+		usergroupIds[userGroupInGroup.ChildUsergroupId] = true
+	}
+	usergroupBindList, usergroupParams := bindInts(idList(usergroupIds))
+	repoBindList, repoParams := bindInts(targets.repoIdList())
+	repogroupBindList, repogroupParams := bindInts(targets.repogroupIdList())
+
+	grantQueries := []struct {
+		query       string
+		params      []interface{}
+		userOrGroup UserOrGroupRel
+		repoOrGroup RepoOrGroupRel
+	}{
+		{
+			query: fmt.Sprintf(`SELECT Repo_Roles_membership_Users.repo_id,
+         Repo_Roles_membership_Users.user_id,
+         repo_roles_enum.rolename
+FROM Repo_Roles_membership_Users
+INNER JOIN repo_roles_enum
+    ON repo_roles_enum.id = Repo_Roles_membership_Users.repo_role
+WHERE Repo_Roles_membership_Users.user_id = ?
+        AND Repo_Roles_membership_Users.repo_id IN ( %s )`, repoBindList),
+			params:      append([]interface{}{userId}, repoParams...),
+			userOrGroup: UserUGR,
+			repoOrGroup: RepoUGR,
+		},
+		{
+			query: fmt.Sprintf(`SELECT Repo_Roles_membership_UserGroups.repo_id,
+         Repo_Roles_membership_UserGroups.usergroup_id,
+         repo_roles_enum.rolename
+FROM Repo_Roles_membership_UserGroups
+INNER JOIN repo_roles_enum
+    ON repo_roles_enum.id = Repo_Roles_membership_UserGroups.repo_role
+WHERE Repo_Roles_membership_UserGroups.usergroup_id IN ( %s )
+        AND Repo_Roles_membership_UserGroups.repo_id IN ( %s )`, usergroupBindList, repoBindList),
+			params:      append(append([]interface{}{}, usergroupParams...), repoParams...),
+			userOrGroup: UsergroupUGR,
+			repoOrGroup: RepoUGR,
+		},
+		{
+			query: fmt.Sprintf(`SELECT RepoGroup_Roles_membership_Users.repogroup_id,
+         RepoGroup_Roles_membership_Users.user_id,
+         repogroup_roles_enum.rolename
+FROM RepoGroup_Roles_membership_Users
+INNER JOIN repogroup_roles_enum
+    ON RepoGroup_Roles_membership_Users.repogroup_role = repogroup_roles_enum.id
+WHERE RepoGroup_Roles_membership_Users.user_id = ?
+        AND RepoGroup_Roles_membership_Users.repogroup_id IN ( %s )`, repogroupBindList),
+			params:      append([]interface{}{userId}, repogroupParams...),
+			userOrGroup: UserUGR,
+			repoOrGroup: RepogroupUGR,
+		},
+		{
+			query: fmt.Sprintf(`SELECT RepoGroup_Roles_membership_Usergroup.repogroup_id,
+         RepoGroup_Roles_membership_Usergroup.usergroup_id,
+         repogroup_roles_enum.rolename
+FROM RepoGroup_Roles_membership_Usergroup
+INNER JOIN repogroup_roles_enum
+    ON RepoGroup_Roles_membership_Usergroup.repogroup_role = repogroup_roles_enum.id
+WHERE RepoGroup_Roles_membership_Usergroup.usergroup_id IN ( %s )
+        AND RepoGroup_Roles_membership_Usergroup.repogroup_id IN ( %s )`, usergroupBindList, repogroupBindList),
+			params:      append(append([]interface{}{}, usergroupParams...), repogroupParams...),
+			userOrGroup: UsergroupUGR,
+			repoOrGroup: RepogroupUGR,
+		},
+	}
+	grants := []*AssignedRole{}
+	for _, grantQuery := range grantQueries {
+		assignedRoles, err := queryGrants(grantQuery.query, grantQuery.params, grantQuery.userOrGroup, grantQuery.repoOrGroup, sqlTx)
+		if err != nil {
+			return nil, fmt.Errorf("error from queryGrants: %w", err)
+		}
+		grants = append(grants, assignedRoles...)
+	}
+
+	err = sqlTx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error when cleaning up sqlite Tx: %w", err)
+	}
+
+	principal := RequestDetails{
+		UserId:                 userId,
+		Username:               username,
+		UsergroupRelationships: usergroupRels,
+	}
+	return targets.requestDetails(principal, reponames, grants), nil
+}
+
+// GatherServiceBatchRequestDetails is GatherBatchRequestDetails for a service account, gathering only its direct grants on the repos and their repogroups.
+func GatherServiceBatchRequestDetails(serviceAccountId int, reponames []string, dbInstance *DBInstance) ([]*RequestDetails, error) {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when making Tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+
+	name, err := checkServiceAccountInDb(serviceAccountId, sqlTx)
+	if err != nil {
+		return nil, fmt.Errorf("error from checkServiceAccountInDb: %w", err)
+	}
+	targets, err := getBatchTargets(reponames, sqlTx)
+	if err != nil {
+		return nil, err
+	}
+
+	repoBindList, repoParams := bindInts(targets.repoIdList())
+	repoGrants, err := queryGrants(fmt.Sprintf(`SELECT Repo_Roles_membership_ServiceAccounts.repo_id,
+         Repo_Roles_membership_ServiceAccounts.service_account_id,
+         repo_roles_enum.rolename
+FROM Repo_Roles_membership_ServiceAccounts
+INNER JOIN repo_roles_enum
+    ON repo_roles_enum.id = Repo_Roles_membership_ServiceAccounts.repo_role
+WHERE Repo_Roles_membership_ServiceAccounts.service_account_id = ?
+        AND Repo_Roles_membership_ServiceAccounts.repo_id IN ( %s )`, repoBindList),
+		append([]interface{}{serviceAccountId}, repoParams...), ServiceAccountUGR, RepoUGR, sqlTx)
+	if err != nil {
+		return nil, fmt.Errorf("error from queryGrants: %w", err)
+	}
+	repogroupBindList, repogroupParams := bindInts(targets.repogroupIdList())
+	repogroupGrants, err := queryGrants(fmt.Sprintf(`SELECT RepoGroup_Roles_membership_ServiceAccounts.repogroup_id,
+         RepoGroup_Roles_membership_ServiceAccounts.service_account_id,
+         repogroup_roles_enum.rolename
+FROM RepoGroup_Roles_membership_ServiceAccounts
+INNER JOIN repogroup_roles_enum
+    ON RepoGroup_Roles_membership_ServiceAccounts.repogroup_role = repogroup_roles_enum.id
+WHERE RepoGroup_Roles_membership_ServiceAccounts.service_account_id = ?
+        AND RepoGroup_Roles_membership_ServiceAccounts.repogroup_id IN ( %s )`, repogroupBindList),
+		append([]interface{}{serviceAccountId}, repogroupParams...), ServiceAccountUGR, RepogroupUGR, sqlTx)
+	if err != nil {
+		return nil, fmt.Errorf("error from queryGrants: %w", err)
+	}
+
+	err = sqlTx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error when cleaning up sqlite Tx: %w", err)
+	}
+
+	principal := RequestDetails{
+		ServiceAccountId:       serviceAccountId,
+		ServiceAccountName:     name,
+		UsergroupRelationships: &UsergroupRelationships{},
+	}
+	return targets.requestDetails(principal, reponames, append(repoGrants, repogroupGrants...)), nil
+}
@@ -43,6 +43,23 @@ INSERT INTO repo_roles_enum (
                             );
 
 
+-- Table: Repo_Roles_membership_ServiceAccounts
+-- Created by db-serviceAccounts.sql.
+
+INSERT INTO Repo_Roles_membership_ServiceAccounts (
+                                                      id,
+                                                      repo_id,
+                                                      service_account_id,
+                                                      repo_role
+                                                  )
+                                                  VALUES (
+                                                      1,
+                                                      1,
+                                                      2,
+                                                      1
+                                                  );
+
+
 -- Table: Repo_Roles_membership_UserGroups
 CREATE TABLE IF NOT EXISTS Repo_Roles_membership_UserGroups (
     id           INTEGER PRIMARY KEY
@@ -159,6 +176,23 @@ INSERT INTO repogroup_roles_enum (
                                  );
 
 
+-- Table: RepoGroup_Roles_membership_ServiceAccounts
+-- Created by db-serviceAccounts.sql.
+
+INSERT INTO RepoGroup_Roles_membership_ServiceAccounts (
+                                                           id,
+                                                           repogroup_id,
+                                                           service_account_id,
+                                                           repogroup_role
+                                                       )
+                                                       VALUES (
+                                                           1,
+                                                           1,
+                                                           1,
+                                                           2
+                                                       );
+
+
 -- Table: RepoGroup_Roles_membership_Usergroup
 CREATE TABLE IF NOT EXISTS RepoGroup_Roles_membership_Usergroup (
     id             INTEGER PRIMARY KEY
@@ -256,6 +290,28 @@ INSERT INTO Repos (
                   );
 
 
+-- Table: service_accounts
+-- Created by db-serviceAccounts.sql.
+
+INSERT INTO service_accounts (
+                                id,
+                                name
+                            )
+                            VALUES (
+                                1,
+                                'ci-bot'
+                            );
+
+INSERT INTO service_accounts (
+                                id,
+                                name
+                            )
+                            VALUES (
+                                2,
+                                'deploy-bot'
+                            );
+
+
 -- Table: UserGroup_membership_usergroups
 CREATE TABLE IF NOT EXISTS UserGroup_membership_usergroups (
     id                 INTEGER PRIMARY KEY
@@ -0,0 +1,32 @@
+--
+-- SSH key registry. Like db-tokens.sql this holds no example data and is
+-- applied on every open, so every statement must be idempotent.
+--
+
+-- Table: ssh_keys
+-- Public keys which authenticate to the SSH gateway, each belonging to
+-- either a user or, as a deploy key, a service account; the other id is 0.
+-- fingerprint is the OpenSSH SHA256 fingerprint and public_key the key in
+-- authorized_keys format. A key with a repo_id only works for that repo, and
+-- a read_only key only for reads.
+CREATE TABLE IF NOT EXISTS ssh_keys (
+    id                 INTEGER PRIMARY KEY
+                               NOT NULL,
+    fingerprint        TEXT    UNIQUE
+                               NOT NULL,
+    public_key         TEXT    NOT NULL,
+    user_id            INTEGER NOT NULL
+                               DEFAULT 0,
+    service_account_id INTEGER NOT NULL
+                               DEFAULT 0,
+    repo_id            INTEGER NOT NULL
+                               DEFAULT 0,
+    read_only          INTEGER NOT NULL
+                               DEFAULT 0,
+    title              TEXT    NOT NULL
+                               DEFAULT '',
+    created_at         INTEGER NOT NULL,
+    CHECK ( (user_id = 0) != (service_account_id = 0) ) 
+);
+
+CREATE INDEX IF NOT EXISTS ssh_keys_user_id ON ssh_keys (user_id);
@@ -0,0 +1,44 @@
+--
+-- Service accounts and their role grants. These were added after db-init.sql
+-- was first used, so like db-tokens.sql they are applied on every open, before
+-- db-init.sql for a new db, and every statement must be idempotent. The
+-- example service accounts and grants are in db-init.sql.
+--
+
+-- Table: service_accounts
+-- Non-human principals such as CI systems and deploy bots.
+CREATE TABLE IF NOT EXISTS service_accounts (
+    id   INTEGER PRIMARY KEY
+                 UNIQUE
+                 NOT NULL,
+    name TEXT    UNIQUE
+                 NOT NULL
+);
+
+-- Table: Repo_Roles_membership_ServiceAccounts
+-- Service accounts never hold the owner role.
+CREATE TABLE IF NOT EXISTS Repo_Roles_membership_ServiceAccounts (
+    id                 INTEGER PRIMARY KEY
+                               UNIQUE
+                               NOT NULL,
+    repo_id            INTEGER REFERENCES Repos (id) ON DELETE CASCADE
+                               NOT NULL,
+    service_account_id INTEGER NOT NULL
+                               REFERENCES service_accounts (id) ON DELETE CASCADE,
+    repo_role          INTEGER REFERENCES repo_roles_enum (id) 
+                               NOT NULL
+                               CHECK (repo_role IN (1, 2) ) 
+);
+
+-- Table: RepoGroup_Roles_membership_ServiceAccounts
+CREATE TABLE IF NOT EXISTS RepoGroup_Roles_membership_ServiceAccounts (
+    id                 INTEGER PRIMARY KEY
+                               UNIQUE
+                               NOT NULL,
+    repogroup_id       INTEGER REFERENCES RepoGroups (id) ON DELETE CASCADE
+                               NOT NULL,
+    service_account_id INTEGER NOT NULL
+                               REFERENCES service_accounts (id) ON DELETE CASCADE,
+    repogroup_role     INTEGER REFERENCES repogroup_roles_enum (id) 
+                               NOT NULL
+);
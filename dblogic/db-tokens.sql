@@ -0,0 +1,69 @@
+--
+-- Token state: revocations and the issuance ledger. Unlike db-init.sql this
+-- holds no example data and is applied on every open, so every statement must
+-- be idempotent. CREATE TABLE IF NOT EXISTS leaves existing tables as they are,
+-- so a column added to a table here also needs a migration in
+-- migrationLogic.go for dbs created before it.
+--
+
+-- Table: revoked_tokens
+-- Biscuit revocation ids of revoked blocks, hex encoded. expires_at is the
+-- unix time the token expires, after which the row can be pruned.
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    revocation_id TEXT    PRIMARY KEY
+                          NOT NULL,
+    revoked_at    INTEGER NOT NULL,
+    expires_at    INTEGER,
+    reason        TEXT    NOT NULL
+                          DEFAULT ''
+);
+
+-- Table: revoked_users
+-- Every token issued to user_id at or before revoked_before (unix time) is
+-- revoked.
+CREATE TABLE IF NOT EXISTS revoked_users (
+    user_id        INTEGER PRIMARY KEY
+                           NOT NULL,
+    revoked_before INTEGER NOT NULL,
+    reason         TEXT    NOT NULL
+                           DEFAULT ''
+);
+
+-- Table: issued_tokens
+-- Ledger of every token minted by an issuer with a ledger. Rows are removed
+-- once the token has expired. Service account tokens have a user_id of 0.
+-- parent_token_id is the token an exchanged token was issued for, and is empty
+-- for other tokens.
+CREATE TABLE IF NOT EXISTS issued_tokens (
+    token_id           TEXT    PRIMARY KEY
+                               NOT NULL,
+    user_id            INTEGER NOT NULL,
+    service_account_id INTEGER NOT NULL
+                               DEFAULT 0,
+    key_id             TEXT    NOT NULL,
+    created_at         INTEGER NOT NULL,
+    expires_at         INTEGER,
+    name               TEXT    NOT NULL
+                               DEFAULT '',
+    description        TEXT    NOT NULL
+                               DEFAULT '',
+    kind               TEXT    NOT NULL
+                               DEFAULT '',
+    scope              TEXT    NOT NULL
+                               DEFAULT '',
+    parent_token_id    TEXT    NOT NULL
+                               DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS issued_tokens_user_id ON issued_tokens (user_id);
+
+CREATE INDEX IF NOT EXISTS issued_tokens_parent_token_id ON issued_tokens (parent_token_id);
+
+-- Table: issued_token_revocation_ids
+-- Hex encoded revocation ids of the blocks of each issued token.
+CREATE TABLE IF NOT EXISTS issued_token_revocation_ids (
+    revocation_id TEXT PRIMARY KEY
+                       NOT NULL,
+    token_id      TEXT NOT NULL
+                       REFERENCES issued_tokens (token_id) ON DELETE CASCADE
+);
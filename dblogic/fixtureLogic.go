@@ -0,0 +1,175 @@
+package dblogic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// NamedEntity is a user, usergroup, service account, repo or repogroup row.
+type NamedEntity struct {
+	// Id is the id of the entity
+	Id int
+	// Name is the username, groupname or reponame of the entity
+	Name string
+}
+
+// Fixtures is a set of rows to load into a database, such as for policy scenarios or tests.
+type Fixtures struct {
+	// Users are rows for the Users table
+	Users []*NamedEntity
+	// Usergroups are rows for the UserGroups table
+	Usergroups []*NamedEntity
+	// Repos are rows for the Repos table
+	Repos []*NamedEntity
+	// Repogroups are rows for the RepoGroups table
+	Repogroups []*NamedEntity
+	// ServiceAccounts are rows for the service_accounts table
+	ServiceAccounts []*NamedEntity
+	// UserInGroups are users to add to usergroups
+	UserInGroups []*UserInGroup
+	// UserGroupInGroups are usergroups to nest in other usergroups
+	UserGroupInGroups []*UserGroupInGroup
+	// RepogroupRels are repos to add to repogroups
+	RepogroupRels []*RepogroupRel
+	// AssignedRoles are role grants between users, usergroups or service accounts and repos or repogroups
+	AssignedRoles []*AssignedRole
+}
+
+// repoRoleEnumToStr converts the repo role enum to the rolename used in the role enum tables. Returns an error if unable to convert.
+func repoRoleEnumToStr(repoRole RepoRoleType, isRepogroup bool) (string, error) {
+	switch repoRole {
+	case OwnerRole:
+		if isRepogroup {
+			return "", fmt.Errorf("repogroups cannot have owner roles")
+		}
+		return "owner", nil
+	case ReaderRole:
+		return "reader", nil
+	case WriterRole:
+		return "writer", nil
+	default:
+		return "", fmt.Errorf("unable to convert %d", repoRole)
+	}
+}
+
+// insertAssignedRole inserts a single role grant into whichever of the role tables matches it. sqlTx will not be rolled back by this function if an error occurs.
+func insertAssignedRole(assignedRole *AssignedRole, sqlTx *sql.Tx) error {
+	isRepogroup := assignedRole.RepoOrGroup == RepogroupUGR
+	roleNameStr, err := repoRoleEnumToStr(assignedRole.RepoRole, isRepogroup)
+	if err != nil {
+		return fmt.Errorf("error when mapping role enum to db role: %w", err)
+	}
+	if assignedRole.UserOrGroup == ServiceAccountUGR && assignedRole.RepoRole == OwnerRole {
+		return fmt.Errorf("service accounts cannot have owner roles")
+	}
+
+	insertQuery := ""
+	switch {
+	case assignedRole.UserOrGroup == UserUGR && assignedRole.RepoOrGroup == RepoUGR:
+		insertQuery = `INSERT INTO Repo_Roles_membership_Users (user_id, repo_id, repo_role)
+SELECT $userorgroup, $repoorgroup, id FROM repo_roles_enum WHERE rolename = $rolename`
+	case assignedRole.UserOrGroup == UsergroupUGR && assignedRole.RepoOrGroup == RepoUGR:
+		insertQuery = `INSERT INTO Repo_Roles_membership_UserGroups (usergroup_id, repo_id, repo_role)
+SELECT $userorgroup, $repoorgroup, id FROM repo_roles_enum WHERE rolename = $rolename`
+	case assignedRole.UserOrGroup == UserUGR && assignedRole.RepoOrGroup == RepogroupUGR:
+		insertQuery = `INSERT INTO RepoGroup_Roles_membership_Users (user_id, repogroup_id, repogroup_role)
+SELECT $userorgroup, $repoorgroup, id FROM repogroup_roles_enum WHERE rolename = $rolename`
+	case assignedRole.UserOrGroup == UsergroupUGR && assignedRole.RepoOrGroup == RepogroupUGR:
+		insertQuery = `INSERT INTO RepoGroup_Roles_membership_Usergroup (usergroup_id, repogroup_id, repogroup_role)
+SELECT $userorgroup, $repoorgroup, id FROM repogroup_roles_enum WHERE rolename = $rolename`
+	case assignedRole.UserOrGroup == ServiceAccountUGR && assignedRole.RepoOrGroup == RepoUGR:
+		insertQuery = `INSERT INTO Repo_Roles_membership_ServiceAccounts (service_account_id, repo_id, repo_role)
+SELECT $userorgroup, $repoorgroup, id FROM repo_roles_enum WHERE rolename = $rolename`
+	case assignedRole.UserOrGroup == ServiceAccountUGR && assignedRole.RepoOrGroup == RepogroupUGR:
+		insertQuery = `INSERT INTO RepoGroup_Roles_membership_ServiceAccounts (service_account_id, repogroup_id, repogroup_role)
+SELECT $userorgroup, $repoorgroup, id FROM repogroup_roles_enum WHERE rolename = $rolename`
+	default:
+		return fmt.Errorf("role assignment has undefined user or repo side")
+	}
+
+	_, err = sqlTx.Exec(insertQuery,
+		sql.Named("userorgroup", assignedRole.UserOrGroupID),
+		sql.Named("repoorgroup", assignedRole.RepoOrGroupID),
+		sql.Named("rolename", roleNameStr),
+	)
+	if err != nil {
+		return fmt.Errorf("error when inserting role assignment: %w", err)
+	}
+	return nil
+}
+
+// LoadFixtures inserts fixtures into the database in a single Tx. Nothing is inserted if an error occurs.
+func (dbInstance *DBInstance) LoadFixtures(fixtures *Fixtures) error {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("error when making Tx: %w", err)
+	}
+
+	namedInserts := []struct {
+		query    string
+		entities []*NamedEntity
+	}{
+		{"INSERT INTO Users (id, username) VALUES ($id, $name)", fixtures.Users},
+		{"INSERT INTO UserGroups (id, groupname) VALUES ($id, $name)", fixtures.Usergroups},
+		{"INSERT INTO Repos (id, reponame) VALUES ($id, $name)", fixtures.Repos},
+		{"INSERT INTO RepoGroups (id, groupname) VALUES ($id, $name)", fixtures.Repogroups},
+		{"INSERT INTO service_accounts (id, name) VALUES ($id, $name)", fixtures.ServiceAccounts},
+	}
+	for _, namedInsert := range namedInserts {
+		for _, entity := range namedInsert.entities {
+			_, err = sqlTx.Exec(namedInsert.query,
+				sql.Named("id", entity.Id),
+				sql.Named("name", entity.Name),
+			)
+			if err != nil {
+				sqlTx.Rollback()
+				return fmt.Errorf("error when inserting %s: %w", entity.Name, err)
+			}
+		}
+	}
+
+	for _, userInGroup := range fixtures.UserInGroups {
+		_, err = sqlTx.Exec("INSERT INTO UserGroup_membership_users (usergroup_id, user_id) VALUES ($usergroupid, $userid)",
+			sql.Named("usergroupid", userInGroup.UsergroupId),
+			sql.Named("userid", userInGroup.UserId),
+		)
+		if err != nil {
+			sqlTx.Rollback()
+			return fmt.Errorf("error when inserting usergroup membership: %w", err)
+		}
+	}
+	for _, ugInUg := range fixtures.UserGroupInGroups {
+		_, err = sqlTx.Exec("INSERT INTO UserGroup_membership_usergroups (usergroup_id, child_usergroup_id) VALUES ($usergroupid, $childusergroupid)",
+			sql.Named("usergroupid", ugInUg.ParentUsergroupId),
+			sql.Named("childusergroupid", ugInUg.ChildUsergroupId),
+		)
+		if err != nil {
+			sqlTx.Rollback()
+			return fmt.Errorf("error when inserting nested usergroup: %w", err)
+		}
+	}
+	for _, repogroupRel := range fixtures.RepogroupRels {
+		_, err = sqlTx.Exec("INSERT INTO RepoGroup_membership (repogroup_id, repo_id) VALUES ($repogroupid, $repoid)",
+			sql.Named("repogroupid", repogroupRel.RepogroupId),
+			sql.Named("repoid", repogroupRel.RepoId),
+		)
+		if err != nil {
+			sqlTx.Rollback()
+			return fmt.Errorf("error when inserting repogroup membership: %w", err)
+		}
+	}
+	for _, assignedRole := range fixtures.AssignedRoles {
+		err = insertAssignedRole(assignedRole, sqlTx)
+		if err != nil {
+			sqlTx.Rollback()
+			return fmt.Errorf("error from insertAssignedRole: %w", err)
+		}
+	}
+
+	err = sqlTx.Commit()
+	if err != nil {
+		return fmt.Errorf("error when committing fixtures Tx: %w", err)
+	}
+	return nil
+}
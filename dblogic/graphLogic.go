@@ -0,0 +1,287 @@
+package dblogic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// OrgGraph is the full set of entities and relationships in the forge. Unlike RequestDetails it is not scoped to a single request and is intended for visualizing or auditing the authz data as a whole.
+type OrgGraph struct {
+	// Users maps user ids to usernames
+	Users map[int]string
+	// Usergroups maps usergroup ids to usergroup names
+	Usergroups map[int]string
+	// Repos maps repo ids to repo names
+	Repos map[int]string
+	// Repogroups maps repogroup ids to repogroup names
+	Repogroups map[int]string
+	// ServiceAccounts maps service account ids to service account names
+	ServiceAccounts map[int]string
+	// UserInGroups is every user to usergroup membership
+	UserInGroups []*UserInGroup
+	// UserGroupInGroups is every nested usergroup relationship
+	UserGroupInGroups []*UserGroupInGroup
+	// RepogroupRels is every repo to repogroup membership
+	RepogroupRels []*RepogroupRel
+	// AssignedRoles is every role grant between users, usergroups or service accounts and repos or repogroups
+	AssignedRoles []*AssignedRole
+}
+
+// getNamedEntities runs a query returning (id, name) rows and returns them as a map. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getNamedEntities(query string, sqlTx *sql.Tx) (map[int]string, error) {
+	sqlRows, err := sqlTx.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for named entities: %w", err)
+	}
+	defer sqlRows.Close()
+
+	entities := map[int]string{}
+	for sqlRows.Next() {
+		var id int
+		var name string
+		if err := sqlRows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("error when scanning for named entities: %w", err)
+		}
+		entities[id] = name
+	}
+	sqlRows.Close()
+
+	return entities, nil
+}
+
+// getAllUserInGroups will get every user to usergroup membership. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getAllUserInGroups(sqlTx *sql.Tx) ([]*UserInGroup, error) {
+	getMembershipQuery := "SELECT usergroup_id, user_id FROM UserGroup_membership_users"
+	sqlRows, err := sqlTx.Query(getMembershipQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for usergroup membership: %w", err)
+	}
+	defer sqlRows.Close()
+
+	userInGroups := []*UserInGroup{}
+	for sqlRows.Next() {
+		userInGroup := &UserInGroup{}
+		if err := sqlRows.Scan(&userInGroup.UsergroupId, &userInGroup.UserId); err != nil {
+			return nil, fmt.Errorf("error when scanning for usergroup membership: %w", err)
+		}
+		userInGroups = append(userInGroups, userInGroup)
+	}
+	sqlRows.Close()
+
+	return userInGroups, nil
+}
+
+// getAllUserGroupInGroups will get every nested usergroup relationship. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getAllUserGroupInGroups(sqlTx *sql.Tx) ([]*UserGroupInGroup, error) {
+	getNestingQuery := "SELECT usergroup_id, child_usergroup_id FROM UserGroup_membership_usergroups"
+	sqlRows, err := sqlTx.Query(getNestingQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for nested usergroups: %w", err)
+	}
+	defer sqlRows.Close()
+
+	usergroupInGroups := []*UserGroupInGroup{}
+	for sqlRows.Next() {
+		usergroupInGroup := &UserGroupInGroup{}
+		if err := sqlRows.Scan(&usergroupInGroup.ParentUsergroupId, &usergroupInGroup.ChildUsergroupId); err != nil {
+			return nil, fmt.Errorf("error when scanning for nested usergroups: %w", err)
+		}
+		usergroupInGroups = append(usergroupInGroups, usergroupInGroup)
+	}
+	sqlRows.Close()
+
+	return usergroupInGroups, nil
+}
+
+// getAllRepogroupRels will get every repo to repogroup membership. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getAllRepogroupRels(sqlTx *sql.Tx) ([]*RepogroupRel, error) {
+	getRepogroupQuery := "SELECT repogroup_id, repo_id FROM RepoGroup_membership"
+	sqlRows, err := sqlTx.Query(getRepogroupQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error when querying for repogroup membership: %w", err)
+	}
+	defer sqlRows.Close()
+
+	repogroupRels := []*RepogroupRel{}
+	for sqlRows.Next() {
+		repogroupRel := &RepogroupRel{}
+		if err := sqlRows.Scan(&repogroupRel.RepogroupId, &repogroupRel.RepoId); err != nil {
+			return nil, fmt.Errorf("error when scanning for repogroups: %w", err)
+		}
+		repogroupRels = append(repogroupRels, repogroupRel)
+	}
+	sqlRows.Close()
+
+	return repogroupRels, nil
+}
+
+// getAllAssignedRoles will get every role grant in the database, regardless of which user or repo it applies to. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getAllAssignedRoles(sqlTx *sql.Tx) ([]*AssignedRole, error) {
+	// Each of the role tables has the same shape once joined
+	// against its enum table, so they are queried in the same way.
+	roleQueries := []struct {
+		query       string
+		userOrGroup UserOrGroupRel
+		repoOrGroup RepoOrGroupRel
+	}{
+		{
+			query: `SELECT Repo_Roles_membership_Users.user_id,
+         Repo_Roles_membership_Users.repo_id,
+         repo_roles_enum.rolename
+FROM Repo_Roles_membership_Users
+INNER JOIN repo_roles_enum
+    ON repo_roles_enum.id = Repo_Roles_membership_Users.repo_role`,
+			userOrGroup: UserUGR,
+			repoOrGroup: RepoUGR,
+		},
+		{
+			query: `SELECT Repo_Roles_membership_UserGroups.usergroup_id,
+         Repo_Roles_membership_UserGroups.repo_id,
+         repo_roles_enum.rolename
+FROM Repo_Roles_membership_UserGroups
+INNER JOIN repo_roles_enum
+    ON repo_roles_enum.id = Repo_Roles_membership_UserGroups.repo_role`,
+			userOrGroup: UsergroupUGR,
+			repoOrGroup: RepoUGR,
+		},
+		{
+			query: `SELECT RepoGroup_Roles_membership_Users.user_id,
+         RepoGroup_Roles_membership_Users.repogroup_id,
+         repogroup_roles_enum.rolename
+FROM RepoGroup_Roles_membership_Users
+INNER JOIN repogroup_roles_enum
+    ON RepoGroup_Roles_membership_Users.repogroup_role = repogroup_roles_enum.id`,
+			userOrGroup: UserUGR,
+			repoOrGroup: RepogroupUGR,
+		},
+		{
+			query: `SELECT RepoGroup_Roles_membership_Usergroup.usergroup_id,
+         RepoGroup_Roles_membership_Usergroup.repogroup_id,
+         repogroup_roles_enum.rolename
+FROM RepoGroup_Roles_membership_Usergroup
+INNER JOIN repogroup_roles_enum
+    ON RepoGroup_Roles_membership_Usergroup.repogroup_role = repogroup_roles_enum.id`,
+			userOrGroup: UsergroupUGR,
+			repoOrGroup: RepogroupUGR,
+		},
+		{
+			query: `SELECT Repo_Roles_membership_ServiceAccounts.service_account_id,
+         Repo_Roles_membership_ServiceAccounts.repo_id,
+         repo_roles_enum.rolename
+FROM Repo_Roles_membership_ServiceAccounts
+INNER JOIN repo_roles_enum
+    ON repo_roles_enum.id = Repo_Roles_membership_ServiceAccounts.repo_role`,
+			userOrGroup: ServiceAccountUGR,
+			repoOrGroup: RepoUGR,
+		},
+		{
+			query: `SELECT RepoGroup_Roles_membership_ServiceAccounts.service_account_id,
+         RepoGroup_Roles_membership_ServiceAccounts.repogroup_id,
+         repogroup_roles_enum.rolename
+FROM RepoGroup_Roles_membership_ServiceAccounts
+INNER JOIN repogroup_roles_enum
+    ON RepoGroup_Roles_membership_ServiceAccounts.repogroup_role = repogroup_roles_enum.id`,
+			userOrGroup: ServiceAccountUGR,
+			repoOrGroup: RepogroupUGR,
+		},
+	}
+
+	assignedRoles := []*AssignedRole{}
+	for _, roleQuery := range roleQueries {
+		sqlRows, err := sqlTx.Query(roleQuery.query)
+		if err != nil {
+			return nil, fmt.Errorf("error when querying for role assignments: %w", err)
+		}
+		for sqlRows.Next() {
+			var userOrGroupId int
+			var repoOrGroupId int
+			var roleNameStr string
+			if err := sqlRows.Scan(&userOrGroupId, &repoOrGroupId, &roleNameStr); err != nil {
+				sqlRows.Close()
+				return nil, fmt.Errorf("error when scanning for role assignments: %w", err)
+			}
+			repoRole, err := repoRoleStrToEnum(roleNameStr, roleQuery.repoOrGroup == RepogroupUGR)
+			if err != nil {
+				sqlRows.Close()
+				return nil, fmt.Errorf("error when mapping db role to enum: %w", err)
+			}
+			assignedRole := &AssignedRole{
+				UserOrGroup:   roleQuery.userOrGroup,
+				UserOrGroupID: userOrGroupId,
+				RepoOrGroup:   roleQuery.repoOrGroup,
+				RepoOrGroupID: repoOrGroupId,
+				RepoRole:      repoRole,
+			}
+			assignedRoles = append(assignedRoles, assignedRole)
+		}
+		sqlRows.Close()
+	}
+
+	return assignedRoles, nil
+}
+
+// GatherOrgGraph loads every user, usergroup, service account, repo, repogroup and the relationships between them.
+func GatherOrgGraph(dbInstance *DBInstance) (*OrgGraph, error) {
+	orgGraph := &OrgGraph{}
+
+	// Same as GatherRequestDetails, use a Tx to get a consistent view across the queries.
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when making Tx: %w", err)
+	}
+
+	orgGraph.Users, err = getNamedEntities("SELECT id, username FROM Users", sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error when getting users: %w", err)
+	}
+	orgGraph.Usergroups, err = getNamedEntities("SELECT id, groupname FROM UserGroups", sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error when getting usergroups: %w", err)
+	}
+	orgGraph.Repos, err = getNamedEntities("SELECT id, reponame FROM Repos", sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error when getting repos: %w", err)
+	}
+	orgGraph.Repogroups, err = getNamedEntities("SELECT id, groupname FROM RepoGroups", sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error when getting repogroups: %w", err)
+	}
+	orgGraph.ServiceAccounts, err = getNamedEntities("SELECT id, name FROM service_accounts", sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error when getting service accounts: %w", err)
+	}
+
+	orgGraph.UserInGroups, err = getAllUserInGroups(sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from getAllUserInGroups: %w", err)
+	}
+	orgGraph.UserGroupInGroups, err = getAllUserGroupInGroups(sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from getAllUserGroupInGroups: %w", err)
+	}
+	orgGraph.RepogroupRels, err = getAllRepogroupRels(sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from getAllRepogroupRels: %w", err)
+	}
+	orgGraph.AssignedRoles, err = getAllAssignedRoles(sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from getAllAssignedRoles: %w", err)
+	}
+
+	err = sqlTx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error when cleaning up sqlite Tx: %w", err)
+	}
+
+	return orgGraph, nil
+}
@@ -0,0 +1,245 @@
+package dblogic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// IssuedToken is a ledger entry for a minted token.
+type IssuedToken struct {
+	// TokenId is the id recorded in the token's token_id authority fact
+	TokenId string `json:"token_id"`
+	// UserId is the user the token was issued to. Zero for service account tokens.
+	UserId int `json:"user_id"`
+	// ServiceAccountId is the service account the token was issued to. Zero for user tokens.
+	ServiceAccountId int `json:"service_account_id,omitempty"`
+	// KeyId identifies the root key which signed the token
+	KeyId string `json:"key_id"`
+	// CreatedAt is when the token was issued
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the token expires. Zero if it never expires.
+	ExpiresAt time.Time `json:"expires_at"`
+	// RevocationIds are the hex encoded revocation ids of the token's blocks at issuance
+	RevocationIds []string `json:"revocation_ids"`
+	// Name is an operator provided label, like a personal access token name
+	Name string `json:"name"`
+	// Description is an operator provided description
+	Description string `json:"description"`
+	// Kind is the kind of token, e.g. "pat". Empty for plain user tokens.
+	Kind string `json:"kind"`
+	// Scope is a readable summary of the restrictions in the token's authority block
+	Scope string `json:"scope"`
+	// ParentTokenId is the token an exchanged token was issued for. Empty for other tokens.
+	ParentTokenId string `json:"parent_token_id,omitempty"`
+	// Revoked is set if the token's authority block has been revoked. It is not stored, but looked up when the entry is read.
+	Revoked bool `json:"revoked"`
+}
+
+// RecordIssuance adds issuedToken to the ledger. Entries for tokens which have expired are removed at the same time.
+func (dbInstance *DBInstance) RecordIssuance(issuedToken *IssuedToken) error {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("error when making Tx: %w", err)
+	}
+	_, err = sqlTx.Exec(`INSERT INTO issued_tokens (token_id, user_id, service_account_id, key_id, created_at, expires_at, name, description, kind, scope, parent_token_id)
+VALUES ($tokenid, $userid, $serviceaccountid, $keyid, $createdat, $expiresat, $name, $description, $kind, $scope, $parenttokenid)`,
+		sql.Named("tokenid", issuedToken.TokenId),
+		sql.Named("userid", issuedToken.UserId),
+		sql.Named("serviceaccountid", issuedToken.ServiceAccountId),
+		sql.Named("keyid", issuedToken.KeyId),
+		sql.Named("createdat", issuedToken.CreatedAt.Unix()),
+		sql.Named("expiresat", nullableUnix(issuedToken.ExpiresAt)),
+		sql.Named("name", issuedToken.Name),
+		sql.Named("description", issuedToken.Description),
+		sql.Named("kind", issuedToken.Kind),
+		sql.Named("scope", issuedToken.Scope),
+		sql.Named("parenttokenid", issuedToken.ParentTokenId),
+	)
+	if err != nil {
+		sqlTx.Rollback()
+		return fmt.Errorf("error when recording token %s: %w", issuedToken.TokenId, err)
+	}
+	for _, revocationId := range issuedToken.RevocationIds {
+		_, err = sqlTx.Exec("INSERT INTO issued_token_revocation_ids (revocation_id, token_id) VALUES ($revocationid, $tokenid)",
+			sql.Named("revocationid", revocationId),
+			sql.Named("tokenid", issuedToken.TokenId),
+		)
+		if err != nil {
+			sqlTx.Rollback()
+			return fmt.Errorf("error when recording revocation id of token %s: %w", issuedToken.TokenId, err)
+		}
+	}
+	_, err = pruneIssuedTokens(time.Now(), sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	err = sqlTx.Commit()
+	if err != nil {
+		return fmt.Errorf("error when committing token %s: %w", issuedToken.TokenId, err)
+	}
+	return nil
+}
+
+// scanIssuedTokens reads the issued_tokens rows of query along with their revocation ids.
+func scanIssuedTokens(sqlTx *sql.Tx, query string, args ...interface{}) ([]*IssuedToken, error) {
+	sqlRows, err := sqlTx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting issued tokens: %w", err)
+	}
+	defer sqlRows.Close()
+	issuedTokens := []*IssuedToken{}
+	for sqlRows.Next() {
+		issuedToken := &IssuedToken{RevocationIds: []string{}}
+		var createdAt int64
+		var expiresAt sql.NullInt64
+		err := sqlRows.Scan(&issuedToken.TokenId, &issuedToken.UserId, &issuedToken.ServiceAccountId, &issuedToken.KeyId,
+			&createdAt, &expiresAt, &issuedToken.Name, &issuedToken.Description,
+			&issuedToken.Kind, &issuedToken.Scope, &issuedToken.ParentTokenId, &issuedToken.Revoked)
+		if err != nil {
+			return nil, fmt.Errorf("error when scanning issued token: %w", err)
+		}
+		issuedToken.CreatedAt = time.Unix(createdAt, 0).UTC()
+		issuedToken.ExpiresAt = fromNullableUnix(expiresAt)
+		issuedTokens = append(issuedTokens, issuedToken)
+	}
+	sqlRows.Close()
+
+	for _, issuedToken := range issuedTokens {
+		sqlRows, err := sqlTx.Query("SELECT revocation_id FROM issued_token_revocation_ids WHERE token_id = $tokenid ORDER BY rowid",
+			sql.Named("tokenid", issuedToken.TokenId))
+		if err != nil {
+			return nil, fmt.Errorf("error when getting revocation ids of token %s: %w", issuedToken.TokenId, err)
+		}
+		for sqlRows.Next() {
+			var revocationId string
+			if err := sqlRows.Scan(&revocationId); err != nil {
+				sqlRows.Close()
+				return nil, fmt.Errorf("error when scanning revocation id: %w", err)
+			}
+			issuedToken.RevocationIds = append(issuedToken.RevocationIds, revocationId)
+		}
+		sqlRows.Close()
+	}
+	return issuedTokens, nil
+}
+
+// issuedTokenColumns are the issued_tokens columns in the order scanIssuedTokens reads them, followed by whether the token has been revoked.
+const issuedTokenColumns = `token_id, user_id, service_account_id, key_id, created_at, expires_at, name, description, kind, scope, parent_token_id,
+    EXISTS (SELECT 1 FROM revoked_tokens
+        INNER JOIN issued_token_revocation_ids
+            ON issued_token_revocation_ids.revocation_id = revoked_tokens.revocation_id
+        WHERE issued_token_revocation_ids.token_id = issued_tokens.token_id)
+    OR EXISTS (SELECT 1 FROM revoked_users
+        WHERE revoked_users.user_id = issued_tokens.user_id
+            AND revoked_users.revoked_before >= issued_tokens.created_at)`
+
+// ListIssuedTokens returns the ledger entries for tokens issued to userId, or for every user if userId is 0, oldest first.
+func (dbInstance *DBInstance) ListIssuedTokens(userId int) ([]*IssuedToken, error) {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when making Tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+	if userId == 0 {
+		return scanIssuedTokens(sqlTx, "SELECT "+issuedTokenColumns+" FROM issued_tokens ORDER BY created_at, token_id")
+	}
+	return scanIssuedTokens(sqlTx, "SELECT "+issuedTokenColumns+" FROM issued_tokens WHERE user_id = $userid ORDER BY created_at, token_id",
+		sql.Named("userid", userId))
+}
+
+// GetIssuedToken returns the ledger entry for tokenId, or an error if there is none.
+func (dbInstance *DBInstance) GetIssuedToken(tokenId string) (*IssuedToken, error) {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when making Tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+	issuedTokens, err := scanIssuedTokens(sqlTx, "SELECT "+issuedTokenColumns+" FROM issued_tokens WHERE token_id = $tokenid",
+		sql.Named("tokenid", tokenId))
+	if err != nil {
+		return nil, err
+	}
+	if len(issuedTokens) == 0 {
+		return nil, fmt.Errorf("unknown token: %s", tokenId)
+	}
+	return issuedTokens[0], nil
+}
+
+// pruneIssuedTokens removes ledger entries of tokens which expired before now. sqlTx will not be rolled back by this function if an error occurs.
+func pruneIssuedTokens(now time.Time, sqlTx *sql.Tx) (int64, error) {
+	_, err := sqlTx.Exec(`DELETE FROM issued_token_revocation_ids WHERE token_id IN (
+    SELECT token_id FROM issued_tokens WHERE expires_at IS NOT NULL AND expires_at < $now)`,
+		sql.Named("now", now.Unix()))
+	if err != nil {
+		return 0, fmt.Errorf("error when pruning revocation ids of expired tokens: %w", err)
+	}
+	result, err := sqlTx.Exec("DELETE FROM issued_tokens WHERE expires_at IS NOT NULL AND expires_at < $now",
+		sql.Named("now", now.Unix()))
+	if err != nil {
+		return 0, fmt.Errorf("error when pruning expired tokens: %w", err)
+	}
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error when counting pruned tokens: %w", err)
+	}
+	return pruned, nil
+}
+
+// PruneIssuedTokens removes ledger entries of tokens which expired before now. Returns the number of entries removed.
+func (dbInstance *DBInstance) PruneIssuedTokens(now time.Time) (int64, error) {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("error when making Tx: %w", err)
+	}
+	pruned, err := pruneIssuedTokens(now, sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return 0, err
+	}
+	err = sqlTx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("error when committing prune: %w", err)
+	}
+	return pruned, nil
+}
+
+// ListDescendantTokens returns the ledger entries of the tokens exchanged for tokenId, the tokens exchanged for those, and so on, oldest first.
+func (dbInstance *DBInstance) ListDescendantTokens(tokenId string) ([]*IssuedToken, error) {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when making Tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+	return scanIssuedTokens(sqlTx, `WITH RECURSIVE descendants (token_id) AS (
+    SELECT token_id FROM issued_tokens WHERE parent_token_id = $tokenid
+    UNION
+    SELECT issued_tokens.token_id FROM issued_tokens
+        INNER JOIN descendants ON issued_tokens.parent_token_id = descendants.token_id
+)
+SELECT `+issuedTokenColumns+` FROM issued_tokens
+WHERE token_id IN (SELECT token_id FROM descendants)
+ORDER BY created_at, token_id`,
+		sql.Named("tokenid", tokenId))
+}
+
+// RevokeIssuedToken revokes every recorded revocation id of the ledger entry tokenId and of the tokens exchanged for it, which revokes the token, every token attenuated from it, and every token exchanged for it or for one of those.
+func (dbInstance *DBInstance) RevokeIssuedToken(tokenId string, reason string) error {
+	issuedToken, err := dbInstance.GetIssuedToken(tokenId)
+	if err != nil {
+		return err
+	}
+	descendants, err := dbInstance.ListDescendantTokens(tokenId)
+	if err != nil {
+		return err
+	}
+	for _, revokedToken := range append([]*IssuedToken{issuedToken}, descendants...) {
+		err = dbInstance.RevokeIds(revokedToken.RevocationIds, revokedToken.ExpiresAt, reason)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
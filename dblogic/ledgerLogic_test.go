@@ -0,0 +1,268 @@
+package dblogic
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// ledgerTestDb opens an empty in-memory db for ledger tests.
+func ledgerTestDb(t *testing.T) *DBInstance {
+	t.Helper()
+	dbInstance, err := InitMemoryDb(false)
+	if err != nil {
+		t.Fatalf("InitMemoryDb: %s", err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	return dbInstance
+}
+
+// recordIssuance records issuedToken in dbInstance, failing the test on error.
+func recordIssuance(t *testing.T, dbInstance *DBInstance, issuedToken *IssuedToken) {
+	t.Helper()
+	err := dbInstance.RecordIssuance(issuedToken)
+	if err != nil {
+		t.Fatalf("RecordIssuance: %s", err)
+	}
+}
+
+// TestRecordIssuance checks that a recorded entry is read back with every field, and that unknown ids are an error.
+func TestRecordIssuance(t *testing.T) {
+	dbInstance := ledgerTestDb(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	recorded := &IssuedToken{
+		TokenId:       "pat",
+		UserId:        4,
+		KeyId:         "key",
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(time.Hour),
+		RevocationIds: []string{"0a", "0b"},
+		Name:          "laptop",
+		Description:   "clone from the laptop",
+		Kind:          "exchange",
+		Scope:         "actions=read",
+		ParentTokenId: "parent",
+	}
+	recordIssuance(t, dbInstance, recorded)
+
+	issuedToken, err := dbInstance.GetIssuedToken("pat")
+	if err != nil {
+		t.Fatalf("GetIssuedToken: %s", err)
+	}
+	if issuedToken.UserId != recorded.UserId || issuedToken.KeyId != recorded.KeyId ||
+		!issuedToken.CreatedAt.Equal(recorded.CreatedAt) || !issuedToken.ExpiresAt.Equal(recorded.ExpiresAt) ||
+		issuedToken.Name != recorded.Name || issuedToken.Description != recorded.Description ||
+		issuedToken.Kind != recorded.Kind || issuedToken.Scope != recorded.Scope ||
+		issuedToken.ParentTokenId != recorded.ParentTokenId || issuedToken.Revoked {
+		t.Errorf("expected %+v, got %+v", recorded, issuedToken)
+	}
+	if len(issuedToken.RevocationIds) != 2 || issuedToken.RevocationIds[0] != "0a" || issuedToken.RevocationIds[1] != "0b" {
+		t.Errorf("expected revocation ids [0a 0b] in order, got %v", issuedToken.RevocationIds)
+	}
+
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "forever", UserId: 4, KeyId: "key", CreatedAt: now})
+	issuedToken, err = dbInstance.GetIssuedToken("forever")
+	if err != nil {
+		t.Fatalf("GetIssuedToken: %s", err)
+	}
+	if !issuedToken.ExpiresAt.IsZero() {
+		t.Errorf("expected a token without expiry to be read back without one, got %s", issuedToken.ExpiresAt)
+	}
+
+	_, err = dbInstance.GetIssuedToken("missing")
+	if err == nil {
+		t.Errorf("expected an unknown token id to be an error")
+	}
+	err = dbInstance.RecordIssuance(&IssuedToken{TokenId: "pat", UserId: 3, KeyId: "key", CreatedAt: now})
+	if err == nil {
+		t.Errorf("expected recording a token id twice to be an error")
+	}
+}
+
+// TestListIssuedTokens checks that entries are listed oldest first, for one user or for everyone.
+func TestListIssuedTokens(t *testing.T) {
+	dbInstance := ledgerTestDb(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "liam-new", UserId: 4, KeyId: "key", CreatedAt: now})
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "liam-old", UserId: 4, KeyId: "key", CreatedAt: now.Add(-time.Hour)})
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "emma", UserId: 3, KeyId: "key", CreatedAt: now.Add(-time.Minute)})
+
+	testCases := map[int][]string{
+		4: {"liam-old", "liam-new"},
+		3: {"emma"},
+		1: {},
+		0: {"liam-old", "emma", "liam-new"},
+	}
+	for userId, expected := range testCases {
+		issuedTokens, err := dbInstance.ListIssuedTokens(userId)
+		if err != nil {
+			t.Fatalf("ListIssuedTokens: %s", err)
+		}
+		tokenIds := []string{}
+		for _, issuedToken := range issuedTokens {
+			tokenIds = append(tokenIds, issuedToken.TokenId)
+		}
+		if len(tokenIds) != len(expected) {
+			t.Errorf("user %d: expected %v, got %v", userId, expected, tokenIds)
+			continue
+		}
+		for i := range expected {
+			if tokenIds[i] != expected[i] {
+				t.Errorf("user %d: expected %v, got %v", userId, expected, tokenIds)
+				break
+			}
+		}
+	}
+}
+
+// TestPruneIssuedTokens checks that pruning removes only entries which expired before the given time, and that recording an entry prunes the ones which have already expired.
+func TestPruneIssuedTokens(t *testing.T) {
+	dbInstance := ledgerTestDb(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "hour", UserId: 4, KeyId: "key", CreatedAt: now, ExpiresAt: now.Add(time.Hour), RevocationIds: []string{"0a"}})
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "day", UserId: 4, KeyId: "key", CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)})
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "forever", UserId: 4, KeyId: "key", CreatedAt: now})
+
+	pruned, err := dbInstance.PruneIssuedTokens(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("PruneIssuedTokens: %s", err)
+	}
+	if pruned != 1 {
+		t.Errorf("expected 1 entry pruned, got %d", pruned)
+	}
+	if _, err := dbInstance.GetIssuedToken("hour"); err == nil {
+		t.Errorf("expected the expired entry to be pruned")
+	}
+	for _, tokenId := range []string{"day", "forever"} {
+		if _, err := dbInstance.GetIssuedToken(tokenId); err != nil {
+			t.Errorf("expected %s to be kept: %s", tokenId, err)
+		}
+	}
+	var revocationIds int
+	err = dbInstance.sqliteDb.QueryRow("SELECT COUNT(*) FROM issued_token_revocation_ids").Scan(&revocationIds)
+	if err != nil {
+		t.Fatalf("counting revocation ids: %s", err)
+	}
+	if revocationIds != 0 {
+		t.Errorf("expected the revocation ids of pruned entries to be removed, %d remain", revocationIds)
+	}
+
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "expired", UserId: 4, KeyId: "key", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+	if _, err := dbInstance.GetIssuedToken("expired"); err == nil {
+		t.Errorf("expected recording to prune the already expired entry")
+	}
+}
+
+// TestRevokeIssuedToken checks that revoking a ledger entry revokes its recorded revocation ids, marks the entry revoked and carries its expiry to the revocation so it can be pruned.
+func TestRevokeIssuedToken(t *testing.T) {
+	dbInstance := ledgerTestDb(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	revocationId := []byte{0x0a}
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "leaked", UserId: 4, KeyId: "key", CreatedAt: now, ExpiresAt: now.Add(time.Hour), RevocationIds: []string{hex.EncodeToString(revocationId)}})
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "kept", UserId: 4, KeyId: "key", CreatedAt: now, RevocationIds: []string{"0b"}})
+
+	err := dbInstance.RevokeIssuedToken("leaked", "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIssuedToken: %s", err)
+	}
+	revoked, err := dbInstance.IsRevoked([][]byte{revocationId}, 4, now)
+	if err != nil {
+		t.Fatalf("IsRevoked: %s", err)
+	}
+	if !revoked {
+		t.Errorf("expected the entry's revocation id to be revoked")
+	}
+	for tokenId, expected := range map[string]bool{"leaked": true, "kept": false} {
+		issuedToken, err := dbInstance.GetIssuedToken(tokenId)
+		if err != nil {
+			t.Fatalf("GetIssuedToken: %s", err)
+		}
+		if issuedToken.Revoked != expected {
+			t.Errorf("%s: expected revoked %t, got %t", tokenId, expected, issuedToken.Revoked)
+		}
+	}
+
+	revocations, err := dbInstance.ListRevocations()
+	if err != nil {
+		t.Fatalf("ListRevocations: %s", err)
+	}
+	if len(revocations) != 1 || !revocations[0].ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected one revocation expiring with the token, got %+v", revocations)
+	}
+
+	if err := dbInstance.RevokeIssuedToken("missing", ""); err == nil {
+		t.Errorf("expected revoking an unknown token id to be an error")
+	}
+}
+
+// TestRevokeIssuedTokenDescendants checks that revoking a ledger entry revokes the tokens exchanged for it and the tokens exchanged for those, each with its own expiry, and not its parent or siblings.
+func TestRevokeIssuedTokenDescendants(t *testing.T) {
+	dbInstance := ledgerTestDb(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, issuedToken := range []*IssuedToken{
+		{TokenId: "pat", RevocationIds: []string{"01"}},
+		{TokenId: "leaked", ParentTokenId: "pat", RevocationIds: []string{"02"}},
+		{TokenId: "child", ParentTokenId: "leaked", RevocationIds: []string{"03"}, ExpiresAt: now.Add(time.Minute)},
+		{TokenId: "grandchild", ParentTokenId: "child", RevocationIds: []string{"04"}, ExpiresAt: now.Add(2 * time.Minute)},
+		{TokenId: "sibling", ParentTokenId: "pat", RevocationIds: []string{"05"}},
+	} {
+		issuedToken.UserId = 4
+		issuedToken.KeyId = "key"
+		issuedToken.CreatedAt = now
+		recordIssuance(t, dbInstance, issuedToken)
+	}
+
+	descendants, err := dbInstance.ListDescendantTokens("leaked")
+	if err != nil {
+		t.Fatalf("ListDescendantTokens: %s", err)
+	}
+	if len(descendants) != 2 || descendants[0].TokenId != "child" || descendants[1].TokenId != "grandchild" {
+		t.Errorf("expected child and grandchild as descendants, got %+v", descendants)
+	}
+
+	err = dbInstance.RevokeIssuedToken("leaked", "leaked")
+	if err != nil {
+		t.Fatalf("RevokeIssuedToken: %s", err)
+	}
+	for tokenId, expected := range map[string]bool{"pat": false, "leaked": true, "child": true, "grandchild": true, "sibling": false} {
+		issuedToken, err := dbInstance.GetIssuedToken(tokenId)
+		if err != nil {
+			t.Fatalf("GetIssuedToken: %s", err)
+		}
+		if issuedToken.Revoked != expected {
+			t.Errorf("%s: expected revoked %t, got %t", tokenId, expected, issuedToken.Revoked)
+		}
+	}
+	revocations, err := dbInstance.ListRevocations()
+	if err != nil {
+		t.Fatalf("ListRevocations: %s", err)
+	}
+	for _, revocation := range revocations {
+		if revocation.RevocationId == "04" && !revocation.ExpiresAt.Equal(now.Add(2*time.Minute)) {
+			t.Errorf("expected the grandchild's revocation to expire with it, got %s", revocation.ExpiresAt)
+		}
+	}
+}
+
+// TestRevokedUserEntries checks that revoking a user marks the entries issued to them up to then as revoked, and no one else's.
+func TestRevokedUserEntries(t *testing.T) {
+	dbInstance := ledgerTestDb(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "liam", UserId: 4, KeyId: "key", CreatedAt: now.Add(-time.Minute)})
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "liam-later", UserId: 4, KeyId: "key", CreatedAt: now.Add(time.Hour)})
+	recordIssuance(t, dbInstance, &IssuedToken{TokenId: "emma", UserId: 3, KeyId: "key", CreatedAt: now.Add(-time.Minute)})
+
+	err := dbInstance.RevokeUser(4, "left the org")
+	if err != nil {
+		t.Fatalf("RevokeUser: %s", err)
+	}
+	for tokenId, expected := range map[string]bool{"liam": true, "liam-later": false, "emma": false} {
+		issuedToken, err := dbInstance.GetIssuedToken(tokenId)
+		if err != nil {
+			t.Fatalf("GetIssuedToken: %s", err)
+		}
+		if issuedToken.Revoked != expected {
+			t.Errorf("%s: expected revoked %t, got %t", tokenId, expected, issuedToken.Revoked)
+		}
+	}
+}
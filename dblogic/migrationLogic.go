@@ -0,0 +1,157 @@
+package dblogic
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migration upgrades a persisted db by one schema version, for changes the idempotent schema files cannot make themselves such as adding columns to existing tables.
+type migration struct {
+	// description says what the migration changes, for error messages
+	description string
+	// apply makes the change. dbs created before schema versions were recorded all report version 0 whatever their schema, so apply must check for what it adds rather than assume it is missing, and must skip tables which do not exist yet since the schema files create those afterwards.
+	apply func(sqlTx *sql.Tx) error
+}
+
+// migrations are applied in order to persisted dbs; a db at schema version N has had the first N applied. New dbs are created with the current schema and start at len(migrations). Append to this list, never reorder or remove from it.
+var migrations = []migration{
+	{"add kind and scope to issued_tokens", addTokenKindAndScope},
+	{"add service_account_id to issued_tokens", addTokenServiceAccount},
+	{"add parent_token_id to issued_tokens", addTokenParent},
+}
+
+// schemaVersion reads the schema version recorded in the db header.
+func schemaVersion(sqliteDb *sql.DB) (int, error) {
+	var version int
+	err := sqliteDb.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error when reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// setSchemaVersion records version in the db header as part of sqlTx.
+func setSchemaVersion(sqlTx *sql.Tx, version int) error {
+	// PRAGMA values cannot be bound as parameters
+	_, err := sqlTx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	if err != nil {
+		return fmt.Errorf("error when setting schema version: %w", err)
+	}
+	return nil
+}
+
+// migrate applies the migrations sqliteDb has not had yet, each in its own transaction along with recording the new version, so an interrupted upgrade resumes from the last completed migration. An error is returned if the db was written by a newer version with migrations this one does not know.
+func migrate(sqliteDb *sql.DB) error {
+	version, err := schemaVersion(sqliteDb)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("db schema version %d is newer than the %d this build supports", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		sqlTx, err := sqliteDb.Begin()
+		if err != nil {
+			return fmt.Errorf("error when beginning migration transaction: %w", err)
+		}
+		err = migrations[version].apply(sqlTx)
+		if err == nil {
+			err = setSchemaVersion(sqlTx, version+1)
+		}
+		if err != nil {
+			sqlTx.Rollback()
+			return fmt.Errorf("error in migration %d, %s: %w", version+1, migrations[version].description, err)
+		}
+		err = sqlTx.Commit()
+		if err != nil {
+			return fmt.Errorf("error when committing migration %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// stampSchemaVersion records that sqliteDb, which was just created with the current schema, needs none of the migrations.
+func stampSchemaVersion(sqliteDb *sql.DB) error {
+	sqlTx, err := sqliteDb.Begin()
+	if err != nil {
+		return fmt.Errorf("error when beginning transaction: %w", err)
+	}
+	err = setSchemaVersion(sqlTx, len(migrations))
+	if err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	err = sqlTx.Commit()
+	if err != nil {
+		return fmt.Errorf("error when committing schema version: %w", err)
+	}
+	return nil
+}
+
+// tableColumns returns the names of the columns of table, which is empty if the table does not exist. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func tableColumns(sqlTx *sql.Tx, table string) (map[string]bool, error) {
+	sqlRows, err := sqlTx.Query("SELECT name FROM pragma_table_info($table)", sql.Named("table", table))
+	if err != nil {
+		return nil, fmt.Errorf("error when reading columns of %s: %w", table, err)
+	}
+	defer sqlRows.Close()
+	columns := map[string]bool{}
+	for sqlRows.Next() {
+		var column string
+		err = sqlRows.Scan(&column)
+		if err != nil {
+			return nil, fmt.Errorf("error when scanning columns of %s: %w", table, err)
+		}
+		columns[column] = true
+	}
+	err = sqlRows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error when reading columns of %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+// addMissingColumns adds each of columnDefs, a column name followed by its type and constraints, to table unless table already has a column of that name. Nothing is done if table does not exist. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func addMissingColumns(sqlTx *sql.Tx, table string, columnDefs []string) error {
+	columns, err := tableColumns(sqlTx, table)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	for _, columnDef := range columnDefs {
+		column, _, _ := strings.Cut(columnDef, " ")
+		if columns[column] {
+			continue
+		}
+		_, err = sqlTx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, columnDef))
+		if err != nil {
+			return fmt.Errorf("error when adding column %s to %s: %w", column, table, err)
+		}
+	}
+	return nil
+}
+
+// addTokenKindAndScope adds the columns personal access tokens record in the ledger to dbs created before them.
+func addTokenKindAndScope(sqlTx *sql.Tx) error {
+	return addMissingColumns(sqlTx, "issued_tokens", []string{
+		"kind TEXT NOT NULL DEFAULT ''",
+		"scope TEXT NOT NULL DEFAULT ''",
+	})
+}
+
+// addTokenServiceAccount adds the column service account tokens record in the ledger to dbs created before them.
+func addTokenServiceAccount(sqlTx *sql.Tx) error {
+	return addMissingColumns(sqlTx, "issued_tokens", []string{
+		"service_account_id INTEGER NOT NULL DEFAULT 0",
+	})
+}
+
+// addTokenParent adds the column exchanged tokens record their parent token in to dbs created before it.
+func addTokenParent(sqlTx *sql.Tx) error {
+	return addMissingColumns(sqlTx, "issued_tokens", []string{
+		"parent_token_id TEXT NOT NULL DEFAULT ''",
+	})
+}
@@ -0,0 +1,199 @@
+package dblogic
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSchemaVersion opens the db at sqliteDbFilename directly and reads its schema version.
+func readSchemaVersion(t *testing.T, sqliteDbFilename string) int {
+	t.Helper()
+	sqliteDb, err := sql.Open("sqlite3", sqliteDbFilename)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	defer sqliteDb.Close()
+	version, err := schemaVersion(sqliteDb)
+	if err != nil {
+		t.Fatalf("schemaVersion: %s", err)
+	}
+	return version
+}
+
+// TestNewDbSchemaVersion checks that a new db is recorded as needing no migrations and is reopened without applying any.
+func TestNewDbSchemaVersion(t *testing.T) {
+	sqliteDbFilename := filepath.Join(t.TempDir(), "forgeAuthz.db")
+	for open := 0; open < 2; open++ {
+		dbInstance, err := openDb(sqliteDbFilename)
+		if err != nil {
+			t.Fatalf("openDb: %s", err)
+		}
+		dbInstance.Close()
+		version := readSchemaVersion(t, sqliteDbFilename)
+		if version != len(migrations) {
+			t.Fatalf("expected schema version %d, got %d", len(migrations), version)
+		}
+	}
+}
+
+// TestNewerSchemaVersion checks that a db written by a newer build, with migrations this one does not know, is refused rather than used.
+func TestNewerSchemaVersion(t *testing.T) {
+	sqliteDbFilename := filepath.Join(t.TempDir(), "forgeAuthz.db")
+	dbInstance, err := openDb(sqliteDbFilename)
+	if err != nil {
+		t.Fatalf("openDb: %s", err)
+	}
+	_, err = dbInstance.sqliteDb.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)+1))
+	if err != nil {
+		t.Fatalf("setting user_version: %s", err)
+	}
+	dbInstance.Close()
+
+	_, err = openDb(sqliteDbFilename)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("expected the newer db to be refused, got %v", err)
+	}
+}
+
+// ledgerSchemaBeforePATs is the issued_tokens table as created before personal access tokens added the kind and scope columns.
+const ledgerSchemaBeforePATs = `
+CREATE TABLE issued_tokens (
+    token_id    TEXT    PRIMARY KEY
+                        NOT NULL,
+    user_id     INTEGER NOT NULL,
+    key_id      TEXT    NOT NULL,
+    created_at  INTEGER NOT NULL,
+    expires_at  INTEGER,
+    name        TEXT    NOT NULL
+                        DEFAULT '',
+    description TEXT    NOT NULL
+                        DEFAULT ''
+);
+INSERT INTO issued_tokens (token_id, user_id, key_id, created_at) VALUES ('legacy', 4, 'key', 1);
+`
+
+// createLegacyDb creates a db at sqliteDbFilename as it was before service accounts, with the example users, groups and repos plus legacySchema, at schema version 0 as every db made before versions were recorded is.
+func createLegacyDb(t *testing.T, sqliteDbFilename string, legacySchema string) {
+	t.Helper()
+	sqliteDb, err := sql.Open("sqlite3", sqliteDbFilename)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	defer sqliteDb.Close()
+	_, err = sqliteDb.Exec(sqlServiceAccounts)
+	if err != nil {
+		t.Fatalf("creating service account schema: %s", err)
+	}
+	_, err = sqliteDb.Exec(sqlInit)
+	if err != nil {
+		t.Fatalf("creating example schema: %s", err)
+	}
+	for _, table := range []string{"Repo_Roles_membership_ServiceAccounts", "RepoGroup_Roles_membership_ServiceAccounts", "service_accounts"} {
+		_, err = sqliteDb.Exec("DROP TABLE " + table)
+		if err != nil {
+			t.Fatalf("dropping %s: %s", table, err)
+		}
+	}
+	_, err = sqliteDb.Exec(legacySchema)
+	if err != nil {
+		t.Fatalf("creating legacy schema: %s", err)
+	}
+}
+
+// TestMigrateTokenKindAndScope checks that a ledger created before personal access tokens gains their columns, and those added since, and keeps its rows.
+func TestMigrateTokenKindAndScope(t *testing.T) {
+	sqliteDbFilename := filepath.Join(t.TempDir(), "forgeAuthz.db")
+	createLegacyDb(t, sqliteDbFilename, ledgerSchemaBeforePATs)
+
+	dbInstance, err := openDb(sqliteDbFilename)
+	if err != nil {
+		t.Fatalf("openDb: %s", err)
+	}
+	defer dbInstance.Close()
+	if version := readSchemaVersion(t, sqliteDbFilename); version != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d", len(migrations), version)
+	}
+
+	var kind, scope, parentTokenId string
+	err = dbInstance.sqliteDb.QueryRow("SELECT kind, scope, parent_token_id FROM issued_tokens WHERE token_id = 'legacy'").Scan(&kind, &scope, &parentTokenId)
+	if err != nil {
+		t.Fatalf("reading migrated row: %s", err)
+	}
+	if kind != "" || scope != "" || parentTokenId != "" {
+		t.Errorf("expected empty kind, scope and parent, got %q, %q and %q", kind, scope, parentTokenId)
+	}
+}
+
+// ledgerSchemaBeforeServiceAccounts is the issued_tokens table as created before service accounts added the service_account_id column.
+const ledgerSchemaBeforeServiceAccounts = `
+CREATE TABLE issued_tokens (
+    token_id    TEXT    PRIMARY KEY
+                        NOT NULL,
+    user_id     INTEGER NOT NULL,
+    key_id      TEXT    NOT NULL,
+    created_at  INTEGER NOT NULL,
+    expires_at  INTEGER,
+    name        TEXT    NOT NULL
+                        DEFAULT '',
+    description TEXT    NOT NULL
+                        DEFAULT '',
+    kind        TEXT    NOT NULL
+                        DEFAULT '',
+    scope       TEXT    NOT NULL
+                        DEFAULT ''
+);
+`
+
+// TestMigrateServiceAccounts checks that a db created before service accounts can hold service accounts, their grants and their tokens once opened.
+func TestMigrateServiceAccounts(t *testing.T) {
+	sqliteDbFilename := filepath.Join(t.TempDir(), "forgeAuthz.db")
+	createLegacyDb(t, sqliteDbFilename, ledgerSchemaBeforeServiceAccounts)
+
+	dbInstance, err := openDb(sqliteDbFilename)
+	if err != nil {
+		t.Fatalf("openDb: %s", err)
+	}
+	defer dbInstance.Close()
+
+	err = dbInstance.LoadFixtures(&Fixtures{
+		ServiceAccounts: []*NamedEntity{{Id: 1, Name: "ci-bot"}},
+		AssignedRoles: []*AssignedRole{{
+			UserOrGroup:   ServiceAccountUGR,
+			UserOrGroupID: 1,
+			RepoOrGroup:   RepoUGR,
+			RepoOrGroupID: 3,
+			RepoRole:      ReaderRole,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("LoadFixtures: %s", err)
+	}
+	reqDetails, err := GatherServiceRequestDetails(1, "Charlie", dbInstance)
+	if err != nil {
+		t.Fatalf("GatherServiceRequestDetails: %s", err)
+	}
+	if len(reqDetails.AssignedRoles) != 1 {
+		t.Errorf("expected the service account's grant on Charlie, got %d roles", len(reqDetails.AssignedRoles))
+	}
+
+	err = dbInstance.RecordIssuance(&IssuedToken{
+		TokenId:          "service",
+		ServiceAccountId: 1,
+		KeyId:            "key",
+		CreatedAt:        time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("RecordIssuance: %s", err)
+	}
+	issuedToken, err := dbInstance.GetIssuedToken("service")
+	if err != nil {
+		t.Fatalf("GetIssuedToken: %s", err)
+	}
+	if issuedToken.ServiceAccountId != 1 {
+		t.Errorf("expected service account 1, got %d", issuedToken.ServiceAccountId)
+	}
+}
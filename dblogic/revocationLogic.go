@@ -0,0 +1,170 @@
+package dblogic
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Revocation is a revoked token block, or every token issued to a user before a point in time.
+type Revocation struct {
+	// RevocationId is the hex encoded biscuit revocation id of the revoked block. Empty for user revocations.
+	RevocationId string `json:"revocation_id,omitempty"`
+	// UserId is the user whose tokens are revoked. Zero for revocation id revocations.
+	UserId int `json:"user_id,omitempty"`
+	// RevokedAt is when the revocation was made. For user revocations every token issued at or before it is revoked.
+	RevokedAt time.Time `json:"revoked_at"`
+	// ExpiresAt is when the revoked token expires anyway, after which the revocation can be pruned. Zero if unknown.
+	ExpiresAt time.Time `json:"expires_at"`
+	// Reason is the operator supplied reason for the revocation
+	Reason string `json:"reason"`
+}
+
+// nullableUnix converts t to unix seconds, with the zero time as NULL.
+func nullableUnix(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+// fromNullableUnix is the inverse of nullableUnix.
+func fromNullableUnix(unix sql.NullInt64) time.Time {
+	if !unix.Valid {
+		return time.Time{}
+	}
+	return time.Unix(unix.Int64, 0).UTC()
+}
+
+// RevokeIds revokes the given hex encoded revocation ids. expiresAt is when the token expires, or zero to look it up in the issuance ledger. Revoking an id which is already revoked is not an error.
+func (dbInstance *DBInstance) RevokeIds(revocationIds []string, expiresAt time.Time, reason string) error {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("error when making Tx: %w", err)
+	}
+	revokedAt := time.Now().Unix()
+	for _, revocationId := range revocationIds {
+		if _, err := hex.DecodeString(revocationId); err != nil || revocationId == "" {
+			sqlTx.Rollback()
+			return fmt.Errorf("invalid revocation id: %q", revocationId)
+		}
+		_, err = sqlTx.Exec(`INSERT INTO revoked_tokens (revocation_id, revoked_at, expires_at, reason)
+VALUES ($revocationid, $revokedat, COALESCE($expiresat, (
+    SELECT issued_tokens.expires_at
+    FROM issued_token_revocation_ids
+    INNER JOIN issued_tokens
+        ON issued_tokens.token_id = issued_token_revocation_ids.token_id
+    WHERE issued_token_revocation_ids.revocation_id = $revocationid)), $reason)
+ON CONFLICT (revocation_id) DO NOTHING`,
+			sql.Named("revocationid", revocationId),
+			sql.Named("revokedat", revokedAt),
+			sql.Named("expiresat", nullableUnix(expiresAt)),
+			sql.Named("reason", reason),
+		)
+		if err != nil {
+			sqlTx.Rollback()
+			return fmt.Errorf("error when revoking %s: %w", revocationId, err)
+		}
+	}
+	err = sqlTx.Commit()
+	if err != nil {
+		return fmt.Errorf("error when committing revocations: %w", err)
+	}
+	return nil
+}
+
+// RevokeUser revokes every token issued to the user up to now. Tokens issued afterwards are not affected.
+func (dbInstance *DBInstance) RevokeUser(userId int, reason string) error {
+	_, err := dbInstance.sqliteDb.Exec(`INSERT INTO revoked_users (user_id, revoked_before, reason)
+VALUES ($userid, $revokedbefore, $reason)
+ON CONFLICT (user_id) DO UPDATE SET revoked_before = excluded.revoked_before, reason = excluded.reason`,
+		sql.Named("userid", userId),
+		sql.Named("revokedbefore", time.Now().Unix()),
+		sql.Named("reason", reason),
+	)
+	if err != nil {
+		return fmt.Errorf("error when revoking tokens of user %d: %w", userId, err)
+	}
+	return nil
+}
+
+// ListRevocations returns every revocation, user revocations first.
+func (dbInstance *DBInstance) ListRevocations() ([]*Revocation, error) {
+	revocations := []*Revocation{}
+	sqlRows, err := dbInstance.sqliteDb.Query("SELECT user_id, revoked_before, reason FROM revoked_users ORDER BY user_id")
+	if err != nil {
+		return nil, fmt.Errorf("error when getting user revocations: %w", err)
+	}
+	defer sqlRows.Close()
+	for sqlRows.Next() {
+		revocation := &Revocation{}
+		var revokedBefore int64
+		if err := sqlRows.Scan(&revocation.UserId, &revokedBefore, &revocation.Reason); err != nil {
+			return nil, fmt.Errorf("error when scanning user revocation: %w", err)
+		}
+		revocation.RevokedAt = time.Unix(revokedBefore, 0).UTC()
+		revocations = append(revocations, revocation)
+	}
+	sqlRows.Close()
+
+	sqlRows, err = dbInstance.sqliteDb.Query("SELECT revocation_id, revoked_at, expires_at, reason FROM revoked_tokens ORDER BY revoked_at, revocation_id")
+	if err != nil {
+		return nil, fmt.Errorf("error when getting token revocations: %w", err)
+	}
+	defer sqlRows.Close()
+	for sqlRows.Next() {
+		revocation := &Revocation{}
+		var revokedAt int64
+		var expiresAt sql.NullInt64
+		if err := sqlRows.Scan(&revocation.RevocationId, &revokedAt, &expiresAt, &revocation.Reason); err != nil {
+			return nil, fmt.Errorf("error when scanning token revocation: %w", err)
+		}
+		revocation.RevokedAt = time.Unix(revokedAt, 0).UTC()
+		revocation.ExpiresAt = fromNullableUnix(expiresAt)
+		revocations = append(revocations, revocation)
+	}
+	return revocations, nil
+}
+
+// PruneRevocations removes revocations of tokens which expired before now, since those tokens are refused anyway. Revocations with an unknown expiry and user revocations are kept. Returns the number of revocations removed.
+func (dbInstance *DBInstance) PruneRevocations(now time.Time) (int64, error) {
+	result, err := dbInstance.sqliteDb.Exec("DELETE FROM revoked_tokens WHERE expires_at IS NOT NULL AND expires_at < $now",
+		sql.Named("now", now.Unix()))
+	if err != nil {
+		return 0, fmt.Errorf("error when pruning revocations: %w", err)
+	}
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error when counting pruned revocations: %w", err)
+	}
+	return pruned, nil
+}
+
+// IsRevoked reports whether any of revocationIds has been revoked, or whether the user's tokens issued at or before issuedAt have been revoked. A zero issuedAt is treated as revoked if the user has any revocation, since the token's age is unknown.
+func (dbInstance *DBInstance) IsRevoked(revocationIds [][]byte, userId int, issuedAt time.Time) (bool, error) {
+	for _, revocationId := range revocationIds {
+		var found int
+		err := dbInstance.sqliteDb.QueryRow("SELECT 1 FROM revoked_tokens WHERE revocation_id = $revocationid",
+			sql.Named("revocationid", hex.EncodeToString(revocationId))).Scan(&found)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return false, fmt.Errorf("error when looking up revocation id: %w", err)
+		default:
+			return true, nil
+		}
+	}
+
+	var revokedBefore int64
+	err := dbInstance.sqliteDb.QueryRow("SELECT revoked_before FROM revoked_users WHERE user_id = $userid",
+		sql.Named("userid", userId)).Scan(&revokedBefore)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("error when looking up user revocation: %w", err)
+	}
+	return issuedAt.IsZero() || issuedAt.Unix() <= revokedBefore, nil
+}
@@ -3,6 +3,8 @@ package dblogic
 import (
 	"context"
 	"database/sql"
+	_ "embed"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -10,6 +12,26 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sqlInit is the example schema and data. It is embedded so the db can be initialized regardless of the working directory.
+//
+//go:embed db-init.sql
+var sqlInit string
+
+// sqlServiceAccounts is the schema for service accounts and their role grants. It is applied every time a db is opened, before sqlInit for a new db as the example data includes service accounts.
+//
+//go:embed db-serviceAccounts.sql
+var sqlServiceAccounts string
+
+// sqlTokens is the schema for token state such as revocations. It is idempotent and applied every time a db is opened, so existing db files pick up new tables.
+//
+//go:embed db-tokens.sql
+var sqlTokens string
+
+// sqlKeys is the schema for the SSH key registry. Like sqlTokens it is applied every time a db is opened.
+//
+//go:embed db-keys.sql
+var sqlKeys string
+
 // RepoRoleType is a possible repo role
 type RepoRoleType int
 
@@ -64,6 +86,8 @@ const (
 	UndefUGR UserOrGroupRel = iota
 	UserUGR
 	UsergroupUGR
+	// ServiceAccountUGR is a service account, which is never granted the owner role
+	ServiceAccountUGR
 )
 
 // RepoOrGroup specifies if the relationship is for a repo or a repogroup
@@ -75,11 +99,11 @@ const (
 	RepogroupUGR
 )
 
-// AssignedRole covers a relationship between a role, a user or usergroup, and a repo or repogroup.
+// AssignedRole covers a relationship between a role, a user, usergroup or service account, and a repo or repogroup.
 type AssignedRole struct {
-	// UserOrGroup specifies if UserOrGroupID is a userid or a usergroup id
+	// UserOrGroup specifies if UserOrGroupID is a userid, a usergroup id or a service account id
 	UserOrGroup UserOrGroupRel
-	// UserOrGroupID is an ID for either a user or usergroup
+	// UserOrGroupID is an ID for either a user, usergroup or service account
 	UserOrGroupID int
 	// RepoOrGroup specifies if RepoOrGroupID is a repoid or a repogroup id
 	RepoOrGroup RepoOrGroupRel
@@ -89,12 +113,16 @@ type AssignedRole struct {
 	RepoRole RepoRoleType
 }
 
-// RequestDetails provides information about the user logging in.
+// RequestDetails provides information about the user or service account logging in.
 type RequestDetails struct {
-	// UserId is the user id of the user
+	// UserId is the user id of the user. Zero for service account requests.
 	UserId int
 	// Username is the username of the user
 	Username string
+	// ServiceAccountId is the id of the service account. Zero for user requests.
+	ServiceAccountId int
+	// ServiceAccountName is the name of the service account
+	ServiceAccountName string
 	// UsergroupRelationships is the set of relevant usergroup relationships for the authz logic to use in eval.
 	UsergroupRelationships *UsergroupRelationships
 	// RepoId is the id of the repo being acted upon
@@ -105,6 +133,33 @@ type RequestDetails struct {
 	RepogroupRels []*RepogroupRel
 	// AssignedRoles is the set of roles assigned between entities and repos
 	AssignedRoles []*AssignedRole
+	// RequestContext describes how the request was made. It is supplied by the caller rather than the db.
+	RequestContext
+}
+
+const (
+	// TransportHTTP is the transport of requests made over the HTTP API
+	TransportHTTP = "http"
+	// TransportSSH is the transport of requests made through the SSH gateway
+	TransportSSH = "ssh"
+)
+
+// RequestContext describes how a request was made, as opposed to who made it. The transport fills it in, and the authorizer turns it into facts so attenuations and the policy can depend on it.
+type RequestContext struct {
+	// Ref is the git ref being written to, if any
+	Ref string
+	// SourceIP is the address the request came from, if known
+	SourceIP string
+	// PossessedKeys are the fingerprints of keys the client proved it holds by signing a challenge, such as the key it authenticated to the SSH gateway with
+	PossessedKeys []string
+	// MFA is set if the client performed multi-factor authentication for the request or its session
+	MFA bool
+	// ClientType is the kind of client, such as "git", "cli" or "browser", if known
+	ClientType string
+	// UserAgent is the client's self-reported user agent, if any
+	UserAgent string
+	// Transport is how the request reached the forge, TransportHTTP or TransportSSH, if known
+	Transport string
 }
 
 // DBInstance passes around an instance of the pointer to the DB for handling close operations, creating Tx's, etc.
@@ -144,39 +199,122 @@ func (dbInstance *DBInstance) Close() error {
 	return nil
 }
 
-// InitDb initializes a sqlite database and fills it with test data
-func InitDb() (*DBInstance, error) {
-	dbInitFilename := "dblogic/db-init.sql"
-	sqlInitBytes, err := os.ReadFile(dbInitFilename)
+// initSchema brings sqliteDb up to the current schema. Pending migrations are applied to an existing db first, as the schema files may refer to columns they add, then the idempotent schema files are applied. A new db is then filled with the example schema and data and recorded as needing no migrations.
+func initSchema(sqliteDb *sql.DB, isNew bool) error {
+	if !isNew {
+		err := migrate(sqliteDb)
+		if err != nil {
+			return fmt.Errorf("error when migrating sqlite db: %w", err)
+		}
+	}
+	_, err := sqliteDb.Exec(sqlServiceAccounts)
 	if err != nil {
-		return nil, fmt.Errorf("error in os.ReadFile for %s: %w",
-			dbInitFilename, err)
+		return fmt.Errorf("error when trying to create service account tables: %w",
+			err)
+	}
+	_, err = sqliteDb.Exec(sqlTokens)
+	if err != nil {
+		return fmt.Errorf("error when trying to create token tables: %w",
+			err)
+	}
+	_, err = sqliteDb.Exec(sqlKeys)
+	if err != nil {
+		return fmt.Errorf("error when trying to create key tables: %w",
+			err)
+	}
+	if !isNew {
+		return nil
 	}
-	sqlInit := string(sqlInitBytes)
 
-	sqliteDbFilename := "forgeAuthz.db"
-	file, err := os.Create(sqliteDbFilename)
+	// Initialize the DB with the example schema and data.
+	_, err = sqliteDb.Exec(sqlInit)
 	if err != nil {
-		return nil, fmt.Errorf("error in os.Create for %s: %w",
+		return fmt.Errorf("error when trying to init sqlite db: %w",
+			err)
+	}
+	return stampSchemaVersion(sqliteDb)
+}
+
+// InitDb opens the sqlite database in the working directory. If it does not exist yet it is created and filled with test data; an existing db keeps its data, so state such as revocations persists between runs, and is migrated to the current schema.
+func InitDb() (*DBInstance, error) {
+	return openDb("forgeAuthz.db")
+}
+
+// openDb opens the sqlite database at sqliteDbFilename as described for InitDb.
+func openDb(sqliteDbFilename string) (*DBInstance, error) {
+	_, err := os.Stat(sqliteDbFilename)
+	isNew := errors.Is(err, os.ErrNotExist)
+	if err != nil && !isNew {
+		return nil, fmt.Errorf("error in os.Stat for %s: %w",
 			sqliteDbFilename, err)
 	}
-	err = file.Close()
+
+	sqliteDb, err := sql.Open("sqlite3", sqliteDbFilename)
 	if err != nil {
-		return nil, fmt.Errorf("error when closing %s: %w",
+		return nil, fmt.Errorf("error when trying to open %s: %w",
 			sqliteDbFilename, err)
 	}
 
+	err = initSchema(sqliteDb, isNew)
+	if err != nil {
+		sqliteDb.Close()
+		if isNew {
+			os.Remove(sqliteDbFilename)
+		}
+		return nil, err
+	}
+
+	dbInstance := &DBInstance{
+		sqliteDb: sqliteDb,
+		filepath: sqliteDbFilename,
+	}
+	return dbInstance, nil
+}
+
+// InitMemoryDb initializes an in-memory sqlite database with the example schema. If withSeedData is false the example rows are removed, leaving only the schema and role enums, so the caller can load its own fixtures.
+func InitMemoryDb(withSeedData bool) (*DBInstance, error) {
+	sqliteDbFilename := ":memory:"
 	sqliteDb, err := sql.Open("sqlite3", sqliteDbFilename)
 	if err != nil {
 		return nil, fmt.Errorf("error when trying to open %s: %w",
 			sqliteDbFilename, err)
 	}
+	// Every connection to :memory: is a separate database, so keep the
+	// pool to the one connection which has the schema.
+	sqliteDb.SetMaxOpenConns(1)
 
-	// Initialize the DB with the example schema and data.
-	_, err = sqliteDb.Exec(sqlInit)
+	err = initSchema(sqliteDb, true)
 	if err != nil {
-		return nil, fmt.Errorf("error when trying to init sqlite db: %w",
-			err)
+		sqliteDb.Close()
+		return nil, err
+	}
+
+	if !withSeedData {
+		// Role enums are part of the schema, everything else is example data.
+		seedTables := []string{
+			"Repo_Roles_membership_ServiceAccounts",
+			"Repo_Roles_membership_UserGroups",
+			"Repo_Roles_membership_Users",
+			"RepoGroup_Roles_membership_Usergroup",
+			"RepoGroup_Roles_membership_Users",
+			"RepoGroup_Roles_membership_ServiceAccounts",
+			"RepoGroup_membership",
+			"UserGroup_membership_usergroups",
+			"UserGroup_membership_users",
+			"RepoGroups",
+			"Repos",
+			"UserGroups",
+			"Users",
+			"service_accounts",
+		}
+		for _, seedTable := range seedTables {
+			_, err = sqliteDb.Exec(fmt.Sprintf("DELETE FROM %s", seedTable))
+			if err != nil {
+				sqliteDb.Close()
+				return nil, fmt.Errorf("error when clearing seed data from %s: %w",
+					seedTable, err)
+			}
+		}
 	}
 
 	dbInstance := &DBInstance{
@@ -198,6 +336,18 @@ func checkUserInDb(userId int, sqlTx *sql.Tx) (username string, err error) {
 	return userName, nil
 }
 
+// checkServiceAccountInDb will check if the service account is in the database. If the service account is found its name will be returned. An error will be returned if the service account cannot be found or other issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func checkServiceAccountInDb(serviceAccountId int, sqlTx *sql.Tx) (string, error) {
+	getNameQuery := "SELECT name FROM service_accounts WHERE id = $serviceaccountid"
+	var name string
+	sqlRow := sqlTx.QueryRow(getNameQuery, sql.Named("serviceaccountid", serviceAccountId))
+	err := sqlRow.Scan(&name)
+	if err != nil {
+		return "", fmt.Errorf("error querying for service account from DB: %w", err)
+	}
+	return name, nil
+}
+
 // checkRepoInDb will check if the repo is in the database. If the repo is found the repoid will be returned. An error will be returned if the repo cannot be found or other issues occur. sqlTx will not be rolled back by this function if an error occurs.
 func checkRepoInDb(reponame string, sqlTx *sql.Tx) (int, error) {
 	getReponameQuery := "SELECT id, reponame FROM Repos WHERE reponame = $reponame"
@@ -491,6 +641,16 @@ WHERE RepoGroup_Roles_membership_Usergroup.usergroup_id IN ( %s)
 	return assignedRoles, nil
 }
 
+// GetUsername returns the name of the user with userId, or an error if there is no such user.
+func (dbInstance *DBInstance) GetUsername(userId int) (string, error) {
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error when making Tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+	return checkUserInDb(userId, sqlTx)
+}
+
 // GatherRequestDetails provides information about the request for use in authZ.
 func GatherRequestDetails(userId int, reponame string, dbInstance *DBInstance) (*RequestDetails, error) {
 	reqDetails := &RequestDetails{
@@ -547,3 +707,130 @@ func GatherRequestDetails(userId int, reponame string, dbInstance *DBInstance) (
 
 	return reqDetails, nil
 }
+
+// getServiceAccountRoles will get the roles the service account is granted on the repo and its repogroups. An empty list will be returned if no grants are found. An error will be returned if issues occur. sqlTx will not be rolled back by this function if an error occurs.
+func getServiceAccountRoles(serviceAccountId int, repoId int, repogroupRels []*RepogroupRel, sqlTx *sql.Tx) ([]*AssignedRole, error) {
+	assignedRoles := []*AssignedRole{}
+
+	getRepoRolesQuery := `SELECT repo_roles_enum.rolename
+FROM Repo_Roles_membership_ServiceAccounts
+INNER JOIN repo_roles_enum
+    ON repo_roles_enum.id = Repo_Roles_membership_ServiceAccounts.repo_role
+WHERE Repo_Roles_membership_ServiceAccounts.repo_id = $repoid
+        AND Repo_Roles_membership_ServiceAccounts.service_account_id = $serviceaccountid`
+	sqlRows, err := sqlTx.Query(getRepoRolesQuery,
+		sql.Named("repoid", repoId),
+		sql.Named("serviceaccountid", serviceAccountId),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting how service account is mapped to repo roles: %w", err)
+	}
+	defer sqlRows.Close()
+	for sqlRows.Next() {
+		var repoRoleStr string
+		if err := sqlRows.Scan(&repoRoleStr); err != nil {
+			return nil, fmt.Errorf("error when scanning for repo role str: %w", err)
+		}
+		repoRole, err := repoRoleStrToEnum(repoRoleStr, false)
+		if err != nil {
+			return nil, fmt.Errorf("error when mapping db role to enum: %w", err)
+		}
+		assignedRole := &AssignedRole{
+			UserOrGroup:   ServiceAccountUGR,
+			UserOrGroupID: serviceAccountId,
+			RepoOrGroup:   RepoUGR,
+			RepoOrGroupID: repoId,
+			RepoRole:      repoRole,
+		}
+		assignedRoles = append(assignedRoles, assignedRole)
+	}
+	sqlRows.Close()
+
+	getRepogroupRolesQuery := `SELECT repogroup_roles_enum.rolename
+FROM RepoGroup_Roles_membership_ServiceAccounts
+INNER JOIN repogroup_roles_enum
+    ON RepoGroup_Roles_membership_ServiceAccounts.repogroup_role = repogroup_roles_enum.id
+WHERE RepoGroup_Roles_membership_ServiceAccounts.repogroup_id = $repogroupid
+        AND RepoGroup_Roles_membership_ServiceAccounts.service_account_id = $serviceaccountid`
+	for _, repogroupRel := range repogroupRels {
+		sqlRows, err := sqlTx.Query(getRepogroupRolesQuery,
+			sql.Named("repogroupid", repogroupRel.RepogroupId),
+			sql.Named("serviceaccountid", serviceAccountId),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error getting how service account is mapped to repogroup roles: %w", err)
+		}
+		for sqlRows.Next() {
+			var roleNameStr string
+			if err := sqlRows.Scan(&roleNameStr); err != nil {
+				sqlRows.Close()
+				return nil, fmt.Errorf("error when scanning for repogroup role str: %w", err)
+			}
+			repoRole, err := repoRoleStrToEnum(roleNameStr, true)
+			if err != nil {
+				sqlRows.Close()
+				return nil, fmt.Errorf("error when mapping db role to enum: %w", err)
+			}
+			assignedRole := &AssignedRole{
+				UserOrGroup:   ServiceAccountUGR,
+				UserOrGroupID: serviceAccountId,
+				RepoOrGroup:   RepogroupUGR,
+				RepoOrGroupID: repogroupRel.RepogroupId,
+				RepoRole:      repoRole,
+			}
+			assignedRoles = append(assignedRoles, assignedRole)
+		}
+		sqlRows.Close()
+	}
+
+	return assignedRoles, nil
+}
+
+// GatherServiceRequestDetails is GatherRequestDetails for a service account. Service accounts are not members of usergroups, so only their direct grants on the repo and its repogroups are gathered.
+func GatherServiceRequestDetails(serviceAccountId int, reponame string, dbInstance *DBInstance) (*RequestDetails, error) {
+	reqDetails := &RequestDetails{
+		ServiceAccountId:       serviceAccountId,
+		RepoName:               reponame,
+		UsergroupRelationships: &UsergroupRelationships{},
+	}
+
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when making Tx: %w", err)
+	}
+
+	name, err := checkServiceAccountInDb(serviceAccountId, sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from checkServiceAccountInDb: %w", err)
+	}
+	reqDetails.ServiceAccountName = name
+
+	repoId, err := checkRepoInDb(reponame, sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from checkRepoInDb: %w", err)
+	}
+	reqDetails.RepoId = repoId
+
+	repogroupRels, err := getRepogroupRels(repoId, sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from getRepogroupRels: %w", err)
+	}
+	reqDetails.RepogroupRels = repogroupRels
+
+	assignedRoles, err := getServiceAccountRoles(serviceAccountId, repoId, repogroupRels, sqlTx)
+	if err != nil {
+		sqlTx.Rollback()
+		return nil, fmt.Errorf("error from getServiceAccountRoles: %w", err)
+	}
+	reqDetails.AssignedRoles = assignedRoles
+
+	err = sqlTx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("error when cleaning up sqlite Tx: %w", err)
+	}
+
+	return reqDetails, nil
+}
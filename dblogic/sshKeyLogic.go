@@ -0,0 +1,161 @@
+package dblogic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SSHKey is a public key registered for the SSH gateway. It belongs to either a user or, as a deploy key, a service account.
+type SSHKey struct {
+	// Id identifies the key in the registry
+	Id int `json:"id"`
+	// Fingerprint is the OpenSSH SHA256 fingerprint of the key, e.g. "SHA256:..."
+	Fingerprint string `json:"fingerprint"`
+	// PublicKey is the key in authorized_keys format, without a comment
+	PublicKey string `json:"public_key"`
+	// UserId is the user the key belongs to. Zero for deploy keys.
+	UserId int `json:"user_id,omitempty"`
+	// ServiceAccountId is the service account a deploy key belongs to. Zero for user keys.
+	ServiceAccountId int `json:"service_account_id,omitempty"`
+	// RepoId is the only repo the key may be used for. Zero if the key is not restricted to a repo.
+	RepoId int `json:"repo_id,omitempty"`
+	// ReadOnly keys may only be used for reads
+	ReadOnly bool `json:"read_only"`
+	// Title is an owner provided label, like the key's comment
+	Title string `json:"title"`
+	// CreatedAt is when the key was registered
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// sshKeyColumns are the ssh_keys columns in the order scanSSHKeys reads them.
+const sshKeyColumns = "id, fingerprint, public_key, user_id, service_account_id, repo_id, read_only, title, created_at"
+
+// scanSSHKeys reads the ssh_keys rows of query.
+func (dbInstance *DBInstance) scanSSHKeys(query string, args ...interface{}) ([]*SSHKey, error) {
+	sqlRows, err := dbInstance.sqliteDb.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting SSH keys: %w", err)
+	}
+	defer sqlRows.Close()
+	sshKeys := []*SSHKey{}
+	for sqlRows.Next() {
+		sshKey := &SSHKey{}
+		var createdAt int64
+		err = sqlRows.Scan(&sshKey.Id, &sshKey.Fingerprint, &sshKey.PublicKey, &sshKey.UserId, &sshKey.ServiceAccountId,
+			&sshKey.RepoId, &sshKey.ReadOnly, &sshKey.Title, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("error when scanning SSH key: %w", err)
+		}
+		sshKey.CreatedAt = time.Unix(createdAt, 0).UTC()
+		sshKeys = append(sshKeys, sshKey)
+	}
+	err = sqlRows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error when getting SSH keys: %w", err)
+	}
+	return sshKeys, nil
+}
+
+// AddSSHKey registers sshKey and sets its Id and CreatedAt. The owner, and the repo if the key is restricted to one, must exist, and a key can only be registered once.
+func (dbInstance *DBInstance) AddSSHKey(sshKey *SSHKey) error {
+	if (sshKey.UserId == 0) == (sshKey.ServiceAccountId == 0) {
+		return fmt.Errorf("SSH key must belong to exactly one of a user and a service account")
+	}
+	sqlTx, err := dbInstance.sqliteDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("error when making Tx: %w", err)
+	}
+	defer sqlTx.Rollback()
+
+	if sshKey.UserId != 0 {
+		_, err = checkUserInDb(sshKey.UserId, sqlTx)
+	} else {
+		_, err = checkServiceAccountInDb(sshKey.ServiceAccountId, sqlTx)
+	}
+	if err != nil {
+		return fmt.Errorf("error when checking SSH key owner: %w", err)
+	}
+	if sshKey.RepoId != 0 {
+		var reponame string
+		err = sqlTx.QueryRow("SELECT reponame FROM Repos WHERE id = $repoid", sql.Named("repoid", sshKey.RepoId)).Scan(&reponame)
+		if err != nil {
+			return fmt.Errorf("error querying for repo %d from DB: %w", sshKey.RepoId, err)
+		}
+	}
+
+	sshKey.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	result, err := sqlTx.Exec(`INSERT INTO ssh_keys (fingerprint, public_key, user_id, service_account_id, repo_id, read_only, title, created_at)
+VALUES ($fingerprint, $publickey, $userid, $serviceaccountid, $repoid, $readonly, $title, $createdat)`,
+		sql.Named("fingerprint", sshKey.Fingerprint),
+		sql.Named("publickey", sshKey.PublicKey),
+		sql.Named("userid", sshKey.UserId),
+		sql.Named("serviceaccountid", sshKey.ServiceAccountId),
+		sql.Named("repoid", sshKey.RepoId),
+		sql.Named("readonly", sshKey.ReadOnly),
+		sql.Named("title", sshKey.Title),
+		sql.Named("createdat", sshKey.CreatedAt.Unix()),
+	)
+	if err != nil {
+		return fmt.Errorf("error when registering SSH key %s: %w", sshKey.Fingerprint, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error when getting id of SSH key %s: %w", sshKey.Fingerprint, err)
+	}
+	sshKey.Id = int(id)
+	err = sqlTx.Commit()
+	if err != nil {
+		return fmt.Errorf("error when committing SSH key %s: %w", sshKey.Fingerprint, err)
+	}
+	return nil
+}
+
+// RemoveSSHKey removes the key with id from the registry, or returns an error if there is no such key.
+func (dbInstance *DBInstance) RemoveSSHKey(id int) error {
+	result, err := dbInstance.sqliteDb.Exec("DELETE FROM ssh_keys WHERE id = $id", sql.Named("id", id))
+	if err != nil {
+		return fmt.Errorf("error when removing SSH key %d: %w", id, err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error when removing SSH key %d: %w", id, err)
+	}
+	if removed == 0 {
+		return fmt.Errorf("unknown SSH key: %d", id)
+	}
+	return nil
+}
+
+// ListSSHKeys returns the keys of userId, or every key including deploy keys if userId is 0, oldest first.
+func (dbInstance *DBInstance) ListSSHKeys(userId int) ([]*SSHKey, error) {
+	if userId == 0 {
+		return dbInstance.scanSSHKeys("SELECT " + sshKeyColumns + " FROM ssh_keys ORDER BY id")
+	}
+	return dbInstance.scanSSHKeys("SELECT "+sshKeyColumns+" FROM ssh_keys WHERE user_id = $userid ORDER BY id", sql.Named("userid", userId))
+}
+
+// GetSSHKey returns the key with id, or an error if there is none.
+func (dbInstance *DBInstance) GetSSHKey(id int) (*SSHKey, error) {
+	sshKeys, err := dbInstance.scanSSHKeys("SELECT "+sshKeyColumns+" FROM ssh_keys WHERE id = $id", sql.Named("id", id))
+	if err != nil {
+		return nil, err
+	}
+	if len(sshKeys) == 0 {
+		return nil, fmt.Errorf("unknown SSH key: %d", id)
+	}
+	return sshKeys[0], nil
+}
+
+// LookupSSHKey returns the key with fingerprint, or an error if it is not registered.
+func (dbInstance *DBInstance) LookupSSHKey(fingerprint string) (*SSHKey, error) {
+	sshKeys, err := dbInstance.scanSSHKeys("SELECT "+sshKeyColumns+" FROM ssh_keys WHERE fingerprint = $fingerprint", sql.Named("fingerprint", fingerprint))
+	if err != nil {
+		return nil, err
+	}
+	if len(sshKeys) == 0 {
+		return nil, fmt.Errorf("unknown SSH key: %s", fingerprint)
+	}
+	return sshKeys[0], nil
+}
@@ -0,0 +1,108 @@
+package dblogic
+
+import (
+	"testing"
+)
+
+// sshKeyTestDb opens an in-memory db with the example users, service accounts and repos for SSH key tests.
+func sshKeyTestDb(t *testing.T) *DBInstance {
+	t.Helper()
+	dbInstance, err := InitMemoryDb(true)
+	if err != nil {
+		t.Fatalf("InitMemoryDb: %s", err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	return dbInstance
+}
+
+// addSSHKey registers sshKey in dbInstance, failing the test on error.
+func addSSHKey(t *testing.T, dbInstance *DBInstance, sshKey *SSHKey) {
+	t.Helper()
+	err := dbInstance.AddSSHKey(sshKey)
+	if err != nil {
+		t.Fatalf("AddSSHKey: %s", err)
+	}
+}
+
+// TestSSHKeyRegistry checks that registered keys are read back by id and fingerprint, listed per user or all together, and removed.
+func TestSSHKeyRegistry(t *testing.T) {
+	dbInstance := sshKeyTestDb(t)
+	userKey := &SSHKey{Fingerprint: "SHA256:liam", PublicKey: "ssh-ed25519 liam", UserId: 4, RepoId: 3, ReadOnly: true, Title: "laptop"}
+	addSSHKey(t, dbInstance, userKey)
+	addSSHKey(t, dbInstance, &SSHKey{Fingerprint: "SHA256:emma", PublicKey: "ssh-ed25519 emma", UserId: 3})
+	addSSHKey(t, dbInstance, &SSHKey{Fingerprint: "SHA256:deploy", PublicKey: "ssh-ed25519 deploy", ServiceAccountId: 2})
+	if userKey.Id == 0 || userKey.CreatedAt.IsZero() {
+		t.Fatalf("expected AddSSHKey to set the id and creation time, got %+v", userKey)
+	}
+
+	sshKey, err := dbInstance.GetSSHKey(userKey.Id)
+	if err != nil {
+		t.Fatalf("GetSSHKey: %s", err)
+	}
+	if *sshKey != *userKey {
+		t.Errorf("expected %+v, got %+v", userKey, sshKey)
+	}
+	sshKey, err = dbInstance.LookupSSHKey("SHA256:liam")
+	if err != nil || sshKey.Id != userKey.Id {
+		t.Errorf("expected LookupSSHKey to find key %d, got %+v (%v)", userKey.Id, sshKey, err)
+	}
+
+	liamKeys, err := dbInstance.ListSSHKeys(4)
+	if err != nil {
+		t.Fatalf("ListSSHKeys: %s", err)
+	}
+	if len(liamKeys) != 1 || liamKeys[0].Id != userKey.Id {
+		t.Errorf("expected only Liam's key, got %+v", liamKeys)
+	}
+	allKeys, err := dbInstance.ListSSHKeys(0)
+	if err != nil {
+		t.Fatalf("ListSSHKeys: %s", err)
+	}
+	if len(allKeys) != 3 || allKeys[2].ServiceAccountId != 2 {
+		t.Errorf("expected every key including the deploy key, oldest first, got %+v", allKeys)
+	}
+
+	err = dbInstance.RemoveSSHKey(userKey.Id)
+	if err != nil {
+		t.Fatalf("RemoveSSHKey: %s", err)
+	}
+	if _, err = dbInstance.GetSSHKey(userKey.Id); err == nil {
+		t.Errorf("expected a removed key to be unknown")
+	}
+	if _, err = dbInstance.LookupSSHKey("SHA256:liam"); err == nil {
+		t.Errorf("expected a removed key's fingerprint to be unknown")
+	}
+	if err = dbInstance.RemoveSSHKey(userKey.Id); err == nil {
+		t.Errorf("expected removing a removed key to fail")
+	}
+}
+
+// TestAddSSHKeyRefused checks that keys are refused unless they have exactly one owner which exists, a repo which exists if they name one, and a fingerprint which is not registered yet.
+func TestAddSSHKeyRefused(t *testing.T) {
+	dbInstance := sshKeyTestDb(t)
+	addSSHKey(t, dbInstance, &SSHKey{Fingerprint: "SHA256:liam", PublicKey: "ssh-ed25519 liam", UserId: 4})
+
+	for _, test := range []struct {
+		name   string
+		sshKey *SSHKey
+	}{
+		{"duplicate fingerprint", &SSHKey{Fingerprint: "SHA256:liam", PublicKey: "ssh-ed25519 liam", UserId: 3}},
+		{"both owners", &SSHKey{Fingerprint: "SHA256:both", PublicKey: "ssh-ed25519 both", UserId: 4, ServiceAccountId: 2}},
+		{"neither owner", &SSHKey{Fingerprint: "SHA256:neither", PublicKey: "ssh-ed25519 neither"}},
+		{"unknown user", &SSHKey{Fingerprint: "SHA256:nobody", PublicKey: "ssh-ed25519 nobody", UserId: 99}},
+		{"unknown service account", &SSHKey{Fingerprint: "SHA256:nobot", PublicKey: "ssh-ed25519 nobot", ServiceAccountId: 99}},
+		{"unknown repo", &SSHKey{Fingerprint: "SHA256:norepo", PublicKey: "ssh-ed25519 norepo", UserId: 4, RepoId: 99}},
+	} {
+		err := dbInstance.AddSSHKey(test.sshKey)
+		if err == nil {
+			t.Errorf("%s: expected the key to be refused", test.name)
+		}
+	}
+	sshKeys, err := dbInstance.ListSSHKeys(0)
+	if err != nil {
+		t.Fatalf("ListSSHKeys: %s", err)
+	}
+	if len(sshKeys) != 1 {
+		t.Errorf("expected refused keys not to be registered, got %+v", sshKeys)
+	}
+}
@@ -5,9 +5,12 @@ go 1.20
 require (
 	github.com/biscuit-auth/biscuit-go/v2 v2.2.0
 	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/crypto v0.31.0
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/alecthomas/participle/v2 v2.0.0 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -0,0 +1,107 @@
+package httpapi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// maxBatchChecks caps the checks in one POST /authorize/batch request.
+const maxBatchChecks = 500
+
+// batchCheck is a repo and action in a POST /authorize/batch request.
+type batchCheck struct {
+	Repo   string `json:"repo"`
+	Action string `json:"action"`
+}
+
+// batchAuthorizeRequest is the body of POST /authorize/batch.
+type batchAuthorizeRequest struct {
+	Checks []batchCheck `json:"checks"`
+}
+
+// batchDecision is the decision for one batchCheck.
+type batchDecision struct {
+	Repo    string `json:"repo"`
+	Action  string `json:"action"`
+	Allowed bool   `json:"allowed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// batchAuthorizeResponse is the body of a POST /authorize/batch response, with decisions in the order of the checks.
+type batchAuthorizeResponse struct {
+	Decisions []*batchDecision `json:"decisions"`
+}
+
+// requestContext describes the HTTP request r for the authorizer.
+func requestContext(r *http.Request) dblogic.RequestContext {
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+	return dblogic.RequestContext{
+		SourceIP:  sourceIP,
+		UserAgent: r.UserAgent(),
+		Transport: dblogic.TransportHTTP,
+	}
+}
+
+// handleBatchAuthorize decides whether the token presented as the bearer credential allows each of the posted repo / action checks, for pages which list many repos at once.
+func (server *Server) handleBatchAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	credential := bearerToken(r)
+	if credential == "" {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("bearer token required"))
+		return
+	}
+	token, err := authz.DecodeToken(credential)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	batchReq := &batchAuthorizeRequest{}
+	err = readJSON(r, batchReq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(batchReq.Checks) > maxBatchChecks {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("at most %d checks are allowed, got %d", maxBatchChecks, len(batchReq.Checks)))
+		return
+	}
+	items := []authz.BatchItem{}
+	for _, check := range batchReq.Checks {
+		action, err := authz.ParseAction(check.Action)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		items = append(items, authz.BatchItem{RepoName: check.Repo, Action: action})
+	}
+
+	decisions, err := authz.BatchAuthorize(token, server.tokenIssuer.PublicRoot, server.dbInstance, requestContext(r), items)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	batchResp := &batchAuthorizeResponse{Decisions: []*batchDecision{}}
+	for i, decision := range decisions {
+		respDecision := &batchDecision{
+			Repo:    decision.RepoName,
+			Action:  batchReq.Checks[i].Action,
+			Allowed: decision.Allowed,
+		}
+		if decision.Err != nil {
+			respDecision.Error = decision.Err.Error()
+		}
+		batchResp.Decisions = append(batchResp.Decisions, respDecision)
+	}
+	writeJSON(w, http.StatusOK, batchResp)
+}
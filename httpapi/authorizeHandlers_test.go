@@ -0,0 +1,45 @@
+package httpapi
+
+import (
+	"net/http"
+	"testing"
+
+	"biscuitExample/authz"
+)
+
+// TestBatchAuthorize checks the decisions for Liam (user 4), who may read Charlie through FooOps but not Alpha.
+func TestBatchAuthorize(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	batchReq := &batchAuthorizeRequest{Checks: []batchCheck{
+		{Repo: "Charlie", Action: "read"},
+		{Repo: "Alpha", Action: "read"},
+		{Repo: "Missing", Action: "read"},
+	}}
+	batchResp := &batchAuthorizeResponse{}
+	status := doJSON(t, server, http.MethodPost, "/authorize/batch", credential, batchReq, batchResp)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	expected := []bool{true, false, false}
+	if len(batchResp.Decisions) != len(expected) {
+		t.Fatalf("expected %d decisions, got %d", len(expected), len(batchResp.Decisions))
+	}
+	for i, decision := range batchResp.Decisions {
+		if decision.Allowed != expected[i] {
+			t.Errorf("%s %s: expected allowed %t, got %t (%s)", decision.Action, decision.Repo, expected[i], decision.Allowed, decision.Error)
+		}
+	}
+}
+
+// TestBatchAuthorizeNullCheck checks that a null entry in checks is refused as a bad request rather than crashing the handler.
+func TestBatchAuthorizeNullCheck(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	status := doJSON(t, server, http.MethodPost, "/authorize/batch", credential, map[string]interface{}{"checks": []interface{}{nil}}, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", status)
+	}
+}
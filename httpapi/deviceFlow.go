@@ -0,0 +1,356 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"biscuitExample/authz"
+)
+
+// deviceCodeGrantType is the grant_type of device access token requests, from RFC 8628.
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceKind is the ledger kind of tokens issued by the device flow.
+const deviceKind = "device"
+
+const (
+	// deviceCodeLifetime is how long a user has to approve a device authorization
+	deviceCodeLifetime = 10 * time.Minute
+	// devicePollInterval is how often a device may poll for its token, raised by slowDownInterval each time it polls too often
+	devicePollInterval = 5 * time.Second
+	slowDownInterval   = 5 * time.Second
+	// maxPendingDeviceGrants bounds the grants anyone can start without authenticating, and so the work sweep does under the lock
+	maxPendingDeviceGrants = 1000
+)
+
+// userCodeAlphabet has no vowels, so user codes cannot spell words, and no characters which are easily confused.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// deviceAuthorization is a pending device authorization grant.
+type deviceAuthorization struct {
+	deviceCode string
+	userCode   string
+	clientId   string
+	expiresAt  time.Time
+	interval   time.Duration
+	lastPoll   time.Time
+	// userId is the approving user, 0 until the grant is approved
+	userId int
+	denied bool
+	// issuing is set while a poll is issuing the token of an approved grant, so no other poll issues one too
+	issuing bool
+}
+
+// deviceFlow holds the pending device authorization grants. Grants only live as long as the process, which is shorter than anyone waits at a login prompt.
+type deviceFlow struct {
+	mu           sync.Mutex
+	byDeviceCode map[string]*deviceAuthorization
+	byUserCode   map[string]*deviceAuthorization
+	// maxPending is how many grants may be pending at once
+	maxPending int
+	// standInApproval enables the approval page, which lets anyone approve a grant as any user. It stands in for a real login page in local testing.
+	standInApproval bool
+}
+
+// newDeviceFlow creates an empty deviceFlow.
+func newDeviceFlow() *deviceFlow {
+	return &deviceFlow{
+		byDeviceCode: map[string]*deviceAuthorization{},
+		byUserCode:   map[string]*deviceAuthorization{},
+		maxPending:   maxPendingDeviceGrants,
+	}
+}
+
+// sweep removes expired grants. flow.mu must be held.
+func (flow *deviceFlow) sweep(now time.Time) {
+	for deviceCode, authorization := range flow.byDeviceCode {
+		if now.After(authorization.expiresAt) && !authorization.issuing {
+			delete(flow.byDeviceCode, deviceCode)
+			delete(flow.byUserCode, authorization.userCode)
+		}
+	}
+}
+
+// newUserCode generates a user code such as "BDFG-HJKL".
+func newUserCode() (string, error) {
+	code := make([]byte, 8)
+	for i := range code {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", fmt.Errorf("error when generating user code: %w", err)
+		}
+		code[i] = userCodeAlphabet[index.Int64()]
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// normalizeUserCode uppercases a user code as typed and restores its dash, so users can type it either way.
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(userCode))
+	if len(userCode) != 8 {
+		return userCode
+	}
+	return userCode[:4] + "-" + userCode[4:]
+}
+
+// deviceCodeResponse is the body returned by POST /device/code.
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// oauthErrorResponse is an OAuth 2.0 error response, which RFC 8628 uses to tell polling devices to keep waiting.
+type oauthErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// deviceTokenResponse is the body returned by POST /device/token once the grant is approved.
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// requestOrigin returns the scheme and host the request was made to, for building URLs to show the user.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// handleDeviceCode starts a device authorization grant, per RFC 8628 section 3.1.
+func (server *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error when parsing form: %w", err))
+		return
+	}
+
+	deviceCodeBytes := make([]byte, 32)
+	_, err = rand.Read(deviceCodeBytes)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error when generating device code: %w", err))
+		return
+	}
+	authorization := &deviceAuthorization{
+		deviceCode: hex.EncodeToString(deviceCodeBytes),
+		clientId:   r.PostForm.Get("client_id"),
+		expiresAt:  time.Now().Add(deviceCodeLifetime),
+		interval:   devicePollInterval,
+	}
+
+	server.deviceFlow.mu.Lock()
+	server.deviceFlow.sweep(time.Now())
+	if len(server.deviceFlow.byDeviceCode) >= server.deviceFlow.maxPending {
+		server.deviceFlow.mu.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(int(devicePollInterval/time.Second)))
+		writeJSON(w, http.StatusTooManyRequests, &oauthErrorResponse{Error: "slow_down"})
+		return
+	}
+	for authorization.userCode == "" || server.deviceFlow.byUserCode[authorization.userCode] != nil {
+		authorization.userCode, err = newUserCode()
+		if err != nil {
+			server.deviceFlow.mu.Unlock()
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	server.deviceFlow.byDeviceCode[authorization.deviceCode] = authorization
+	server.deviceFlow.byUserCode[authorization.userCode] = authorization
+	server.deviceFlow.mu.Unlock()
+
+	verificationURI := requestOrigin(r) + "/device"
+	writeJSON(w, http.StatusOK, &deviceCodeResponse{
+		DeviceCode:              authorization.deviceCode,
+		UserCode:                authorization.userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(authorization.userCode),
+		ExpiresIn:               int64(deviceCodeLifetime / time.Second),
+		Interval:                int64(devicePollInterval / time.Second),
+	})
+}
+
+// handleDeviceToken is polled by the device until the grant is approved, denied or expires, per RFC 8628 section 3.4. Once approved it issues a token to the approving user, which can only be collected once. The grant is kept until the token is issued, so a device can poll again if issuing fails.
+func (server *Server) handleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &oauthErrorResponse{Error: "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != deviceCodeGrantType {
+		writeJSON(w, http.StatusBadRequest, &oauthErrorResponse{Error: "unsupported_grant_type"})
+		return
+	}
+
+	now := time.Now()
+	server.deviceFlow.mu.Lock()
+	server.deviceFlow.sweep(now)
+	authorization := server.deviceFlow.byDeviceCode[r.PostForm.Get("device_code")]
+	if authorization == nil {
+		server.deviceFlow.mu.Unlock()
+		writeJSON(w, http.StatusBadRequest, &oauthErrorResponse{Error: "expired_token"})
+		return
+	}
+	if now.Sub(authorization.lastPoll) < authorization.interval {
+		authorization.interval += slowDownInterval
+		authorization.lastPoll = now
+		server.deviceFlow.mu.Unlock()
+		writeJSON(w, http.StatusBadRequest, &oauthErrorResponse{Error: "slow_down"})
+		return
+	}
+	authorization.lastPoll = now
+	if authorization.denied {
+		// Denied grants are finished, so the device code cannot be reused
+		server.deviceFlow.remove(authorization)
+		server.deviceFlow.mu.Unlock()
+		writeJSON(w, http.StatusBadRequest, &oauthErrorResponse{Error: "access_denied"})
+		return
+	}
+	if authorization.userId == 0 || authorization.issuing {
+		server.deviceFlow.mu.Unlock()
+		writeJSON(w, http.StatusBadRequest, &oauthErrorResponse{Error: "authorization_pending"})
+		return
+	}
+	authorization.issuing = true
+	server.deviceFlow.mu.Unlock()
+
+	encoded, err := server.issueDeviceToken(authorization)
+	server.deviceFlow.mu.Lock()
+	if err != nil {
+		authorization.issuing = false
+		server.deviceFlow.mu.Unlock()
+		log.Printf("Error when issuing device flow token: %s", err.Error())
+		writeJSON(w, http.StatusInternalServerError, &oauthErrorResponse{Error: "server_error"})
+		return
+	}
+	// The token is collected, so the device code cannot be reused
+	server.deviceFlow.remove(authorization)
+	server.deviceFlow.mu.Unlock()
+	writeJSON(w, http.StatusOK, &deviceTokenResponse{AccessToken: encoded, TokenType: "Bearer"})
+}
+
+// remove removes authorization from the pending grants. flow.mu must be held.
+func (flow *deviceFlow) remove(authorization *deviceAuthorization) {
+	delete(flow.byDeviceCode, authorization.deviceCode)
+	delete(flow.byUserCode, authorization.userCode)
+}
+
+// issueDeviceToken issues and encodes the token of the approved grant authorization.
+func (server *Server) issueDeviceToken(authorization *deviceAuthorization) (string, error) {
+	token, err := server.tokenIssuer.IssueTokenWithOptions(authorization.userId, authz.IssueOptions{
+		Name: authorization.clientId,
+		Kind: deviceKind,
+	})
+	if err != nil {
+		return "", err
+	}
+	return authz.EncodeToken(token)
+}
+
+// approvalPage is the stand-in approval page. A real deployment would show the user code to a user who has logged in with SSO instead of asking who they are.
+var approvalPage = template.Must(template.New("approval").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Forge device login</title></head>
+<body>
+<h1>Forge device login</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<form method="post" action="/device">
+<p><label>Code <input name="user_code" value="{{.UserCode}}"></label></p>
+<p><label>User id <input name="user_id" value=""></label></p>
+<p><button name="decision" value="approve">Approve</button> <button name="decision" value="deny">Deny</button></p>
+</form>
+</body>
+</html>
+`))
+
+// approvalPageData fills in approvalPage.
+type approvalPageData struct {
+	UserCode string
+	Message  string
+}
+
+// handleDeviceApproval serves the stand-in approval page on GET and records the decision on POST. It is only served when the stand-in approval is enabled.
+func (server *Server) handleDeviceApproval(w http.ResponseWriter, r *http.Request) {
+	if !server.deviceFlow.standInApproval {
+		writeError(w, http.StatusNotFound, fmt.Errorf("device approval page is disabled"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	switch r.Method {
+	case http.MethodGet:
+		err := approvalPage.Execute(w, &approvalPageData{UserCode: r.URL.Query().Get("user_code")})
+		if err != nil {
+			log.Printf("Error when writing approval page: %s", err.Error())
+		}
+	case http.MethodPost:
+		message, status := server.decideDeviceApproval(r)
+		w.WriteHeader(status)
+		err := approvalPage.Execute(w, &approvalPageData{Message: message})
+		if err != nil {
+			log.Printf("Error when writing approval page: %s", err.Error())
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// decideDeviceApproval approves or denies the grant named in the approval form, and returns the message and status to show.
+func (server *Server) decideDeviceApproval(r *http.Request) (string, int) {
+	err := r.ParseForm()
+	if err != nil {
+		return "The form could not be read.", http.StatusBadRequest
+	}
+	userCode := normalizeUserCode(r.PostForm.Get("user_code"))
+	approve := r.PostForm.Get("decision") == "approve"
+	userId := 0
+	if approve {
+		userId, err = strconv.Atoi(r.PostForm.Get("user_id"))
+		if err != nil {
+			return "The user id must be a number.", http.StatusBadRequest
+		}
+		_, err = server.dbInstance.GetUsername(userId)
+		if err != nil {
+			return "There is no such user.", http.StatusBadRequest
+		}
+	}
+
+	server.deviceFlow.mu.Lock()
+	defer server.deviceFlow.mu.Unlock()
+	server.deviceFlow.sweep(time.Now())
+	authorization := server.deviceFlow.byUserCode[userCode]
+	if authorization == nil || authorization.denied || authorization.userId != 0 {
+		return "The code is unknown or has expired.", http.StatusBadRequest
+	}
+	if !approve {
+		authorization.denied = true
+		return "The device was denied.", http.StatusOK
+	}
+	authorization.userId = userId
+	return "The device is approved and will be signed in shortly.", http.StatusOK
+}
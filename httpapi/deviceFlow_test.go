@@ -0,0 +1,241 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"biscuitExample/authz"
+)
+
+// startDeviceLogin requests a device code from server, failing the test unless one is granted.
+func startDeviceLogin(t *testing.T, server *Server) *deviceCodeResponse {
+	t.Helper()
+	w := postForm(t, server, "/device/code", "", url.Values{"client_id": {"laptop"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	codeResp := &deviceCodeResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), codeResp)
+	if err != nil {
+		t.Fatalf("json.Unmarshal of %s: %s", w.Body.String(), err)
+	}
+	return codeResp
+}
+
+// pollDeviceToken polls for the token of deviceCode as a device would, after letting the poll interval pass, and returns the status with either the token or the OAuth error.
+func pollDeviceToken(t *testing.T, server *Server, deviceCode string) (int, string, string) {
+	t.Helper()
+	server.deviceFlow.mu.Lock()
+	if authorization := server.deviceFlow.byDeviceCode[deviceCode]; authorization != nil {
+		authorization.lastPoll = time.Time{}
+	}
+	server.deviceFlow.mu.Unlock()
+	return pollDeviceTokenNow(t, server, deviceCode)
+}
+
+// pollDeviceTokenNow is pollDeviceToken without waiting for the poll interval.
+func pollDeviceTokenNow(t *testing.T, server *Server, deviceCode string) (int, string, string) {
+	t.Helper()
+	w := postForm(t, server, "/device/token", "", url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {deviceCode},
+	})
+	if w.Code == http.StatusOK {
+		tokenResp := &deviceTokenResponse{}
+		err := json.Unmarshal(w.Body.Bytes(), tokenResp)
+		if err != nil {
+			t.Errorf("json.Unmarshal of %s: %s", w.Body.String(), err)
+		}
+		return w.Code, tokenResp.AccessToken, ""
+	}
+	errorResp := &oauthErrorResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), errorResp)
+	if err != nil {
+		t.Errorf("json.Unmarshal of %s: %s", w.Body.String(), err)
+	}
+	return w.Code, "", errorResp.Error
+}
+
+// decideDevice submits the stand-in approval form for userCode and returns the response status.
+func decideDevice(t *testing.T, server *Server, userCode string, userId string, decision string) int {
+	t.Helper()
+	return postForm(t, server, "/device", "", url.Values{
+		"user_code": {userCode},
+		"user_id":   {userId},
+		"decision":  {decision},
+	}).Code
+}
+
+// TestDeviceFlowRedeemOnce checks that an approved device code is exchanged for a token of the approving user exactly once, and cannot be approved again.
+func TestDeviceFlowRedeemOnce(t *testing.T) {
+	server := newTestServer(t)
+	server.EnableStandInApproval()
+	codeResp := startDeviceLogin(t, server)
+
+	status, _, oauthError := pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusBadRequest || oauthError != "authorization_pending" {
+		t.Fatalf("expected authorization_pending before approval, got %d %s", status, oauthError)
+	}
+
+	// Users may type the code without its dash and in lower case
+	userCode := strings.ToLower(strings.Replace(codeResp.UserCode, "-", "", 1))
+	if status := decideDevice(t, server, userCode, "4", "approve"); status != http.StatusOK {
+		t.Fatalf("expected the approval to succeed, got %d", status)
+	}
+	status, accessToken, oauthError := pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusOK {
+		t.Fatalf("expected the token after approval, got %d %s", status, oauthError)
+	}
+	introspection := &authz.Introspection{}
+	w := postForm(t, server, "/introspect", testIntrospectionSecret, url.Values{"token": {accessToken}})
+	if err := json.Unmarshal(w.Body.Bytes(), introspection); err != nil {
+		t.Fatalf("json.Unmarshal of %s: %s", w.Body.String(), err)
+	}
+	if !introspection.Active || introspection.Subject != "userid:4" {
+		t.Errorf("expected an active token for userid:4, got %+v", introspection)
+	}
+
+	status, accessToken, oauthError = pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusBadRequest || accessToken != "" || oauthError != "expired_token" {
+		t.Errorf("expected redeeming the device code again to fail with expired_token, got %d %s", status, oauthError)
+	}
+	if status := decideDevice(t, server, codeResp.UserCode, "3", "approve"); status != http.StatusBadRequest {
+		t.Errorf("expected approving a redeemed code to fail, got %d", status)
+	}
+}
+
+// TestDeviceFlowConcurrentRedeem checks that only one of many devices polling an approved device code at once gets a token.
+func TestDeviceFlowConcurrentRedeem(t *testing.T) {
+	server := newTestServer(t)
+	server.EnableStandInApproval()
+	codeResp := startDeviceLogin(t, server)
+	if status := decideDevice(t, server, codeResp.UserCode, "4", "approve"); status != http.StatusOK {
+		t.Fatalf("expected the approval to succeed, got %d", status)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _, _ := pollDeviceTokenNow(t, server, codeResp.DeviceCode)
+			if status == http.StatusOK {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if redeemed != 1 {
+		t.Errorf("expected the device code to be redeemed once, got %d", redeemed)
+	}
+}
+
+// TestDeviceFlowIssueFails checks that an approved grant whose token cannot be issued is kept, so the device can collect the token once issuing works again.
+func TestDeviceFlowIssueFails(t *testing.T) {
+	server := newTestServer(t)
+	server.EnableStandInApproval()
+	codeResp := startDeviceLogin(t, server)
+	if status := decideDevice(t, server, codeResp.UserCode, "4", "approve"); status != http.StatusOK {
+		t.Fatalf("expected the approval to succeed, got %d", status)
+	}
+
+	server.tokenIssuer.RequireExpiry = true
+	status, _, oauthError := pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusInternalServerError || oauthError != "server_error" {
+		t.Fatalf("expected server_error while the issuer refuses the token, got %d %s", status, oauthError)
+	}
+
+	server.tokenIssuer.RequireExpiry = false
+	status, accessToken, oauthError := pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusOK || accessToken == "" {
+		t.Errorf("expected the token once the issuer accepts it, got %d %s", status, oauthError)
+	}
+}
+
+// TestDeviceFlowPendingLimit checks that no more device codes are handed out while the limit of pending grants is reached.
+func TestDeviceFlowPendingLimit(t *testing.T) {
+	server := newTestServer(t)
+	server.deviceFlow.maxPending = 2
+	startDeviceLogin(t, server)
+	startDeviceLogin(t, server)
+
+	w := postForm(t, server, "/device/code", "", url.Values{"client_id": {"laptop"}})
+	errorResp := &oauthErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), errorResp); err != nil {
+		t.Fatalf("json.Unmarshal of %s: %s", w.Body.String(), err)
+	}
+	if w.Code != http.StatusTooManyRequests || errorResp.Error != "slow_down" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 slow_down with Retry-After past the limit, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// TestDeviceFlowDenied checks that a denied device code never yields a token.
+func TestDeviceFlowDenied(t *testing.T) {
+	server := newTestServer(t)
+	server.EnableStandInApproval()
+	codeResp := startDeviceLogin(t, server)
+	if status := decideDevice(t, server, codeResp.UserCode, "", "deny"); status != http.StatusOK {
+		t.Fatalf("expected the denial to succeed, got %d", status)
+	}
+
+	status, _, oauthError := pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusBadRequest || oauthError != "access_denied" {
+		t.Errorf("expected access_denied, got %d %s", status, oauthError)
+	}
+	status, _, oauthError = pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusBadRequest || oauthError != "expired_token" {
+		t.Errorf("expected the denied code to be gone, got %d %s", status, oauthError)
+	}
+	if status := decideDevice(t, server, codeResp.UserCode, "4", "approve"); status != http.StatusBadRequest {
+		t.Errorf("expected approving a denied code to fail, got %d", status)
+	}
+}
+
+// TestDeviceFlowPolling checks that devices polling faster than the interval are told to slow down, and that unknown device codes and grant types are refused.
+func TestDeviceFlowPolling(t *testing.T) {
+	server := newTestServer(t)
+	codeResp := startDeviceLogin(t, server)
+
+	pollDeviceToken(t, server, codeResp.DeviceCode)
+	status, _, oauthError := pollDeviceTokenNow(t, server, codeResp.DeviceCode)
+	if status != http.StatusBadRequest || oauthError != "slow_down" {
+		t.Errorf("expected slow_down, got %d %s", status, oauthError)
+	}
+	status, _, oauthError = pollDeviceToken(t, server, "unknown")
+	if status != http.StatusBadRequest || oauthError != "expired_token" {
+		t.Errorf("expected an unknown device code to be refused with expired_token, got %d %s", status, oauthError)
+	}
+	w := postForm(t, server, "/device/token", "", url.Values{"grant_type": {"password"}, "device_code": {codeResp.DeviceCode}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected another grant type to be refused, got %d", w.Code)
+	}
+}
+
+// TestDeviceApproval checks that the stand-in approval page is off unless enabled, and only approves existing users.
+func TestDeviceApproval(t *testing.T) {
+	server := newTestServer(t)
+	codeResp := startDeviceLogin(t, server)
+	if status := decideDevice(t, server, codeResp.UserCode, "4", "approve"); status != http.StatusNotFound {
+		t.Errorf("expected the approval page to be disabled, got %d", status)
+	}
+
+	server.EnableStandInApproval()
+	for _, userId := range []string{"", "999"} {
+		if status := decideDevice(t, server, codeResp.UserCode, userId, "approve"); status != http.StatusBadRequest {
+			t.Errorf("user id %q: expected status 400, got %d", userId, status)
+		}
+	}
+	status, _, oauthError := pollDeviceToken(t, server, codeResp.DeviceCode)
+	if status != http.StatusBadRequest || oauthError != "authorization_pending" {
+		t.Errorf("expected the grant to still be pending, got %d %s", status, oauthError)
+	}
+}
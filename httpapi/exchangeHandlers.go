@@ -0,0 +1,59 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"biscuitExample/authz"
+)
+
+// exchangeRequest is the body of POST /tokens/exchange.
+type exchangeRequest struct {
+	authz.TokenExchange
+	// ExpiresIn is how many seconds the new token is valid for
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// handleExchange issues a short-lived token in exchange for the token presented as the bearer credential, restricted to the requested repos and actions.
+func (server *Server) handleExchange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	credential := bearerToken(r)
+	if credential == "" {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("bearer token required"))
+		return
+	}
+	token, err := authz.DecodeToken(credential)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	exchangeReq := &exchangeRequest{}
+	err = readJSON(r, exchangeReq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	exchange := exchangeReq.TokenExchange
+	exchange.TTL = time.Duration(exchangeReq.ExpiresIn) * time.Second
+	exchanged, err := server.tokenIssuer.ExchangeToken(token, &exchange)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	encoded, err := authz.EncodeToken(exchanged)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tokenId, err := authz.TokenId(exchanged, server.tokenIssuer.PublicRoot)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &createTokenResponse{TokenId: tokenId, Token: encoded})
+}
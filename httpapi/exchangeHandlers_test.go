@@ -0,0 +1,44 @@
+package httpapi
+
+import (
+	"net/http"
+	"testing"
+
+	"biscuitExample/authz"
+)
+
+// TestExchangeEndpoint checks that a token is exchanged for a narrower one, and that requests to widen it or without a token are refused.
+func TestExchangeEndpoint(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	exchangeReq := &exchangeRequest{TokenExchange: authz.TokenExchange{Repos: []int{3}, Actions: []string{"read"}}, ExpiresIn: 60}
+	exchangeResp := &createTokenResponse{}
+	status := doJSON(t, server, http.MethodPost, "/tokens/exchange", credential, exchangeReq, exchangeResp)
+	if status != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", status)
+	}
+	for _, check := range []struct {
+		repo    string
+		action  authz.Action
+		allowed bool
+	}{
+		{"Charlie", authz.Read, true},
+		{"Charlie", authz.Write, false},
+		{"Bravo", authz.Read, false},
+	} {
+		if checkCredential(t, server, 4, exchangeResp.Token, check.repo, check.action) != check.allowed {
+			t.Errorf("%d on %s: expected allowed %t", check.action, check.repo, check.allowed)
+		}
+	}
+
+	widenReq := &exchangeRequest{TokenExchange: authz.TokenExchange{Repos: []int{2}}}
+	status = doJSON(t, server, http.MethodPost, "/tokens/exchange", exchangeResp.Token, widenReq, nil)
+	if status != http.StatusForbidden {
+		t.Errorf("expected widening the exchanged token to be refused with 403, got %d", status)
+	}
+	status = doJSON(t, server, http.MethodPost, "/tokens/exchange", "", exchangeReq, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a token, got %d", status)
+	}
+}
@@ -0,0 +1,144 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// Server serves the forge token endpoints over HTTP.
+type Server struct {
+	// dbInstance holds the org data and token state
+	dbInstance *dblogic.DBInstance
+	// tokenIssuer issues tokens and verifies the tokens presented to the server
+	tokenIssuer *authz.TokenIssuer
+	// adminSecret is the bearer secret for admin endpoints. Admin endpoints are refused when it is empty.
+	adminSecret string
+	// introspectionSecret is the bearer secret services present to the introspection endpoint, which is refused when it is empty
+	introspectionSecret string
+	// deviceFlow holds the pending device authorization grants
+	deviceFlow *deviceFlow
+	// mux routes requests to the handlers
+	mux *http.ServeMux
+}
+
+// NewServer creates a Server using dbInstance for state and tokenIssuer for tokens.
+func NewServer(dbInstance *dblogic.DBInstance, tokenIssuer *authz.TokenIssuer, adminSecret string, introspectionSecret string) *Server {
+	server := &Server{
+		dbInstance:          dbInstance,
+		tokenIssuer:         tokenIssuer,
+		adminSecret:         adminSecret,
+		introspectionSecret: introspectionSecret,
+		deviceFlow:          newDeviceFlow(),
+		mux:                 http.NewServeMux(),
+	}
+	server.mux.HandleFunc("/revocations", server.requireAdmin(server.handleRevocations))
+	server.mux.HandleFunc("/revocations/prune", server.requireAdmin(server.handlePruneRevocations))
+	server.mux.HandleFunc("/user/tokens", server.handleUserTokens)
+	server.mux.HandleFunc("/user/tokens/", server.handleUserToken)
+	server.mux.HandleFunc("/user/keys", server.handleUserKeys)
+	server.mux.HandleFunc("/user/keys/", server.handleUserKey)
+	server.mux.HandleFunc("/deploy-keys", server.requireAdmin(server.handleDeployKeys))
+	server.mux.HandleFunc("/deploy-keys/", server.requireAdmin(server.handleDeployKey))
+	server.mux.HandleFunc("/tokens/inspect", server.handleInspect)
+	server.mux.HandleFunc("/tokens/exchange", server.handleExchange)
+	server.mux.HandleFunc("/authorize/batch", server.handleBatchAuthorize)
+	server.mux.HandleFunc("/device/code", server.handleDeviceCode)
+	server.mux.HandleFunc("/device/token", server.handleDeviceToken)
+	server.mux.HandleFunc("/device", server.handleDeviceApproval)
+	server.mux.HandleFunc("/introspect", server.requireSecret(server.introspectionSecret, "introspection", server.handleIntrospect))
+	return server
+}
+
+// EnableStandInApproval serves the stand-in device approval page at /device, which lets anyone approve a device login as any user. It is only for trying out the device flow locally, in place of a real login page.
+func (server *Server) EnableStandInApproval() {
+	server.deviceFlow.standInApproval = true
+}
+
+// ServeHTTP implements http.Handler.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes body as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("Error when writing response: %s", err.Error())
+	}
+}
+
+// writeError writes err as a JSON error response with the given status.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &errorResponse{Error: err.Error()})
+}
+
+// readJSON decodes the request body into body, rejecting unknown fields.
+func readJSON(r *http.Request, body interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(body)
+	if err != nil {
+		return fmt.Errorf("error when decoding request body: %w", err)
+	}
+	return nil
+}
+
+// bearerToken returns the bearer credential from the Authorization header, or "" if there is none.
+func bearerToken(r *http.Request) string {
+	scheme, credential, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(credential)
+}
+
+// requireAdmin only lets requests through to handler if they carry the admin secret as a bearer credential.
+func (server *Server) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return server.requireSecret(server.adminSecret, "admin", handler)
+}
+
+// requireSecret only lets requests through to handler if they carry secret as a bearer credential. kind names the credential in the error response.
+func (server *Server) requireSecret(secret string, kind string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credential := bearerToken(r)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(credential), []byte(secret)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("%s credential required", kind))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authenticateUser returns the user whose token is presented as the bearer credential, if that token may manage the user's tokens. On failure the error response has already been written.
+func (server *Server) authenticateUser(w http.ResponseWriter, r *http.Request) (int, bool) {
+	credential := bearerToken(r)
+	if credential == "" {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("bearer token required"))
+		return 0, false
+	}
+	token, err := authz.DecodeToken(credential)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return 0, false
+	}
+	userId, err := authz.AuthenticateTokenManagement(token, server.tokenIssuer.PublicRoot)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return 0, false
+	}
+	return userId, true
+}
@@ -0,0 +1,130 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// testAdminSecret and testIntrospectionSecret are the secrets newTestServer configures.
+const (
+	testAdminSecret         = "test-admin-secret"
+	testIntrospectionSecret = "test-introspection-secret"
+)
+
+// newTestServer creates a Server over the seeded example database with a fresh token issuer, recording issued tokens in the database and checking tokens against its revocations as the serve command does.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	dbInstance, err := dblogic.InitMemoryDb(true)
+	if err != nil {
+		t.Fatalf("InitMemoryDb: %s", err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	authz.SetRevocationStore(dbInstance)
+	t.Cleanup(func() { authz.SetRevocationStore(nil) })
+	tokenIssuer, err := authz.NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	tokenIssuer.Ledger = dbInstance
+	return NewServer(dbInstance, tokenIssuer, testAdminSecret, testIntrospectionSecret)
+}
+
+// issueEncoded issues a token to userId with opts and returns it encoded.
+func issueEncoded(t *testing.T, server *Server, userId int, opts authz.IssueOptions) string {
+	t.Helper()
+	token, err := server.tokenIssuer.IssueTokenWithOptions(userId, opts)
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	encoded, err := authz.EncodeToken(token)
+	if err != nil {
+		t.Fatalf("EncodeToken: %s", err)
+	}
+	return encoded
+}
+
+// checkCredential returns whether credential, issued to userId, may perform action on reponame according to the server's database and revocations.
+func checkCredential(t *testing.T, server *Server, userId int, credential string, reponame string, action authz.Action) bool {
+	t.Helper()
+	token, err := authz.DecodeToken(credential)
+	if err != nil {
+		t.Fatalf("DecodeToken: %s", err)
+	}
+	reqDetails, err := dblogic.GatherRequestDetails(userId, reponame, server.dbInstance)
+	if err != nil {
+		t.Fatalf("GatherRequestDetails: %s", err)
+	}
+	hasPermission, _ := authz.CheckAuthz(token, server.tokenIssuer.PublicRoot, reqDetails, action)
+	return hasPermission
+}
+
+// doJSON sends method to path on server with body encoded as JSON, or no body if it is nil, and credential as the bearer token if set. The response body is decoded into respBody if it is not nil, and the status code is returned.
+func doJSON(t *testing.T, server *Server, method string, path string, credential string, body interface{}, respBody interface{}) int {
+	t.Helper()
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("json.Marshal: %s", err)
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+	r := httptest.NewRequest(method, path, reqBody)
+	if credential != "" {
+		r.Header.Set("Authorization", "Bearer "+credential)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if respBody != nil && w.Code < http.StatusBadRequest {
+		err := json.Unmarshal(w.Body.Bytes(), respBody)
+		if err != nil {
+			t.Fatalf("json.Unmarshal of %s: %s", w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// issueForeignEncoded issues a token to userId signed by a new root key rather than the server's, and returns it encoded. Unlike a token from a second test server, issuing it leaves the revocation store alone.
+func issueForeignEncoded(t *testing.T, userId int) string {
+	t.Helper()
+	tokenIssuer, err := authz.NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+	token, err := tokenIssuer.IssueToken(userId)
+	if err != nil {
+		t.Fatalf("IssueToken: %s", err)
+	}
+	encoded, err := authz.EncodeToken(token)
+	if err != nil {
+		t.Fatalf("EncodeToken: %s", err)
+	}
+	return encoded
+}
+
+// postForm posts form to path on server, with credential as the bearer token if set, and returns the recorded response.
+func postForm(t *testing.T, server *Server, path string, credential string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if credential != "" {
+		r.Header.Set("Authorization", "Bearer "+credential)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
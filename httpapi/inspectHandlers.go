@@ -0,0 +1,39 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+
+	"biscuitExample/authz"
+)
+
+// inspectRequest is the body of POST /tokens/inspect.
+type inspectRequest struct {
+	Token string `json:"token"`
+}
+
+// handleInspect verifies the posted token against the server's root key and returns its blocks and metadata. The caller already holds the token, so no credential is required.
+func (server *Server) handleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	inspectReq := &inspectRequest{}
+	err := readJSON(r, inspectReq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	token, err := authz.DecodeToken(inspectReq.Token)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	inspection, err := authz.Inspect(token, server.tokenIssuer.PublicRoot)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inspection)
+}
@@ -0,0 +1,33 @@
+package httpapi
+
+import (
+	"net/http"
+	"testing"
+
+	"biscuitExample/authz"
+)
+
+// TestInspectEndpoint checks that the endpoint inspects tokens signed by the server's key without a credential, and refuses tokens it cannot decode or verify.
+func TestInspectEndpoint(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	inspection := &authz.TokenInspection{}
+	status := doJSON(t, server, http.MethodPost, "/tokens/inspect", "", &inspectRequest{Token: credential}, inspection)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if !inspection.Verified || len(inspection.Blocks) != 1 {
+		t.Errorf("expected a verified token with one block, got %+v", inspection)
+	}
+
+	foreign := issueForeignEncoded(t, 4)
+	status = doJSON(t, server, http.MethodPost, "/tokens/inspect", "", &inspectRequest{Token: foreign}, nil)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("expected a token signed by another key to be refused with 422, got %d", status)
+	}
+	status = doJSON(t, server, http.MethodPost, "/tokens/inspect", "", &inspectRequest{Token: "not-a-token"}, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected an undecodable token to be refused with 400, got %d", status)
+	}
+}
@@ -0,0 +1,40 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"biscuitExample/authz"
+)
+
+// handleIntrospect answers RFC 7662 introspection requests, which post the token as the form field token. Tokens which cannot be decoded are reported inactive like any other invalid token.
+func (server *Server) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error when parsing form: %w", err))
+		return
+	}
+	tokenStr := r.PostForm.Get("token")
+	if tokenStr == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("token is required"))
+		return
+	}
+
+	token, err := authz.DecodeToken(tokenStr)
+	if err != nil {
+		writeJSON(w, http.StatusOK, &authz.Introspection{Active: false})
+		return
+	}
+	introspection, err := authz.Introspect(token, server.tokenIssuer.PublicRoot, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, introspection)
+}
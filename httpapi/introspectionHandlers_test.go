@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"biscuitExample/authz"
+)
+
+// postIntrospect posts token to /introspect as a form with credential as the bearer token, and returns the response status and, if it succeeded, the introspection.
+func postIntrospect(t *testing.T, server *Server, credential string, token string) (int, *authz.Introspection) {
+	t.Helper()
+	form := url.Values{}
+	if token != "" {
+		form.Set("token", token)
+	}
+	w := postForm(t, server, "/introspect", credential, form)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	introspection := &authz.Introspection{}
+	err := json.Unmarshal(w.Body.Bytes(), introspection)
+	if err != nil {
+		t.Fatalf("json.Unmarshal of %s: %s", w.Body.String(), err)
+	}
+	return w.Code, introspection
+}
+
+// TestIntrospectEndpoint checks that the endpoint reports valid tokens active, and revoked, expired, forged and undecodable tokens inactive.
+func TestIntrospectEndpoint(t *testing.T) {
+	server := newTestServer(t)
+	active := issueEncoded(t, server, 4, authz.IssueOptions{})
+	revoked := issueEncoded(t, server, 4, authz.IssueOptions{})
+	status := doJSON(t, server, http.MethodPost, "/revocations", testAdminSecret, &revokeRequest{Token: revoked}, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected status 204 revoking, got %d", status)
+	}
+	expiredToken, err := server.tokenIssuer.IssueTokenWithOptions(4, authz.IssueOptions{TTL: time.Second})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	expired, err := authz.EncodeToken(expiredToken)
+	if err != nil {
+		t.Fatalf("EncodeToken: %s", err)
+	}
+	forged := issueForeignEncoded(t, 4)
+
+	status, introspection := postIntrospect(t, server, testIntrospectionSecret, active)
+	if status != http.StatusOK || !introspection.Active || introspection.Subject != "userid:4" {
+		t.Errorf("expected the token to be active for userid:4, got status %d and %+v", status, introspection)
+	}
+
+	// Bounds are written to the second, so the token has expired two seconds on
+	time.Sleep(2 * time.Second)
+	for name, token := range map[string]string{
+		"revoked":     revoked,
+		"expired":     expired,
+		"forged":      forged,
+		"undecodable": "not-a-token",
+	} {
+		status, introspection := postIntrospect(t, server, testIntrospectionSecret, token)
+		if status != http.StatusOK || introspection.Active || introspection.Subject != "" {
+			t.Errorf("%s: expected a bare inactive response, got status %d and %+v", name, status, introspection)
+		}
+	}
+}
+
+// TestIntrospectEndpointRequiresSecret checks that introspection requires the introspection secret rather than the admin secret or a token, and a token to introspect.
+func TestIntrospectEndpointRequiresSecret(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	for _, secret := range []string{"", testAdminSecret, credential} {
+		status, _ := postIntrospect(t, server, secret, credential)
+		if status != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", status)
+		}
+	}
+	status, _ := postIntrospect(t, server, testIntrospectionSecret, "")
+	if status != http.StatusBadRequest {
+		t.Errorf("expected status 400 without a token, got %d", status)
+	}
+}
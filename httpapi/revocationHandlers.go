@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"biscuitExample/authz"
+)
+
+// revokeRequest is the body of POST /revocations. Exactly one of RevocationIds, Token and UserId is set.
+type revokeRequest struct {
+	// RevocationIds are hex encoded biscuit revocation ids to revoke
+	RevocationIds []string `json:"revocation_ids"`
+	// Token is an encoded token to revoke, along with any token attenuated from it
+	Token string `json:"token"`
+	// AllBlocks revokes every block of Token, including the authority block, so that every token derived from the same issued token is refused, not only Token and its attenuations
+	AllBlocks bool `json:"all_blocks"`
+	// UserId revokes every token issued to the user so far
+	UserId int `json:"user_id"`
+	// ExpiresAt is when the revoked token expires, so the revocation can be pruned afterwards
+	ExpiresAt time.Time `json:"expires_at"`
+	// Reason is recorded with the revocation
+	Reason string `json:"reason"`
+}
+
+// pruneResponse is the body returned by POST /revocations/prune.
+type pruneResponse struct {
+	Pruned int64 `json:"pruned"`
+}
+
+// handleRevocations lists revocations on GET and revokes on POST.
+func (server *Server) handleRevocations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		revocations, err := server.dbInstance.ListRevocations()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, revocations)
+	case http.MethodPost:
+		revokeReq := &revokeRequest{}
+		err := readJSON(r, revokeReq)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		status, err := server.revoke(revokeReq)
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// revoke applies revokeReq, returning the HTTP status to report if it fails.
+func (server *Server) revoke(revokeReq *revokeRequest) (int, error) {
+	set := 0
+	for _, isSet := range []bool{len(revokeReq.RevocationIds) > 0, revokeReq.Token != "", revokeReq.UserId != 0} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return http.StatusBadRequest, fmt.Errorf("exactly one of revocation_ids, token and user_id is required")
+	}
+	if revokeReq.AllBlocks && revokeReq.Token == "" {
+		return http.StatusBadRequest, fmt.Errorf("all_blocks is only valid with token")
+	}
+
+	if revokeReq.UserId != 0 {
+		err := server.dbInstance.RevokeUser(revokeReq.UserId, revokeReq.Reason)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusNoContent, nil
+	}
+
+	revocationIds := revokeReq.RevocationIds
+	if revokeReq.Token != "" {
+		token, err := authz.DecodeToken(revokeReq.Token)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		revocationIds = authz.TokenRevocationIds(token, revokeReq.AllBlocks)
+	}
+	err := server.dbInstance.RevokeIds(revocationIds, revokeReq.ExpiresAt, revokeReq.Reason)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusNoContent, nil
+}
+
+// handlePruneRevocations removes revocations of tokens which have expired.
+func (server *Server) handlePruneRevocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	pruned, err := server.dbInstance.PruneRevocations(time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &pruneResponse{Pruned: pruned})
+}
@@ -0,0 +1,138 @@
+package httpapi
+
+import (
+	"net/http"
+	"testing"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// readsCharlie returns whether credential, issued to userId, may read Charlie according to the server's database and revocations.
+func readsCharlie(t *testing.T, server *Server, userId int, credential string) bool {
+	t.Helper()
+	return checkCredential(t, server, userId, credential, "Charlie", authz.Read)
+}
+
+// TestRevocationsRequireAdmin checks that the revocation endpoints refuse requests without the admin secret, including ones carrying a user token.
+func TestRevocationsRequireAdmin(t *testing.T) {
+	server := newTestServer(t)
+	userCredential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	for _, credential := range []string{"", "wrong-secret", userCredential} {
+		status := doJSON(t, server, http.MethodPost, "/revocations", credential, &revokeRequest{UserId: 1}, nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("POST /revocations: expected status 401, got %d", status)
+		}
+		status = doJSON(t, server, http.MethodGet, "/revocations", credential, nil, nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("GET /revocations: expected status 401, got %d", status)
+		}
+		status = doJSON(t, server, http.MethodPost, "/revocations/prune", credential, nil, nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("POST /revocations/prune: expected status 401, got %d", status)
+		}
+	}
+}
+
+// TestRevokeTokenEndpoint checks that a token revoked through the endpoint is refused and listed, while another token of the same user is still accepted.
+func TestRevokeTokenEndpoint(t *testing.T) {
+	server := newTestServer(t)
+	revoked := issueEncoded(t, server, 4, authz.IssueOptions{})
+	other := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	status := doJSON(t, server, http.MethodPost, "/revocations", testAdminSecret, &revokeRequest{Token: revoked, Reason: "leaked"}, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	if readsCharlie(t, server, 4, revoked) {
+		t.Errorf("expected the revoked token to be refused")
+	}
+	if !readsCharlie(t, server, 4, other) {
+		t.Errorf("expected the other token to be accepted")
+	}
+
+	revocations := []*dblogic.Revocation{}
+	status = doJSON(t, server, http.MethodGet, "/revocations", testAdminSecret, nil, &revocations)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if len(revocations) != 1 || revocations[0].Reason != "leaked" {
+		t.Errorf("expected one revocation with reason leaked, got %+v", revocations)
+	}
+}
+
+// TestRevokeAttenuatedTokenEndpoint checks that revoking an attenuated token only refuses it and leaves the token it was attenuated from valid, unless every block is revoked.
+func TestRevokeAttenuatedTokenEndpoint(t *testing.T) {
+	server := newTestServer(t)
+	parent := issueEncoded(t, server, 4, authz.IssueOptions{})
+	parentToken, err := authz.DecodeToken(parent)
+	if err != nil {
+		t.Fatalf("DecodeToken: %s", err)
+	}
+	childToken, err := authz.AttenuateBiscuit(parentToken, `check if operation("action:read", $repo)`)
+	if err != nil {
+		t.Fatalf("AttenuateBiscuit: %s", err)
+	}
+	child, err := authz.EncodeToken(childToken)
+	if err != nil {
+		t.Fatalf("EncodeToken: %s", err)
+	}
+
+	status := doJSON(t, server, http.MethodPost, "/revocations", testAdminSecret, &revokeRequest{Token: child}, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	if readsCharlie(t, server, 4, child) {
+		t.Errorf("expected the revoked child token to be refused")
+	}
+	if !readsCharlie(t, server, 4, parent) {
+		t.Errorf("expected the parent token to be accepted")
+	}
+
+	status = doJSON(t, server, http.MethodPost, "/revocations", testAdminSecret, &revokeRequest{Token: child, AllBlocks: true}, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	if readsCharlie(t, server, 4, parent) {
+		t.Errorf("expected the parent token to be refused once every block is revoked")
+	}
+}
+
+// TestRevokeUserEndpoint checks that revoking a user through the endpoint refuses their tokens and not other users' tokens.
+func TestRevokeUserEndpoint(t *testing.T) {
+	server := newTestServer(t)
+	liam := issueEncoded(t, server, 4, authz.IssueOptions{})
+	emma := issueEncoded(t, server, 3, authz.IssueOptions{})
+
+	status := doJSON(t, server, http.MethodPost, "/revocations", testAdminSecret, &revokeRequest{UserId: 4}, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	if readsCharlie(t, server, 4, liam) {
+		t.Errorf("expected Liam's token to be refused")
+	}
+	if !readsCharlie(t, server, 3, emma) {
+		t.Errorf("expected Emma's token to be accepted")
+	}
+}
+
+// TestRevokeRequestValidation checks that revocation requests must name exactly one kind of target and valid revocation ids.
+func TestRevokeRequestValidation(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	for name, revokeReq := range map[string]*revokeRequest{
+		"nothing":              {},
+		"token and user":       {Token: credential, UserId: 4},
+		"invalid id":           {RevocationIds: []string{"not-hex"}},
+		"undecodable token":    {Token: "not-a-token"},
+		"ids, token and user":  {RevocationIds: []string{"00"}, Token: credential, UserId: 4},
+		"all blocks of a user": {UserId: 4, AllBlocks: true},
+	} {
+		status := doJSON(t, server, http.MethodPost, "/revocations", testAdminSecret, revokeReq, nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, status)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"biscuitExample/dblogic"
+	"biscuitExample/sshgateway"
+)
+
+// addSSHKeyRequest is the body of POST /user/keys and POST /deploy-keys.
+type addSSHKeyRequest struct {
+	// PublicKey is the key in authorized_keys format, e.g. the contents of id_ed25519.pub
+	PublicKey string `json:"public_key"`
+	// Title labels the key, and defaults to the key's comment
+	Title string `json:"title"`
+	// RepoId is the only repo the key may be used for, 0 for any
+	RepoId int `json:"repo_id"`
+	// ReadOnly keys may only be used for reads
+	ReadOnly bool `json:"read_only"`
+	// ServiceAccountId is the service account a deploy key belongs to. Only used by POST /deploy-keys.
+	ServiceAccountId int `json:"service_account_id"`
+}
+
+// addSSHKey registers the key in the body of r for userId, or as a deploy key for the service account in the body if userId is 0, and writes the registry entry.
+func (server *Server) addSSHKey(w http.ResponseWriter, r *http.Request, userId int) {
+	addReq := &addSSHKeyRequest{}
+	err := readJSON(r, addReq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if userId != 0 && addReq.ServiceAccountId != 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("users cannot add deploy keys"))
+		return
+	}
+	sshKey, err := sshgateway.ParseSSHKey(addReq.PublicKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	sshKey.UserId = userId
+	sshKey.ServiceAccountId = addReq.ServiceAccountId
+	sshKey.RepoId = addReq.RepoId
+	sshKey.ReadOnly = addReq.ReadOnly
+	if addReq.Title != "" {
+		sshKey.Title = addReq.Title
+	}
+	err = server.dbInstance.AddSSHKey(sshKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sshKey)
+}
+
+// sshKeyFromPath returns the key whose id follows prefix in the request path if owned returns true for it. Otherwise a not found response has already been written, so callers cannot tell keys they do not own from keys which do not exist.
+func (server *Server) sshKeyFromPath(w http.ResponseWriter, r *http.Request, prefix string, owned func(*dblogic.SSHKey) bool) (*dblogic.SSHKey, bool) {
+	idStr := strings.TrimPrefix(r.URL.Path, prefix)
+	id, err := strconv.Atoi(idStr)
+	if err == nil {
+		sshKey, err := server.dbInstance.GetSSHKey(id)
+		if err == nil && owned(sshKey) {
+			return sshKey, true
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("unknown SSH key: %s", idStr))
+	return nil, false
+}
+
+// serveSSHKey shows sshKey on GET and removes it on DELETE.
+func (server *Server) serveSSHKey(w http.ResponseWriter, r *http.Request, sshKey *dblogic.SSHKey) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, sshKey)
+	case http.MethodDelete:
+		err := server.dbInstance.RemoveSSHKey(sshKey.Id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleUserKeys lists the authenticated user's SSH keys on GET and registers a key for them on POST.
+func (server *Server) handleUserKeys(w http.ResponseWriter, r *http.Request) {
+	userId, ok := server.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		sshKeys, err := server.dbInstance.ListSSHKeys(userId)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sshKeys)
+	case http.MethodPost:
+		server.addSSHKey(w, r, userId)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleUserKey shows one of the authenticated user's SSH keys on GET and removes it on DELETE.
+func (server *Server) handleUserKey(w http.ResponseWriter, r *http.Request) {
+	userId, ok := server.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	sshKey, ok := server.sshKeyFromPath(w, r, "/user/keys/", func(sshKey *dblogic.SSHKey) bool {
+		return sshKey.UserId == userId
+	})
+	if !ok {
+		return
+	}
+	server.serveSSHKey(w, r, sshKey)
+}
+
+// handleDeployKeys lists every deploy key on GET and registers one for a service account on POST. It is an admin endpoint.
+func (server *Server) handleDeployKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sshKeys, err := server.dbInstance.ListSSHKeys(0)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		deployKeys := []*dblogic.SSHKey{}
+		for _, sshKey := range sshKeys {
+			if sshKey.ServiceAccountId != 0 {
+				deployKeys = append(deployKeys, sshKey)
+			}
+		}
+		writeJSON(w, http.StatusOK, deployKeys)
+	case http.MethodPost:
+		server.addSSHKey(w, r, 0)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleDeployKey shows a deploy key on GET and removes it on DELETE. It is an admin endpoint.
+func (server *Server) handleDeployKey(w http.ResponseWriter, r *http.Request) {
+	sshKey, ok := server.sshKeyFromPath(w, r, "/deploy-keys/", func(sshKey *dblogic.SSHKey) bool {
+		return sshKey.ServiceAccountId != 0
+	})
+	if !ok {
+		return
+	}
+	server.serveSSHKey(w, r, sshKey)
+}
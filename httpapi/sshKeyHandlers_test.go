@@ -0,0 +1,160 @@
+package httpapi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// newPublicKey generates an ed25519 key and returns its public key in authorized_keys format with comment.
+func newPublicKey(t *testing.T, comment string) string {
+	t.Helper()
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %s", err)
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey: %s", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))) + " " + comment
+}
+
+// TestUserKeys checks that users register, list, show and remove their own SSH keys, and that other users' keys look like unknown keys.
+func TestUserKeys(t *testing.T) {
+	server := newTestServer(t)
+	liamToken := issueEncoded(t, server, 4, authz.IssueOptions{})
+	emmaToken := issueEncoded(t, server, 3, authz.IssueOptions{})
+
+	added := &dblogic.SSHKey{}
+	status := doJSON(t, server, http.MethodPost, "/user/keys", liamToken, &addSSHKeyRequest{PublicKey: newPublicKey(t, "liam@laptop"), RepoId: 3, ReadOnly: true}, added)
+	if status != http.StatusCreated {
+		t.Fatalf("expected the key to be registered, got %d", status)
+	}
+	if added.UserId != 4 || added.RepoId != 3 || !added.ReadOnly || added.Title != "liam@laptop" {
+		t.Errorf("unexpected registered key %+v", added)
+	}
+	status = doJSON(t, server, http.MethodPost, "/user/keys", emmaToken, &addSSHKeyRequest{PublicKey: newPublicKey(t, "emma@laptop")}, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("expected Emma's key to be registered, got %d", status)
+	}
+
+	listed := []*dblogic.SSHKey{}
+	status = doJSON(t, server, http.MethodGet, "/user/keys", liamToken, nil, &listed)
+	if status != http.StatusOK || len(listed) != 1 || listed[0].Id != added.Id {
+		t.Errorf("expected only Liam's key to be listed, got %d %+v", status, listed)
+	}
+	keyPath := fmt.Sprintf("/user/keys/%d", added.Id)
+	shown := &dblogic.SSHKey{}
+	status = doJSON(t, server, http.MethodGet, keyPath, liamToken, nil, shown)
+	if status != http.StatusOK || shown.Fingerprint != added.Fingerprint {
+		t.Errorf("expected Liam's key to be shown, got %d %+v", status, shown)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if status := doJSON(t, server, method, keyPath, emmaToken, nil, nil); status != http.StatusNotFound {
+			t.Errorf("%s by another user: expected 404, got %d", method, status)
+		}
+	}
+	if status := doJSON(t, server, http.MethodGet, "/user/keys/999", liamToken, nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown key, got %d", status)
+	}
+
+	if status := doJSON(t, server, http.MethodDelete, keyPath, liamToken, nil, nil); status != http.StatusNoContent {
+		t.Errorf("expected Liam to remove their key, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodGet, keyPath, liamToken, nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected a removed key to be unknown, got %d", status)
+	}
+}
+
+// TestUserKeysRefused checks that users cannot register deploy keys, keys which are already registered, or keys without a token.
+func TestUserKeysRefused(t *testing.T) {
+	server := newTestServer(t)
+	liamToken := issueEncoded(t, server, 4, authz.IssueOptions{})
+	publicKey := newPublicKey(t, "liam@laptop")
+
+	status := doJSON(t, server, http.MethodPost, "/user/keys", liamToken, &addSSHKeyRequest{PublicKey: newPublicKey(t, "bot"), ServiceAccountId: 2}, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected a user adding a deploy key to be refused, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodPost, "/user/keys", "", &addSSHKeyRequest{PublicKey: publicKey}, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected a key without a token to be refused, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodPost, "/user/keys", liamToken, &addSSHKeyRequest{PublicKey: publicKey}, nil); status != http.StatusCreated {
+		t.Fatalf("expected the key to be registered, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodPost, "/user/keys", liamToken, &addSSHKeyRequest{PublicKey: publicKey}, nil); status != http.StatusBadRequest {
+		t.Errorf("expected registering the key again to be refused, got %d", status)
+	}
+
+	deployKeys := []*dblogic.SSHKey{}
+	doJSON(t, server, http.MethodGet, "/deploy-keys", testAdminSecret, nil, &deployKeys)
+	if len(deployKeys) != 0 {
+		t.Errorf("expected no deploy keys, got %+v", deployKeys)
+	}
+}
+
+// TestDeployKeys checks that deploy keys are registered, listed, shown and removed with the admin secret, that user keys are not reachable there, and that every deploy key endpoint refuses other credentials.
+func TestDeployKeys(t *testing.T) {
+	server := newTestServer(t)
+	liamToken := issueEncoded(t, server, 4, authz.IssueOptions{})
+	userKey := &dblogic.SSHKey{}
+	if status := doJSON(t, server, http.MethodPost, "/user/keys", liamToken, &addSSHKeyRequest{PublicKey: newPublicKey(t, "liam@laptop")}, userKey); status != http.StatusCreated {
+		t.Fatalf("expected the user key to be registered, got %d", status)
+	}
+
+	for _, credential := range []string{"", liamToken, "wrong-secret"} {
+		for _, request := range []struct {
+			method string
+			path   string
+			body   interface{}
+		}{
+			{http.MethodGet, "/deploy-keys", nil},
+			{http.MethodPost, "/deploy-keys", &addSSHKeyRequest{PublicKey: newPublicKey(t, "bot"), ServiceAccountId: 2}},
+			{http.MethodGet, fmt.Sprintf("/deploy-keys/%d", userKey.Id), nil},
+			{http.MethodDelete, fmt.Sprintf("/deploy-keys/%d", userKey.Id), nil},
+		} {
+			status := doJSON(t, server, request.method, request.path, credential, request.body, nil)
+			if status != http.StatusUnauthorized && status != http.StatusForbidden {
+				t.Errorf("%s %s with %q: expected the admin secret to be required, got %d", request.method, request.path, credential, status)
+			}
+		}
+	}
+
+	added := &dblogic.SSHKey{}
+	status := doJSON(t, server, http.MethodPost, "/deploy-keys", testAdminSecret, &addSSHKeyRequest{PublicKey: newPublicKey(t, "bot"), ServiceAccountId: 2, RepoId: 1, ReadOnly: true}, added)
+	if status != http.StatusCreated || added.ServiceAccountId != 2 || added.UserId != 0 {
+		t.Fatalf("expected the deploy key to be registered, got %d %+v", status, added)
+	}
+	if status := doJSON(t, server, http.MethodPost, "/deploy-keys", testAdminSecret, &addSSHKeyRequest{PublicKey: newPublicKey(t, "nobody")}, nil); status != http.StatusBadRequest {
+		t.Errorf("expected a deploy key without a service account to be refused, got %d", status)
+	}
+
+	listed := []*dblogic.SSHKey{}
+	status = doJSON(t, server, http.MethodGet, "/deploy-keys", testAdminSecret, nil, &listed)
+	if status != http.StatusOK || len(listed) != 1 || listed[0].Id != added.Id {
+		t.Errorf("expected only the deploy key to be listed, got %d %+v", status, listed)
+	}
+	if status := doJSON(t, server, http.MethodGet, fmt.Sprintf("/deploy-keys/%d", userKey.Id), testAdminSecret, nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected a user key to be unknown as a deploy key, got %d", status)
+	}
+	keyPath := fmt.Sprintf("/deploy-keys/%d", added.Id)
+	if status := doJSON(t, server, http.MethodGet, keyPath, testAdminSecret, nil, nil); status != http.StatusOK {
+		t.Errorf("expected the deploy key to be shown, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodDelete, keyPath, testAdminSecret, nil, nil); status != http.StatusNoContent {
+		t.Errorf("expected the deploy key to be removed, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodGet, keyPath, testAdminSecret, nil, nil); status != http.StatusNotFound {
+		t.Errorf("expected a removed deploy key to be unknown, got %d", status)
+	}
+}
@@ -0,0 +1,97 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"biscuitExample/authz"
+)
+
+// createTokenRequest is the body of POST /user/tokens.
+type createTokenRequest struct {
+	authz.PersonalAccessToken
+	// ExpiresIn is how many seconds the token is valid for
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// createTokenResponse is the body returned by POST /user/tokens.
+type createTokenResponse struct {
+	TokenId string `json:"token_id"`
+	Token   string `json:"token"`
+}
+
+// handleUserTokens lists the authenticated user's tokens on GET and creates a personal access token on POST.
+func (server *Server) handleUserTokens(w http.ResponseWriter, r *http.Request) {
+	userId, ok := server.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		issuedTokens, err := server.dbInstance.ListIssuedTokens(userId)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, issuedTokens)
+	case http.MethodPost:
+		createReq := &createTokenRequest{}
+		err := readJSON(r, createReq)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		pat := createReq.PersonalAccessToken
+		pat.TTL = time.Duration(createReq.ExpiresIn) * time.Second
+		token, err := server.tokenIssuer.IssuePersonalAccessToken(userId, &pat)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		encoded, err := authz.EncodeToken(token)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		tokenId, err := authz.TokenId(token, server.tokenIssuer.PublicRoot)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, &createTokenResponse{TokenId: tokenId, Token: encoded})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleUserToken shows one of the authenticated user's tokens on GET and revokes it on DELETE.
+func (server *Server) handleUserToken(w http.ResponseWriter, r *http.Request) {
+	userId, ok := server.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	tokenId := strings.TrimPrefix(r.URL.Path, "/user/tokens/")
+	issuedToken, err := server.dbInstance.GetIssuedToken(tokenId)
+	if err != nil || issuedToken.UserId != userId {
+		// Do not reveal whether other users' tokens exist
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown token: %s", tokenId))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, issuedToken)
+	case http.MethodDelete:
+		err = server.dbInstance.RevokeIssuedToken(tokenId, "revoked by user")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
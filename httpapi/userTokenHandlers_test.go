@@ -0,0 +1,133 @@
+package httpapi
+
+import (
+	"net/http"
+	"testing"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// createPAT creates a personal access token through POST /user/tokens with credential, failing the test unless it is created.
+func createPAT(t *testing.T, server *Server, credential string, createReq *createTokenRequest) *createTokenResponse {
+	t.Helper()
+	createResp := &createTokenResponse{}
+	status := doJSON(t, server, http.MethodPost, "/user/tokens", credential, createReq, createResp)
+	if status != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", status)
+	}
+	return createResp
+}
+
+// TestUserTokenLifecycle checks that a user can create a personal access token, see it in their list, and revoke it, after which the server refuses it.
+func TestUserTokenLifecycle(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	createResp := createPAT(t, server, credential, &createTokenRequest{
+		PersonalAccessToken: authz.PersonalAccessToken{Name: "laptop", Actions: []string{"read"}},
+		ExpiresIn:           3600,
+	})
+	if !readsCharlie(t, server, 4, createResp.Token) {
+		t.Fatalf("expected the new token to be accepted")
+	}
+
+	issuedTokens := []*dblogic.IssuedToken{}
+	status := doJSON(t, server, http.MethodGet, "/user/tokens", credential, nil, &issuedTokens)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	found := false
+	for _, issuedToken := range issuedTokens {
+		if issuedToken.TokenId == createResp.TokenId {
+			found = issuedToken.Name == "laptop" && issuedToken.Scope == "actions=read"
+		}
+	}
+	if !found {
+		t.Errorf("expected the new token to be listed with its name and scope, got %+v", issuedTokens)
+	}
+
+	status = doJSON(t, server, http.MethodDelete, "/user/tokens/"+createResp.TokenId, credential, nil, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", status)
+	}
+	issuedToken := &dblogic.IssuedToken{}
+	status = doJSON(t, server, http.MethodGet, "/user/tokens/"+createResp.TokenId, credential, nil, issuedToken)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if !issuedToken.Revoked {
+		t.Errorf("expected the token to be shown as revoked")
+	}
+	if readsCharlie(t, server, 4, createResp.Token) {
+		t.Errorf("expected the revoked token to be refused")
+	}
+}
+
+// TestUserTokensOfOtherUsers checks that users can neither see nor revoke each other's tokens, and that the tokens are unaffected by the attempt.
+func TestUserTokensOfOtherUsers(t *testing.T) {
+	server := newTestServer(t)
+	liam := issueEncoded(t, server, 4, authz.IssueOptions{})
+	emma := issueEncoded(t, server, 3, authz.IssueOptions{})
+	createResp := createPAT(t, server, liam, &createTokenRequest{
+		PersonalAccessToken: authz.PersonalAccessToken{Name: "laptop"},
+		ExpiresIn:           3600,
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		status := doJSON(t, server, method, "/user/tokens/"+createResp.TokenId, emma, nil, nil)
+		if status != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", method, status)
+		}
+	}
+	issuedTokens := []*dblogic.IssuedToken{}
+	doJSON(t, server, http.MethodGet, "/user/tokens", emma, nil, &issuedTokens)
+	for _, issuedToken := range issuedTokens {
+		if issuedToken.UserId != 3 {
+			t.Errorf("expected Emma to only see Emma's own tokens, got one of user %d", issuedToken.UserId)
+		}
+	}
+	if !readsCharlie(t, server, 4, createResp.Token) {
+		t.Errorf("expected Liam's token to still be accepted")
+	}
+}
+
+// TestUserTokensRequireManagementToken checks that the token endpoints refuse requests without a token and requests made with a personal access token.
+func TestUserTokensRequireManagementToken(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+	createResp := createPAT(t, server, credential, &createTokenRequest{
+		PersonalAccessToken: authz.PersonalAccessToken{Name: "laptop"},
+		ExpiresIn:           3600,
+	})
+
+	if status := doJSON(t, server, http.MethodGet, "/user/tokens", "", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a token, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodGet, "/user/tokens", createResp.Token, nil, nil); status != http.StatusForbidden {
+		t.Errorf("expected status 403 listing with a personal access token, got %d", status)
+	}
+	createReq := &createTokenRequest{PersonalAccessToken: authz.PersonalAccessToken{Name: "more"}, ExpiresIn: 3600}
+	if status := doJSON(t, server, http.MethodPost, "/user/tokens", createResp.Token, createReq, nil); status != http.StatusForbidden {
+		t.Errorf("expected status 403 creating with a personal access token, got %d", status)
+	}
+	if status := doJSON(t, server, http.MethodDelete, "/user/tokens/"+createResp.TokenId, createResp.Token, nil, nil); status != http.StatusForbidden {
+		t.Errorf("expected status 403 revoking with a personal access token, got %d", status)
+	}
+}
+
+// TestCreateUserTokenValidation checks that personal access tokens without a name or an expiry are refused as bad requests.
+func TestCreateUserTokenValidation(t *testing.T) {
+	server := newTestServer(t)
+	credential := issueEncoded(t, server, 4, authz.IssueOptions{})
+
+	for name, createReq := range map[string]*createTokenRequest{
+		"no name":   {ExpiresIn: 3600},
+		"no expiry": {PersonalAccessToken: authz.PersonalAccessToken{Name: "laptop"}},
+	} {
+		status := doJSON(t, server, http.MethodPost, "/user/tokens", credential, createReq, nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, status)
+		}
+	}
+}
@@ -2,14 +2,75 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"log"
+	"time"
 
 	"biscuitExample/authz"
 	"biscuitExample/dblogic"
 )
 
 func main() {
+	policyPath := flag.String("policy", "", "datalog policy file to authorize with, reloaded on SIGHUP (defaults to the embedded policy)")
+	trustedPartiesPath := flag.String("trusted-parties", "", "file of external party names and public keys whose attestations are trusted")
+	debug := flag.Bool("debug", false, "log every authorizer with its facts and policy, and its world after authorizing")
+	flag.Parse()
+	authz.SetDebugLogging(*debug)
 
+	policy, err := authz.LoadPolicy(*policyPath)
+	if err != nil {
+		log.Fatalf("Error when loading policy: %s", err.Error())
+	}
+	authz.SetPolicy(policy)
+	stopReload := authz.ReloadPolicyOnSIGHUP(*policyPath)
+	defer stopReload()
+	if *trustedPartiesPath != "" {
+		trustedParties, err := authz.LoadTrustedParties(*trustedPartiesPath)
+		if err != nil {
+			log.Fatalf("Error when loading trusted parties: %s", err.Error())
+		}
+		authz.SetTrustedParties(trustedParties)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		runExample()
+		return
+	}
+
+	switch args[0] {
+	case "attestation":
+		err = runAttestation(args[1:])
+	case "check":
+		err = runCheck(args[1:])
+	case "graph":
+		err = runGraph(args[1:])
+	case "inspect":
+		err = runInspect(args[1:])
+	case "login":
+		err = runLogin(args[1:])
+	case "policy":
+		err = runPolicy(args[1:])
+	case "revocation":
+		err = runRevocation(args[1:])
+	case "serve":
+		err = runServe(args[1:])
+	case "ssh-key":
+		err = runSSHKey(args[1:])
+	case "ssh-serve":
+		err = runSSHServe(args[1:])
+	case "token":
+		err = runToken(args[1:])
+	default:
+		log.Fatalf("Unknown command: %s", args[0])
+	}
+	if err != nil {
+		log.Fatalf("Error when running %s: %s", args[0], err.Error())
+	}
+}
+
+// runExample issues, attenuates and checks a token for the hardcoded scenario below.
+func runExample() {
 	dbInstance, err := dblogic.InitDb()
 	if err != nil {
 		log.Fatalf("Error when initializing db: %s", err.Error())
@@ -43,12 +104,17 @@ func main() {
 		log.Fatalf("Error when issuing biscuit token: %s", err.Error())
 	}
 
-	// Some other attenuations to try are:
-	// check if repo("repo:3")
-	// check if operation($action, $repo), $action == "action:read"
-	attenuationStr := "check if time($date), $date <= 2100-03-30T19:00:10Z"
+	attenuation := authz.NewAttenuation()
+	err = attenuation.ExpiresAt(time.Date(2100, time.March, 30, 19, 0, 10, 0, time.UTC))
+	if err != nil {
+		log.Fatalf("Error when building attenuation: %s", err.Error())
+	}
+	err = attenuation.RestrictToActions(authz.Read)
+	if err != nil {
+		log.Fatalf("Error when building attenuation: %s", err.Error())
+	}
 
-	biscuitToken, err = authz.AttenuateBiscuit(biscuitToken, attenuationStr)
+	biscuitToken, err = attenuation.Apply(biscuitToken)
 	if err != nil {
 		log.Fatalf("Error when attenuating biscuit token: %s", err.Error())
 	}
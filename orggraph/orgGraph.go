@@ -0,0 +1,411 @@
+package orggraph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"biscuitExample/dblogic"
+)
+
+// NodeKind is the type of entity a node represents
+type NodeKind int
+
+const (
+	// UserNode represents a user
+	UserNode NodeKind = iota
+	// UsergroupNode represents a usergroup
+	UsergroupNode
+	// ServiceAccountNode represents a service account
+	ServiceAccountNode
+	// RepogroupNode represents a repogroup
+	RepogroupNode
+	// RepoNode represents a repo
+	RepoNode
+)
+
+// EdgeKind is the type of relationship an edge represents
+type EdgeKind int
+
+const (
+	// MemberEdge points from a user to a usergroup it is a member of
+	MemberEdge EdgeKind = iota
+	// NestedEdge points from a parent usergroup to a child usergroup it has authority over
+	NestedEdge
+	// RoleEdge points from a user, usergroup or service account to the repo or repogroup it holds a role on
+	RoleEdge
+	// RepogroupEdge points from a repogroup to a repo in it
+	RepogroupEdge
+)
+
+// Node is a single entity in the graph.
+type Node struct {
+	// ID is unique within the graph and safe to use as a DOT or Mermaid identifier
+	ID string
+	// Kind is the type of entity
+	Kind NodeKind
+	// EntityId is the database id of the entity
+	EntityId int
+	// Name is the database name of the entity
+	Name string
+}
+
+// Edge is a directed relationship between two nodes. Edges are directed so that authority flows from users towards repos.
+type Edge struct {
+	// From is the ID of the source node
+	From string
+	// To is the ID of the destination node
+	To string
+	// Kind is the type of relationship
+	Kind EdgeKind
+	// Label is displayed on the edge, such as the role name
+	Label string
+	// Highlighted is set on edges which make an authz decision succeed
+	Highlighted bool
+}
+
+// Graph is the user / usergroup / service account / repogroup / repo / role graph of the forge.
+type Graph struct {
+	// Nodes maps node IDs to nodes
+	Nodes map[string]*Node
+	// Edges is every relationship between Nodes
+	Edges []*Edge
+}
+
+// nodeId builds the graph ID for an entity
+func nodeId(kind NodeKind, entityId int) string {
+	prefix := ""
+	switch kind {
+	case UserNode:
+		prefix = "user"
+	case UsergroupNode:
+		prefix = "usergroup"
+	case ServiceAccountNode:
+		prefix = "service"
+	case RepogroupNode:
+		prefix = "repogroup"
+	case RepoNode:
+		prefix = "repo"
+	}
+	return fmt.Sprintf("%s_%d", prefix, entityId)
+}
+
+// roleLabel converts a role to the label drawn on a RoleEdge
+func roleLabel(repoRole dblogic.RepoRoleType) string {
+	switch repoRole {
+	case dblogic.OwnerRole:
+		return "owner"
+	case dblogic.WriterRole:
+		return "writer"
+	case dblogic.ReaderRole:
+		return "reader"
+	default:
+		return "unknown"
+	}
+}
+
+// principalId returns the node ID for the user, usergroup or service account side of an assigned role
+func principalId(assignedRole *dblogic.AssignedRole) string {
+	switch assignedRole.UserOrGroup {
+	case dblogic.UsergroupUGR:
+		return nodeId(UsergroupNode, assignedRole.UserOrGroupID)
+	case dblogic.ServiceAccountUGR:
+		return nodeId(ServiceAccountNode, assignedRole.UserOrGroupID)
+	}
+	return nodeId(UserNode, assignedRole.UserOrGroupID)
+}
+
+// targetId returns the node ID for the repo or repogroup side of an assigned role
+func targetId(assignedRole *dblogic.AssignedRole) string {
+	if assignedRole.RepoOrGroup == dblogic.RepogroupUGR {
+		return nodeId(RepogroupNode, assignedRole.RepoOrGroupID)
+	}
+	return nodeId(RepoNode, assignedRole.RepoOrGroupID)
+}
+
+// FromOrgGraph builds a Graph from the relationships stored in the database.
+func FromOrgGraph(orgGraph *dblogic.OrgGraph) *Graph {
+	graph := &Graph{
+		Nodes: map[string]*Node{},
+		Edges: []*Edge{},
+	}
+	addNodes := func(kind NodeKind, entities map[int]string) {
+		for entityId, name := range entities {
+			id := nodeId(kind, entityId)
+			graph.Nodes[id] = &Node{
+				ID:       id,
+				Kind:     kind,
+				EntityId: entityId,
+				Name:     name,
+			}
+		}
+	}
+	addNodes(UserNode, orgGraph.Users)
+	addNodes(UsergroupNode, orgGraph.Usergroups)
+	addNodes(ServiceAccountNode, orgGraph.ServiceAccounts)
+	addNodes(RepogroupNode, orgGraph.Repogroups)
+	addNodes(RepoNode, orgGraph.Repos)
+
+	for _, userInGroup := range orgGraph.UserInGroups {
+		graph.Edges = append(graph.Edges, &Edge{
+			From:  nodeId(UserNode, userInGroup.UserId),
+			To:    nodeId(UsergroupNode, userInGroup.UsergroupId),
+			Kind:  MemberEdge,
+			Label: "member",
+		})
+	}
+	for _, ugInUg := range orgGraph.UserGroupInGroups {
+		graph.Edges = append(graph.Edges, &Edge{
+			From:  nodeId(UsergroupNode, ugInUg.ParentUsergroupId),
+			To:    nodeId(UsergroupNode, ugInUg.ChildUsergroupId),
+			Kind:  NestedEdge,
+			Label: "contains",
+		})
+	}
+	for _, assignedRole := range orgGraph.AssignedRoles {
+		graph.Edges = append(graph.Edges, &Edge{
+			From:  principalId(assignedRole),
+			To:    targetId(assignedRole),
+			Kind:  RoleEdge,
+			Label: roleLabel(assignedRole.RepoRole),
+		})
+	}
+	for _, repogroupRel := range orgGraph.RepogroupRels {
+		graph.Edges = append(graph.Edges, &Edge{
+			From:  nodeId(RepogroupNode, repogroupRel.RepogroupId),
+			To:    nodeId(RepoNode, repogroupRel.RepoId),
+			Kind:  RepogroupEdge,
+			Label: "contains",
+		})
+	}
+
+	return graph
+}
+
+// reachable returns the set of node IDs reachable from start. If forward is false edges are followed in reverse.
+func (graph *Graph) reachable(start string, forward bool) map[string]bool {
+	seen := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, edge := range graph.Edges {
+			from, to := edge.From, edge.To
+			if !forward {
+				from, to = to, from
+			}
+			if from == current && !seen[to] {
+				seen[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+	return seen
+}
+
+// subgraph returns a copy of the graph with only the nodes in keep, and the edges between them.
+func (graph *Graph) subgraph(keep map[string]bool) *Graph {
+	filtered := &Graph{
+		Nodes: map[string]*Node{},
+		Edges: []*Edge{},
+	}
+	for id, node := range graph.Nodes {
+		if keep[id] {
+			filtered.Nodes[id] = node
+		}
+	}
+	for _, edge := range graph.Edges {
+		if keep[edge.From] && keep[edge.To] {
+			filtered.Edges = append(filtered.Edges, edge)
+		}
+	}
+	return filtered
+}
+
+// FilterByUser returns the part of the graph that userId has authority through: their usergroups, the roles those hold, and the repos the roles apply to.
+func (graph *Graph) FilterByUser(userId int) *Graph {
+	return graph.subgraph(graph.reachable(nodeId(UserNode, userId), true))
+}
+
+// FilterByRepo returns the part of the graph that grants authority on repoId: its repogroups, the roles held on them, and the users and usergroups holding those roles.
+func (graph *Graph) FilterByRepo(repoId int) *Graph {
+	return graph.subgraph(graph.reachable(nodeId(RepoNode, repoId), false))
+}
+
+// FilterByUserAndRepo returns the paths in the graph from userId to repoId.
+func (graph *Graph) FilterByUserAndRepo(userId int, repoId int) *Graph {
+	fromUser := graph.reachable(nodeId(UserNode, userId), true)
+	toRepo := graph.reachable(nodeId(RepoNode, repoId), false)
+	keep := map[string]bool{}
+	for id := range fromUser {
+		if toRepo[id] {
+			keep[id] = true
+		}
+	}
+	return graph.subgraph(keep)
+}
+
+// highlightPath highlights the shortest path of membership edges from the node from to the node to. Returns false if there is no such path.
+func (graph *Graph) highlightPath(from string, to string) bool {
+	prevEdge := map[string]*Edge{}
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 && !seen[to] {
+		current := queue[0]
+		queue = queue[1:]
+		for _, edge := range graph.Edges {
+			if edge.Kind != MemberEdge && edge.Kind != NestedEdge {
+				continue
+			}
+			if edge.From == current && !seen[edge.To] {
+				seen[edge.To] = true
+				prevEdge[edge.To] = edge
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+	if !seen[to] {
+		return false
+	}
+	for current := to; current != from; current = prevEdge[current].From {
+		prevEdge[current].Highlighted = true
+	}
+	return true
+}
+
+// Highlight marks the edges which give userId authority over repoId through grantingRoles, such as those returned by authz.ExplainAuthz.
+func (graph *Graph) Highlight(userId int, repoId int, grantingRoles []*dblogic.AssignedRole) {
+	userNodeId := nodeId(UserNode, userId)
+	repoNodeId := nodeId(RepoNode, repoId)
+	for _, grantingRole := range grantingRoles {
+		from := principalId(grantingRole)
+		to := targetId(grantingRole)
+		// Roles which are not in the graph highlight nothing, not even the path to them
+		var roleEdge *Edge
+		for _, edge := range graph.Edges {
+			if edge.Kind == RoleEdge && edge.From == from && edge.To == to && edge.Label == roleLabel(grantingRole.RepoRole) {
+				roleEdge = edge
+			}
+		}
+		if roleEdge == nil || !graph.highlightPath(userNodeId, from) {
+			continue
+		}
+		roleEdge.Highlighted = true
+		for _, edge := range graph.Edges {
+			if edge.Kind == RepogroupEdge && edge.From == to && edge.To == repoNodeId {
+				edge.Highlighted = true
+			}
+		}
+	}
+}
+
+// sortedNodes returns the nodes ordered by kind and then entity id so rendering is deterministic.
+func (graph *Graph) sortedNodes() []*Node {
+	nodes := []*Node{}
+	for _, node := range graph.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Kind != nodes[j].Kind {
+			return nodes[i].Kind < nodes[j].Kind
+		}
+		return nodes[i].EntityId < nodes[j].EntityId
+	})
+	return nodes
+}
+
+// nodeLabel is the human readable text drawn for a node
+func nodeLabel(node *Node) string {
+	kindStr := ""
+	switch node.Kind {
+	case UserNode:
+		kindStr = "user"
+	case UsergroupNode:
+		kindStr = "usergroup"
+	case ServiceAccountNode:
+		kindStr = "service account"
+	case RepogroupNode:
+		kindStr = "repogroup"
+	case RepoNode:
+		kindStr = "repo"
+	}
+	return fmt.Sprintf("%s (%s %d)", node.Name, kindStr, node.EntityId)
+}
+
+// DOT renders the graph in Graphviz DOT format.
+func (graph *Graph) DOT() string {
+	// Line breaks in names become escaped line breaks, so a name cannot end the statement
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace
+	builder := &strings.Builder{}
+	builder.WriteString("digraph forge {\n")
+	builder.WriteString("  rankdir=LR;\n")
+	for _, node := range graph.sortedNodes() {
+		shape := ""
+		switch node.Kind {
+		case UserNode:
+			shape = "ellipse"
+		case UsergroupNode:
+			shape = "hexagon"
+		case ServiceAccountNode:
+			shape = "octagon"
+		case RepogroupNode:
+			shape = "folder"
+		case RepoNode:
+			shape = "box"
+		}
+		fmt.Fprintf(builder, "  \"%s\" [label=\"%s\", shape=%s];\n",
+			node.ID, escape(nodeLabel(node)), shape)
+	}
+	for _, edge := range graph.Edges {
+		style := ""
+		if edge.Kind == MemberEdge || edge.Kind == NestedEdge || edge.Kind == RepogroupEdge {
+			style = ", style=dashed"
+		}
+		if edge.Highlighted {
+			style = ", color=red, penwidth=3"
+		}
+		fmt.Fprintf(builder, "  \"%s\" -> \"%s\" [label=\"%s\"%s];\n",
+			edge.From, edge.To, escape(edge.Label), style)
+	}
+	builder.WriteString("}\n")
+	return builder.String()
+}
+
+// Mermaid renders the graph as a Mermaid flowchart.
+func (graph *Graph) Mermaid() string {
+	// Mermaid statements end at a line break and labels are rendered as HTML, so both are escaped
+	escape := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;", "\r\n", "<br>", "\n", "<br>", "\r", "<br>").Replace
+	builder := &strings.Builder{}
+	builder.WriteString("flowchart LR\n")
+	for _, node := range graph.sortedNodes() {
+		label := escape(nodeLabel(node))
+		switch node.Kind {
+		case UserNode:
+			fmt.Fprintf(builder, "  %s([\"%s\"])\n", node.ID, label)
+		case UsergroupNode:
+			fmt.Fprintf(builder, "  %s{{\"%s\"}}\n", node.ID, label)
+		case ServiceAccountNode:
+			fmt.Fprintf(builder, "  %s>\"%s\"]\n", node.ID, label)
+		case RepogroupNode:
+			fmt.Fprintf(builder, "  %s[(\"%s\")]\n", node.ID, label)
+		case RepoNode:
+			fmt.Fprintf(builder, "  %s[\"%s\"]\n", node.ID, label)
+		}
+	}
+	highlighted := []string{}
+	for i, edge := range graph.Edges {
+		arrow := "-->"
+		if edge.Kind == MemberEdge || edge.Kind == NestedEdge || edge.Kind == RepogroupEdge {
+			arrow = "-.->"
+		}
+		if edge.Highlighted {
+			arrow = "==>"
+			highlighted = append(highlighted, fmt.Sprintf("%d", i))
+		}
+		fmt.Fprintf(builder, "  %s %s|\"%s\"| %s\n", edge.From, arrow, escape(edge.Label), edge.To)
+	}
+	if len(highlighted) > 0 {
+		fmt.Fprintf(builder, "  linkStyle %s stroke:red,stroke-width:3px\n", strings.Join(highlighted, ","))
+	}
+	return builder.String()
+}
@@ -0,0 +1,240 @@
+package orggraph
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"biscuitExample/dblogic"
+)
+
+// testGraph builds a small graph in which Ann is a member of FooOps, which contains BarOps, which contains BazOps. BazOps writes the Foo repogroup of Bravo and Charlie, and Cy is a member of BazOps directly. Bob, whose name needs escaping, reads Alpha.
+func testGraph() *Graph {
+	return FromOrgGraph(&dblogic.OrgGraph{
+		Users:           map[int]string{1: "Ann", 2: "Bob \"the builder\"\nJr", 3: "Cy"},
+		Usergroups:      map[int]string{1: "FooOps", 2: "BarOps", 3: "BazOps"},
+		Repos:           map[int]string{1: "Alpha", 2: "Bravo", 3: "Charlie"},
+		Repogroups:      map[int]string{1: "Foo"},
+		ServiceAccounts: map[int]string{},
+		UserInGroups: []*dblogic.UserInGroup{
+			{UserId: 1, UsergroupId: 1},
+			{UserId: 3, UsergroupId: 3},
+		},
+		UserGroupInGroups: []*dblogic.UserGroupInGroup{
+			{ParentUsergroupId: 1, ChildUsergroupId: 2},
+			{ParentUsergroupId: 2, ChildUsergroupId: 3},
+		},
+		RepogroupRels: []*dblogic.RepogroupRel{
+			{RepogroupId: 1, RepoId: 2},
+			{RepogroupId: 1, RepoId: 3},
+		},
+		AssignedRoles: []*dblogic.AssignedRole{
+			bazOpsWritesFoo(),
+			{UserOrGroup: dblogic.UserUGR, UserOrGroupID: 2, RepoOrGroup: dblogic.RepoUGR, RepoOrGroupID: 1, RepoRole: dblogic.ReaderRole},
+		},
+	})
+}
+
+// bazOpsWritesFoo is the role BazOps holds on the Foo repogroup in testGraph.
+func bazOpsWritesFoo() *dblogic.AssignedRole {
+	return &dblogic.AssignedRole{
+		UserOrGroup:   dblogic.UsergroupUGR,
+		UserOrGroupID: 3,
+		RepoOrGroup:   dblogic.RepogroupUGR,
+		RepoOrGroupID: 1,
+		RepoRole:      dblogic.WriterRole,
+	}
+}
+
+// nodeIds returns the sorted IDs of the nodes in graph.
+func nodeIds(graph *Graph) []string {
+	ids := []string{}
+	for id := range graph.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// highlightedEdges returns the highlighted edges of graph as "from->to".
+func highlightedEdges(graph *Graph) []string {
+	edges := []string{}
+	for _, edge := range graph.Edges {
+		if edge.Highlighted {
+			edges = append(edges, edge.From+"->"+edge.To)
+		}
+	}
+	sort.Strings(edges)
+	return edges
+}
+
+// TestFilters checks that filtering by user follows authority down through nested usergroups, filtering by repo follows it back up, and filtering by both keeps only the paths between them.
+func TestFilters(t *testing.T) {
+	testCases := []struct {
+		name      string
+		filter    func(graph *Graph) *Graph
+		wantNodes []string
+		wantEdges int
+	}{
+		{
+			name:      "user through nested usergroups",
+			filter:    func(graph *Graph) *Graph { return graph.FilterByUser(1) },
+			wantNodes: []string{"repo_2", "repo_3", "repogroup_1", "user_1", "usergroup_1", "usergroup_2", "usergroup_3"},
+			wantEdges: 6,
+		},
+		{
+			name:      "user with a direct role",
+			filter:    func(graph *Graph) *Graph { return graph.FilterByUser(2) },
+			wantNodes: []string{"repo_1", "user_2"},
+			wantEdges: 1,
+		},
+		{
+			name:      "repo",
+			filter:    func(graph *Graph) *Graph { return graph.FilterByRepo(3) },
+			wantNodes: []string{"repo_3", "repogroup_1", "user_1", "user_3", "usergroup_1", "usergroup_2", "usergroup_3"},
+			wantEdges: 6,
+		},
+		{
+			name:      "user and repo",
+			filter:    func(graph *Graph) *Graph { return graph.FilterByUserAndRepo(1, 3) },
+			wantNodes: []string{"repo_3", "repogroup_1", "user_1", "usergroup_1", "usergroup_2", "usergroup_3"},
+			wantEdges: 5,
+		},
+		{
+			name:      "user without a path to the repo",
+			filter:    func(graph *Graph) *Graph { return graph.FilterByUserAndRepo(2, 3) },
+			wantNodes: []string{},
+			wantEdges: 0,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			filtered := testCase.filter(testGraph())
+			ids := nodeIds(filtered)
+			if strings.Join(ids, " ") != strings.Join(testCase.wantNodes, " ") {
+				t.Errorf("expected nodes %v, got %v", testCase.wantNodes, ids)
+			}
+			if len(filtered.Edges) != testCase.wantEdges {
+				t.Errorf("expected %d edges, got %d", testCase.wantEdges, len(filtered.Edges))
+			}
+			for _, edge := range filtered.Edges {
+				if filtered.Nodes[edge.From] == nil || filtered.Nodes[edge.To] == nil {
+					t.Errorf("edge %s->%s leaves the filtered graph", edge.From, edge.To)
+				}
+			}
+		})
+	}
+}
+
+// TestHighlight checks that only the edges of the path granting the role are highlighted, and nothing is highlighted for a role the user cannot reach or a role which is not the one held.
+func TestHighlight(t *testing.T) {
+	otherRole := bazOpsWritesFoo()
+	otherRole.RepoRole = dblogic.ReaderRole
+	testCases := []struct {
+		name          string
+		userId        int
+		grantingRoles []*dblogic.AssignedRole
+		want          []string
+	}{
+		{
+			name:          "path through nested usergroups",
+			userId:        1,
+			grantingRoles: []*dblogic.AssignedRole{bazOpsWritesFoo()},
+			want: []string{
+				"repogroup_1->repo_3",
+				"user_1->usergroup_1",
+				"usergroup_1->usergroup_2",
+				"usergroup_2->usergroup_3",
+				"usergroup_3->repogroup_1",
+			},
+		},
+		{
+			name:          "direct member",
+			userId:        3,
+			grantingRoles: []*dblogic.AssignedRole{bazOpsWritesFoo()},
+			want:          []string{"repogroup_1->repo_3", "user_3->usergroup_3", "usergroup_3->repogroup_1"},
+		},
+		{
+			name:          "unreachable role",
+			userId:        2,
+			grantingRoles: []*dblogic.AssignedRole{bazOpsWritesFoo()},
+			want:          []string{},
+		},
+		{
+			name:          "role not held",
+			userId:        1,
+			grantingRoles: []*dblogic.AssignedRole{otherRole},
+			want:          []string{},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			graph := testGraph()
+			graph.Highlight(testCase.userId, 3, testCase.grantingRoles)
+			highlighted := highlightedEdges(graph)
+			if strings.Join(highlighted, " ") != strings.Join(testCase.want, " ") {
+				t.Errorf("expected %v highlighted, got %v", testCase.want, highlighted)
+			}
+		})
+	}
+}
+
+// TestRender checks the DOT and Mermaid output for a highlighted path, and that names with quotes and line breaks cannot break out of their labels.
+func TestRender(t *testing.T) {
+	graph := testGraph()
+	graph.Highlight(1, 3, []*dblogic.AssignedRole{bazOpsWritesFoo()})
+	// Every node and edge is a single statement on its own line, between the header and footer lines
+	wantLines := len(graph.Nodes) + len(graph.Edges)
+
+	testCases := []struct {
+		name        string
+		render      func(graph *Graph) string
+		headerLines int
+		want        []string
+	}{
+		{
+			name:        "DOT",
+			render:      (*Graph).DOT,
+			headerLines: 3,
+			want: []string{
+				"digraph forge {\n",
+				`  "user_1" [label="Ann (user 1)", shape=ellipse];`,
+				`  "user_2" [label="Bob \"the builder\"\nJr (user 2)", shape=ellipse];`,
+				`  "usergroup_1" -> "usergroup_2" [label="contains", color=red, penwidth=3];`,
+				`  "usergroup_3" -> "repogroup_1" [label="writer", color=red, penwidth=3];`,
+				`  "repogroup_1" -> "repo_2" [label="contains", style=dashed];`,
+				`  "user_2" -> "repo_1" [label="reader"];`,
+			},
+		},
+		{
+			name:        "Mermaid",
+			render:      (*Graph).Mermaid,
+			headerLines: 2,
+			want: []string{
+				"flowchart LR\n",
+				`  user_1(["Ann (user 1)"])`,
+				`  user_2(["Bob #quot;the builder#quot;<br>Jr (user 2)"])`,
+				`  usergroup_1{{"FooOps (usergroup 1)"}}`,
+				`  repogroup_1[("Foo (repogroup 1)")]`,
+				`  usergroup_1 ==>|"contains"| usergroup_2`,
+				`  repogroup_1 -.->|"contains"| repo_2`,
+				`  user_2 -->|"reader"| repo_1`,
+				"  linkStyle ",
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rendered := testCase.render(graph)
+			for _, want := range testCase.want {
+				if !strings.Contains(rendered, want) {
+					t.Errorf("expected %q in:\n%s", want, rendered)
+				}
+			}
+			lines := strings.Split(strings.TrimSuffix(rendered, "\n"), "\n")
+			if len(lines) != wantLines+testCase.headerLines {
+				t.Errorf("expected %d lines, got %d:\n%s", wantLines+testCase.headerLines, len(lines), rendered)
+			}
+		})
+	}
+}
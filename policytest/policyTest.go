@@ -0,0 +1,389 @@
+package policytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"gopkg.in/yaml.v3"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// Decision is the expected or actual outcome of a case
+type Decision string
+
+const (
+	// Allow means CheckAuthz granted the request
+	Allow Decision = "allow"
+	// Deny means CheckAuthz refused the request
+	Deny Decision = "deny"
+	// Error means the case could not be run, for example because the token could not be attenuated or the user or repo is unknown, so CheckAuthz never decided
+	Error Decision = "error"
+)
+
+// Entity is a user, usergroup, service account, repo or repogroup row in a scenario fixture.
+type Entity struct {
+	Id   int    `yaml:"id" json:"id"`
+	Name string `yaml:"name" json:"name"`
+}
+
+// Membership puts a user in a usergroup.
+type Membership struct {
+	User      int `yaml:"user" json:"user"`
+	Usergroup int `yaml:"usergroup" json:"usergroup"`
+}
+
+// NestedGroup gives the parent usergroup authority over the child usergroup.
+type NestedGroup struct {
+	Parent int `yaml:"parent" json:"parent"`
+	Child  int `yaml:"child" json:"child"`
+}
+
+// RepogroupMember puts a repo in a repogroup.
+type RepogroupMember struct {
+	Repogroup int `yaml:"repogroup" json:"repogroup"`
+	Repo      int `yaml:"repo" json:"repo"`
+}
+
+// RoleGrant gives a user, usergroup or service account a role on a repo or repogroup. Exactly one of User / Usergroup / Service and one of Repo / Repogroup must be set.
+type RoleGrant struct {
+	User      int    `yaml:"user" json:"user"`
+	Usergroup int    `yaml:"usergroup" json:"usergroup"`
+	Service   int    `yaml:"service" json:"service"`
+	Repo      int    `yaml:"repo" json:"repo"`
+	Repogroup int    `yaml:"repogroup" json:"repogroup"`
+	Role      string `yaml:"role" json:"role"`
+}
+
+// Fixtures describes the database a scenario runs against.
+type Fixtures struct {
+	// Seed starts from the example data in db-init.sql rather than an empty database
+	Seed             bool               `yaml:"seed" json:"seed"`
+	Users            []*Entity          `yaml:"users" json:"users"`
+	Usergroups       []*Entity          `yaml:"usergroups" json:"usergroups"`
+	Repos            []*Entity          `yaml:"repos" json:"repos"`
+	Repogroups       []*Entity          `yaml:"repogroups" json:"repogroups"`
+	ServiceAccounts  []*Entity          `yaml:"service_accounts" json:"service_accounts"`
+	Memberships      []*Membership      `yaml:"memberships" json:"memberships"`
+	NestedGroups     []*NestedGroup     `yaml:"nested_groups" json:"nested_groups"`
+	RepogroupMembers []*RepogroupMember `yaml:"repogroup_members" json:"repogroup_members"`
+	Roles            []*RoleGrant       `yaml:"roles" json:"roles"`
+}
+
+// Token describes the biscuit a case presents.
+type Token struct {
+	// User is the user id the token is issued to
+	User int `yaml:"user" json:"user"`
+	// Service is the service account id the token is issued to, instead of User
+	Service int `yaml:"service" json:"service"`
+	// Attenuations are datalog block sources, each appended as its own block
+	Attenuations []string `yaml:"attenuations" json:"attenuations"`
+}
+
+// Context describes how a case's request is made, and maps onto dblogic.RequestContext.
+type Context struct {
+	Ref        string `yaml:"ref" json:"ref"`
+	SourceIP   string `yaml:"source_ip" json:"source_ip"`
+	MFA        bool   `yaml:"mfa" json:"mfa"`
+	ClientType string `yaml:"client_type" json:"client_type"`
+	UserAgent  string `yaml:"user_agent" json:"user_agent"`
+	Transport  string `yaml:"transport" json:"transport"`
+}
+
+// Case is a single request and its expected decision.
+type Case struct {
+	Name    string   `yaml:"name" json:"name"`
+	Token   Token    `yaml:"token" json:"token"`
+	Repo    string   `yaml:"repo" json:"repo"`
+	Action  string   `yaml:"action" json:"action"`
+	Context Context  `yaml:"context" json:"context"`
+	Expect  Decision `yaml:"expect" json:"expect"`
+	// WorldRoles are role grants added to the authorizer world on top of those gathered from the database, so cases can check that roles of other principals or on other repos grant nothing
+	WorldRoles []*RoleGrant `yaml:"world_roles" json:"world_roles"`
+}
+
+// Scenario is a set of cases which share database fixtures.
+type Scenario struct {
+	Name     string    `yaml:"name" json:"name"`
+	Fixtures *Fixtures `yaml:"fixtures" json:"fixtures"`
+	Cases    []*Case   `yaml:"cases" json:"cases"`
+	// Path is the file the scenario was loaded from
+	Path string `yaml:"-" json:"-"`
+}
+
+// CaseResult is the outcome of running a single case.
+type CaseResult struct {
+	// Scenario is the name of the scenario the case is in
+	Scenario string
+	// Case is the name of the case
+	Case string
+	// Expected is the decision the case expected
+	Expected Decision
+	// Actual is the decision CheckAuthz made, or Error if the case could not be run
+	Actual Decision
+	// Reason explains a deny
+	Reason error
+	// Err is why the case could not be run
+	Err error
+}
+
+// Passed reports if the case made the expected decision. A case which could not be run only passes if it expected Error.
+func (caseResult *CaseResult) Passed() bool {
+	if caseResult.Err != nil {
+		return caseResult.Expected == Error
+	}
+	return caseResult.Expected == caseResult.Actual
+}
+
+// LoadScenario reads a scenario from a .yaml, .yml or .json file.
+func LoadScenario(scenarioPath string) (*Scenario, error) {
+	scenarioBytes, err := os.ReadFile(scenarioPath)
+	if err != nil {
+		return nil, fmt.Errorf("error in os.ReadFile for %s: %w", scenarioPath, err)
+	}
+
+	scenario := &Scenario{}
+	switch filepath.Ext(scenarioPath) {
+	case ".json":
+		decoder := json.NewDecoder(strings.NewReader(string(scenarioBytes)))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(scenario)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(strings.NewReader(string(scenarioBytes)))
+		decoder.KnownFields(true)
+		err = decoder.Decode(scenario)
+	default:
+		return nil, fmt.Errorf("unknown scenario file type: %s", scenarioPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when decoding %s: %w", scenarioPath, err)
+	}
+	scenario.Path = scenarioPath
+	if scenario.Name == "" {
+		scenario.Name = filepath.Base(scenarioPath)
+	}
+
+	for _, scenarioCase := range scenario.Cases {
+		if scenarioCase.Expect != Allow && scenarioCase.Expect != Deny && scenarioCase.Expect != Error {
+			return nil, fmt.Errorf("case %q in %s must expect %s, %s or %s",
+				scenarioCase.Name, scenarioPath, Allow, Deny, Error)
+		}
+		if _, err := authz.ParseAction(scenarioCase.Action); err != nil {
+			return nil, fmt.Errorf("case %q in %s: %w", scenarioCase.Name, scenarioPath, err)
+		}
+	}
+	return scenario, nil
+}
+
+// FindScenarioFiles expands paths into the scenario files they name. Directories are searched, non-recursively, for .yaml, .yml and .json files.
+func FindScenarioFiles(paths []string) ([]string, error) {
+	scenarioPaths := []string{}
+	for _, path := range paths {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error in os.Stat for %s: %w", path, err)
+		}
+		if !fileInfo.IsDir() {
+			scenarioPaths = append(scenarioPaths, path)
+			continue
+		}
+		for _, pattern := range []string{"*.yaml", "*.yml", "*.json"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, fmt.Errorf("error when searching %s: %w", path, err)
+			}
+			scenarioPaths = append(scenarioPaths, matches...)
+		}
+	}
+	sort.Strings(scenarioPaths)
+	return scenarioPaths, nil
+}
+
+// roleGrantToAssignedRole converts a scenario RoleGrant to the dblogic representation.
+func roleGrantToAssignedRole(roleGrant *RoleGrant) (*dblogic.AssignedRole, error) {
+	assignedRole := &dblogic.AssignedRole{}
+	switch {
+	case roleGrant.User != 0 && roleGrant.Usergroup == 0 && roleGrant.Service == 0:
+		assignedRole.UserOrGroup = dblogic.UserUGR
+		assignedRole.UserOrGroupID = roleGrant.User
+	case roleGrant.Usergroup != 0 && roleGrant.User == 0 && roleGrant.Service == 0:
+		assignedRole.UserOrGroup = dblogic.UsergroupUGR
+		assignedRole.UserOrGroupID = roleGrant.Usergroup
+	case roleGrant.Service != 0 && roleGrant.User == 0 && roleGrant.Usergroup == 0:
+		assignedRole.UserOrGroup = dblogic.ServiceAccountUGR
+		assignedRole.UserOrGroupID = roleGrant.Service
+	default:
+		return nil, fmt.Errorf("role grant must set exactly one of user, usergroup or service")
+	}
+	switch {
+	case roleGrant.Repo != 0 && roleGrant.Repogroup == 0:
+		assignedRole.RepoOrGroup = dblogic.RepoUGR
+		assignedRole.RepoOrGroupID = roleGrant.Repo
+	case roleGrant.Repogroup != 0 && roleGrant.Repo == 0:
+		assignedRole.RepoOrGroup = dblogic.RepogroupUGR
+		assignedRole.RepoOrGroupID = roleGrant.Repogroup
+	default:
+		return nil, fmt.Errorf("role grant must set exactly one of repo or repogroup")
+	}
+	switch roleGrant.Role {
+	case "owner":
+		assignedRole.RepoRole = dblogic.OwnerRole
+	case "writer":
+		assignedRole.RepoRole = dblogic.WriterRole
+	case "reader":
+		assignedRole.RepoRole = dblogic.ReaderRole
+	default:
+		return nil, fmt.Errorf("unknown role: %s", roleGrant.Role)
+	}
+	return assignedRole, nil
+}
+
+// toDbFixtures converts the scenario fixtures to the rows dblogic loads.
+func (fixtures *Fixtures) toDbFixtures() (*dblogic.Fixtures, error) {
+	toNamedEntities := func(entities []*Entity) []*dblogic.NamedEntity {
+		namedEntities := []*dblogic.NamedEntity{}
+		for _, entity := range entities {
+			namedEntities = append(namedEntities, &dblogic.NamedEntity{
+				Id:   entity.Id,
+				Name: entity.Name,
+			})
+		}
+		return namedEntities
+	}
+
+	dbFixtures := &dblogic.Fixtures{
+		Users:           toNamedEntities(fixtures.Users),
+		Usergroups:      toNamedEntities(fixtures.Usergroups),
+		Repos:           toNamedEntities(fixtures.Repos),
+		Repogroups:      toNamedEntities(fixtures.Repogroups),
+		ServiceAccounts: toNamedEntities(fixtures.ServiceAccounts),
+	}
+	for _, membership := range fixtures.Memberships {
+		dbFixtures.UserInGroups = append(dbFixtures.UserInGroups, &dblogic.UserInGroup{
+			UserId:      membership.User,
+			UsergroupId: membership.Usergroup,
+		})
+	}
+	for _, nestedGroup := range fixtures.NestedGroups {
+		dbFixtures.UserGroupInGroups = append(dbFixtures.UserGroupInGroups, &dblogic.UserGroupInGroup{
+			ParentUsergroupId: nestedGroup.Parent,
+			ChildUsergroupId:  nestedGroup.Child,
+		})
+	}
+	for _, repogroupMember := range fixtures.RepogroupMembers {
+		dbFixtures.RepogroupRels = append(dbFixtures.RepogroupRels, &dblogic.RepogroupRel{
+			RepogroupId: repogroupMember.Repogroup,
+			RepoId:      repogroupMember.Repo,
+		})
+	}
+	for _, roleGrant := range fixtures.Roles {
+		assignedRole, err := roleGrantToAssignedRole(roleGrant)
+		if err != nil {
+			return nil, fmt.Errorf("error when converting role grant: %w", err)
+		}
+		dbFixtures.AssignedRoles = append(dbFixtures.AssignedRoles, assignedRole)
+	}
+	return dbFixtures, nil
+}
+
+// runCase issues the case's token and checks it against the database. The reason CheckAuthz gave for a deny is returned separately from err, which is only set if the case could not be run.
+func runCase(scenarioCase *Case, tokenIssuer *authz.TokenIssuer, dbInstance *dblogic.DBInstance) (decision Decision, reason error, err error) {
+	action, err := authz.ParseAction(scenarioCase.Action)
+	if err != nil {
+		return Error, nil, fmt.Errorf("error when parsing action: %w", err)
+	}
+	var reqDetails *dblogic.RequestDetails
+	var biscuitToken *biscuit.Biscuit
+	if scenarioCase.Token.Service != 0 {
+		reqDetails, err = dblogic.GatherServiceRequestDetails(scenarioCase.Token.Service, scenarioCase.Repo, dbInstance)
+	} else {
+		reqDetails, err = dblogic.GatherRequestDetails(scenarioCase.Token.User, scenarioCase.Repo, dbInstance)
+	}
+	if err != nil {
+		// Unknown users, service accounts and repos are refused before authz runs
+		return Error, nil, fmt.Errorf("error when gathering request details: %w", err)
+	}
+	reqDetails.RequestContext = dblogic.RequestContext{
+		Ref:        scenarioCase.Context.Ref,
+		SourceIP:   scenarioCase.Context.SourceIP,
+		MFA:        scenarioCase.Context.MFA,
+		ClientType: scenarioCase.Context.ClientType,
+		UserAgent:  scenarioCase.Context.UserAgent,
+		Transport:  scenarioCase.Context.Transport,
+	}
+	for _, roleGrant := range scenarioCase.WorldRoles {
+		assignedRole, err := roleGrantToAssignedRole(roleGrant)
+		if err != nil {
+			return Error, nil, fmt.Errorf("error when converting world role: %w", err)
+		}
+		reqDetails.AssignedRoles = append(reqDetails.AssignedRoles, assignedRole)
+	}
+
+	if scenarioCase.Token.Service != 0 {
+		biscuitToken, err = tokenIssuer.IssueServiceToken(scenarioCase.Token.Service, authz.IssueOptions{})
+	} else {
+		biscuitToken, err = tokenIssuer.IssueToken(scenarioCase.Token.User)
+	}
+	if err != nil {
+		return Error, nil, fmt.Errorf("error when issuing token: %w", err)
+	}
+	for _, attenuation := range scenarioCase.Token.Attenuations {
+		biscuitToken, err = authz.AttenuateBiscuit(biscuitToken, attenuation)
+		if err != nil {
+			return Error, nil, fmt.Errorf("error when attenuating token: %w", err)
+		}
+	}
+
+	hasPermission, reason := authz.CheckAuthz(biscuitToken, tokenIssuer.PublicRoot, reqDetails, action)
+	if reason != nil || !hasPermission {
+		return Deny, reason, nil
+	}
+	return Allow, nil, nil
+}
+
+// Run loads the scenario fixtures into a fresh in-memory database and runs every case against CheckAuthz with the active policy. An error is returned if the scenario could not be set up; individual case failures are reported in the results.
+func (scenario *Scenario) Run() ([]*CaseResult, error) {
+	fixtures := scenario.Fixtures
+	if fixtures == nil {
+		fixtures = &Fixtures{Seed: true}
+	}
+	dbFixtures, err := fixtures.toDbFixtures()
+	if err != nil {
+		return nil, fmt.Errorf("error in fixtures for %s: %w", scenario.Name, err)
+	}
+
+	dbInstance, err := dblogic.InitMemoryDb(fixtures.Seed)
+	if err != nil {
+		return nil, fmt.Errorf("error when initializing db: %w", err)
+	}
+	defer dbInstance.Close()
+	err = dbInstance.LoadFixtures(dbFixtures)
+	if err != nil {
+		return nil, fmt.Errorf("error when loading fixtures for %s: %w", scenario.Name, err)
+	}
+
+	tokenIssuer, err := authz.NewTokenIssuer()
+	if err != nil {
+		return nil, fmt.Errorf("error when creating token issuer: %w", err)
+	}
+
+	caseResults := []*CaseResult{}
+	for _, scenarioCase := range scenario.Cases {
+		decision, reason, err := runCase(scenarioCase, tokenIssuer, dbInstance)
+		caseResults = append(caseResults, &CaseResult{
+			Scenario: scenario.Name,
+			Case:     scenarioCase.Name,
+			Expected: scenarioCase.Expect,
+			Actual:   decision,
+			Reason:   reason,
+			Err:      err,
+		})
+	}
+	return caseResults, nil
+}
@@ -0,0 +1,98 @@
+package policytest
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestScenarios runs the scenarios checked in next to the embedded policy so policy changes are gated by go test.
+func TestScenarios(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	scenarioPaths, err := FindScenarioFiles([]string{"../authz/policy/tests"})
+	if err != nil {
+		t.Fatalf("FindScenarioFiles: %s", err)
+	}
+	if len(scenarioPaths) == 0 {
+		t.Fatal("no scenarios found")
+	}
+
+	for _, scenarioPath := range scenarioPaths {
+		scenario, err := LoadScenario(scenarioPath)
+		if err != nil {
+			t.Fatalf("LoadScenario: %s", err)
+		}
+		caseResults, err := scenario.Run()
+		if err != nil {
+			t.Fatalf("Run %s: %s", scenario.Name, err)
+		}
+		for _, caseResult := range caseResults {
+			t.Run(caseResult.Scenario+"/"+caseResult.Case, func(t *testing.T) {
+				if !caseResult.Passed() {
+					explanation := caseResult.Reason
+					if caseResult.Err != nil {
+						explanation = caseResult.Err
+					}
+					t.Errorf("expected %s, got %s: %v", caseResult.Expected, caseResult.Actual, explanation)
+				}
+			})
+		}
+	}
+}
+
+// TestSetupErrors checks that a case which cannot be run fails even if it expected a deny, unless it expects the error.
+func TestSetupErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	scenario := &Scenario{
+		Name: "setup errors",
+		Cases: []*Case{
+			{
+				Name:   "malformed attenuation",
+				Token:  Token{User: 4, Attenuations: []string{"check if operation("}},
+				Repo:   "Charlie",
+				Action: "write",
+				Expect: Deny,
+			},
+			{
+				Name:       "bad world role",
+				Token:      Token{User: 4},
+				Repo:       "Alpha",
+				Action:     "read",
+				Expect:     Deny,
+				WorldRoles: []*RoleGrant{{User: 1, Repo: 1, Role: "admin"}},
+			},
+			{
+				Name:   "unknown user expecting deny",
+				Token:  Token{User: 99},
+				Repo:   "Charlie",
+				Action: "read",
+				Expect: Deny,
+			},
+			{
+				Name:   "unknown repo expecting error",
+				Token:  Token{User: 4},
+				Repo:   "Zulu",
+				Action: "read",
+				Expect: Error,
+			},
+		},
+	}
+	caseResults, err := scenario.Run()
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	wantPassed := []bool{false, false, false, true}
+	for i, caseResult := range caseResults {
+		if caseResult.Actual != Error || caseResult.Err == nil {
+			t.Errorf("%s: expected a setup error, got %s", caseResult.Case, caseResult.Actual)
+		}
+		if caseResult.Passed() != wantPassed[i] {
+			t.Errorf("%s: expected passed to be %t", caseResult.Case, wantPassed[i])
+		}
+	}
+}
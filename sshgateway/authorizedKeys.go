@@ -0,0 +1,84 @@
+package sshgateway
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyOwner is who a public key authenticates, and the restrictions the key places on what they can do over SSH.
+type KeyOwner struct {
+	// UserId is the user the key belongs to. Zero for deploy keys.
+	UserId int
+	// ServiceAccountId is the service account a deploy key belongs to. Zero for user keys.
+	ServiceAccountId int
+	// RepoId is the only repo the key may be used for. Zero if the key is not restricted to a repo.
+	RepoId int
+	// ReadOnly keys may only be used for reads
+	ReadOnly bool
+}
+
+// String describes the owner for logs, e.g. "user 4".
+func (owner *KeyOwner) String() string {
+	if owner.ServiceAccountId != 0 {
+		return fmt.Sprintf("service account %d", owner.ServiceAccountId)
+	}
+	return fmt.Sprintf("user %d", owner.UserId)
+}
+
+// KeyLookup maps the public key a client authenticates with to its owner.
+type KeyLookup interface {
+	// LookupKey returns the owner of key, or an error if the key is not authorized.
+	LookupKey(key ssh.PublicKey) (*KeyOwner, error)
+}
+
+// AuthorizedKeys is a KeyLookup read from a file in the OpenSSH authorized_keys format, with each line prefixed by the id of the user the key belongs to.
+type AuthorizedKeys struct {
+	owners map[string]*KeyOwner
+}
+
+// LoadAuthorizedKeys reads keysPath, whose lines look like `4 ssh-ed25519 AAAA... liam@laptop`. Blank lines and lines starting with '#' are ignored.
+func LoadAuthorizedKeys(keysPath string) (*AuthorizedKeys, error) {
+	keysFile, err := os.ReadFile(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("error when reading authorized keys from %s: %w", keysPath, err)
+	}
+	authorizedKeys := &AuthorizedKeys{owners: map[string]*KeyOwner{}}
+	scanner := bufio.NewScanner(bytes.NewReader(keysFile))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		userIdStr, keyStr, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("line %d of %s must hold a user id and a key", lineNumber, keysPath)
+		}
+		userId, err := strconv.Atoi(userIdStr)
+		if err != nil || userId <= 0 {
+			return nil, fmt.Errorf("line %d of %s has an invalid user id: %s", lineNumber, keysPath, userIdStr)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyStr))
+		if err != nil {
+			return nil, fmt.Errorf("error when parsing key on line %d of %s: %w", lineNumber, keysPath, err)
+		}
+		authorizedKeys.owners[string(key.Marshal())] = &KeyOwner{UserId: userId}
+	}
+	return authorizedKeys, nil
+}
+
+// LookupKey implements KeyLookup.
+func (authorizedKeys *AuthorizedKeys) LookupKey(key ssh.PublicKey) (*KeyOwner, error) {
+	owner, ok := authorizedKeys.owners[string(key.Marshal())]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", ssh.FingerprintSHA256(key))
+	}
+	return owner, nil
+}
@@ -0,0 +1,58 @@
+package sshgateway
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"biscuitExample/dblogic"
+)
+
+// ParseSSHKey parses a public key in authorized_keys format, such as the contents of id_ed25519.pub, into a registry entry with its fingerprint. The key's comment becomes the title. The owner and restrictions are left for the caller to set.
+func ParseSSHKey(authorizedKey string) (*dblogic.SSHKey, error) {
+	key, comment, _, rest, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing SSH key: %w", err)
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, fmt.Errorf("expected a single SSH key")
+	}
+	return &dblogic.SSHKey{
+		Fingerprint: ssh.FingerprintSHA256(key),
+		PublicKey:   string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))),
+		Title:       comment,
+	}, nil
+}
+
+// RegisteredKeys is a KeyLookup backed by the SSH key registry in the database.
+type RegisteredKeys struct {
+	dbInstance *dblogic.DBInstance
+}
+
+// NewRegisteredKeys creates a RegisteredKeys looking keys up in dbInstance.
+func NewRegisteredKeys(dbInstance *dblogic.DBInstance) *RegisteredKeys {
+	return &RegisteredKeys{dbInstance: dbInstance}
+}
+
+// LookupKey implements KeyLookup.
+func (registeredKeys *RegisteredKeys) LookupKey(key ssh.PublicKey) (*KeyOwner, error) {
+	sshKey, err := registeredKeys.dbInstance.LookupSSHKey(ssh.FingerprintSHA256(key))
+	if err != nil {
+		return nil, err
+	}
+	// The fingerprint is only the index, so make sure the key itself matches
+	registered, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sshKey.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing registered SSH key %d: %w", sshKey.Id, err)
+	}
+	if !bytes.Equal(registered.Marshal(), key.Marshal()) {
+		return nil, fmt.Errorf("SSH key %d does not match its fingerprint", sshKey.Id)
+	}
+	return &KeyOwner{
+		UserId:           sshKey.UserId,
+		ServiceAccountId: sshKey.ServiceAccountId,
+		RepoId:           sshKey.RepoId,
+		ReadOnly:         sshKey.ReadOnly,
+	}, nil
+}
@@ -0,0 +1,449 @@
+package sshgateway
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/biscuit-auth/biscuit-go/v2"
+	"golang.org/x/crypto/ssh"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+const (
+	uploadPack  = "git-upload-pack"
+	receivePack = "git-receive-pack"
+)
+
+// keyOwnerExtension carries the JSON encoded KeyOwner from the key check to the sessions of a connection. It is absent for unregistered keys.
+const keyOwnerExtension = "key-owner"
+
+// keyFingerprintExtension carries the fingerprint of the key a connection authenticated with.
+const keyFingerprintExtension = "key-fingerprint"
+
+// tokenEnv is the environment variable a client presents a token in, e.g. with `ssh -o SetEnv=FORGE_TOKEN=...`.
+const tokenEnv = "FORGE_TOKEN"
+
+// internalTokenTTL is how long the token minted for each git command is valid for. It is only ever used inside the gateway.
+const internalTokenTTL = time.Minute
+
+// handshakeTimeout is how long a client has to complete the SSH handshake and authenticate, so connections which stall before then do not hold a goroutine forever.
+const handshakeTimeout = 30 * time.Second
+
+// maxAcceptDelay is the longest Serve waits before accepting again after a temporary error, such as running out of file descriptors.
+const maxAcceptDelay = time.Second
+
+// gitClientType is the client type of every request to the gateway, since it only serves git commands.
+const gitClientType = "git"
+
+// sshKind is the ledger kind of the tokens the gateway mints, if its issuer keeps a ledger.
+const sshKind = "ssh"
+
+// Gateway serves git over SSH. Clients authenticate with a public key which KeyLookup maps to a user or service account, and each git command is authorized by minting a token for them, or by the token the client presents in FORGE_TOKEN, restricted by the key's restrictions. CheckAuthz is run against the repo, with a possession fact for the key since SSH authentication proves the client holds it, before the local git command is run against the bare repo.
+type Gateway struct {
+	// config holds the host key and authenticates clients
+	config *ssh.ServerConfig
+	// dbInstance holds the org data the git commands are authorized against
+	dbInstance *dblogic.DBInstance
+	// tokenIssuer mints the token each git command is authorized with, and verifies presented tokens
+	tokenIssuer *authz.TokenIssuer
+	// keys maps client keys to their owners
+	keys KeyLookup
+	// acceptUnregisteredKeys lets keys which keys does not know connect, as long as they present a token
+	acceptUnregisteredKeys bool
+	// repoDir holds the bare repos, named <reponame>.git
+	repoDir string
+	// handshakeTimeout is how long a connection may take to complete the SSH handshake
+	handshakeTimeout time.Duration
+}
+
+// NewGateway creates a Gateway which identifies itself with hostKey, authenticates clients with keys and serves the bare repos in repoDir.
+func NewGateway(dbInstance *dblogic.DBInstance, tokenIssuer *authz.TokenIssuer, keys KeyLookup, hostKey ssh.Signer, repoDir string) *Gateway {
+	gateway := &Gateway{
+		dbInstance:       dbInstance,
+		tokenIssuer:      tokenIssuer,
+		keys:             keys,
+		repoDir:          repoDir,
+		handshakeTimeout: handshakeTimeout,
+	}
+	gateway.config = &ssh.ServerConfig{PublicKeyCallback: gateway.authenticateKey}
+	gateway.config.AddHostKey(hostKey)
+	return gateway
+}
+
+// AcceptUnregisteredKeys lets clients authenticate with keys KeyLookup does not know, as long as they present a token in FORGE_TOKEN. This is for runners holding tokens bound to a key of their own, which need not be registered since the token grants the access.
+func (gateway *Gateway) AcceptUnregisteredKeys() {
+	gateway.acceptUnregisteredKeys = true
+}
+
+// authenticateKey is the PublicKeyCallback of the gateway. The permissions it returns only apply once the client has signed the session identifier with key.
+func (gateway *Gateway) authenticateKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	extensions := map[string]string{keyFingerprintExtension: ssh.FingerprintSHA256(key)}
+	owner, err := gateway.keys.LookupKey(key)
+	if err != nil {
+		if !gateway.acceptUnregisteredKeys {
+			log.Printf("Refused SSH key from %s: %s", conn.RemoteAddr(), err.Error())
+			return nil, err
+		}
+		return &ssh.Permissions{Extensions: extensions}, nil
+	}
+	ownerJSON, err := json.Marshal(owner)
+	if err != nil {
+		return nil, fmt.Errorf("error when encoding key owner: %w", err)
+	}
+	extensions[keyOwnerExtension] = string(ownerJSON)
+	return &ssh.Permissions{Extensions: extensions}, nil
+}
+
+// client is an authenticated SSH connection.
+type client struct {
+	// owner is who the client's key belongs to, nil for unregistered keys
+	owner *KeyOwner
+	// fingerprint is the fingerprint of the key the client authenticated with
+	fingerprint string
+	// remoteAddr is the address of the client
+	remoteAddr net.Addr
+}
+
+// String describes the client for logs.
+func (client *client) String() string {
+	if client.owner == nil {
+		return fmt.Sprintf("unregistered key %s from %s", client.fingerprint, client.remoteAddr)
+	}
+	return fmt.Sprintf("%s from %s", client.owner, client.remoteAddr)
+}
+
+// LoadHostKey reads the OpenSSH private key in keyPath. If keyPath does not exist a new ed25519 key is generated and written to it, readable only by the owner.
+func LoadHostKey(keyPath string) (ssh.Signer, error) {
+	keyPem, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error when generating host key: %w", err)
+		}
+		pemBlock, err := ssh.MarshalPrivateKey(privateKey, "forge ssh gateway")
+		if err != nil {
+			return nil, fmt.Errorf("error when marshalling host key: %w", err)
+		}
+		err = os.WriteFile(keyPath, pem.EncodeToMemory(pemBlock), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("error when writing host key to %s: %w", keyPath, err)
+		}
+		return ssh.NewSignerFromKey(privateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when reading host key from %s: %w", keyPath, err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyPem)
+	if err != nil {
+		return nil, fmt.Errorf("error when parsing host key in %s: %w", keyPath, err)
+	}
+	return signer, nil
+}
+
+// Serve accepts connections on listener until it is closed. Temporary accept errors are logged and retried after a delay which grows up to maxAcceptDelay, like net/http does, and any other error is returned.
+func (gateway *Gateway) Serve(listener net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				log.Printf("Error when accepting SSH connection, retrying in %s: %s", delay, err.Error())
+				time.Sleep(delay)
+				continue
+			}
+			return fmt.Errorf("error when accepting SSH connection: %w", err)
+		}
+		delay = 0
+		go gateway.handleConn(conn)
+	}
+}
+
+// handleConn runs the SSH handshake on conn and serves its session channels.
+func (gateway *Gateway) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(gateway.handshakeTimeout))
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, gateway.config)
+	if err != nil {
+		log.Printf("SSH handshake with %s failed: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	// git commands may run for as long as they need once the client is authenticated
+	conn.SetDeadline(time.Time{})
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	client := &client{
+		fingerprint: serverConn.Permissions.Extensions[keyFingerprintExtension],
+		remoteAddr:  conn.RemoteAddr(),
+	}
+	if ownerJSON, ok := serverConn.Permissions.Extensions[keyOwnerExtension]; ok {
+		client.owner = &KeyOwner{}
+		err = json.Unmarshal([]byte(ownerJSON), client.owner)
+		if err != nil {
+			log.Printf("SSH connection from %s has an invalid key owner: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Error when accepting SSH channel from %s: %s", conn.RemoteAddr(), err.Error())
+			continue
+		}
+		go gateway.handleSession(channel, channelRequests, client)
+	}
+}
+
+// execRequest is the payload of an exec request, from RFC 4254 section 6.5.
+type execRequest struct {
+	Command string
+}
+
+// envRequest is the payload of an env request, from RFC 4254 section 6.4.
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+// exitStatus is the payload of an exit-status request, from RFC 4254 section 6.10.
+type exitStatus struct {
+	Status uint32
+}
+
+// sessionEnv holds the environment variables a session may set.
+type sessionEnv struct {
+	// gitProtocol is GIT_PROTOCOL, which git uses to ask for protocol v2
+	gitProtocol string
+	// token is the encoded token presented in FORGE_TOKEN, if any
+	token string
+}
+
+// handleSession runs the one git command a session asks for and closes it with the command's exit status. Shells and other requests are refused, and only the GIT_PROTOCOL and FORGE_TOKEN variables may be set.
+func (gateway *Gateway) handleSession(channel ssh.Channel, requests <-chan *ssh.Request, client *client) {
+	defer channel.Close()
+	session := &sessionEnv{}
+	for request := range requests {
+		switch request.Type {
+		case "env":
+			env := &envRequest{}
+			if ssh.Unmarshal(request.Payload, env) != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			switch env.Name {
+			case "GIT_PROTOCOL":
+				session.gitProtocol = env.Value
+			case tokenEnv:
+				session.token = env.Value
+			default:
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+		case "exec":
+			exec := &execRequest{}
+			err := ssh.Unmarshal(request.Payload, exec)
+			if err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			status := gateway.runGitCommand(channel, exec.Command, session, client)
+			_, err = channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatus{Status: status}))
+			if err != nil {
+				log.Printf("Error when sending exit status to %s: %s", client.remoteAddr, err.Error())
+			}
+			return
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+// parseGitCommand splits a command such as `git-upload-pack 'org/Charlie.git'` into the git service and the repo name, which is the last element of the path without ".git".
+func parseGitCommand(command string) (string, string, error) {
+	service, repoPath, found := strings.Cut(command, " ")
+	if !found || (service != uploadPack && service != receivePack) {
+		return "", "", fmt.Errorf("only %s and %s are supported", uploadPack, receivePack)
+	}
+	repoPath = strings.Trim(strings.TrimSpace(repoPath), "'/")
+	reponame := strings.TrimSuffix(path.Base(repoPath), ".git")
+	if repoPath == "" || reponame == "" || reponame == "." || reponame == ".." {
+		return "", "", fmt.Errorf("invalid repo path: %s", repoPath)
+	}
+	return service, reponame, nil
+}
+
+// mintToken issues a token to the key's owner.
+func (gateway *Gateway) mintToken(owner *KeyOwner) (*biscuit.Biscuit, error) {
+	opts := authz.IssueOptions{TTL: internalTokenTTL, Kind: sshKind}
+	var token *biscuit.Biscuit
+	var err error
+	if owner.ServiceAccountId != 0 {
+		token, err = gateway.tokenIssuer.IssueServiceToken(owner.ServiceAccountId, opts)
+	} else {
+		token, err = gateway.tokenIssuer.IssueTokenWithOptions(owner.UserId, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when issuing token: %w", err)
+	}
+	return token, nil
+}
+
+// restrictToKey attenuates token to the repo and read-only restrictions of the key's owner.
+func restrictToKey(token *biscuit.Biscuit, owner *KeyOwner) (*biscuit.Biscuit, error) {
+	if owner.RepoId == 0 && !owner.ReadOnly {
+		return token, nil
+	}
+	attenuation := authz.NewAttenuation()
+	if owner.RepoId != 0 {
+		err := attenuation.RestrictToRepos(owner.RepoId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if owner.ReadOnly {
+		err := attenuation.RestrictToActions(authz.Read)
+		if err != nil {
+			return nil, err
+		}
+	}
+	attenuation.SetContext("ssh key restrictions")
+	return attenuation.Apply(token)
+}
+
+// authorize checks that the client may perform action on reponame, with the token it presented or else one minted for its key's owner.
+func (gateway *Gateway) authorize(client *client, presented string, reponame string, action authz.Action) error {
+	var token *biscuit.Biscuit
+	var userId, serviceAccountId int
+	var err error
+	if presented != "" {
+		token, err = authz.DecodeToken(presented)
+		if err != nil {
+			return err
+		}
+		userId, serviceAccountId, err = authz.TokenPrincipal(token, gateway.tokenIssuer.PublicRoot)
+		if err != nil {
+			return err
+		}
+	} else if client.owner != nil {
+		token, err = gateway.mintToken(client.owner)
+		if err != nil {
+			return err
+		}
+		userId, serviceAccountId = client.owner.UserId, client.owner.ServiceAccountId
+	} else {
+		return fmt.Errorf("unregistered keys must present a token in %s", tokenEnv)
+	}
+	if client.owner != nil {
+		token, err = restrictToKey(token, client.owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	var reqDetails *dblogic.RequestDetails
+	if serviceAccountId != 0 {
+		reqDetails, err = dblogic.GatherServiceRequestDetails(serviceAccountId, reponame, gateway.dbInstance)
+	} else {
+		reqDetails, err = dblogic.GatherRequestDetails(userId, reponame, gateway.dbInstance)
+	}
+	if err != nil {
+		return fmt.Errorf("error when gathering request details: %w", err)
+	}
+	if tcpAddr, ok := client.remoteAddr.(*net.TCPAddr); ok {
+		reqDetails.SourceIP = tcpAddr.IP.String()
+	}
+	// SSH authentication has the client sign the session identifier with
+	// its key, which is the challenge proving it holds the key
+	reqDetails.PossessedKeys = []string{client.fingerprint}
+	reqDetails.Transport = dblogic.TransportSSH
+	reqDetails.ClientType = gitClientType
+	_, err = authz.CheckAuthz(token, gateway.tokenIssuer.PublicRoot, reqDetails, action)
+	return err
+}
+
+// runGitCommand authorizes command and runs it against the bare repo with the channel as its stdin and stdout, and returns its exit status. Failures are reported to the client on stderr.
+func (gateway *Gateway) runGitCommand(channel ssh.Channel, command string, session *sessionEnv, client *client) uint32 {
+	service, reponame, err := parseGitCommand(command)
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "%s\n", err.Error())
+		return 1
+	}
+	action := authz.Read
+	if service == receivePack {
+		action = authz.Write
+	}
+	err = gateway.authorize(client, session.token, reponame, action)
+	if err != nil {
+		// Do not tell the client whether the repo exists
+		log.Printf("Refused %s on %s for %s: %s", service, reponame, client, err.Error())
+		fmt.Fprintf(channel.Stderr(), "access to %s denied\n", reponame)
+		return 1
+	}
+	repoPath := filepath.Join(gateway.repoDir, reponame+".git")
+	info, err := os.Stat(repoPath)
+	if err != nil || !info.IsDir() {
+		log.Printf("Repo %s is authorized but has no bare repo at %s", reponame, repoPath)
+		fmt.Fprintf(channel.Stderr(), "access to %s denied\n", reponame)
+		return 1
+	}
+
+	gitCmd := exec.Command(service, repoPath)
+	gitCmd.Stdout = channel
+	gitCmd.Stderr = channel.Stderr()
+	if session.gitProtocol != "" {
+		gitCmd.Env = append(os.Environ(), "GIT_PROTOCOL="+session.gitProtocol)
+	}
+	// Copy stdin by hand, since the client only closes it once the command
+	// has exited and Wait would otherwise wait for it
+	stdin, err := gitCmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "internal error\n")
+		return 1
+	}
+	err = gitCmd.Start()
+	if err != nil {
+		log.Printf("Error when starting %s: %s", service, err.Error())
+		fmt.Fprintf(channel.Stderr(), "internal error\n")
+		return 1
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	err = gitCmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return uint32(exitErr.ExitCode())
+	}
+	if err != nil {
+		log.Printf("Error when running %s: %s", service, err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,394 @@
+package sshgateway
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"biscuitExample/authz"
+	"biscuitExample/dblogic"
+)
+
+// newSigner generates an ed25519 key for a test client or host.
+func newSigner(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %s", err)
+	}
+	return signer
+}
+
+// runGit runs git in gitDir and returns its trimmed output.
+func runGit(t *testing.T, gitDir string, stdin string, args ...string) string {
+	gitCmd := exec.Command("git", append([]string{"--git-dir", gitDir}, args...)...)
+	gitCmd.Stdin = strings.NewReader(stdin)
+	gitCmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	output, err := gitCmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %s", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// initBareRepo creates a bare repo at gitDir whose main branch holds one empty commit.
+func initBareRepo(t *testing.T, gitDir string) {
+	runGit(t, gitDir, "", "init", "--bare", "--initial-branch", "main")
+	tree := runGit(t, gitDir, "", "hash-object", "-t", "tree", "-w", "--stdin")
+	commit := runGit(t, gitDir, "initial commit", "commit-tree", tree)
+	runGit(t, gitDir, "", "update-ref", "refs/heads/main", commit)
+}
+
+// startGateway serves bare Charlie and Alpha repos over SSH on a local port, with clientKey registered for owner, and returns the gateway and its address. acceptUnregistered is passed on to the gateway before it starts serving.
+func startGateway(t *testing.T, clientKey ssh.Signer, owner *KeyOwner, acceptUnregistered bool) (*Gateway, string) {
+	if _, err := exec.LookPath(uploadPack); err != nil {
+		t.Skipf("%s is not installed", uploadPack)
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	repoDir := t.TempDir()
+	for _, reponame := range []string{"Charlie", "Alpha"} {
+		initBareRepo(t, filepath.Join(repoDir, reponame+".git"))
+	}
+	dbInstance, err := dblogic.InitMemoryDb(true)
+	if err != nil {
+		t.Fatalf("InitMemoryDb: %s", err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	tokenIssuer, err := authz.NewTokenIssuer()
+	if err != nil {
+		t.Fatalf("NewTokenIssuer: %s", err)
+	}
+
+	sshKey, err := ParseSSHKey(string(ssh.MarshalAuthorizedKey(clientKey.PublicKey())))
+	if err != nil {
+		t.Fatalf("ParseSSHKey: %s", err)
+	}
+	sshKey.UserId = owner.UserId
+	sshKey.ServiceAccountId = owner.ServiceAccountId
+	sshKey.RepoId = owner.RepoId
+	sshKey.ReadOnly = owner.ReadOnly
+	err = dbInstance.AddSSHKey(sshKey)
+	if err != nil {
+		t.Fatalf("AddSSHKey: %s", err)
+	}
+	gateway := NewGateway(dbInstance, tokenIssuer, NewRegisteredKeys(dbInstance), newSigner(t), repoDir)
+	if acceptUnregistered {
+		gateway.AcceptUnregisteredKeys()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go gateway.Serve(listener)
+	return gateway, listener.Addr().String()
+}
+
+// runCommand runs command on the gateway as clientKey and returns its exit status, stdout and stderr.
+func runCommand(t *testing.T, addr string, clientKey ssh.Signer, command string) (int, string, string) {
+	return runCommandWithToken(t, addr, clientKey, "", command)
+}
+
+// runCommandWithToken is runCommand presenting token in FORGE_TOKEN, unless it is empty.
+func runCommandWithToken(t *testing.T, addr string, clientKey ssh.Signer, token string, command string) (int, string, string) {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %s", err)
+	}
+	defer session.Close()
+
+	if token != "" {
+		err = session.Setenv(tokenEnv, token)
+		if err != nil {
+			t.Fatalf("Setenv: %s", err)
+		}
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %s", err)
+	}
+	err = session.Start(command)
+	if err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	// A flush packet ends the negotiation before it starts, so upload-pack
+	// only advertises its refs
+	stdin.Write([]byte("0000"))
+	stdin.Close()
+	err = session.Wait()
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), stdout.String(), stderr.String()
+	}
+	if err != nil {
+		t.Fatalf("Wait: %s", err)
+	}
+	return 0, stdout.String(), stderr.String()
+}
+
+func TestUploadPackAllowed(t *testing.T) {
+	userKey := newSigner(t)
+	_, addr := startGateway(t, userKey, &KeyOwner{UserId: 4}, false)
+
+	status, stdout, stderr := runCommand(t, addr, userKey, "git-upload-pack 'org/Charlie.git'")
+	if status != 0 {
+		t.Fatalf("expected exit status 0, got %d: %s", status, stderr)
+	}
+	if !strings.Contains(stdout, "refs/heads/main") {
+		t.Errorf("expected a ref advertisement, got %q", stdout)
+	}
+}
+
+func TestUploadPackDenied(t *testing.T) {
+	userKey := newSigner(t)
+	_, addr := startGateway(t, userKey, &KeyOwner{UserId: 4}, false)
+
+	status, stdout, stderr := runCommand(t, addr, userKey, "git-upload-pack 'Alpha.git'")
+	if status == 0 {
+		t.Fatalf("expected a non-zero exit status, got output %q", stdout)
+	}
+	if !strings.Contains(stderr, "access to Alpha denied") {
+		t.Errorf("expected a denial on stderr, got %q", stderr)
+	}
+}
+
+func TestReadOnlyKey(t *testing.T) {
+	userKey := newSigner(t)
+	_, addr := startGateway(t, userKey, &KeyOwner{UserId: 4, ReadOnly: true}, false)
+
+	status, _, stderr := runCommand(t, addr, userKey, "git-upload-pack 'Charlie.git'")
+	if status != 0 {
+		t.Fatalf("expected reads to be allowed, got exit status %d: %s", status, stderr)
+	}
+	// Liam can write Charlie, but not with a read-only key
+	status, _, stderr = runCommand(t, addr, userKey, "git-receive-pack 'Charlie.git'")
+	if status == 0 || !strings.Contains(stderr, "access to Charlie denied") {
+		t.Errorf("expected writes to be denied, got exit status %d: %s", status, stderr)
+	}
+}
+
+func TestRepoRestrictedKey(t *testing.T) {
+	userKey := newSigner(t)
+	// Alpha is repo 1, which Liam cannot read anyway, so restricting the key
+	// to it leaves nothing
+	_, addr := startGateway(t, userKey, &KeyOwner{UserId: 4, RepoId: 1}, false)
+
+	status, _, stderr := runCommand(t, addr, userKey, "git-upload-pack 'Charlie.git'")
+	if status == 0 || !strings.Contains(stderr, "access to Charlie denied") {
+		t.Errorf("expected a key restricted to another repo to be denied, got exit status %d: %s", status, stderr)
+	}
+}
+
+func TestDeployKey(t *testing.T) {
+	deployKey := newSigner(t)
+	// deploy-bot (2) reads Alpha
+	_, addr := startGateway(t, deployKey, &KeyOwner{ServiceAccountId: 2, RepoId: 1, ReadOnly: true}, false)
+
+	status, stdout, stderr := runCommand(t, addr, deployKey, "git-upload-pack 'Alpha.git'")
+	if status != 0 || !strings.Contains(stdout, "refs/heads/main") {
+		t.Fatalf("expected the deploy key to read Alpha, got exit status %d: %s", status, stderr)
+	}
+	status, _, _ = runCommand(t, addr, deployKey, "git-upload-pack 'Charlie.git'")
+	if status == 0 {
+		t.Errorf("expected the deploy key to be denied Charlie")
+	}
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	userKey := newSigner(t)
+	_, addr := startGateway(t, userKey, &KeyOwner{UserId: 4}, false)
+
+	status, _, stderr := runCommand(t, addr, userKey, "rm -rf /")
+	if status == 0 || !strings.Contains(stderr, "only git-upload-pack and git-receive-pack are supported") {
+		t.Errorf("expected the command to be refused, got status %d and %q", status, stderr)
+	}
+}
+
+func TestUnknownKeyRefused(t *testing.T) {
+	_, addr := startGateway(t, newSigner(t), &KeyOwner{UserId: 4}, false)
+
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newSigner(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatalf("expected the handshake to fail for an unknown key")
+	}
+}
+
+func TestParseGitCommand(t *testing.T) {
+	tests := []struct {
+		command  string
+		service  string
+		reponame string
+		valid    bool
+	}{
+		{"git-upload-pack 'org/Charlie.git'", uploadPack, "Charlie", true},
+		{"git-receive-pack '/Charlie.git'", receivePack, "Charlie", true},
+		{"git-upload-pack Charlie", uploadPack, "Charlie", true},
+		{"git-upload-pack '../..'", "", "", false},
+		{"git-upload-pack ''", "", "", false},
+		{"git-upload-archive 'Charlie.git'", "", "", false},
+		{"git-upload-pack", "", "", false},
+	}
+	for _, test := range tests {
+		service, reponame, err := parseGitCommand(test.command)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %t, got error %v", test.command, test.valid, err)
+			continue
+		}
+		if service != test.service || reponame != test.reponame {
+			t.Errorf("%q: expected %s on %s, got %s on %s", test.command, test.service, test.reponame, service, reponame)
+		}
+	}
+}
+
+// issueBoundToken issues a token to user 4 bound to key, encoded.
+func issueBoundToken(t *testing.T, gateway *Gateway, key ssh.PublicKey) string {
+	token, err := gateway.tokenIssuer.IssueTokenWithOptions(4, authz.IssueOptions{BoundKey: ssh.FingerprintSHA256(key)})
+	if err != nil {
+		t.Fatalf("IssueTokenWithOptions: %s", err)
+	}
+	encoded, err := authz.EncodeToken(token)
+	if err != nil {
+		t.Fatalf("EncodeToken: %s", err)
+	}
+	return encoded
+}
+
+func TestBoundTokenFromRunnerKey(t *testing.T) {
+	// Deploy key of deploy-bot, which cannot read Charlie on its own
+	registeredKey := newSigner(t)
+	gateway, addr := startGateway(t, registeredKey, &KeyOwner{ServiceAccountId: 2}, true)
+	runnerKey := newSigner(t)
+	token := issueBoundToken(t, gateway, runnerKey.PublicKey())
+
+	status, stdout, stderr := runCommandWithToken(t, addr, runnerKey, token, "git-upload-pack 'Charlie.git'")
+	if status != 0 || !strings.Contains(stdout, "refs/heads/main") {
+		t.Fatalf("expected the bound token to be accepted from the runner's key, got exit status %d: %s", status, stderr)
+	}
+	// A stolen token is useless without the runner's key
+	status, _, stderr = runCommandWithToken(t, addr, newSigner(t), token, "git-upload-pack 'Charlie.git'")
+	if status == 0 || !strings.Contains(stderr, "access to Charlie denied") {
+		t.Errorf("expected the bound token to be denied from another key, got exit status %d: %s", status, stderr)
+	}
+	status, _, _ = runCommandWithToken(t, addr, registeredKey, token, "git-upload-pack 'Charlie.git'")
+	if status == 0 {
+		t.Errorf("expected the bound token to be denied from a registered key which is not the bound key")
+	}
+}
+
+func TestUnregisteredKeyNeedsToken(t *testing.T) {
+	_, addr := startGateway(t, newSigner(t), &KeyOwner{UserId: 4}, true)
+
+	status, _, stderr := runCommand(t, addr, newSigner(t), "git-upload-pack 'Charlie.git'")
+	if status == 0 || !strings.Contains(stderr, "access to Charlie denied") {
+		t.Errorf("expected an unregistered key without a token to be denied, got exit status %d: %s", status, stderr)
+	}
+}
+
+func TestPresentedTokenKeepsKeyRestrictions(t *testing.T) {
+	userKey := newSigner(t)
+	gateway, addr := startGateway(t, userKey, &KeyOwner{UserId: 4, ReadOnly: true}, false)
+	token := issueBoundToken(t, gateway, userKey.PublicKey())
+
+	status, _, stderr := runCommandWithToken(t, addr, userKey, token, "git-upload-pack 'Charlie.git'")
+	if status != 0 {
+		t.Fatalf("expected reads to be allowed, got exit status %d: %s", status, stderr)
+	}
+	status, _, stderr = runCommandWithToken(t, addr, userKey, token, "git-receive-pack 'Charlie.git'")
+	if status == 0 || !strings.Contains(stderr, "access to Charlie denied") {
+		t.Errorf("expected the read-only key to deny writes with a presented token, got exit status %d: %s", status, stderr)
+	}
+}
+
+// temporaryError is an accept error a listener may recover from, such as running out of file descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails every Accept, with temporaryError until temporary runs out and with net.ErrClosed after that.
+type failingListener struct {
+	net.Listener
+	temporary int
+	accepts   int
+}
+
+func (listener *failingListener) Accept() (net.Conn, error) {
+	listener.accepts++
+	if listener.accepts <= listener.temporary {
+		return nil, temporaryError{}
+	}
+	return nil, net.ErrClosed
+}
+
+// TestServeRetriesTemporaryErrors checks that Serve keeps accepting after temporary errors and only returns once the listener is closed.
+func TestServeRetriesTemporaryErrors(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	gateway := NewGateway(nil, nil, nil, newSigner(t), t.TempDir())
+	listener := &failingListener{temporary: 3}
+	err := gateway.Serve(listener)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected Serve to return the closed listener's error, got %v", err)
+	}
+	if listener.accepts != 4 {
+		t.Errorf("expected 3 retries before the closed error, got %d accepts", listener.accepts)
+	}
+}
+
+// TestHandshakeTimeout checks that a client which never completes the SSH handshake is disconnected once the handshake timeout passes.
+func TestHandshakeTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	gateway := NewGateway(nil, nil, nil, newSigner(t), t.TempDir())
+	gateway.handshakeTimeout = 100 * time.Millisecond
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	// Read the server's version line and anything after it, but never answer
+	go io.Copy(io.Discard, clientSide)
+	done := make(chan struct{})
+	go func() {
+		gateway.handleConn(serverSide)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the stalled handshake to be abandoned")
+	}
+}
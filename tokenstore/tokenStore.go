@@ -0,0 +1,39 @@
+package tokenstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPath returns where the forge CLI stores the user's token, forge/token under the user's config directory.
+func DefaultPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("error when finding user config dir: %w", err)
+	}
+	return filepath.Join(configDir, "forge", "token"), nil
+}
+
+// Save writes the encoded token to tokenPath, readable only by the owner, creating its directory if needed.
+func Save(tokenPath string, token string) error {
+	err := os.MkdirAll(filepath.Dir(tokenPath), 0700)
+	if err != nil {
+		return fmt.Errorf("error when creating token dir: %w", err)
+	}
+	err = os.WriteFile(tokenPath, []byte(token+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("error when writing token to %s: %w", tokenPath, err)
+	}
+	return nil
+}
+
+// Load reads the encoded token stored in tokenPath.
+func Load(tokenPath string) (string, error) {
+	token, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return "", fmt.Errorf("error when reading token from %s: %w", tokenPath, err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}